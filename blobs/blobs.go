@@ -0,0 +1,114 @@
+package blobs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+var json = jsoniter.ConfigFastest
+
+// Derives the AES-256 key used for the attachments of tickets closed before envelope encryption from their plaintext enc_key
+func LegacyTicketKey(encKey string) []byte {
+	keyHash := sha256.New()
+	keyHash.Write([]byte(encKey))
+	return keyHash.Sum(nil)
+}
+
+// Returns the storage key prefix under which the attachments of a ticket are stored
+func TicketPrefix(tikId string) string {
+	return tikId + "/"
+}
+
+// Returns the storage key of the encrypted blob of an attachment
+func Key(tikId string, attachmentId string) string {
+	return TicketPrefix(tikId) + attachmentId + ".encBlob"
+}
+
+// AES-GCM encrypts data, prefixing the output with the nonce
+func Encrypt(key []byte, data []byte) ([]byte, error) {
+	c, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(c)
+
+	if err != nil {
+		return nil, fmt.Errorf("error creating gcm: %w", err)
+	}
+
+	aesNonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, aesNonce); err != nil {
+		return nil, fmt.Errorf("error creating nonce: %w", err)
+	}
+
+	return gcm.Seal(aesNonce, aesNonce, data, nil), nil
+}
+
+// Decrypts data created by Encrypt
+func Decrypt(key []byte, data []byte) ([]byte, error) {
+	c, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(c)
+
+	if err != nil {
+		return nil, fmt.Errorf("error creating gcm: %w", err)
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("encrypted data is too short")
+	}
+
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting data: %w", err)
+	}
+
+	return plaintext, nil
+}
+
+// Encrypts the JSON encoding of v, for storing sensitive columns such as a ticket's messages
+func EncryptJSON(key []byte, v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+
+	if err != nil {
+		return nil, fmt.Errorf("error encoding data: %w", err)
+	}
+
+	return Encrypt(key, data)
+}
+
+// Decodes a column encrypted by EncryptJSON into v
+//
+// Rows written before column encryption only have the plaintext JSON column, which is decoded instead.
+// v is left untouched if both columns are NULL
+func DecryptJSON(key []byte, encrypted []byte, plaintext []byte, v any) error {
+	if encrypted == nil {
+		if plaintext == nil {
+			return nil
+		}
+
+		return json.Unmarshal(plaintext, v)
+	}
+
+	data, err := Decrypt(key, encrypted)
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
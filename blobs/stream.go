@@ -0,0 +1,266 @@
+package blobs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Streamed blobs are split into chunks that are each sealed with AES-256-GCM, so they can be encrypted and
+// decrypted without holding the whole blob in memory:
+//
+//	header: magic (4) | version (1) | chunk size (4, big endian) | nonce prefix (7)
+//	chunk:  AES-GCM(plaintext chunk) with nonce = nonce prefix | chunk index (4, big endian) | final flag (1)
+//
+// Every chunk is authenticated together with the header, and only the last chunk carries the final flag, so
+// reordered, truncated or extended blobs fail to decrypt. Blobs without the header are legacy single-shot blobs
+const (
+	streamMagic      = "IBLS"
+	streamVersion    = 1
+	streamHeaderSize = 4 + 1 + 4 + 7
+	streamPrefixSize = 7
+	ChunkSize        = 64 * 1024
+)
+
+var ErrTruncated = errors.New("encrypted blob is truncated")
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	c, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(c)
+
+	if err != nil {
+		return nil, fmt.Errorf("error creating gcm: %w", err)
+	}
+
+	return gcm, nil
+}
+
+func chunkNonce(prefix []byte, index uint32, final bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[streamPrefixSize:], index)
+
+	if final {
+		nonce[11] = 1
+	}
+
+	return nonce
+}
+
+type writer struct {
+	w      io.Writer
+	gcm    cipher.AEAD
+	header []byte
+	index  uint32
+	buf    []byte // Plaintext of the chunk being filled
+	closed bool
+}
+
+// Returns a writer that encrypts everything written to it into w. Close must be called to write the final chunk
+func NewWriter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	gcm, err := newGCM(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, streamHeaderSize)
+	copy(header, streamMagic)
+	header[4] = streamVersion
+	binary.BigEndian.PutUint32(header[5:9], ChunkSize)
+
+	if _, err := io.ReadFull(rand.Reader, header[9:]); err != nil {
+		return nil, fmt.Errorf("error creating nonce prefix: %w", err)
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &writer{
+		w:      w,
+		gcm:    gcm,
+		header: header,
+		buf:    make([]byte, 0, ChunkSize),
+	}, nil
+}
+
+func (sw *writer) seal(final bool) error {
+	if sw.index == ^uint32(0) {
+		return errors.New("blob is too large to encrypt")
+	}
+
+	_, err := sw.w.Write(sw.gcm.Seal(nil, chunkNonce(sw.header[9:], sw.index, final), sw.buf, sw.header))
+
+	if err != nil {
+		return err
+	}
+
+	sw.index++
+	sw.buf = sw.buf[:0]
+
+	return nil
+}
+
+func (sw *writer) Write(p []byte) (int, error) {
+	if sw.closed {
+		return 0, errors.New("write to closed blob writer")
+	}
+
+	var n int
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data arrives, as the last chunk has to be marked as final
+		if len(sw.buf) == ChunkSize {
+			if err := sw.seal(false); err != nil {
+				return n, err
+			}
+		}
+
+		copied := copy(sw.buf[len(sw.buf):ChunkSize], p)
+		sw.buf = sw.buf[:len(sw.buf)+copied]
+		p = p[copied:]
+		n += copied
+	}
+
+	return n, nil
+}
+
+// Writes the final chunk. This does not close the underlying writer
+func (sw *writer) Close() error {
+	if sw.closed {
+		return nil
+	}
+
+	sw.closed = true
+	return sw.seal(true)
+}
+
+type reader struct {
+	r         *bufio.Reader
+	gcm       cipher.AEAD
+	header    []byte
+	index     uint32
+	chunkSize int
+	buf       []byte // Ciphertext of the chunk being read
+	plain     []byte // Decrypted data not yet returned
+	done      bool
+}
+
+// Returns a reader that decrypts a blob written by NewWriter (or a legacy blob written by Encrypt)
+//
+// Data is only returned once the chunk it belongs to has been authenticated
+func NewReader(r io.Reader, key []byte) (io.Reader, error) {
+	br := bufio.NewReaderSize(r, ChunkSize+streamHeaderSize)
+
+	header, err := br.Peek(streamHeaderSize)
+
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error reading header: %w", err)
+	}
+
+	if len(header) < 5 || string(header[:4]) != streamMagic || header[4] != streamVersion {
+		// Legacy blobs are small enough to have been encrypted in memory in the first place
+		data, err := io.ReadAll(br)
+
+		if err != nil {
+			return nil, err
+		}
+
+		plaintext, err := Decrypt(key, data)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return bytes.NewReader(plaintext), nil
+	}
+
+	if len(header) < streamHeaderSize {
+		return nil, ErrTruncated
+	}
+
+	header = append([]byte{}, header...)
+
+	if _, err := br.Discard(streamHeaderSize); err != nil {
+		return nil, err
+	}
+
+	chunkSize := int(binary.BigEndian.Uint32(header[5:9]))
+
+	if chunkSize <= 0 || chunkSize > 16*1024*1024 {
+		return nil, fmt.Errorf("invalid chunk size: %d", chunkSize)
+	}
+
+	gcm, err := newGCM(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &reader{
+		r:         br,
+		gcm:       gcm,
+		header:    header,
+		chunkSize: chunkSize,
+		buf:       make([]byte, chunkSize+gcm.Overhead()),
+	}, nil
+}
+
+func (sr *reader) readChunk() error {
+	n, err := io.ReadFull(sr.r, sr.buf)
+
+	var final bool
+	switch err {
+	case nil:
+		// A full chunk is only the last one if nothing follows it
+		_, peekErr := sr.r.Peek(1)
+		final = peekErr == io.EOF
+	case io.ErrUnexpectedEOF:
+		final = true
+	case io.EOF:
+		// The final chunk always exists, even for empty blobs
+		return ErrTruncated
+	default:
+		return err
+	}
+
+	plain, err := sr.gcm.Open(sr.buf[:0], chunkNonce(sr.header[9:], sr.index, final), sr.buf[:n], sr.header)
+
+	if err != nil {
+		return fmt.Errorf("error decrypting chunk %d: %w", sr.index, err)
+	}
+
+	sr.index++
+	sr.plain = plain
+	sr.done = final
+
+	return nil
+}
+
+func (sr *reader) Read(p []byte) (int, error) {
+	for len(sr.plain) == 0 {
+		if sr.done {
+			return 0, io.EOF
+		}
+
+		if err := sr.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, sr.plain)
+	sr.plain = sr.plain[n:]
+
+	return n, nil
+}
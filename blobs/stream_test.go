@@ -0,0 +1,175 @@
+package blobs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+func testKey(t *testing.T) []byte {
+	key := make([]byte, 32)
+
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func encryptStream(t *testing.T, key []byte, data []byte) []byte {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func decryptStream(key []byte, blob []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(blob), key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(r)
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key := testKey(t)
+
+	sizes := map[string]int{
+		"empty":              0,
+		"small":              100,
+		"one chunk":          ChunkSize,
+		"one chunk and more": ChunkSize + 1,
+		"several chunks":     3*ChunkSize + 500,
+		"exact chunks":       3 * ChunkSize,
+	}
+
+	for name, size := range sizes {
+		t.Run(name, func(t *testing.T) {
+			data := make([]byte, size)
+			rand.Read(data)
+
+			got, err := decryptStream(key, encryptStream(t, key, data))
+
+			if err != nil {
+				t.Fatalf("decrypting: %v", err)
+			}
+
+			if !bytes.Equal(got, data) {
+				t.Fatalf("decrypted %d bytes, want the %d written", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestStreamLegacy(t *testing.T) {
+	key := testKey(t)
+	data := []byte("written before blobs were streamed")
+
+	blob, err := Encrypt(key, data)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := decryptStream(key, blob)
+
+	if err != nil {
+		t.Fatalf("decrypting legacy blob: %v", err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Fatalf("decrypted %q, want %q", got, data)
+	}
+}
+
+func TestStreamTampered(t *testing.T) {
+	key := testKey(t)
+	data := make([]byte, 3*ChunkSize+500)
+	rand.Read(data)
+
+	blob := encryptStream(t, key, data)
+	sealed := ChunkSize + 16 // Size of a full chunk once sealed
+
+	chunk := func(i int) []byte {
+		start := streamHeaderSize + i*sealed
+		return blob[start : start+sealed]
+	}
+
+	var reordered []byte
+	reordered = append(reordered, blob[:streamHeaderSize]...)
+	reordered = append(reordered, chunk(1)...)
+	reordered = append(reordered, chunk(0)...)
+	reordered = append(reordered, blob[streamHeaderSize+2*sealed:]...)
+
+	flipped := append([]byte{}, blob...)
+	flipped[streamHeaderSize+10] ^= 1
+
+	header := append([]byte{}, blob...)
+	header[10] ^= 1 // In the nonce prefix
+
+	tests := map[string]struct {
+		blob []byte
+		key  []byte
+	}{
+		"truncated final chunk":   {blob: blob[:len(blob)-10], key: key},
+		"missing final chunk":     {blob: blob[:streamHeaderSize+3*sealed], key: key},
+		"cut at a chunk boundary": {blob: blob[:streamHeaderSize+2*sealed], key: key},
+		"header only":             {blob: blob[:streamHeaderSize], key: key},
+		"truncated header":        {blob: blob[:streamHeaderSize-2], key: key},
+		"extended":                {blob: append(append([]byte{}, blob...), chunk(0)...), key: key},
+		"reordered chunks":        {blob: reordered, key: key},
+		"flipped bit":             {blob: flipped, key: key},
+		"modified header":         {blob: header, key: key},
+		"wrong key":               {blob: blob, key: testKey(t)},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := decryptStream(tt.key, tt.blob)
+
+			if err == nil {
+				t.Fatalf("decrypted %d bytes, want an error", len(got))
+			}
+		})
+	}
+}
+
+func TestStreamOnlyReturnsAuthenticatedData(t *testing.T) {
+	key := testKey(t)
+	data := make([]byte, 2*ChunkSize+500)
+	rand.Read(data)
+
+	blob := encryptStream(t, key, data)
+	blob[len(blob)-1] ^= 1 // Breaks the final chunk only
+
+	r, err := NewReader(bytes.NewReader(blob), key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := io.ReadAll(r)
+
+	if err == nil {
+		t.Fatal("read tampered blob without an error")
+	}
+
+	if len(got) != 2*ChunkSize || !bytes.Equal(got, data[:2*ChunkSize]) {
+		t.Fatalf("read %d bytes before the error, want the %d of the intact chunks", len(got), 2*ChunkSize)
+	}
+}
@@ -0,0 +1,134 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"ibl-tickets/keys"
+	"ibl-tickets/migrations"
+	"ibl-tickets/signing"
+	"ibl-tickets/storage"
+	"ibl-tickets/tickets"
+	"ibl-tickets/types"
+	"os"
+	"sort"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+)
+
+// Dependencies available to CLI subcommands
+type Context struct {
+	Config  *types.Config
+	Secrets *types.Secrets
+	Keyring *keys.Keyring
+	Signer  *signing.Keys
+	Store   storage.Store
+	Tickets tickets.Store
+	Pool    *pgxpool.Pool
+	Ctx     context.Context
+	Logger  *zap.Logger
+}
+
+type Command struct {
+	Usage       string // Arguments the command takes
+	Description string
+	Run         func(c *Context, args []string) error
+
+	AnySchema bool // Whether the command can run against a database that isn't fully migrated
+}
+
+// Subcommands, run as ./ibl-tickets <name> [args]
+var Commands = map[string]Command{}
+
+func AddCommand(name string, cmd Command) {
+	Commands[name] = cmd
+}
+
+func init() {
+	AddCommand("migrate", Command{
+		Usage:       "up | down [--force] [n] | status",
+		Description: "Applies all pending schema migrations, reverts the newest n (default 1, --force if that deletes data) or lists them",
+		Run:         migrate,
+		AnySchema:   true,
+	})
+
+	AddCommand("rotate-keys", Command{
+		Usage:       "[--dry-run] [--batch-size n] [--after ticketId]",
+		Description: "Re-wraps every ticket data key under the current master key",
+		Run:         rotateKeys,
+	})
+
+	AddCommand("encrypt-transcripts", Command{
+		Usage:       "[--batch-size n] [--after ticketId]",
+		Description: "Encrypts the messages and ticket context of tickets stored before column encryption",
+		Run:         encryptTranscripts,
+	})
+
+	AddCommand("export", Command{
+		Usage:       "[-o file] <ticketId>",
+		Description: "Writes a closed ticket's transcript and decrypted attachments to a zip",
+		Run:         export,
+	})
+
+	AddCommand("gc", Command{
+		Usage:       "[--dry-run] [--grace duration]",
+		Description: "Removes attachment blobs that are no longer referenced by any ticket",
+		Run:         gc,
+	})
+
+	AddCommand("verify", Command{
+		Usage:       "<file>",
+		Description: "Checks that a .ibltranscript file was signed by the bot and has not been modified",
+		Run:         verify,
+		AnySchema:   true,
+	})
+
+	AddCommand("replay", Command{
+		Usage:       "[--expect file] [--update] [--owner id] <recording>",
+		Description: "Replays recorded interactions and commands against a fake Discord and prints the calls they made",
+		Run:         replayEvents,
+		AnySchema:   true,
+	})
+
+	AddCommand("signing-key", Command{
+		Description: "Prints the ID and public key of the transcript signing key",
+		Run:         signingKey,
+		AnySchema:   true,
+	})
+}
+
+func usage() {
+	var names []string
+
+	for name := range Commands {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	fmt.Fprintln(os.Stderr, "Usage: ibl-tickets [command] [args]\n\nRunning without a command starts the bot.\n\nCommands:")
+
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s %s\n    \t%s\n", name, Commands[name].Usage, Commands[name].Description)
+	}
+}
+
+// Runs the subcommand named by args[0]
+func Run(c *Context, args []string) error {
+	cmd, ok := Commands[args[0]]
+
+	if !ok {
+		usage()
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+
+	if !cmd.AnySchema {
+		err := migrations.Check(c.Ctx, c.Pool)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return cmd.Run(c, args[1:])
+}
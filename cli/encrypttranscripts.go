@@ -0,0 +1,104 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"ibl-tickets/blobs"
+	"ibl-tickets/tickets"
+)
+
+// Encrypts the messages and ticket_context columns of tickets written before column encryption
+//
+// Tickets without a data key get a new one. Encrypted tickets are skipped by later runs, so an interrupted
+// run can simply be run again (or resumed from the last ticket with --after)
+func encryptTranscripts(c *Context, args []string) error {
+	fs := flag.NewFlagSet("encrypt-transcripts", flag.ContinueOnError)
+	batchSize := fs.Int("batch-size", 100, "Number of tickets to encrypt per transaction")
+	after := fs.String("after", "", "Resume after this ticket ID")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *batchSize < 1 {
+		return fmt.Errorf("batch size must be positive")
+	}
+
+	total, err := c.Tickets.CountPlaintextTickets(c.Ctx, *after)
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d tickets to encrypt\n", total)
+
+	var done int
+	var cursor = *after
+	for {
+		n, last, err := encryptBatch(c, cursor, *batchSize)
+
+		if err != nil {
+			return fmt.Errorf("error encrypting batch after %q (rerun with --after %q to resume): %w", cursor, cursor, err)
+		}
+
+		if n == 0 {
+			break
+		}
+
+		done += n
+		cursor = last
+
+		fmt.Printf("%d/%d tickets encrypted, last ticket %s\n", done, total, cursor)
+	}
+
+	fmt.Println("Done")
+
+	return nil
+}
+
+// Encrypts up to batchSize tickets after cursor in one transaction, returning how many were processed and the last ticket ID
+func encryptBatch(c *Context, cursor string, batchSize int) (int, string, error) {
+	ids, err := c.Tickets.EncryptPlaintextTickets(c.Ctx, cursor, batchSize, func(t *tickets.Ticket) error {
+		var dataKey []byte
+		var err error
+
+		if t.EncKey == "" {
+			dataKey, t.EncKey, t.EncKeyID, err = c.Keyring.NewDataKey()
+
+			if err != nil {
+				return fmt.Errorf("error creating key for ticket %s: %w", t.ID, err)
+			}
+		} else {
+			dataKey, err = c.Keyring.TicketKey(t.EncKey, t.EncKeyID)
+
+			if err != nil {
+				return fmt.Errorf("error getting key of ticket %s: %w", t.ID, err)
+			}
+		}
+
+		// The columns already hold JSON, so they are encrypted as is
+		if t.Messages != nil {
+			t.EncMessages, err = blobs.Encrypt(dataKey, t.Messages)
+
+			if err != nil {
+				return fmt.Errorf("error encrypting messages of ticket %s: %w", t.ID, err)
+			}
+		}
+
+		if t.TicketContext != nil {
+			t.EncTicketContext, err = blobs.Encrypt(dataKey, t.TicketContext)
+
+			if err != nil {
+				return fmt.Errorf("error encrypting context of ticket %s: %w", t.ID, err)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil || len(ids) == 0 {
+		return 0, "", err
+	}
+
+	return len(ids), ids[len(ids)-1], nil
+}
@@ -0,0 +1,226 @@
+package cli
+
+import (
+	"archive/zip"
+	"errors"
+	"flag"
+	"fmt"
+	"ibl-tickets/blobs"
+	"ibl-tickets/dedup"
+	"ibl-tickets/storage"
+	"ibl-tickets/tickets"
+	"ibl-tickets/types"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+var json = jsoniter.ConfigFastest
+
+// Writes a closed ticket to a zip containing transcript.json and its decrypted attachments under
+// attachments/{attachmentId}/{original filename}
+func export(c *Context, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	output := fs.String("o", "", "File to write the zip to (default {ticketId}.zip)")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: export [-o file] <ticketId>")
+	}
+
+	tikId := fs.Arg(0)
+
+	if *output == "" {
+		*output = tikId + ".zip"
+	}
+
+	transcript, dataKey, err := exportTranscript(c, tikId)
+
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a failed export never leaves a partial zip behind
+	tmp, err := os.CreateTemp(filepath.Dir(*output), "."+filepath.Base(*output)+".*.tmp")
+
+	if err != nil {
+		return fmt.Errorf("error creating output file: %w", err)
+	}
+
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	zw := zip.NewWriter(tmp)
+
+	var exported, missing int
+	for mi := range transcript.Messages {
+		for ai := range transcript.Messages[mi].Attachments {
+			attachment := &transcript.Messages[mi].Attachments[ai]
+
+			if !attachment.Stored() {
+				continue
+			}
+
+			err = exportAttachment(c, zw, tikId, dataKey, attachment)
+
+			if errors.Is(err, storage.ErrNotFound) {
+				fmt.Fprintf(os.Stderr, "Attachment %s (%s) was not found in storage, skipping\n", attachment.ID, attachment.Name)
+				attachment.Errors = append(attachment.Errors, "Attachment was not found in storage when the ticket was exported.")
+				missing++
+				continue
+			}
+
+			if err != nil {
+				return fmt.Errorf("error exporting attachment %s: %w", attachment.ID, err)
+			}
+
+			exported++
+		}
+	}
+
+	w, err := zw.Create("transcript.json")
+
+	if err != nil {
+		return fmt.Errorf("error adding transcript: %w", err)
+	}
+
+	data, err := json.MarshalIndent(transcript, "", "  ")
+
+	if err != nil {
+		return fmt.Errorf("error encoding transcript: %w", err)
+	}
+
+	if _, err = w.Write(data); err != nil {
+		return fmt.Errorf("error writing transcript: %w", err)
+	}
+
+	if err = zw.Close(); err != nil {
+		return fmt.Errorf("error writing zip: %w", err)
+	}
+
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("error writing zip: %w", err)
+	}
+
+	if err = os.Rename(tmp.Name(), *output); err != nil {
+		return fmt.Errorf("error writing zip: %w", err)
+	}
+
+	fmt.Printf("Exported ticket %s with %d attachments (%d missing) to %s\n", tikId, exported, missing, *output)
+
+	return nil
+}
+
+// Loads and decrypts a closed ticket, returning its transcript and data key (nil for old tickets that never had one)
+func exportTranscript(c *Context, tikId string) (*types.FileTranscriptData, []byte, error) {
+	tik, err := c.Tickets.Get(c.Ctx, tikId)
+
+	if errors.Is(err, tickets.ErrNotFound) {
+		return nil, nil, fmt.Errorf("ticket %s does not exist", tikId)
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if tik.Open {
+		return nil, nil, fmt.Errorf("ticket %s is still open", tikId)
+	}
+
+	if tik.Messages == nil && tik.EncMessages == nil {
+		return nil, nil, fmt.Errorf("ticket %s has been purged", tikId)
+	}
+
+	var t = types.FileTranscriptData{
+		TicketID:    tikId,
+		Issue:       tik.Issue,
+		TopicID:     tik.TopicID,
+		UserID:      tik.UserID,
+		ChannelID:   tik.ChannelID,
+		CloseUserID: tik.CloseUserID,
+	}
+
+	t.Topic = c.Config.Topics[t.TopicID]
+
+	var dataKey []byte
+
+	if tik.EncKey != "" {
+		dataKey, err = c.Keyring.TicketKey(tik.EncKey, tik.EncKeyID)
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("error getting ticket key: %w", err)
+		}
+	}
+
+	err = blobs.DecryptJSON(dataKey, tik.EncTicketContext, tik.TicketContext, &t.TicketContext)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("error decrypting ticket context: %w", err)
+	}
+
+	err = blobs.DecryptJSON(dataKey, tik.EncMessages, tik.Messages, &t.Messages)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("error decrypting messages: %w", err)
+	}
+
+	return &t, dataKey, nil
+}
+
+// Returns a filename that is safe to use inside the zip, adding an extension from the content type if it has none
+func exportFilename(attachment *types.Attachment) string {
+	name := path.Base(strings.ReplaceAll(attachment.Name, "\\", "/"))
+
+	if name == "." || name == "/" || name == ".." {
+		name = attachment.ID
+	}
+
+	contentType := attachment.DetectedType
+
+	if contentType == "" {
+		contentType = attachment.ContentType
+	}
+
+	if path.Ext(name) == "" && contentType != "" {
+		exts, _ := mime.ExtensionsByType(contentType)
+
+		if len(exts) > 0 {
+			name += exts[0]
+		}
+	}
+
+	return name
+}
+
+// Decrypts an attachment blob into the zip
+func exportAttachment(c *Context, zw *zip.Writer, tikId string, dataKey []byte, attachment *types.Attachment) error {
+	r, err := dedup.OpenAttachment(c.Ctx, c.Tickets, c.Store, c.Keyring, tikId, attachment.ID, dataKey)
+
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	w, err := zw.Create("attachments/" + attachment.ID + "/" + exportFilename(attachment))
+
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, r)
+
+	if err != nil {
+		return fmt.Errorf("error decrypting blob: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,45 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"ibl-tickets/dedup"
+	"time"
+)
+
+// Removes attachment blobs that no ticket references any more, and stored contents that have no blob
+func gc(c *Context, args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "Only list the blobs that would be removed")
+	grace := fs.Duration("grace", 24*time.Hour, "Only remove blobs stored at least this long ago")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	res, err := dedup.GC(c.Ctx, c.Tickets, c.Store, *grace, *dryRun)
+
+	for _, hash := range res.Unreferenced {
+		if *dryRun {
+			fmt.Printf("[dry run] would remove %s\n", hash)
+		} else {
+			fmt.Printf("Removed %s\n", hash)
+		}
+	}
+
+	for _, hash := range res.Orphaned {
+		if *dryRun {
+			fmt.Printf("[dry run] would remove orphaned %s\n", hash)
+		} else {
+			fmt.Printf("Removed orphaned %s\n", hash)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Done, %d unreferenced and %d orphaned blobs\n", len(res.Unreferenced), len(res.Orphaned))
+
+	return nil
+}
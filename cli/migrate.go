@@ -0,0 +1,84 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"ibl-tickets/migrations"
+	"strconv"
+)
+
+// Applies, reverts or lists the embedded schema migrations
+func migrate(c *Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: migrate up | down [--force] [n] | status")
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := migrations.Up(c.Ctx, c.Pool)
+
+		for _, m := range applied {
+			fmt.Printf("Applied %04d_%s\n", m.Version, m.Name)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Done, %d migrations applied\n", len(applied))
+	case "down":
+		fs := flag.NewFlagSet("migrate down", flag.ContinueOnError)
+		force := fs.Bool("force", false, "revert migrations even if that deletes data")
+
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+
+		// Reverting is destructive, so only the newest migration is reverted unless asked otherwise
+		var n = 1
+
+		if fs.NArg() > 0 {
+			var err error
+			n, err = strconv.Atoi(fs.Arg(0))
+
+			if err != nil || n < 1 {
+				return errors.New("n must be a positive number")
+			}
+		}
+
+		reverted, err := migrations.Down(c.Ctx, c.Pool, n, *force)
+
+		for _, m := range reverted {
+			fmt.Printf("Reverted %04d_%s\n", m.Version, m.Name)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Done, %d migrations reverted\n", len(reverted))
+	case "status":
+		statuses, unknown, err := migrations.Statuses(c.Ctx, c.Pool)
+
+		if err != nil {
+			return err
+		}
+
+		for _, s := range statuses {
+			if s.AppliedAt == nil {
+				fmt.Printf("%04d_%s\tpending\n", s.Version, s.Name)
+			} else {
+				fmt.Printf("%04d_%s\tapplied %s\n", s.Version, s.Name, s.AppliedAt.Format("2006-01-02 15:04:05"))
+			}
+		}
+
+		for _, version := range unknown {
+			fmt.Printf("%04d\tapplied, but unknown to this build\n", version)
+		}
+	default:
+		return fmt.Errorf("unknown migrate command: %s", args[0])
+	}
+
+	return nil
+}
@@ -0,0 +1,133 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"ibl-tickets/dispatch"
+	"ibl-tickets/fakediscord"
+	"ibl-tickets/replay"
+	"ibl-tickets/storage"
+	"ibl-tickets/tickets"
+	"os"
+	"slices"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// Replays a recording of gateway events against a fake Discord and prints (or checks) the calls the handlers made
+func replayEvents(c *Context, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	expect := fs.String("expect", "", "File with the expected calls, replay fails if the calls made differ")
+	update := fs.Bool("update", false, "Write the calls made to the --expect file instead of checking them")
+
+	var owners []string
+	fs.Func("owner", "Pseudonymized user ID (as it appears in the recording) to treat as a bot owner, can be repeated", func(id string) error {
+		owners = append(owners, id)
+		return nil
+	})
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: replay [--expect file] [--update] [--owner id] <recording>")
+	}
+
+	if *update && *expect == "" {
+		return errors.New("--update needs --expect")
+	}
+
+	events, err := replay.Load(fs.Arg(0))
+
+	if err != nil {
+		return fmt.Errorf("error reading recording: %w", err)
+	}
+
+	// Attachments are kept in a scratch directory, tickets in memory and locks in a Redis of our own, so nothing touches
+	// the configured database, Redis or storage
+	dir, err := os.MkdirTemp("", "ibl-tickets-replay-")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(dir)
+
+	rd, err := miniredis.Run()
+
+	if err != nil {
+		return fmt.Errorf("error starting miniredis: %w", err)
+	}
+
+	defer rd.Close()
+
+	rediscli := redis.NewClient(&redis.Options{Addr: rd.Addr()})
+	defer rediscli.Close()
+
+	discord := fakediscord.New()
+	defer discord.Close()
+
+	tikStore := tickets.NewMemoryStore()
+
+	runner := &replay.Runner{
+		Dispatcher: &dispatch.Dispatcher{
+			Config:  c.Config,
+			Secrets: c.Secrets,
+			Keyring: c.Keyring,
+			Signer:  c.Signer,
+			Store:   &storage.FileStore{Root: dir},
+			Tickets: tikStore,
+			Ctx:     c.Ctx,
+			Logger:  c.Logger,
+			Redis:   rediscli,
+			IsOwner: func(userId string) bool {
+				return slices.Contains(owners, userId)
+			},
+		},
+		Discord: discord,
+		Tickets: tikStore,
+	}
+
+	results, err := runner.Run(events)
+
+	if err != nil {
+		return err
+	}
+
+	summary := replay.Summary(results)
+
+	if *expect == "" {
+		fmt.Print(summary)
+		return nil
+	}
+
+	if *update {
+		err = os.WriteFile(*expect, []byte(summary), 0644)
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Wrote the calls of %d events to %s\n", len(results), *expect)
+		return nil
+	}
+
+	expected, err := os.ReadFile(*expect)
+
+	if err != nil {
+		return err
+	}
+
+	err = replay.Check(results, string(expected))
+
+	if err != nil {
+		fmt.Print(summary)
+		return fmt.Errorf("calls differ from %s: %w", *expect, err)
+	}
+
+	fmt.Printf("All %d events made the expected calls\n", len(results))
+	return nil
+}
@@ -0,0 +1,147 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"ibl-tickets/blobs"
+	"ibl-tickets/tickets"
+)
+
+// Walks the tickets and attachment blobs in batches, re-wrapping every enc_key not wrapped by the current master key
+//
+// Blobs are untouched as the data keys themselves don't change. Re-wrapped tickets are skipped by later
+// runs, so an interrupted rotation can simply be run again (or resumed from the last ticket with --after)
+func rotateKeys(c *Context, args []string) error {
+	fs := flag.NewFlagSet("rotate-keys", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "Only report the tickets that would be re-wrapped")
+	batchSize := fs.Int("batch-size", 100, "Number of tickets to re-wrap per transaction")
+	after := fs.String("after", "", "Resume after this ticket ID")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *batchSize < 1 {
+		return fmt.Errorf("batch size must be positive")
+	}
+
+	total, err := c.Tickets.CountKeysToRewrap(c.Ctx, c.Keyring.CurrentID, *after)
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d tickets to re-wrap under master key %s\n", total, c.Keyring.CurrentID)
+
+	var done int
+	var cursor = *after
+	for {
+		n, last, err := rotateBatch(c, cursor, *batchSize, *dryRun)
+
+		if err != nil {
+			return fmt.Errorf("error re-wrapping batch after %q (rerun with --after %q to resume): %w", cursor, cursor, err)
+		}
+
+		if n == 0 {
+			break
+		}
+
+		done += n
+		cursor = last
+
+		if *dryRun {
+			fmt.Printf("[dry run] %d/%d tickets can be re-wrapped, last ticket %s\n", done, total, cursor)
+		} else {
+			fmt.Printf("%d/%d tickets re-wrapped, last ticket %s\n", done, total, cursor)
+		}
+	}
+
+	// Blob keys are always wrapped, and already re-wrapped blobs are skipped, so this pass simply starts over on reruns
+	var blobsDone int
+	var blobCursor string
+	for {
+		n, last, err := rotateBlobBatch(c, blobCursor, *batchSize, *dryRun)
+
+		if err != nil {
+			return fmt.Errorf("error re-wrapping blob keys after %q: %w", blobCursor, err)
+		}
+
+		if n == 0 {
+			break
+		}
+
+		blobsDone += n
+		blobCursor = last
+
+		if *dryRun {
+			fmt.Printf("[dry run] %d blob keys can be re-wrapped\n", blobsDone)
+		} else {
+			fmt.Printf("%d blob keys re-wrapped\n", blobsDone)
+		}
+	}
+
+	fmt.Println("Done")
+
+	return nil
+}
+
+// Re-wraps up to batchSize tickets after cursor in one transaction, returning how many were processed and the last ticket ID
+func rotateBatch(c *Context, cursor string, batchSize int, dryRun bool) (int, string, error) {
+	ids, err := c.Tickets.RewrapTicketKeys(c.Ctx, c.Keyring.CurrentID, cursor, batchSize, func(id string, key tickets.WrappedKey) (tickets.WrappedKey, error) {
+		var dataKey []byte
+
+		if key.EncKeyID == "" {
+			// Legacy plaintext key material, wrap the key it derives instead
+			dataKey = blobs.LegacyTicketKey(key.EncKey)
+		} else {
+			var err error
+			dataKey, err = c.Keyring.Unwrap(key.EncKey, key.EncKeyID)
+
+			if err != nil {
+				return key, fmt.Errorf("error unwrapping key of ticket %s: %w", id, err)
+			}
+		}
+
+		return rewrapKey(c, dataKey, key, dryRun)
+	})
+
+	if err != nil || len(ids) == 0 {
+		return 0, "", err
+	}
+
+	return len(ids), ids[len(ids)-1], nil
+}
+
+// Re-wraps up to batchSize attachment blob keys after cursor in one transaction, returning how many were processed and the last hash
+func rotateBlobBatch(c *Context, cursor string, batchSize int, dryRun bool) (int, string, error) {
+	hashes, err := c.Tickets.RewrapBlobKeys(c.Ctx, c.Keyring.CurrentID, cursor, batchSize, func(hash string, key tickets.WrappedKey) (tickets.WrappedKey, error) {
+		dataKey, err := c.Keyring.Unwrap(key.EncKey, key.EncKeyID)
+
+		if err != nil {
+			return key, fmt.Errorf("error unwrapping key of blob %s: %w", hash, err)
+		}
+
+		return rewrapKey(c, dataKey, key, dryRun)
+	})
+
+	if err != nil || len(hashes) == 0 {
+		return 0, "", err
+	}
+
+	return len(hashes), hashes[len(hashes)-1], nil
+}
+
+// Wraps dataKey with the current master key, or returns key as it was on a dry run
+func rewrapKey(c *Context, dataKey []byte, key tickets.WrappedKey, dryRun bool) (tickets.WrappedKey, error) {
+	if dryRun {
+		return key, nil
+	}
+
+	wrapped, keyId, err := c.Keyring.Wrap(dataKey)
+
+	if err != nil {
+		return key, fmt.Errorf("error wrapping key: %w", err)
+	}
+
+	return tickets.WrappedKey{EncKey: wrapped, EncKeyID: keyId}, nil
+}
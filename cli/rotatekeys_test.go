@@ -0,0 +1,107 @@
+package cli
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"ibl-tickets/keys"
+	"ibl-tickets/tickets"
+	"ibl-tickets/types"
+	"testing"
+)
+
+func masterKey(t *testing.T) string {
+	key := make([]byte, 32)
+
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func TestRotateKeysWithClaimedOrphan(t *testing.T) {
+	ctx := context.Background()
+	oldKey := masterKey(t)
+
+	old, err := keys.Load(&types.Secrets{MasterKeyID: "k1", MasterKey: oldKey})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := tickets.NewMemoryStore()
+
+	_, ticketKey, keyId, err := old.NewDataKey()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Create(ctx, &tickets.Ticket{ID: "t1", UserID: "u1", ChannelID: "c1", TopicID: "support", EncKey: ticketKey, EncKeyID: keyId})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, blobKey, keyId, err := old.NewDataKey()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.StartClose(ctx, "t1", "staff1", "attachments"); err != nil {
+		t.Fatal(err)
+	}
+
+	blob := &tickets.Blob{Hash: "h1", Size: 1, EncKey: blobKey, EncKeyID: keyId}
+	err = m.SaveCloseAttachment(ctx, "t1", &tickets.CloseAttachment{AttachmentID: "a1", MessageID: "m1"}, blob, func(ctx context.Context) error { return nil })
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// gc claims stored contents it found without a blob, leaving a placeholder without a key until it removes them
+	if claimed, err := m.ClaimOrphan(ctx, "h0"); err != nil || !claimed {
+		t.Fatalf("ClaimOrphan = %v, %v", claimed, err)
+	}
+
+	rotated, err := keys.Load(&types.Secrets{MasterKeyID: "k2", MasterKey: masterKey(t), PreviousMasterKeys: map[string]string{"k1": oldKey}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Context{Keyring: rotated, Tickets: m, Ctx: ctx}
+
+	// Twice, as reruns start the blob pass over
+	for run := 0; run < 2; run++ {
+		if err := rotateKeys(c, []string{"--batch-size", "1"}); err != nil {
+			t.Fatalf("run %d: %v", run+1, err)
+		}
+	}
+
+	tik, err := m.Get(ctx, "t1")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tik.EncKeyID != "k2" {
+		t.Fatalf("ticket key wrapped with %s, want k2", tik.EncKeyID)
+	}
+
+	b, err := m.Blob(ctx, "t1", "a1")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.EncKeyID != "k2" {
+		t.Fatalf("blob key wrapped with %s, want k2", b.EncKeyID)
+	}
+
+	if _, err := rotated.Unwrap(b.EncKey, b.EncKeyID); err != nil {
+		t.Fatalf("unwrapping rotated blob key: %v", err)
+	}
+}
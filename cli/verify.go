@@ -0,0 +1,36 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Checks that a .ibltranscript file was produced by the bot and has not been modified
+func verify(c *Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: verify <file>")
+	}
+
+	file, err := os.ReadFile(args[0])
+
+	if err != nil {
+		return fmt.Errorf("error reading transcript: %w", err)
+	}
+
+	t, err := c.Signer.Verify(file)
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Transcript of ticket %s is valid\nSigned at %s with key %s\n", t.TicketID, t.Signature.SignedAt.Format("2006-01-02 15:04:05 MST"), t.Signature.KeyID)
+
+	return nil
+}
+
+// Prints the current signing key, which has to be added to previous_transcript_verify_keys when it is replaced
+func signingKey(c *Context, args []string) error {
+	fmt.Printf("Key ID: %s\nPublic key: %s\n", c.Signer.KeyID, c.Signer.PublicKey())
+	return nil
+}
@@ -0,0 +1,277 @@
+package closejob
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"ibl-tickets/blobs"
+	"ibl-tickets/dedup"
+	"ibl-tickets/downloader"
+	"ibl-tickets/sniff"
+	"ibl-tickets/tickets"
+	"ibl-tickets/types"
+	"io"
+
+	"github.com/bwmarrin/discordgo"
+	"go.uber.org/zap"
+)
+
+// Used when attachments.max_size is not set
+const defaultMaxAttachmentSize = 16_000_000
+
+// An attachment as it will appear in the transcript, stored encrypted in close_job_attachments once it has been saved
+type savedAttachment struct {
+	Attachment types.Attachment `json:"attachment"`
+	Flags      []string         `json:"flags"` // Why the attachment was flagged, for the close embed
+}
+
+// An attachment being saved to the transcript
+type pendingAttachment struct {
+	messageId  string
+	attachment *discordgo.MessageAttachment
+	sniffed    sniff.Result
+	upload     *dedup.Upload // Encrypted contents, nil if the attachment is not being stored
+	size       int64         // Plaintext bytes read, more than maxSize if the attachment was too large
+	err        error         // Why the attachment couldn't be downloaded
+}
+
+// Returns the attachments saved so far by attachment ID
+func (r *Runner) savedAttachments(ctx context.Context, j *job) (map[string]savedAttachment, error) {
+	rows, err := r.Tickets.CloseAttachments(ctx, j.TicketID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var saved = map[string]savedAttachment{}
+	for _, a := range rows {
+		var s savedAttachment
+		err = blobs.DecryptJSON(j.DataKey, a.Data, nil, &s)
+
+		if err != nil {
+			return nil, fmt.Errorf("error decrypting saved attachment %s: %w", a.AttachmentID, err)
+		}
+
+		saved[a.AttachmentID] = s
+	}
+
+	return saved, nil
+}
+
+// Saves the attachments of the snapshot that haven't been saved by an earlier run
+func (r *Runner) attachments(ctx context.Context, j *job) error {
+	snap, err := r.loadSnapshot(ctx, j)
+
+	if err != nil {
+		return err
+	}
+
+	saved, err := r.savedAttachments(ctx, j)
+
+	if err != nil {
+		return err
+	}
+
+	var pending []*pendingAttachment
+	for _, a := range snap.Attachments {
+		if _, ok := saved[a.Attachment.ID]; !ok {
+			pending = append(pending, &pendingAttachment{messageId: a.MessageID, attachment: a.Attachment})
+		}
+	}
+
+	if len(pending) > 0 {
+		r.Logger.Info("Uploading attachments", zap.String("ticket_id", j.TicketID), zap.Int("count", len(pending)), zap.Int("saved", len(saved)))
+	}
+
+	err = r.saveAttachments(ctx, j, pending)
+
+	if err != nil {
+		return err
+	}
+
+	err = r.Tickets.AdvanceCloseJob(ctx, j.TicketID, j.Token, StepTranscript)
+
+	if err != nil {
+		return err
+	}
+
+	j.Step = StepTranscript
+	return nil
+}
+
+// Downloads attachments in parallel, encrypting them as they arrive, then stores each distinct file once. Attachments
+// that can't be downloaded are recorded as such rather than failing the close.
+//
+// Every attachment is saved in its own transaction along with its blob reference, so a later run only has to
+// download the attachments that hadn't been saved yet
+func (r *Runner) saveAttachments(ctx context.Context, j *job, pending []*pendingAttachment) error {
+	var maxSize = r.Config.Attachments.MaxSize
+
+	if maxSize <= 0 {
+		maxSize = defaultMaxAttachmentSize
+	}
+
+	// Uploads that never get committed (because of a too large attachment or a failed close) only leave temporary files
+	defer func() {
+		for _, p := range pending {
+			if p.upload != nil {
+				p.upload.Discard()
+			}
+		}
+	}()
+
+	dl := &downloader.Downloader{
+		Workers:  r.Config.Attachments.DownloadWorkers,
+		Timeout:  r.Config.Attachments.DownloadTimeout,
+		Attempts: r.Config.Attachments.DownloadAttempts,
+	}
+
+	dl.ForEach(len(pending), func(i int) {
+		p := pending[i]
+
+		if int64(p.attachment.Size) > maxSize {
+			return
+		}
+
+		p.err = downloadAttachment(dl, ctx, r.Config.Attachments, []byte(r.Secrets.BlobHashSecret), p, maxSize)
+
+		if p.err != nil {
+			r.Logger.Warn("Error downloading attachment", zap.Error(p.err), zap.String("ticket_id", j.TicketID), zap.String("attachment_id", p.attachment.ID))
+		}
+	})
+
+	for _, p := range pending {
+		err := r.saveAttachment(ctx, j, p, maxSize)
+
+		if err != nil {
+			return fmt.Errorf("error storing attachment %s: %w", p.attachment.ID, err)
+		}
+	}
+
+	return nil
+}
+
+func (r *Runner) saveAttachment(ctx context.Context, j *job, p *pendingAttachment, maxSize int64) error {
+	attachment := p.attachment
+
+	var s = savedAttachment{
+		Attachment: types.Attachment{
+			ID:           attachment.ID,
+			Name:         attachment.Filename,
+			ContentType:  attachment.ContentType,
+			DetectedType: p.sniffed.Type,
+			Errors:       []string{},
+		},
+	}
+
+	switch {
+	case int64(attachment.Size) > maxSize || p.size > maxSize:
+		// Discord's reported size can't be trusted, so the limit is also enforced on what was actually downloaded
+		s.Attachment.Errors = append(s.Attachment.Errors, "Attachment is too large to be uploaded to the transcript.")
+	case p.err != nil:
+		s.Attachment.Errors = append(s.Attachment.Errors, "Attachment could not be downloaded, so it is not part of the transcript.")
+	}
+
+	if p.sniffed.Mismatch {
+		s.Attachment.Errors = append(s.Attachment.Errors, "Attachment claims to be "+p.sniffed.Claimed+" but its contents look like "+p.sniffed.Type+".")
+		s.Flags = append(s.Flags, attachment.Filename+": claims to be "+p.sniffed.Claimed+", looks like "+p.sniffed.Type)
+	}
+
+	if p.sniffed.Blocked {
+		s.Attachment.Errors = append(s.Attachment.Errors, "Attachments of type "+p.sniffed.Type+" are not allowed in transcripts.")
+		s.Flags = append(s.Flags, attachment.Filename+": "+p.sniffed.Type+" is not allowed")
+	}
+
+	var stored = p.upload != nil && p.size <= maxSize
+
+	if stored {
+		s.Attachment.Size = int(p.size)
+		s.Attachment.SHA256 = p.upload.SHA256
+	} else {
+		// Not stored, so keep Discord's links around
+		s.Attachment.URL = attachment.URL
+		s.Attachment.ProxyURL = attachment.ProxyURL
+		s.Attachment.Size = attachment.Size
+	}
+
+	data, err := blobs.EncryptJSON(j.DataKey, s)
+
+	if err != nil {
+		return err
+	}
+
+	saved := &tickets.CloseAttachment{AttachmentID: attachment.ID, MessageID: p.messageId, Data: data}
+
+	if !stored {
+		return r.Tickets.SaveCloseAttachment(ctx, j.TicketID, saved, nil, nil)
+	}
+
+	upload := p.upload
+	p.upload = nil
+
+	return upload.Commit(ctx, r.Tickets, r.Store, r.Keyring, j.TicketID, saved)
+}
+
+// Downloads an attachment into an encrypted upload, stopping once more than maxSize bytes have been read. Discord's
+// cached copy is tried first, falling back to the original URL.
+//
+// The type of the attachment is sniffed from its first bytes before anything is written, and blocked attachments are
+// discarded without being downloaded any further
+func downloadAttachment(dl *downloader.Downloader, ctx context.Context, policy types.ConfigAttachments, hashSecret []byte, p *pendingAttachment, maxSize int64) error {
+	var urls []string
+
+	if p.attachment.ProxyURL != "" {
+		urls = append(urls, p.attachment.ProxyURL)
+	}
+
+	if p.attachment.URL != "" && p.attachment.URL != p.attachment.ProxyURL {
+		urls = append(urls, p.attachment.URL)
+	}
+
+	if len(urls) == 0 {
+		return errors.New("attachment has no url")
+	}
+
+	var err error
+	for _, url := range urls {
+		err = dl.Get(ctx, url, func(r io.Reader) error {
+			// Start over if an earlier attempt got part of the way
+			if p.upload != nil {
+				p.upload.Discard()
+				p.upload = nil
+			}
+
+			header := make([]byte, sniff.HeaderSize)
+			n, err := io.ReadFull(r, header)
+
+			if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+				return err
+			}
+
+			header = header[:n]
+			p.sniffed = sniff.Check(policy, header, p.attachment.Filename, p.attachment.ContentType)
+
+			if p.sniffed.Blocked {
+				return nil
+			}
+
+			upload, err := dedup.Stage(io.MultiReader(bytes.NewReader(header), r), hashSecret, maxSize)
+
+			if err != nil {
+				return err
+			}
+
+			p.upload = upload
+			p.size = upload.Size
+
+			return nil
+		})
+
+		if err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
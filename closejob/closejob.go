@@ -0,0 +1,354 @@
+package closejob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"ibl-tickets/discordapi"
+	"ibl-tickets/inflight"
+	"ibl-tickets/keys"
+	"ibl-tickets/locks"
+	"ibl-tickets/signing"
+	"ibl-tickets/storage"
+	"ibl-tickets/tickets"
+	"ibl-tickets/types"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+var json = jsoniter.ConfigFastest
+
+// Closing a ticket is a job persisted in close_jobs, which moves through these steps in order. Every step stores its
+// result and advances the job in one transaction, and is safe to run again if the process dies part way through it,
+// so an interrupted close is picked up where it left off
+const (
+	StepSnapshot    = "snapshot"    // Backfill the message log and save a copy of it with the job
+	StepAttachments = "attachments" // Store the attachments of the snapshot, recording each one in close_job_attachments
+	StepTranscript  = "transcript"  // Store the encrypted transcript and mark the ticket as closed
+	StepNotify      = "notify"      // Send the transcript to the log channel and the ticket opener
+	StepArchive     = "archive"     // Lock and archive the ticket thread
+	StepDone        = tickets.StepDone
+)
+
+const (
+	// How often Worker looks for unfinished jobs to resume
+	ResumeInterval = 5 * time.Minute
+
+	// Jobs whose runs have failed this many times are no longer resumed by Resume, and are reported to the log channel
+	// for staff to resume by pressing close once the cause has been fixed
+	MaxAttempts = 8
+
+	// The longest Resume waits before retrying a failed job
+	maxBackoff = 6 * time.Hour
+)
+
+// Returned if a newer lock on the ticket has been taken since the job started running, in which case the holder of
+// that lock carries on with the job
+var ErrFenced = tickets.ErrFenced
+
+// A step that failed, the job resumes from it the next time it is run
+type StepError struct {
+	Step string
+	Err  error
+}
+
+func (e *StepError) Error() string {
+	return e.Step + ": " + e.Err.Error()
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+// Runs close jobs
+type Runner struct {
+	Discord discordapi.Client
+	Config  *types.Config
+	Secrets *types.Secrets
+	Keyring *keys.Keyring
+	Signer  *signing.Keys
+	Store   storage.Store
+	Tickets tickets.Store
+	Redis   *redis.Client
+	Logger  *zap.Logger
+	Tracker *inflight.Tracker // Resume stops starting jobs once it drains
+}
+
+// The state of a close job
+type job struct {
+	TicketID     string
+	Token        int64 // Fencing token of the lock the job is running under
+	Step         string
+	CloseUserID  string
+	Attempts     int
+	LogMessageID *string
+
+	// Loaded from the ticket
+	UserID    string
+	ChannelID string
+	TopicID   string
+	Issue     string
+	DataKey   []byte
+}
+
+// Creates the close job of a ticket if it doesn't have one yet. Returns false if the ticket was already being closed
+func Start(ctx context.Context, store tickets.Store, tikId string, closeUserId string) (bool, error) {
+	return store.StartClose(ctx, tikId, closeUserId, StepSnapshot)
+}
+
+// Runs the close job of a ticket from the step it is at until it is done, while holding lock on the ticket. Failures
+// are recorded against the job and returned as a *StepError
+//
+// The lock is kept alive while the job runs. Every step only commits if no newer lock has been taken on the ticket
+// since, and the job stops if the lock is lost
+func (r *Runner) Run(ctx context.Context, lock *locks.Lock) error {
+	tikId := lock.TicketID
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	stop := lock.KeepAlive(ctx, func(err error) {
+		r.Logger.Error("Lost lock while closing ticket", zap.Error(err), zap.String("ticket_id", tikId))
+		cancel(err)
+	})
+
+	defer stop()
+
+	j, err := r.load(ctx, tikId, lock.Token)
+
+	if err != nil {
+		return err
+	}
+
+	for j.Step != StepDone {
+		step := j.Step
+
+		switch step {
+		case StepSnapshot:
+			err = r.snapshot(ctx, j)
+		case StepAttachments:
+			err = r.attachments(ctx, j)
+		case StepTranscript:
+			err = r.transcript(ctx, j)
+		case StepNotify:
+			err = r.notify(ctx, j)
+		case StepArchive:
+			err = r.archive(ctx, j)
+		default:
+			err = fmt.Errorf("unknown step %s", step)
+		}
+
+		if err != nil {
+			if cause := context.Cause(ctx); cause != nil {
+				err = fmt.Errorf("%w (%w)", err, cause)
+			}
+
+			uerr := r.Tickets.FailCloseJob(context.WithoutCancel(ctx), tikId, err.Error())
+
+			if uerr != nil {
+				r.Logger.Error("Error recording close job failure", zap.Error(uerr), zap.String("ticket_id", tikId))
+			}
+
+			return &StepError{Step: step, Err: err}
+		}
+
+		r.Logger.Info("Close job step finished", zap.String("ticket_id", tikId), zap.String("step", step), zap.String("next", j.Step))
+	}
+
+	return nil
+}
+
+// Loads a job along with its ticket, counting the run as an attempt
+func (r *Runner) load(ctx context.Context, tikId string, token int64) (*job, error) {
+	cj, err := r.Tickets.ClaimCloseJob(ctx, tikId, token)
+
+	if errors.Is(err, tickets.ErrNotFound) {
+		return nil, fmt.Errorf("ticket %s has no close job", tikId)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := r.Tickets.Get(ctx, tikId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var j = job{
+		TicketID:     tikId,
+		Token:        token,
+		Step:         cj.Step,
+		CloseUserID:  cj.CloseUserID,
+		Attempts:     cj.Attempts,
+		LogMessageID: cj.LogMessageID,
+		UserID:       t.UserID,
+		ChannelID:    t.ChannelID,
+		TopicID:      t.TopicID,
+		Issue:        t.Issue,
+	}
+
+	// Tickets opened before column encryption get their data key in the snapshot step
+	if t.EncKey != "" {
+		j.DataKey, err = r.Keyring.TicketKey(t.EncKey, t.EncKeyID)
+
+		if err != nil {
+			return nil, fmt.Errorf("error getting data key: %w", err)
+		}
+	}
+
+	return &j, nil
+}
+
+// How long Resume waits after a job fails before retrying it, doubling with every attempt
+func backoff(attempts int) time.Duration {
+	d := ResumeInterval
+
+	for i := 1; i < attempts && d < maxBackoff; i++ {
+		d *= 2
+	}
+
+	return min(d, maxBackoff)
+}
+
+// Reports whether Resume should run a job now. Jobs that have never run are started straight away, while any other job
+// is retried with backoff until it reaches MaxAttempts. That includes jobs without an error, whose run was cut short by
+// the process dying (a clean drain waits for running jobs), as a job that kills the process would otherwise do so forever
+func due(j *tickets.CloseJob, now time.Time) bool {
+	if j.Attempts == 0 {
+		return true
+	}
+
+	if j.Attempts >= MaxAttempts {
+		return false
+	}
+
+	return now.Sub(j.UpdatedAt) >= backoff(j.Attempts)
+}
+
+// Runs every unfinished job that is due, such as those interrupted by a restart or that failed on an earlier run
+func (r *Runner) Resume(ctx context.Context) {
+	jobs, err := r.Tickets.UnfinishedCloseJobs(ctx)
+
+	if err != nil {
+		r.Logger.Error("Error getting unfinished close jobs", zap.Error(err))
+		return
+	}
+
+	now := time.Now()
+
+	for _, uj := range jobs {
+		if !due(uj, now) {
+			continue
+		}
+
+		done, ok := r.Tracker.Start("close job " + uj.TicketID)
+
+		if !ok {
+			return
+		}
+
+		r.resume(ctx, uj)
+		done()
+	}
+}
+
+func (r *Runner) resume(ctx context.Context, uj *tickets.CloseJob) {
+	tikId := uj.TicketID
+
+	// The job is resumed on behalf of whoever started it
+	lock, err := locks.Acquire(ctx, r.Redis, tikId, uj.CloseUserID, locks.DefaultTTL)
+
+	var held *locks.HeldError
+	if errors.As(err, &held) {
+		// Still running, most likely from a close button
+		return
+	}
+
+	if err != nil {
+		r.Logger.Error("Error locking ticket", zap.Error(err), zap.String("ticket_id", tikId))
+		return
+	}
+
+	defer lock.Release(ctx)
+
+	r.Logger.Info("Resuming close job", zap.String("ticket_id", tikId), zap.Int("attempts", uj.Attempts))
+
+	err = r.Run(ctx, lock)
+
+	if err == nil {
+		return
+	}
+
+	r.Logger.Error("Error resuming close job", zap.Error(err), zap.String("ticket_id", tikId))
+
+	var stepErr *StepError
+	if errors.As(err, &stepErr) && uj.Attempts+1 >= MaxAttempts {
+		r.reportGivenUp(tikId, uj.Attempts+1, stepErr)
+	}
+}
+
+// Reports a job that Resume will no longer retry to the log channel
+func (r *Runner) reportGivenUp(tikId string, attempts int, stepErr *StepError) {
+	reason := stepErr.Err.Error()
+
+	if len(reason) > 1024 {
+		reason = reason[:1021] + "..."
+	}
+
+	_, err := r.Discord.ChannelMessageSendComplex(r.Config.Channels.LogChannel, &discordgo.MessageSend{
+		Embeds: []*discordgo.MessageEmbed{
+			{
+				Title:       "Ticket Close Failed",
+				Description: fmt.Sprintf("Closing this ticket has failed %d times, so it won't be retried automatically. Press close in its thread to try again once the cause has been fixed.", attempts),
+				Fields: []*discordgo.MessageEmbedField{
+					{
+						Name:   "Ticket ID",
+						Value:  tikId,
+						Inline: false,
+					},
+					{
+						Name:   "Step",
+						Value:  stepErr.Step,
+						Inline: false,
+					},
+					{
+						Name:   "Error",
+						Value:  reason,
+						Inline: false,
+					},
+				},
+			},
+		},
+		AllowedMentions: &discordgo.MessageAllowedMentions{
+			Parse: []discordgo.AllowedMentionType{},
+		},
+	})
+
+	if err != nil {
+		r.Logger.Error("Error reporting failed close job", zap.Error(err), zap.String("ticket_id", tikId))
+	}
+}
+
+// Resumes unfinished jobs now and then every ResumeInterval until ctx is done or the tracker drains
+func (r *Runner) Worker(ctx context.Context) {
+	ticker := time.NewTicker(ResumeInterval)
+	defer ticker.Stop()
+
+	for {
+		r.Resume(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.Tracker.Draining():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,509 @@
+package closejob
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"ibl-tickets/blobs"
+	"ibl-tickets/dedup"
+	"ibl-tickets/downloader"
+	"ibl-tickets/fakediscord"
+	"ibl-tickets/keys"
+	"ibl-tickets/locks"
+	"ibl-tickets/signing"
+	"ibl-tickets/storage"
+	"ibl-tickets/tickets"
+	"ibl-tickets/types"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/bwmarrin/discordgo"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+const (
+	testThread     = "2000000000000000001"
+	testLogChannel = "2000000000000000002"
+	testOpener     = "3000000000000000001"
+	testStaff      = "3000000000000000002"
+)
+
+func randomKey(t *testing.T) string {
+	key := make([]byte, 32)
+
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+type testEnv struct {
+	runner  *Runner
+	discord *fakediscord.Server
+	tickets *tickets.MemoryStore
+	redis   *redis.Client
+}
+
+// A runner closing tickets against fakediscord, a MemoryStore, a scratch directory and miniredis
+func newTestEnv(t *testing.T) *testEnv {
+	secrets := &types.Secrets{
+		MasterKeyID:          "k1",
+		MasterKey:            randomKey(t),
+		TranscriptSigningKey: randomKey(t),
+		BlobHashSecret:       "hash secret",
+		LinkSecret:           "link secret",
+	}
+
+	keyring, err := keys.Load(secrets)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := signing.Load(secrets)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	discord := fakediscord.New()
+	t.Cleanup(discord.Close)
+
+	discord.AddChannel(&discordgo.Channel{ID: testThread, Type: discordgo.ChannelTypeGuildPrivateThread})
+	discord.AddChannel(&discordgo.Channel{ID: testLogChannel, Type: discordgo.ChannelTypeGuildText})
+
+	rd := miniredis.RunT(t)
+	rediscli := redis.NewClient(&redis.Options{Addr: rd.Addr()})
+	t.Cleanup(func() { rediscli.Close() })
+
+	config := &types.Config{
+		Topics:   map[string]types.Topic{"support": {Name: "Support"}},
+		Channels: types.ConfigChannels{LogChannel: testLogChannel},
+	}
+
+	config.Database.ExposedPath = "https://tickets.example/"
+
+	store := tickets.NewMemoryStore()
+
+	return &testEnv{
+		runner: &Runner{
+			Discord: discord.Session(),
+			Config:  config,
+			Secrets: secrets,
+			Keyring: keyring,
+			Signer:  signer,
+			Store:   &storage.FileStore{Root: t.TempDir()},
+			Tickets: store,
+			Redis:   rediscli,
+			Logger:  zap.NewNop(),
+		},
+		discord: discord,
+		tickets: store,
+		redis:   rediscli,
+	}
+}
+
+// Opens a ticket like the tikModal handler does, with a thread holding a few messages and two attachments with the
+// same contents
+func (e *testEnv) openTicket(t *testing.T, tikId string) {
+	ctx := context.Background()
+
+	dataKey, wrapped, keyId, err := e.runner.Keyring.NewDataKey()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encContext, err := blobs.EncryptJSON(dataKey, map[string]string{"Question": "Answer"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = e.tickets.Create(ctx, &tickets.Ticket{
+		ID:               tikId,
+		UserID:           testOpener,
+		ChannelID:        testThread,
+		TopicID:          "support",
+		Issue:            "Can't log in",
+		EncTicketContext: encContext,
+		EncKey:           wrapped,
+		EncKeyID:         keyId,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("log file contents"))
+	}))
+	t.Cleanup(files.Close)
+
+	opener := &discordgo.User{ID: testOpener}
+
+	e.discord.AddMessage(testThread, &discordgo.Message{Author: opener, Content: "hello"})
+	e.discord.AddMessage(testThread, &discordgo.Message{
+		Author:  opener,
+		Content: "here are my logs",
+		Attachments: []*discordgo.MessageAttachment{
+			{ID: "a1", Filename: "log.txt", ContentType: "text/plain", Size: 17, URL: files.URL + "/a1"},
+			{ID: "a2", Filename: "log-copy.txt", ContentType: "text/plain", Size: 17, URL: files.URL + "/a2"},
+		},
+	})
+	e.discord.AddMessage(testThread, &discordgo.Message{Author: &discordgo.User{ID: testStaff}, Content: "thanks"})
+}
+
+// Runs the close job of a ticket under a new lock, like the close button and Resume do
+func (e *testEnv) run(t *testing.T, tikId string) error {
+	ctx := context.Background()
+
+	lock, err := locks.Acquire(ctx, e.redis, tikId, testStaff, locks.DefaultTTL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer lock.Release(ctx)
+
+	return e.runner.Run(ctx, lock)
+}
+
+func TestClose(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv(t)
+	e.openTicket(t, "t1")
+
+	if created, err := Start(ctx, e.tickets, "t1", testStaff); err != nil || !created {
+		t.Fatalf("Start = %v, %v", created, err)
+	}
+
+	if err := e.run(t, "t1"); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	j, err := e.tickets.CloseJob(ctx, "t1")
+
+	if err != nil || j.Step != StepDone || j.LogMessageID == nil || j.DMMessageID == nil {
+		t.Fatalf("close job = %+v, %v", j, err)
+	}
+
+	tik, _ := e.tickets.Get(ctx, "t1")
+
+	if tik.Open || tik.CloseUserID != testStaff || tik.EncMessages == nil || tik.Messages != nil {
+		t.Fatalf("ticket after closing = %+v", tik)
+	}
+
+	dataKey, err := e.runner.Keyring.TicketKey(tik.EncKey, tik.EncKeyID)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var messages []types.Message
+
+	if err := blobs.DecryptJSON(dataKey, tik.EncMessages, nil, &messages); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(messages) != 3 || messages[1].Content != "here are my logs" || len(messages[1].Attachments) != 2 {
+		t.Fatalf("transcript messages = %+v", messages)
+	}
+
+	// What was kept for the steps is dropped once they are done
+	if log, _ := e.tickets.MessageLog(ctx, "t1"); len(log) != 0 {
+		t.Fatalf("message log still has %d events", len(log))
+	}
+
+	if saved, _ := e.tickets.CloseAttachments(ctx, "t1"); len(saved) != 0 {
+		t.Fatalf("%d saved attachments are left", len(saved))
+	}
+
+	if j.Snapshot != nil {
+		t.Fatal("snapshot was kept")
+	}
+
+	// Both attachments reference one stored blob
+	b1, err1 := e.tickets.Blob(ctx, "t1", "a1")
+	b2, err2 := e.tickets.Blob(ctx, "t1", "a2")
+
+	if err1 != nil || err2 != nil || b1.Hash != b2.Hash {
+		t.Fatalf("attachments reference %v (%v) and %v (%v), want the same blob", b1, err1, b2, err2)
+	}
+
+	r, err := dedup.Open(ctx, e.tickets, e.runner.Store, e.runner.Keyring, "t1", "a2")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := io.ReadAll(r)
+	r.Close()
+
+	if string(data) != "log file contents" {
+		t.Fatalf("stored attachment = %q", data)
+	}
+
+	if sent := e.discord.Messages(testLogChannel); len(sent) != 1 || len(sent[0].Attachments) != 1 || sent[0].Attachments[0].Filename != "t1.ibltranscript" {
+		t.Fatalf("log channel messages = %+v, want the transcript", sent)
+	}
+
+	if dm := e.discord.DM(testOpener); dm == "" || len(e.discord.Messages(dm)) != 1 {
+		t.Fatal("transcript was not sent to the opener")
+	}
+
+	thread := e.discord.Channel(testThread)
+
+	if thread.ThreadMetadata == nil || !thread.ThreadMetadata.Locked || !thread.ThreadMetadata.Archived {
+		t.Fatalf("thread was not locked and archived: %+v", thread.ThreadMetadata)
+	}
+}
+
+func TestCloseResumesFailedStep(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv(t)
+	e.openTicket(t, "t1")
+
+	if _, err := Start(ctx, e.tickets, "t1", testStaff); err != nil {
+		t.Fatal(err)
+	}
+
+	e.discord.FailNext(http.MethodPost, "/channels/"+testLogChannel+"/messages", http.StatusInternalServerError, 0)
+
+	err := e.run(t, "t1")
+
+	var stepErr *StepError
+	if !errors.As(err, &stepErr) || stepErr.Step != StepNotify {
+		t.Fatalf("Run error = %v, want a failed %s step", err, StepNotify)
+	}
+
+	j, _ := e.tickets.CloseJob(ctx, "t1")
+
+	if j.Step != StepNotify || j.LastError == "" {
+		t.Fatalf("close job after failing = %+v", j)
+	}
+
+	if tik, _ := e.tickets.Get(ctx, "t1"); tik.Open {
+		t.Fatal("ticket is still open although its transcript was stored")
+	}
+
+	// Running it again carries on from notify rather than starting over
+	before := len(e.discord.Calls())
+
+	if err := e.run(t, "t1"); err != nil {
+		t.Fatalf("resumed Run: %v", err)
+	}
+
+	j, _ = e.tickets.CloseJob(ctx, "t1")
+
+	if j.Step != StepDone || j.Attempts != 2 || j.LastError != "" {
+		t.Fatalf("close job after resuming = %+v", j)
+	}
+
+	if sent := e.discord.Messages(testLogChannel); len(sent) != 1 {
+		t.Fatalf("log channel has %d transcripts, want 1", len(sent))
+	}
+
+	for _, c := range e.discord.Calls()[before:] {
+		if c.Method == http.MethodGet && c.Path == "/channels/"+testThread+"/messages" {
+			t.Fatal("resumed close backfilled the thread again")
+		}
+	}
+}
+
+func TestCloseFenced(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv(t)
+	e.openTicket(t, "t1")
+
+	if _, err := Start(ctx, e.tickets, "t1", testStaff); err != nil {
+		t.Fatal(err)
+	}
+
+	lock, err := locks.Acquire(ctx, e.redis, "t1", testStaff, locks.DefaultTTL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer lock.Release(ctx)
+
+	// A newer lock claimed the job while this one was stalled
+	if _, err := e.tickets.ClaimCloseJob(ctx, "t1", lock.Token+1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.runner.Run(ctx, lock); !errors.Is(err, ErrFenced) {
+		t.Fatalf("Run error = %v, want %v", err, ErrFenced)
+	}
+
+	if j, _ := e.tickets.CloseJob(ctx, "t1"); j.Step != StepSnapshot {
+		t.Fatalf("fenced run moved the job to %s", j.Step)
+	}
+}
+
+func TestResumeBackoff(t *testing.T) {
+	now := time.Now()
+
+	if backoff(1) != ResumeInterval || backoff(3) != 4*ResumeInterval || backoff(MaxAttempts*4) != maxBackoff {
+		t.Fatalf("backoff = %v, %v, %v", backoff(1), backoff(3), backoff(MaxAttempts*4))
+	}
+
+	var cases = []struct {
+		name string
+		job  tickets.CloseJob
+		due  bool
+	}{
+		{"never run", tickets.CloseJob{UpdatedAt: now}, true},
+		{"just interrupted", tickets.CloseJob{Attempts: 1, UpdatedAt: now}, false},
+		{"interrupted a while ago", tickets.CloseJob{Attempts: 1, UpdatedAt: now.Add(-ResumeInterval)}, true},
+		{"interrupted often", tickets.CloseJob{Attempts: 3, UpdatedAt: now.Add(-2 * ResumeInterval)}, false},
+		{"interrupted too often", tickets.CloseJob{Attempts: MaxAttempts, UpdatedAt: now.Add(-24 * time.Hour)}, false},
+		{"just failed", tickets.CloseJob{Attempts: 1, LastError: "boom", UpdatedAt: now}, false},
+		{"failed a while ago", tickets.CloseJob{Attempts: 1, LastError: "boom", UpdatedAt: now.Add(-ResumeInterval)}, true},
+		{"failed often", tickets.CloseJob{Attempts: 3, LastError: "boom", UpdatedAt: now.Add(-2 * ResumeInterval)}, false},
+		{"given up", tickets.CloseJob{Attempts: MaxAttempts, LastError: "boom", UpdatedAt: now.Add(-24 * time.Hour)}, false},
+	}
+
+	for _, c := range cases {
+		if got := due(&c.job, now); got != c.due {
+			t.Errorf("%s: due = %v, want %v", c.name, got, c.due)
+		}
+	}
+}
+
+func TestResumeGivesUp(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv(t)
+	e.openTicket(t, "t1")
+
+	if _, err := Start(ctx, e.tickets, "t1", testStaff); err != nil {
+		t.Fatal(err)
+	}
+
+	// The thread can't be read, so every attempt fails at the snapshot
+	e.discord.FailNext(http.MethodGet, "/channels/"+testThread+"/messages", http.StatusInternalServerError, 0)
+
+	// Runs before this one failed too
+	for i := 1; i < MaxAttempts; i++ {
+		lock, err := locks.Acquire(ctx, e.redis, "t1", testStaff, locks.DefaultTTL)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := e.tickets.ClaimCloseJob(ctx, "t1", lock.Token); err != nil {
+			t.Fatal(err)
+		}
+
+		e.tickets.FailCloseJob(ctx, "t1", "boom")
+		lock.Release(ctx)
+	}
+
+	uj, _ := e.tickets.CloseJob(ctx, "t1")
+
+	if uj.Attempts != MaxAttempts-1 {
+		t.Fatalf("job has %d attempts before resuming", uj.Attempts)
+	}
+
+	e.runner.resume(ctx, uj)
+
+	j, _ := e.tickets.CloseJob(ctx, "t1")
+
+	if j.Attempts != MaxAttempts || j.LastError == "" || due(j, time.Now().Add(48*time.Hour)) {
+		t.Fatalf("close job after its last attempt = %+v", j)
+	}
+
+	sent := e.discord.Messages(testLogChannel)
+
+	if len(sent) != 1 || len(sent[0].Embeds) != 1 || sent[0].Embeds[0].Title != "Ticket Close Failed" {
+		t.Fatalf("log channel messages = %+v, want the job reported", sent)
+	}
+}
+
+func TestDownloadAttachment(t *testing.T) {
+	const maxSize = 16
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Write([]byte("small file"))
+		case "/exact":
+			w.Write([]byte(strings.Repeat("a", maxSize)))
+		case "/large":
+			// Larger than Discord said it was
+			w.Write([]byte(strings.Repeat("a", 10*maxSize)))
+		case "/flaky":
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	tests := []struct {
+		name     string
+		proxyURL string
+		url      string
+		deny     []string
+		size     int64
+		stored   bool
+		wantErr  bool
+	}{
+		{"small", "/small", "", nil, 10, true, false},
+		{"at the limit", "/exact", "", nil, maxSize, true, false},
+		{"over the limit", "/large", "", nil, maxSize + 1, false, false},
+		{"proxy missing", "/missing", "/small", nil, 10, true, false},
+		{"proxy failing", "/flaky", "/small", nil, 10, true, false},
+		{"both missing", "/missing", "/gone", nil, 0, false, true},
+		{"blocked", "/small", "", []string{"text/plain"}, 0, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &pendingAttachment{attachment: &discordgo.MessageAttachment{ID: "a1", Filename: "file.txt", Size: 10}}
+
+			if tt.proxyURL != "" {
+				p.attachment.ProxyURL = srv.URL + tt.proxyURL
+			}
+
+			if tt.url != "" {
+				p.attachment.URL = srv.URL + tt.url
+			}
+
+			t.Cleanup(func() {
+				if p.upload != nil {
+					p.upload.Discard()
+				}
+			})
+
+			dl := &downloader.Downloader{Attempts: 2, Backoff: time.Millisecond}
+			err := downloadAttachment(dl, context.Background(), types.ConfigAttachments{Deny: tt.deny}, []byte("hash secret"), p, maxSize)
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error = %v", err, tt.wantErr)
+			}
+
+			if p.size != tt.size {
+				t.Fatalf("size = %d, want %d", p.size, tt.size)
+			}
+
+			// Uploads over the limit are kept only so saveAttachment can tell, and are never committed
+			if stored := p.upload != nil && p.upload.Hash != ""; stored != tt.stored {
+				t.Fatalf("stored = %v, want %v", stored, tt.stored)
+			}
+
+			if p.sniffed.Blocked != (tt.deny != nil) {
+				t.Fatalf("blocked = %v", p.sniffed.Blocked)
+			}
+		})
+	}
+}
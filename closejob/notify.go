@@ -0,0 +1,259 @@
+package closejob
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"ibl-tickets/blobs"
+	"ibl-tickets/links"
+	"ibl-tickets/types"
+	"os"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"go.uber.org/zap"
+)
+
+// Number of recent messages searched for a transcript sent by an interrupted run
+const sentSearchLimit = 50
+
+// Builds the embed sent along with the transcript
+func closeEmbed(j *job, url string, flagged []string) *discordgo.MessageEmbed {
+	embed := &discordgo.MessageEmbed{
+		Title: "Ticket Closed",
+		Fields: []*discordgo.MessageEmbedField{
+			{
+				Name:   "Ticket ID",
+				Value:  j.TicketID,
+				Inline: false,
+			},
+			{
+				Name:   "User",
+				Value:  "<@" + j.UserID + ">",
+				Inline: false,
+			},
+			{
+				Name:   "Closed By",
+				Value:  "<@" + j.CloseUserID + ">",
+				Inline: false,
+			},
+			{
+				Name:   "Ticket URL",
+				Value:  url,
+				Inline: false,
+			},
+		},
+	}
+
+	if len(flagged) > 0 {
+		var value string
+
+		for _, f := range flagged {
+			// Embed field values are limited to 1024 characters
+			if len(value)+len(f)+1 > 1000 {
+				value += "..."
+				break
+			}
+
+			value += f + "\n"
+		}
+
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:   "Flagged Attachments",
+			Value:  value,
+			Inline: false,
+		})
+	}
+
+	return embed
+}
+
+// Looks for a transcript of the ticket that we already sent to a channel, as a run that died after sending it
+// wouldn't have recorded its ID
+func (r *Runner) findSent(j *job, channelId string) (string, error) {
+	msgs, err := r.Discord.ChannelMessages(channelId, sentSearchLimit, "", "", "")
+
+	if err != nil {
+		return "", err
+	}
+
+	for _, msg := range msgs {
+		if msg.Author == nil || !msg.Author.Bot {
+			continue
+		}
+
+		for _, embed := range msg.Embeds {
+			if embed.Title != "Ticket Closed" || len(embed.Fields) == 0 {
+				continue
+			}
+
+			if embed.Fields[0].Name == "Ticket ID" && embed.Fields[0].Value == j.TicketID {
+				return msg.ID, nil
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// Sends the transcript to a channel unless an earlier run already did, returning the ID of the message
+func (r *Runner) send(j *job, channelId string, embed *discordgo.MessageEmbed, transcript []byte) (string, error) {
+	// Only a run after the first can have sent it already
+	if j.Attempts > 1 {
+		msgId, err := r.findSent(j, channelId)
+
+		if err != nil {
+			return "", fmt.Errorf("error checking for an earlier transcript: %w", err)
+		}
+
+		if msgId != "" {
+			return msgId, nil
+		}
+	}
+
+	msg, err := r.Discord.ChannelMessageSendComplex(channelId, &discordgo.MessageSend{
+		Embeds: []*discordgo.MessageEmbed{embed},
+		Files: []*discordgo.File{
+			{
+				Name:        j.TicketID + ".ibltranscript",
+				ContentType: "application/json+ibltranscript",
+				Reader:      bytes.NewReader(transcript),
+			},
+		},
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return msg.ID, nil
+}
+
+// Sends the signed transcript to the log channel (with a staff link) and to the ticket opener (with their own link)
+func (r *Runner) notify(ctx context.Context, j *job) error {
+	topic, ok := r.Config.Topics[j.TopicID]
+
+	if !ok {
+		return fmt.Errorf("invalid topic id: %s", j.TopicID)
+	}
+
+	t, err := r.Tickets.Get(ctx, j.TicketID)
+
+	if err != nil {
+		return err
+	}
+
+	var transcriptData = types.FileTranscriptData{
+		Issue:       j.Issue,
+		TopicID:     j.TopicID,
+		Topic:       topic,
+		UserID:      j.UserID,
+		CloseUserID: j.CloseUserID,
+		ChannelID:   j.ChannelID,
+		TicketID:    j.TicketID,
+	}
+
+	err = blobs.DecryptJSON(j.DataKey, t.EncTicketContext, t.TicketContext, &transcriptData.TicketContext)
+
+	if err != nil {
+		return fmt.Errorf("error decrypting ticket context: %w", err)
+	}
+
+	err = blobs.DecryptJSON(j.DataKey, t.EncMessages, t.Messages, &transcriptData.Messages)
+
+	if err != nil {
+		return fmt.Errorf("error decrypting messages: %w", err)
+	}
+
+	saved, err := r.savedAttachments(ctx, j)
+
+	if err != nil {
+		return err
+	}
+
+	var flagged []string
+	for _, msg := range transcriptData.Messages {
+		for _, attachment := range msg.Attachments {
+			flagged = append(flagged, saved[attachment.ID].Flags...)
+		}
+	}
+
+	// Sign the transcript so a copy presented back to us can be checked for modifications
+	err = r.Signer.Sign(&transcriptData, time.Now())
+
+	if err != nil {
+		return fmt.Errorf("error signing transcript: %w", err)
+	}
+
+	transcript, err := json.Marshal(transcriptData)
+
+	if err != nil {
+		return fmt.Errorf("error marshalling transcript: %w", err)
+	}
+
+	// Staff and the ticket opener get separately signed links so they can expire independently
+	if j.LogMessageID == nil {
+		msgId, err := r.send(j, r.Config.Channels.LogChannel, closeEmbed(j, links.URL(r.Config, r.Secrets, j.TicketID, links.AudienceStaff), flagged), transcript)
+
+		if err != nil {
+			return fmt.Errorf("error sending transcript to logs channel: %w", err)
+		}
+
+		err = r.Tickets.SetLogMessage(ctx, j.TicketID, j.Token, msgId)
+
+		if err != nil {
+			return err
+		}
+
+		j.LogMessageID = &msgId
+	}
+
+	// The user may not accept DMs, which doesn't stop the ticket from being closed
+	var dmMessageId *string
+
+	dm, err := r.Discord.UserChannelCreate(j.UserID)
+
+	if err != nil {
+		r.Logger.Error("Error creating DM channel", zap.Error(err), zap.String("user_id", j.UserID))
+	} else {
+		msgId, err := r.send(j, dm.ID, closeEmbed(j, links.URL(r.Config, r.Secrets, j.TicketID, links.AudienceUser), flagged), transcript)
+
+		if err != nil {
+			r.Logger.Error("Error sending transcript to user", zap.Error(err), zap.String("user_id", j.UserID))
+		} else {
+			dmMessageId = &msgId
+		}
+	}
+
+	err = r.Tickets.SaveDMMessage(ctx, j.TicketID, j.Token, dmMessageId, StepArchive)
+
+	if err != nil {
+		return err
+	}
+
+	j.Step = StepArchive
+	return nil
+}
+
+// Locks and archives the ticket thread, then drops what the job kept for its earlier steps
+func (r *Runner) archive(ctx context.Context, j *job) error {
+	var locked = true
+	_, err := r.Discord.ChannelEdit(j.ChannelID, &discordgo.ChannelEdit{
+		ParentID: os.Getenv("TICKET_THREAD_CHANNEL"),
+		Locked:   &locked,
+		Archived: &locked,
+	})
+
+	if err != nil && !ThreadMissing(err) {
+		return fmt.Errorf("error setting thread to read-only: %w", err)
+	}
+
+	err = r.Tickets.FinishCloseJob(ctx, j.TicketID, j.Token, StepDone)
+
+	if err != nil {
+		return err
+	}
+
+	j.Step = StepDone
+	return nil
+}
@@ -0,0 +1,183 @@
+package closejob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"ibl-tickets/blobs"
+	"ibl-tickets/handlers/events"
+	"ibl-tickets/types"
+
+	"github.com/bwmarrin/discordgo"
+	"go.uber.org/zap"
+)
+
+// The messages of a ticket as they were when closing started, stored encrypted in close_jobs.snapshot until the
+// transcript has been stored
+type snapshot struct {
+	Messages    []types.Message      `json:"messages"` // Without attachments, which are added from close_job_attachments
+	Attachments []snapshotAttachment `json:"attachments"`
+}
+
+type snapshotAttachment struct {
+	MessageID  string                       `json:"message_id"`
+	Attachment *discordgo.MessageAttachment `json:"attachment"`
+}
+
+func (r *Runner) snapshot(ctx context.Context, j *job) error {
+	if j.DataKey == nil {
+		// Tickets opened before column encryption get a data key now, unless logging a message gave them one since
+		t, err := r.Tickets.Get(ctx, j.TicketID)
+
+		if err != nil {
+			return fmt.Errorf("error getting ticket: %w", err)
+		}
+
+		j.DataKey, err = events.DataKey(r.Keyring, r.Tickets, ctx, t)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// Record any messages the live capture missed, then build the snapshot from the log
+	err := events.Backfill(r.Discord, r.Tickets, ctx, j.TicketID, j.ChannelID, j.DataKey)
+
+	if ThreadMissing(err) {
+		// Deleted threads are closed from what was logged while they existed
+		r.Logger.Warn("Ticket thread no longer exists, closing from the message log", zap.String("ticket_id", j.TicketID))
+	} else if err != nil {
+		return fmt.Errorf("error backfilling messages: %w", err)
+	}
+
+	loggedMessages, err := events.Messages(r.Tickets, ctx, j.TicketID, j.DataKey)
+
+	if err != nil {
+		return fmt.Errorf("error getting logged messages: %w", err)
+	}
+
+	var snap snapshot
+	for _, msg := range loggedMessages {
+		snap.Messages = append(snap.Messages, types.Message{
+			ID:       msg.ID,
+			AuthorID: msg.Author.ID,
+			Content:  msg.Content,
+			Embeds:   msg.Embeds,
+			Edits:    msg.Edits,
+			Deleted:  msg.Deleted,
+		})
+
+		for _, attachment := range msg.Attachments {
+			snap.Attachments = append(snap.Attachments, snapshotAttachment{MessageID: msg.ID, Attachment: attachment})
+		}
+	}
+
+	encSnapshot, err := blobs.EncryptJSON(j.DataKey, snap)
+
+	if err != nil {
+		return fmt.Errorf("error encrypting snapshot: %w", err)
+	}
+
+	err = r.Tickets.SaveSnapshot(ctx, j.TicketID, j.Token, encSnapshot, StepAttachments)
+
+	if err != nil {
+		return err
+	}
+
+	j.Step = StepAttachments
+	return nil
+}
+
+// Reports whether err is Discord saying a channel doesn't exist, such as a ticket thread that was deleted
+func ThreadMissing(err error) bool {
+	var restErr *discordgo.RESTError
+	return errors.As(err, &restErr) && restErr.Message != nil && restErr.Message.Code == discordgo.ErrCodeUnknownChannel
+}
+
+func (r *Runner) loadSnapshot(ctx context.Context, j *job) (*snapshot, error) {
+	cj, err := r.Tickets.CloseJob(ctx, j.TicketID)
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting snapshot: %w", err)
+	}
+
+	if cj.Snapshot == nil {
+		return nil, fmt.Errorf("close job has no snapshot")
+	}
+
+	var snap snapshot
+	err = blobs.DecryptJSON(j.DataKey, cj.Snapshot, nil, &snap)
+
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting snapshot: %w", err)
+	}
+
+	return &snap, nil
+}
+
+func (r *Runner) transcript(ctx context.Context, j *job) error {
+	snap, err := r.loadSnapshot(ctx, j)
+
+	if err != nil {
+		return err
+	}
+
+	saved, err := r.savedAttachments(ctx, j)
+
+	if err != nil {
+		return err
+	}
+
+	var attachments = map[string][]types.Attachment{}
+	for _, a := range snap.Attachments {
+		s, ok := saved[a.Attachment.ID]
+
+		if !ok {
+			return fmt.Errorf("attachment %s was not saved", a.Attachment.ID)
+		}
+
+		attachments[a.MessageID] = append(attachments[a.MessageID], s.Attachment)
+	}
+
+	var messages = snap.Messages
+	for i := range messages {
+		messages[i].Attachments = attachments[messages[i].ID]
+	}
+
+	t, err := r.Tickets.Get(ctx, j.TicketID)
+
+	if err != nil {
+		return fmt.Errorf("error getting ticket context: %w", err)
+	}
+
+	var ticketContext map[string]string
+	err = blobs.DecryptJSON(j.DataKey, t.EncTicketContext, t.TicketContext, &ticketContext)
+
+	if err != nil {
+		return fmt.Errorf("error decrypting ticket context: %w", err)
+	}
+
+	// The ticket context is re-encrypted too, as it is still plaintext for tickets opened before column encryption
+	var encContext []byte
+	encMessages, err := blobs.EncryptJSON(j.DataKey, messages)
+
+	if err == nil {
+		encContext, err = blobs.EncryptJSON(j.DataKey, ticketContext)
+	}
+
+	if err != nil {
+		return fmt.Errorf("error encrypting transcript: %w", err)
+	}
+
+	// The transcript now holds every message along with its edits and deletion, so the message log and the snapshot
+	// are dropped with it. Nothing reads them once the ticket is closed, and they would otherwise keep a second copy
+	// of its messages that outlives the transcript being purged
+	err = r.Tickets.SaveTranscript(ctx, j.TicketID, j.Token, j.CloseUserID, encMessages, encContext, StepNotify)
+
+	if err != nil {
+		return err
+	}
+
+	j.Step = StepNotify
+	return nil
+}
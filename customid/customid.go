@@ -0,0 +1,174 @@
+package customid
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Longest custom ID Discord accepts
+const MaxLength = 100
+
+var (
+	ErrUnknown   = errors.New("no route for custom ID")
+	ErrMalformed = errors.New("malformed custom ID")
+)
+
+// Arguments of a custom ID by parameter name
+type Args map[string]string
+
+// The shape of a custom ID, such as close:{ticketId}
+//
+// Custom IDs are a name followed by an argument per parameter, separated by colons. Changing the parameters of a custom
+// ID means bumping its version, which is written after the name (close@2:{ticketId}:{reason}), so buttons sent with
+// the previous version can still be told apart and migrated. Version 1 is left unmarked
+type Pattern struct {
+	name    string
+	version int
+	params  []string
+}
+
+// Parses a pattern, returning an error if it isn't a name (and version) followed by {param} segments
+func Parse(pattern string) (*Pattern, error) {
+	segments := strings.Split(pattern, ":")
+
+	name, version, err := parseHead(segments[0])
+
+	if err != nil {
+		return nil, fmt.Errorf("pattern %s: %w", pattern, err)
+	}
+
+	p := &Pattern{name: name, version: version}
+
+	seen := map[string]bool{}
+	for _, s := range segments[1:] {
+		if len(s) < 3 || s[0] != '{' || s[len(s)-1] != '}' {
+			return nil, fmt.Errorf("pattern %s: segment %s is not a {param}", pattern, s)
+		}
+
+		param := s[1 : len(s)-1]
+
+		if seen[param] {
+			return nil, fmt.Errorf("pattern %s: duplicate param %s", pattern, param)
+		}
+
+		seen[param] = true
+		p.params = append(p.params, param)
+	}
+
+	return p, nil
+}
+
+// Like Parse, but panics on error. For patterns known at compile time
+func MustParse(pattern string) *Pattern {
+	p, err := Parse(pattern)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return p
+}
+
+// Splits name@version, where the version is optional and at least 2
+func parseHead(head string) (string, int, error) {
+	name, v, versioned := strings.Cut(head, "@")
+
+	if name == "" {
+		return "", 0, errors.New("missing name")
+	}
+
+	if !versioned {
+		return name, 1, nil
+	}
+
+	version, err := strconv.Atoi(v)
+
+	if err != nil || version < 2 || strconv.Itoa(version) != v {
+		return "", 0, fmt.Errorf("invalid version %s", v)
+	}
+
+	return name, version, nil
+}
+
+func (p *Pattern) Name() string {
+	return p.name
+}
+
+func (p *Pattern) Version() int {
+	return p.version
+}
+
+func (p *Pattern) String() string {
+	var sb strings.Builder
+	sb.WriteString(p.head())
+
+	for _, param := range p.params {
+		sb.WriteString(":{" + param + "}")
+	}
+
+	return sb.String()
+}
+
+func (p *Pattern) head() string {
+	if p.version == 1 {
+		return p.name
+	}
+
+	return p.name + "@" + strconv.Itoa(p.version)
+}
+
+// Returns the custom ID with args as the arguments, in the order of the parameters
+func (p *Pattern) Build(args ...string) (string, error) {
+	if len(args) != len(p.params) {
+		return "", fmt.Errorf("%s takes %d arguments, got %d", p, len(p.params), len(args))
+	}
+
+	for i, arg := range args {
+		if arg == "" || strings.Contains(arg, ":") {
+			return "", fmt.Errorf("%s: invalid %s %q", p, p.params[i], arg)
+		}
+	}
+
+	id := strings.Join(append([]string{p.head()}, args...), ":")
+
+	if len(id) > MaxLength {
+		return "", fmt.Errorf("%s: custom ID is %d characters long, the limit is %d", p, len(id), MaxLength)
+	}
+
+	return id, nil
+}
+
+// Parses the arguments of a custom ID of this pattern
+func (p *Pattern) args(segments []string) (Args, error) {
+	if len(segments) != len(p.params) {
+		return nil, fmt.Errorf("%w: %s takes %d arguments, got %d", ErrMalformed, p, len(p.params), len(segments))
+	}
+
+	args := Args{}
+	for i, param := range p.params {
+		if segments[i] == "" {
+			return nil, fmt.Errorf("%w: %s is empty", ErrMalformed, param)
+		}
+
+		args[param] = segments[i]
+	}
+
+	return args, nil
+}
+
+// Checks that args has exactly the parameters of this pattern
+func (p *Pattern) check(args Args) error {
+	if len(args) != len(p.params) {
+		return fmt.Errorf("%s takes %d arguments, got %d", p, len(p.params), len(args))
+	}
+
+	for _, param := range p.params {
+		if args[param] == "" || strings.Contains(args[param], ":") {
+			return fmt.Errorf("%s: invalid %s %q", p, param, args[param])
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,191 @@
+package customid
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testRouter() *Router {
+	r := NewRouter()
+	r.Handle(MustParse("tikm"))
+	r.Handle(MustParse("close:{ticketId}"))
+
+	// A chain of two migrations, from reason:{ticketId} to reason@3:{ticketId}:{reason}:{notify}
+	r.Handle(MustParse("reason@3:{ticketId}:{reason}:{notify}"))
+	r.Migrate(MustParse("reason@2:{ticketId}:{reason}"), func(args Args) (Args, error) {
+		return Args{"ticketId": args["ticketId"], "reason": args["reason"], "notify": "yes"}, nil
+	})
+	r.Migrate(MustParse("reason:{ticketId}"), func(args Args) (Args, error) {
+		return Args{"ticketId": args["ticketId"], "reason": "none"}, nil
+	})
+
+	r.Handle(MustParse("broken@2:{ticketId}"))
+	r.Migrate(MustParse("broken:{ticketId}"), func(args Args) (Args, error) {
+		if args["ticketId"] == "bad" {
+			return nil, errors.New("bad ticket")
+		}
+
+		// Drops the parameter the next version needs
+		return Args{}, nil
+	})
+
+	return r
+}
+
+func TestMatch(t *testing.T) {
+	r := testRouter()
+
+	tests := []struct {
+		name     string
+		customId string
+		pattern  string
+		version  int
+		args     Args
+		err      error
+	}{
+		{name: "no params", customId: "tikm", pattern: "tikm", version: 1, args: Args{}},
+		{name: "params", customId: "close:123", pattern: "close:{ticketId}", version: 1, args: Args{"ticketId": "123"}},
+		{name: "bare close", customId: "close", err: ErrMalformed},
+		{name: "empty arg", customId: "close:", err: ErrMalformed},
+		{name: "extra segments", customId: "close:123:456", err: ErrMalformed},
+		{name: "extra segments without params", customId: "tikm:123", err: ErrMalformed},
+		{name: "non numeric version", customId: "close@x:123", err: ErrMalformed},
+		{name: "version 1 written out", customId: "close@1:123", err: ErrMalformed},
+		{name: "padded version", customId: "close@02:123", err: ErrMalformed},
+		{name: "empty version", customId: "close@:123", err: ErrMalformed},
+		{name: "unregistered version", customId: "close@2:123", err: ErrUnknown},
+		{name: "missing name", customId: ":123", err: ErrMalformed},
+		{name: "unknown name", customId: "nope:123", err: ErrUnknown},
+		{
+			name:     "current version",
+			customId: "reason@3:123:spam:no",
+			pattern:  "reason@3:{ticketId}:{reason}:{notify}",
+			version:  3,
+			args:     Args{"ticketId": "123", "reason": "spam", "notify": "no"},
+		},
+		{
+			name:     "one migration",
+			customId: "reason@2:123:spam",
+			pattern:  "reason@3:{ticketId}:{reason}:{notify}",
+			version:  2,
+			args:     Args{"ticketId": "123", "reason": "spam", "notify": "yes"},
+		},
+		{
+			name:     "two migrations",
+			customId: "reason:123",
+			pattern:  "reason@3:{ticketId}:{reason}:{notify}",
+			version:  1,
+			args:     Args{"ticketId": "123", "reason": "none", "notify": "yes"},
+		},
+		{name: "migration error", customId: "broken:bad", err: ErrMalformed},
+		{name: "migration missing params", customId: "broken:123", err: ErrMalformed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := r.Match(tt.customId)
+
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("Match(%q) error = %v, want %v", tt.customId, err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Match(%q) error = %v", tt.customId, err)
+			}
+
+			if m.Pattern.String() != tt.pattern || m.Version != tt.version || !reflect.DeepEqual(m.Args, tt.args) {
+				t.Errorf("Match(%q) = %s v%d %v, want %s v%d %v", tt.customId, m.Pattern, m.Version, m.Args, tt.pattern, tt.version, tt.args)
+			}
+		})
+	}
+}
+
+func TestBuild(t *testing.T) {
+	closeId := MustParse("close:{ticketId}")
+	versioned := MustParse("reason@2:{ticketId}:{reason}")
+
+	tests := []struct {
+		name    string
+		pattern *Pattern
+		args    []string
+		want    string
+		wantErr bool
+	}{
+		{name: "one arg", pattern: closeId, args: []string{"123"}, want: "close:123"},
+		{name: "versioned", pattern: versioned, args: []string{"123", "spam"}, want: "reason@2:123:spam"},
+		{name: "colon in arg", pattern: closeId, args: []string{"12:3"}, wantErr: true},
+		{name: "empty arg", pattern: closeId, args: []string{""}, wantErr: true},
+		{name: "too few args", pattern: versioned, args: []string{"123"}, wantErr: true},
+		{name: "too many args", pattern: closeId, args: []string{"123", "456"}, wantErr: true},
+		{name: "at the limit", pattern: closeId, args: []string{strings.Repeat("a", MaxLength-len("close:"))}, want: "close:" + strings.Repeat("a", MaxLength-len("close:"))},
+		{name: "over the limit", pattern: closeId, args: []string{strings.Repeat("a", MaxLength-len("close:")+1)}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.pattern.Build(tt.args...)
+
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Build(%q) = %q, want an error", tt.args, got)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Build(%q) error = %v", tt.args, err)
+			}
+
+			if got != tt.want {
+				t.Errorf("Build(%q) = %q, want %q", tt.args, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildRoundTrip(t *testing.T) {
+	r := testRouter()
+
+	for _, name := range []string{"tikm", "close", "reason"} {
+		p := r.Pattern(name)
+
+		args := make([]string, len(p.params))
+		for i := range args {
+			args[i] = fmt.Sprintf("arg%d", i)
+		}
+
+		id, err := p.Build(args...)
+
+		if err != nil {
+			t.Fatalf("Build %s: %v", p, err)
+		}
+
+		m, err := r.Match(id)
+
+		if err != nil {
+			t.Fatalf("Match(%q): %v", id, err)
+		}
+
+		for i, param := range p.params {
+			if m.Args[param] != args[i] {
+				t.Errorf("Match(%q) %s = %q, want %q", id, param, m.Args[param], args[i])
+			}
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, pattern := range []string{"", "@2", "close:ticketId", "close:{}", "close:{a}:{a}", "close@1:{a}", "close@x"} {
+		if _, err := Parse(pattern); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", pattern)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package customid
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Converts the arguments of a custom ID to those of the next version of its pattern
+type Migration func(args Args) (Args, error)
+
+type route struct {
+	pattern *Pattern
+	migrate Migration // Nil for the current version
+}
+
+// A custom ID matched by a Router
+type Match struct {
+	Pattern *Pattern // Current pattern of the custom ID
+	Version int      // Version the custom ID was sent with, older than Pattern's if it was migrated
+	Args    Args     // Arguments for the current pattern
+}
+
+// Matches custom IDs against the patterns registered with it, migrating custom IDs of older versions
+type Router struct {
+	routes  map[string]*route // By name@version
+	current map[string]*Pattern
+}
+
+func NewRouter() *Router {
+	return &Router{
+		routes:  map[string]*route{},
+		current: map[string]*Pattern{},
+	}
+}
+
+func key(name string, version int) string {
+	return fmt.Sprintf("%s@%d", name, version)
+}
+
+// Registers the current version of a custom ID
+//
+// Panics if the name is already registered at the same or a newer version, as that is a programming error
+func (r *Router) Handle(p *Pattern) {
+	if cur, ok := r.current[p.name]; ok && cur.version >= p.version {
+		panic(fmt.Sprintf("customid: %s is already registered as %s", p, cur))
+	}
+
+	r.routes[key(p.name, p.version)] = &route{pattern: p}
+	r.current[p.name] = p
+}
+
+// Registers an older version of a custom ID, whose arguments migrate converts to those of the next version. Every
+// version between it and the current one must be registered as well
+//
+// Panics if p isn't older than the current version, which must be registered first
+func (r *Router) Migrate(p *Pattern, migrate Migration) {
+	cur, ok := r.current[p.name]
+
+	if !ok || p.version >= cur.version {
+		panic(fmt.Sprintf("customid: migration from %s needs a newer version registered first", p))
+	}
+
+	r.routes[key(p.name, p.version)] = &route{pattern: p, migrate: migrate}
+}
+
+// Returns the current pattern registered with a name, or nil
+func (r *Router) Pattern(name string) *Pattern {
+	return r.current[name]
+}
+
+// Matches a custom ID, returning its arguments for the current version of its pattern. Returns an error wrapping
+// ErrUnknown if nothing is registered for its name and version, or ErrMalformed if it doesn't fit its pattern
+func (r *Router) Match(customId string) (*Match, error) {
+	segments := strings.Split(customId, ":")
+
+	name, version, err := parseHead(segments[0])
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrMalformed, err)
+	}
+
+	rt, ok := r.routes[key(name, version)]
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknown, segments[0])
+	}
+
+	args, err := rt.pattern.args(segments[1:])
+
+	if err != nil {
+		return nil, err
+	}
+
+	for rt.migrate != nil {
+		next, ok := r.routes[key(name, rt.pattern.version+1)]
+
+		if !ok {
+			return nil, fmt.Errorf("%w: no version %d of %s to migrate to", ErrUnknown, rt.pattern.version+1, name)
+		}
+
+		args, err = rt.migrate(args)
+
+		if err != nil {
+			return nil, fmt.Errorf("%w: migrating %s: %s", ErrMalformed, rt.pattern, err)
+		}
+
+		err = next.pattern.check(args)
+
+		if err != nil {
+			return nil, fmt.Errorf("%w: migrating %s: %s", ErrMalformed, rt.pattern, err)
+		}
+
+		rt = next
+	}
+
+	return &Match{Pattern: rt.pattern, Version: version, Args: args}, nil
+}
@@ -0,0 +1,219 @@
+package dedup
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"ibl-tickets/blobs"
+	"ibl-tickets/keys"
+	"ibl-tickets/storage"
+	"ibl-tickets/tickets"
+	"io"
+	"os"
+)
+
+// Attachments are stored once per distinct content, as blobs/{hash[:2]}/{hash}.encBlob where hash is an
+// HMAC-SHA256 of the plaintext keyed with blob_hash_secret (so the stored names don't reveal which known files
+// we hold). Every blob is encrypted with its own random key, wrapped with the master key in attachment_blobs,
+// and attachment_refs links each ticket attachment to the blob holding its contents
+const Prefix = "blobs/"
+
+// Returned by Open if an attachment was stored before deduplication, under its ticket's own folder
+var ErrNotReferenced = errors.New("attachment is not stored as a shared blob")
+
+// Returns the storage key of a blob
+func Key(hash string) string {
+	return Prefix + hash[:2] + "/" + hash + ".encBlob"
+}
+
+// An attachment encrypted to a local temporary file while its content hash is computed
+type Upload struct {
+	Size   int64  // Plaintext bytes read, more than maxSize if the attachment was too large
+	SHA256 string // Hex encoded SHA-256 hash of the plaintext
+	Hash   string // Hex encoded HMAC of the plaintext, the blob's content address
+
+	file    *os.File
+	blobKey []byte
+}
+
+// Encrypts r under a new blob key into a temporary file, stopping once more than maxSize bytes have been read
+//
+// Only ciphertext touches the disk. The upload must be committed or discarded
+func Stage(r io.Reader, hashSecret []byte, maxSize int64) (*Upload, error) {
+	blobKey := make([]byte, 32)
+
+	if _, err := rand.Read(blobKey); err != nil {
+		return nil, fmt.Errorf("error generating blob key: %w", err)
+	}
+
+	f, err := os.CreateTemp("", "ibl-tickets-blob-*")
+
+	if err != nil {
+		return nil, fmt.Errorf("error creating temporary blob: %w", err)
+	}
+
+	var u = &Upload{file: f, blobKey: blobKey}
+
+	w, err := blobs.NewWriter(f, blobKey)
+
+	if err != nil {
+		u.Discard()
+		return nil, fmt.Errorf("error creating blob writer: %w", err)
+	}
+
+	sha := sha256.New()
+	mac := hmac.New(sha256.New, hashSecret)
+
+	u.Size, err = io.Copy(io.MultiWriter(w, sha, mac), io.LimitReader(r, maxSize+1))
+
+	if err != nil {
+		u.Discard()
+		return nil, fmt.Errorf("error writing blob: %w", err)
+	}
+
+	if u.Size > maxSize {
+		return u, nil
+	}
+
+	if err = w.Close(); err != nil {
+		u.Discard()
+		return nil, fmt.Errorf("error writing blob: %w", err)
+	}
+
+	u.SHA256 = hex.EncodeToString(sha.Sum(nil))
+	u.Hash = hex.EncodeToString(mac.Sum(nil))
+
+	return u, nil
+}
+
+// Removes the temporary file
+func (u *Upload) Discard() {
+	u.file.Close()
+	os.Remove(u.file.Name())
+}
+
+// Saves an attachment of a close job as a reference to the blob with the upload's content, uploading the blob only
+// if it isn't stored yet. The temporary file is removed either way
+//
+// The reference is recorded along with the attachment, so a close that is resumed never stores it twice
+func (u *Upload) Commit(ctx context.Context, tikStore tickets.Store, store storage.Store, keyring *keys.Keyring, tikId string, a *tickets.CloseAttachment) error {
+	defer u.Discard()
+
+	if u.Hash == "" {
+		return errors.New("cannot commit an oversized upload")
+	}
+
+	wrapped, keyId, err := keyring.Wrap(u.blobKey)
+
+	if err != nil {
+		return err
+	}
+
+	blob := &tickets.Blob{Hash: u.Hash, Size: u.Size, EncKey: wrapped, EncKeyID: keyId}
+
+	return tikStore.SaveCloseAttachment(ctx, tikId, a, blob, func(ctx context.Context) error {
+		return u.upload(ctx, store)
+	})
+}
+
+func (u *Upload) upload(ctx context.Context, store storage.Store) error {
+	if _, err := u.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	w, err := store.Create(ctx, Key(u.Hash))
+
+	if err != nil {
+		return fmt.Errorf("error creating blob: %w", err)
+	}
+
+	_, err = io.Copy(w, u.file)
+
+	if err != nil {
+		w.Abort()
+		return fmt.Errorf("error uploading blob: %w", err)
+	}
+
+	err = w.Close()
+
+	if err != nil {
+		return fmt.Errorf("error uploading blob: %w", err)
+	}
+
+	return nil
+}
+
+type blobReader struct {
+	io.Reader
+	io.Closer
+}
+
+// Opens the decrypted contents of an attachment stored as a shared blob
+//
+// Returns ErrNotReferenced for attachments stored before deduplication, which live at blobs.Key(tikId, attachmentId)
+// encrypted with the ticket's data key, and storage.ErrNotFound if the blob itself is missing
+func Open(ctx context.Context, tikStore tickets.Store, store storage.Store, keyring *keys.Keyring, tikId string, attachmentId string) (io.ReadCloser, error) {
+	blob, err := tikStore.Blob(ctx, tikId, attachmentId)
+
+	if errors.Is(err, tickets.ErrNotFound) {
+		return nil, ErrNotReferenced
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	blobKey, err := keyring.Unwrap(blob.EncKey, blob.EncKeyID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := store.Open(ctx, Key(blob.Hash))
+
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := blobs.NewReader(f, blobKey)
+
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error decrypting blob: %w", err)
+	}
+
+	return blobReader{Reader: r, Closer: f}, nil
+}
+
+// Opens the decrypted contents of any stored attachment, falling back to the per-ticket folder (encrypted with
+// ticketKey) for attachments stored before deduplication. Returns storage.ErrNotFound if the blob is missing
+func OpenAttachment(ctx context.Context, tikStore tickets.Store, store storage.Store, keyring *keys.Keyring, tikId string, attachmentId string, ticketKey []byte) (io.ReadCloser, error) {
+	rc, err := Open(ctx, tikStore, store, keyring, tikId, attachmentId)
+
+	if !errors.Is(err, ErrNotReferenced) {
+		return rc, err
+	}
+
+	if ticketKey == nil {
+		return nil, errors.New("ticket has attachments but no data key")
+	}
+
+	f, err := store.Open(ctx, blobs.Key(tikId, attachmentId))
+
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := blobs.NewReader(f, ticketKey)
+
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error decrypting blob: %w", err)
+	}
+
+	return blobReader{Reader: r, Closer: f}, nil
+}
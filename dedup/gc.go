@@ -0,0 +1,147 @@
+package dedup
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"ibl-tickets/storage"
+	"ibl-tickets/tickets"
+	"strings"
+	"time"
+)
+
+// What GC removed, or would remove on a dry run
+type GCResult struct {
+	Unreferenced []string // Blobs no attachment references
+	Orphaned     []string // Stored contents without a blob, left by uploads whose close failed or removals that crashed
+}
+
+// Deletes blobs that no attachment references and stored contents that have no blob, as long as they are older than
+// grace
+//
+// Each blob is marked as being removed before its contents are deleted and is only dropped afterwards, so a close
+// that is adding a reference to it either goes first (and the blob is kept) or takes it back by storing the contents
+// again, and a removal that fails is picked up by the next run. Orphaned contents are claimed as blobs being removed
+// first, so they are removed the same way
+func GC(ctx context.Context, tikStore tickets.Store, store storage.Store, grace time.Duration, dryRun bool) (*GCResult, error) {
+	before := time.Now().Add(-grace)
+
+	var res = &GCResult{}
+
+	candidates, err := tikStore.UnreferencedBlobs(ctx, before)
+
+	if err != nil {
+		return res, err
+	}
+
+	orphans, err := orphaned(ctx, tikStore, store, before)
+
+	if err != nil {
+		return res, err
+	}
+
+	if dryRun {
+		res.Unreferenced, res.Orphaned = candidates, orphans
+		return res, nil
+	}
+
+	for _, hash := range candidates {
+		ok, err := collect(ctx, tikStore, store, hash)
+
+		if err != nil {
+			return res, err
+		}
+
+		if ok {
+			res.Unreferenced = append(res.Unreferenced, hash)
+		}
+	}
+
+	for _, hash := range orphans {
+		claimed, err := tikStore.ClaimOrphan(ctx, hash)
+
+		if err != nil {
+			return res, err
+		}
+
+		if !claimed {
+			// A close stored the same contents since we looked
+			continue
+		}
+
+		ok, err := collect(ctx, tikStore, store, hash)
+
+		if err != nil {
+			return res, err
+		}
+
+		if ok {
+			res.Orphaned = append(res.Orphaned, hash)
+		}
+	}
+
+	return res, nil
+}
+
+func collect(ctx context.Context, tikStore tickets.Store, store storage.Store, hash string) (bool, error) {
+	ok, err := tikStore.CollectBlob(ctx, hash, func(ctx context.Context) error {
+		return store.Delete(ctx, Key(hash))
+	})
+
+	if err != nil {
+		return false, fmt.Errorf("error removing blob %s: %w", hash, err)
+	}
+
+	return ok, nil
+}
+
+// Returns the hashes of stored contents older than before that have no blob
+func orphaned(ctx context.Context, tikStore tickets.Store, store storage.Store, before time.Time) ([]string, error) {
+	objects, err := store.List(ctx, Prefix)
+
+	if err != nil {
+		return nil, fmt.Errorf("error listing stored blobs: %w", err)
+	}
+
+	var hashes []string
+	for _, obj := range objects {
+		hash, ok := keyHash(obj.Key)
+
+		if !ok || !obj.ModTime.Before(before) {
+			continue
+		}
+
+		exists, err := tikStore.BlobExists(ctx, hash)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !exists {
+			hashes = append(hashes, hash)
+		}
+	}
+
+	return hashes, nil
+}
+
+// Returns the hash a key was made from by Key, if it was
+func keyHash(key string) (string, bool) {
+	name, ok := strings.CutSuffix(strings.TrimPrefix(key, Prefix), ".encBlob")
+
+	if !ok || len(name) < 3 || name[2] != '/' {
+		return "", false
+	}
+
+	hash := name[3:]
+
+	if len(hash) != 64 || hash[:2] != name[:2] {
+		return "", false
+	}
+
+	if _, err := hex.DecodeString(hash); err != nil {
+		return "", false
+	}
+
+	return hash, true
+}
@@ -0,0 +1,145 @@
+package dedup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"ibl-tickets/storage"
+	"ibl-tickets/tickets"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testHash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// Stores contents under the key of hash, stored age ago
+func storeBlob(t *testing.T, store *storage.FileStore, hash string, age time.Duration) {
+	w, err := store.Create(context.Background(), Key(hash))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.Write([]byte("encrypted"))
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := time.Now().Add(-age)
+
+	if err := os.Chtimes(filepath.Join(store.Root, Key(hash)), stored, stored); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Records a blob stored age ago as referenced by an attachment of tikId
+func addBlob(t *testing.T, tikStore *tickets.MemoryStore, store *storage.FileStore, tikId string, hash string, age time.Duration) {
+	ctx := context.Background()
+
+	if _, err := tikStore.Get(ctx, tikId); errors.Is(err, tickets.ErrNotFound) {
+		if err := tikStore.Create(ctx, &tickets.Ticket{ID: tikId, ChannelID: "c-" + tikId}); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := tikStore.StartClose(ctx, tikId, "staff1", "attachments"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	blob := &tickets.Blob{Hash: hash, Size: 9, EncKey: "key", EncKeyID: "k1", CreatedAt: time.Now().Add(-age)}
+
+	err := tikStore.SaveCloseAttachment(ctx, tikId, &tickets.CloseAttachment{AttachmentID: hash[:8]}, blob, func(ctx context.Context) error {
+		storeBlob(t, store, hash, age)
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGC(t *testing.T) {
+	ctx := context.Background()
+	tikStore := tickets.NewMemoryStore()
+	store := &storage.FileStore{Root: t.TempDir()}
+
+	kept, unreferenced, fresh := testHash("kept"), testHash("unreferenced"), testHash("fresh")
+	orphan, freshOrphan := testHash("orphan"), testHash("fresh orphan")
+
+	addBlob(t, tikStore, store, "t1", kept, 48*time.Hour)
+	addBlob(t, tikStore, store, "t2", unreferenced, 48*time.Hour)
+	addBlob(t, tikStore, store, "t3", fresh, time.Minute)
+	storeBlob(t, store, orphan, 48*time.Hour)
+	storeBlob(t, store, freshOrphan, time.Minute)
+
+	for _, id := range []string{"t2", "t3"} {
+		if err := tikStore.Delete(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := GC(ctx, tikStore, store, 24*time.Hour, true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.Unreferenced) != 1 || res.Unreferenced[0] != unreferenced || len(res.Orphaned) != 1 || res.Orphaned[0] != orphan {
+		t.Fatalf("dry run = %+v, want only the old unreferenced blob and orphan", res)
+	}
+
+	if _, err := store.Open(ctx, Key(orphan)); err != nil {
+		t.Fatalf("dry run removed the orphan: %v", err)
+	}
+
+	res, err = GC(ctx, tikStore, store, 24*time.Hour, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.Unreferenced) != 1 || len(res.Orphaned) != 1 {
+		t.Fatalf("GC = %+v", res)
+	}
+
+	for _, hash := range []string{unreferenced, orphan} {
+		if _, err := store.Open(ctx, Key(hash)); !errors.Is(err, storage.ErrNotFound) {
+			t.Fatalf("blob %s was not removed: %v", hash, err)
+		}
+
+		if exists, _ := tikStore.BlobExists(ctx, hash); exists {
+			t.Fatalf("blob %s is still recorded", hash)
+		}
+	}
+
+	for _, hash := range []string{kept, fresh, freshOrphan} {
+		r, err := store.Open(ctx, Key(hash))
+
+		if err != nil {
+			t.Fatalf("blob %s was removed: %v", hash, err)
+		}
+
+		r.Close()
+	}
+}
+
+func TestKeyHash(t *testing.T) {
+	hash := testHash("contents")
+
+	if got, ok := keyHash(Key(hash)); !ok || got != hash {
+		t.Fatalf("keyHash(Key(%s)) = %s, %v", hash, got, ok)
+	}
+
+	for _, key := range []string{"blobs/ab/abc.encBlob", "blobs/zz/" + hash + ".encBlob", "blobs/" + hash[:2] + "/" + hash, "t1/" + hash + ".encBlob"} {
+		if _, ok := keyHash(key); ok {
+			t.Fatalf("keyHash accepted %s", key)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package dispatch
+
+import (
+	"context"
+	"ibl-tickets/customid"
+	"ibl-tickets/handlers"
+	"ibl-tickets/handlers/commands"
+	"ibl-tickets/handlers/modal"
+	"ibl-tickets/handlers/msgcomponent"
+	"ibl-tickets/inflight"
+	"ibl-tickets/keys"
+	"ibl-tickets/signing"
+	"ibl-tickets/storage"
+	"ibl-tickets/tickets"
+	"ibl-tickets/types"
+	"ibl-tickets/utils"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// Routes commands and interactions to the registered handlers, both for the bot and for replayed events
+type Dispatcher struct {
+	Config  *types.Config
+	Secrets *types.Secrets
+	Keyring *keys.Keyring
+	Signer  *signing.Keys
+	Store   storage.Store
+	Tickets tickets.Store
+	Ctx     context.Context
+	Logger  *zap.Logger
+	Redis   *redis.Client
+	Tracker *inflight.Tracker // Handlers aren't started once it drains
+	IsOwner func(userId string) bool
+}
+
+// Names an interaction for the logs of a shutdown
+func InteractionName(i *discordgo.InteractionCreate) string {
+	switch i.Type {
+	case discordgo.InteractionMessageComponent:
+		return "component " + i.MessageComponentData().CustomID
+	case discordgo.InteractionModalSubmit:
+		return "modal " + i.ModalSubmitData().CustomID
+	default:
+		return "interaction " + i.ID
+	}
+}
+
+// Returns the arguments of a message that mentions the bot, or false if it doesn't mention it
+func CommandArgs(s *discordgo.Session, m *discordgo.MessageCreate) ([]string, bool) {
+	var mentioned bool
+	for _, user := range m.Mentions {
+		if user.ID == s.State.User.ID {
+			mentioned = true
+			break
+		}
+	}
+
+	if !mentioned {
+		return nil, false
+	}
+
+	// The event is shared with the message log handler, so don't modify it
+	content := strings.TrimSpace(strings.TrimPrefix(m.Content, "<@"+s.State.User.ID+">"))
+	content = strings.TrimSpace(strings.TrimPrefix(content, "<@!"+s.State.User.ID+">"))
+
+	return strings.Fields(content), true
+}
+
+// Builds the context a request's handlers run with, logging with fields naming the request
+func (d *Dispatcher) context(s *discordgo.Session, r *handlers.Request, guildId string, channelId string, fields ...zap.Field) *handlers.Context {
+	fields = append([]zap.Field{
+		zap.String("kind", r.Kind),
+		zap.String("userId", r.UserID),
+		zap.String("guildId", guildId),
+		zap.String("channelId", channelId),
+	}, fields...)
+
+	return &handlers.Context{
+		Ctx:     d.Ctx,
+		Discord: s,
+		Config:  d.Config,
+		Secrets: d.Secrets,
+		Keyring: d.Keyring,
+		Signer:  d.Signer,
+		Store:   d.Store,
+		Tickets: d.Tickets,
+		Redis:   d.Redis,
+		Logger:  d.Logger.With(fields...),
+	}
+}
+
+// Runs the command in a message that mentions the bot
+func (d *Dispatcher) Command(s *discordgo.Session, m *discordgo.MessageCreate) {
+	args, ok := CommandArgs(s, m)
+
+	if !ok {
+		return
+	}
+
+	r := &handlers.Request{
+		Kind:    handlers.KindCommand,
+		UserID:  m.Author.ID,
+		Message: m,
+	}
+
+	if len(args) > 0 {
+		r.Name = args[0]
+	}
+
+	c := d.context(s, r, m.GuildID, m.ChannelID, zap.String("command", r.Name))
+
+	h := handlers.Chain(func(c *handlers.Context, r *handlers.Request) error {
+		fn, ok := commands.Handlers[r.Name]
+
+		if !ok {
+			return nil
+		}
+
+		return fn(c, m, args[1:])
+	}, d.middleware(s)...)
+
+	err := h(c, r)
+
+	if err != nil {
+		c.Logger.Error("Error handling command", zap.Error(err))
+		_, merr := s.ChannelMessageSendComplex(m.ChannelID, &discordgo.MessageSend{
+			Content: "An error occurred while running this command: " + err.Error(),
+			AllowedMentions: &discordgo.MessageAllowedMentions{
+				Parse: []discordgo.AllowedMentionType{},
+			},
+		})
+
+		if merr != nil {
+			c.Logger.Error("Error sending message", zap.Error(merr))
+		}
+	}
+}
+
+// Runs the handler of a component or modal interaction
+func (d *Dispatcher) Interaction(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	var customId string
+	var match *customid.Match
+	var matchErr error
+	var h handlers.Handler
+
+	r := &handlers.Request{Interaction: i.Interaction}
+
+	switch i.Type {
+	case discordgo.InteractionMessageComponent:
+		data := i.MessageComponentData()
+		customId = data.CustomID
+		r.Kind = handlers.KindComponent
+		match, matchErr = msgcomponent.Router.Match(customId)
+
+		h = func(c *handlers.Context, r *handlers.Request) error {
+			return msgcomponent.Handlers[r.Name](c, i.Interaction, data, match.Args)
+		}
+	case discordgo.InteractionModalSubmit:
+		data := i.ModalSubmitData()
+		customId = data.CustomID
+		r.Kind = handlers.KindModal
+		match, matchErr = modal.Router.Match(customId)
+
+		h = func(c *handlers.Context, r *handlers.Request) error {
+			return modal.Handlers[r.Name](c, i.Interaction, data, match.Args)
+		}
+	default:
+		return
+	}
+
+	if i.Member != nil && i.Member.User != nil {
+		r.UserID = i.Member.User.ID
+	} else if i.User != nil {
+		r.UserID = i.User.ID
+	}
+
+	if matchErr == nil {
+		r.Name = match.Pattern.Name()
+	} else {
+		// Still goes through the middleware, so unknown custom IDs are rate limited like any other
+		r.Name = "unknown"
+		h = unknownCustomId(matchErr)
+	}
+
+	c := d.context(s, r, i.GuildID, i.ChannelID, zap.String("customId", customId))
+
+	if matchErr == nil && match.Version != match.Pattern.Version() {
+		c.Logger.Info("Migrated custom ID", zap.Int("from", match.Version), zap.Int("to", match.Pattern.Version()))
+	}
+
+	err := handlers.Chain(h, d.middleware(s)...)(c, r)
+
+	if err != nil {
+		c.Logger.Error("Error handling "+r.Kind, zap.Error(err))
+		s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+			Content: utils.Stringp("An error occurred while handling this " + r.Kind + ". Please contact our support team about this: " + err.Error()),
+		})
+	}
+}
+
+// Answers an interaction whose custom ID doesn't match any handler, such as a button sent by an older version of the
+// bot that can't be migrated
+func unknownCustomId(matchErr error) handlers.Handler {
+	return func(c *handlers.Context, r *handlers.Request) error {
+		c.Logger.Warn("Unknown custom ID", zap.Error(matchErr))
+
+		return r.Reply(c, "Sorry, this doesn't work any more, it may be from an older version of the bot. Please try again from a newer message, or contact our support team if this keeps happening.")
+	}
+}
@@ -0,0 +1,149 @@
+package dispatch
+
+import (
+	"fmt"
+	"ibl-tickets/handlers"
+	"ibl-tickets/handlers/commands"
+	"ibl-tickets/utils"
+	"runtime/debug"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// Handlers taking longer than this are logged as slow, as Discord expects interactions to be answered within 3 seconds
+const slowHandler = 3 * time.Second
+
+// The middleware every command and interaction runs through, in order
+func (d *Dispatcher) middleware(s *discordgo.Session) []handlers.Middleware {
+	return []handlers.Middleware{
+		d.recover,
+		d.timing,
+		d.draining,
+		d.auth(s),
+		d.rateLimit,
+	}
+}
+
+// Turns a panicking handler into an error, so it is reported like any other
+func (d *Dispatcher) recover(next handlers.Handler) handlers.Handler {
+	return func(c *handlers.Context, r *handlers.Request) (err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				c.Logger.Error("Handler panicked", zap.Any("panic", p), zap.ByteString("stack", debug.Stack()))
+				err = fmt.Errorf("handler panicked: %v", p)
+			}
+		}()
+
+		return next(c, r)
+	}
+}
+
+// Logs how long handlers take
+func (d *Dispatcher) timing(next handlers.Handler) handlers.Handler {
+	return func(c *handlers.Context, r *handlers.Request) error {
+		start := time.Now()
+		err := next(c, r)
+		took := time.Since(start)
+
+		if took > slowHandler {
+			c.Logger.Warn("Slow handler", zap.Duration("took", took))
+		} else {
+			c.Logger.Debug("Handled request", zap.Duration("took", took))
+		}
+
+		return err
+	}
+}
+
+// Turns requests away once the bot is shutting down, and tracks the ones it runs so shutdown waits for them
+func (d *Dispatcher) draining(next handlers.Handler) handlers.Handler {
+	return func(c *handlers.Context, r *handlers.Request) error {
+		name := r.Kind + " " + r.Name
+
+		if r.Interaction != nil {
+			name = InteractionName(&discordgo.InteractionCreate{Interaction: r.Interaction})
+		}
+
+		done, ok := d.Tracker.Start(name)
+
+		if !ok {
+			return r.Reply(c, "The bot is restarting, please try again in a moment.")
+		}
+
+		defer done()
+
+		return next(c, r)
+	}
+}
+
+// Only lets owners (and staff, for staff commands) run commands, and only lets interactions through from servers
+func (d *Dispatcher) auth(s *discordgo.Session) handlers.Middleware {
+	return func(next handlers.Handler) handlers.Handler {
+		return func(c *handlers.Context, r *handlers.Request) error {
+			if r.Kind != handlers.KindCommand {
+				if r.Interaction.Member == nil {
+					return r.Reply(c, "This can only be used in a server.")
+				}
+
+				return next(c, r)
+			}
+
+			var allowed = d.IsOwner(r.UserID)
+
+			if !allowed && commands.IsStaffCommand(r.Name) {
+				isStaff, err := utils.IsStaff(s, c.Config, r.UserID)
+
+				if err != nil {
+					c.Logger.Error("Error checking staff status", zap.Error(err))
+				}
+
+				allowed = isStaff
+			}
+
+			if !allowed {
+				return r.Reply(c, "You are not allowed to use this bot.")
+			}
+
+			return next(c, r)
+		}
+	}
+}
+
+// Counts a request, starting the window on the first one. Done in one step so a counter can't be left without an
+// expiry (and its user limited for good) if the connection drops in between, and counters that were are given one
+var rateLimitScript = redis.NewScript(`
+local count = redis.call("INCR", KEYS[1])
+if redis.call("PTTL", KEYS[1]) < 0 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return count
+`)
+
+// Limits how many requests a user can make per window, counted in Redis so the limit holds across restarts
+func (d *Dispatcher) rateLimit(next handlers.Handler) handlers.Handler {
+	return func(c *handlers.Context, r *handlers.Request) error {
+		limit := c.Config.RateLimit
+
+		if limit.Requests <= 0 || limit.Window <= 0 {
+			return next(c, r)
+		}
+
+		count, err := rateLimitScript.Run(c.Ctx, c.Redis, []string{"rate_limit:" + r.UserID}, limit.Window.Milliseconds()).Int64()
+
+		// Better to let a request through than to lock everyone out while Redis is down
+		if err != nil {
+			c.Logger.Error("Error counting requests", zap.Error(err))
+			return next(c, r)
+		}
+
+		if count > int64(limit.Requests) {
+			c.Logger.Info("Rate limited", zap.Int64("count", count))
+			return r.Reply(c, "You're doing that too often, please wait a few seconds and try again.")
+		}
+
+		return next(c, r)
+	}
+}
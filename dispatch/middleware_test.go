@@ -0,0 +1,294 @@
+package dispatch
+
+import (
+	"context"
+	"ibl-tickets/fakediscord"
+	"ibl-tickets/handlers"
+	"ibl-tickets/inflight"
+	"ibl-tickets/types"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/bwmarrin/discordgo"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+const (
+	testGuild     = "4000000000000000001"
+	testStaffRole = "4000000000000000002"
+	testChannel   = "4000000000000000003"
+	testOwner     = "6000000000000000001"
+	testStaff     = "6000000000000000002"
+	testUser      = "6000000000000000003"
+)
+
+type testEnv struct {
+	dispatcher *Dispatcher
+	session    *discordgo.Session
+	discord    *fakediscord.Server
+	redis      *miniredis.Miniredis
+	ctx        *handlers.Context
+}
+
+// A dispatcher against fakediscord and miniredis, allowing 2 requests per user every 10 seconds
+func newTestEnv(t *testing.T) *testEnv {
+	discord := fakediscord.New()
+	t.Cleanup(discord.Close)
+
+	discord.AddChannel(&discordgo.Channel{ID: testChannel, Type: discordgo.ChannelTypeGuildText})
+
+	s := discord.Session()
+	s.State.GuildAdd(&discordgo.Guild{ID: testGuild})
+
+	for _, m := range []*discordgo.Member{
+		{GuildID: testGuild, User: &discordgo.User{ID: testStaff}, Roles: []string{testStaffRole}},
+		{GuildID: testGuild, User: &discordgo.User{ID: testUser}},
+	} {
+		if err := s.State.MemberAdd(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rd := miniredis.RunT(t)
+	rediscli := redis.NewClient(&redis.Options{Addr: rd.Addr(), MaxRetries: -1})
+	t.Cleanup(func() { rediscli.Close() })
+
+	config := &types.Config{
+		Staff:     types.ConfigStaff{GuildID: testGuild, Roles: []string{testStaffRole}},
+		RateLimit: types.ConfigRateLimit{Requests: 2, Window: 10 * time.Second},
+	}
+
+	d := &Dispatcher{
+		Config:  config,
+		Ctx:     context.Background(),
+		Logger:  zap.NewNop(),
+		Redis:   rediscli,
+		Tracker: inflight.New(),
+		IsOwner: func(userId string) bool {
+			return userId == testOwner
+		},
+	}
+
+	return &testEnv{
+		dispatcher: d,
+		session:    s,
+		discord:    discord,
+		redis:      rd,
+		ctx: &handlers.Context{
+			Ctx:     d.Ctx,
+			Discord: s,
+			Config:  config,
+			Redis:   rediscli,
+			Logger:  d.Logger,
+		},
+	}
+}
+
+func command(userId string, name string) *handlers.Request {
+	return &handlers.Request{
+		Kind:    handlers.KindCommand,
+		Name:    name,
+		UserID:  userId,
+		Message: &discordgo.MessageCreate{Message: &discordgo.Message{ChannelID: testChannel}},
+	}
+}
+
+// Runs a request through the middleware, returning whether it reached h, the reply sent instead and the error returned
+func (e *testEnv) run(r *handlers.Request, h handlers.Handler) (bool, string, error) {
+	var ran bool
+	before := len(e.discord.Messages(testChannel))
+
+	err := handlers.Chain(func(c *handlers.Context, r *handlers.Request) error {
+		ran = true
+		return h(c, r)
+	}, e.dispatcher.middleware(e.session)...)(e.ctx, r)
+
+	var reply string
+	if msgs := e.discord.Messages(testChannel); len(msgs) > before {
+		reply = msgs[len(msgs)-1].Content
+	}
+
+	return ran, reply, err
+}
+
+func ok(c *handlers.Context, r *handlers.Request) error {
+	return nil
+}
+
+func TestMiddlewareRecover(t *testing.T) {
+	e := newTestEnv(t)
+
+	ran, _, err := e.run(command(testOwner, "msg"), func(c *handlers.Context, r *handlers.Request) error {
+		panic("boom")
+	})
+
+	if !ran || err == nil || !strings.Contains(err.Error(), "handler panicked: boom") {
+		t.Fatalf("panicking handler: ran = %v, err = %v", ran, err)
+	}
+
+	// The tracked request finished, so draining doesn't wait for it
+	if abandoned := e.dispatcher.Tracker.Drain(time.Second); len(abandoned) != 0 {
+		t.Fatalf("abandoned = %v after a panic", abandoned)
+	}
+}
+
+func TestMiddlewareDraining(t *testing.T) {
+	e := newTestEnv(t)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		e.run(command(testOwner, "msg"), func(c *handlers.Context, r *handlers.Request) error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+
+	<-started
+
+	drained := make(chan []string)
+	go func() {
+		drained <- e.dispatcher.Tracker.Drain(time.Minute)
+	}()
+
+	<-e.dispatcher.Tracker.Draining()
+
+	ran, reply, err := e.run(command(testOwner, "msg"), ok)
+
+	if ran || err != nil || !strings.Contains(reply, "restarting") {
+		t.Fatalf("request while draining: ran = %v, err = %v, reply = %q", ran, err, reply)
+	}
+
+	close(release)
+	<-done
+
+	if abandoned := <-drained; len(abandoned) != 0 {
+		t.Fatalf("abandoned = %v, want the running request waited for", abandoned)
+	}
+}
+
+func TestMiddlewareAuth(t *testing.T) {
+	e := newTestEnv(t)
+	e.dispatcher.Config.RateLimit.Requests = 0
+
+	tests := []struct {
+		name    string
+		request *handlers.Request
+		allowed bool
+	}{
+		{"owner command", command(testOwner, "msg"), true},
+		{"owner staff command", command(testOwner, "access"), true},
+		{"staff command by staff", command(testStaff, "access"), true},
+		{"command by staff", command(testStaff, "msg"), false},
+		{"staff command by user", command(testUser, "access"), false},
+		{"command by user", command(testUser, "msg"), false},
+		{"unknown staff", command("6000000000000000009", "access"), false},
+		{"interaction in server", &handlers.Request{
+			Kind:        handlers.KindComponent,
+			UserID:      testUser,
+			Interaction: &discordgo.Interaction{ID: "i1", Token: "t1", Member: &discordgo.Member{User: &discordgo.User{ID: testUser}}},
+		}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ran, reply, err := e.run(tt.request, ok)
+
+			if err != nil || ran != tt.allowed {
+				t.Fatalf("ran = %v, err = %v, want ran = %v", ran, err, tt.allowed)
+			}
+
+			if !tt.allowed && !strings.Contains(reply, "not allowed") {
+				t.Fatalf("reply = %q, want a refusal", reply)
+			}
+		})
+	}
+
+	t.Run("interaction outside server", func(t *testing.T) {
+		r := &handlers.Request{
+			Kind:        handlers.KindComponent,
+			UserID:      testUser,
+			Interaction: &discordgo.Interaction{ID: "i2", Token: "t2", User: &discordgo.User{ID: testUser}},
+		}
+
+		ran, _, err := e.run(r, ok)
+
+		if ran || err != nil {
+			t.Fatalf("ran = %v, err = %v, want a refusal", ran, err)
+		}
+
+		if original := e.discord.Original("t2"); original == nil || !strings.Contains(original.Content, "only be used in a server") {
+			t.Fatalf("response = %+v, want a refusal", original)
+		}
+	})
+}
+
+func TestMiddlewareRateLimit(t *testing.T) {
+	e := newTestEnv(t)
+
+	for i := 1; i <= 3; i++ {
+		ran, reply, err := e.run(command(testOwner, "msg"), ok)
+
+		if err != nil || ran != (i <= 2) {
+			t.Fatalf("request %d: ran = %v, err = %v", i, ran, err)
+		}
+
+		if i > 2 && !strings.Contains(reply, "too often") {
+			t.Fatalf("request %d: reply = %q, want a rate limit", i, reply)
+		}
+	}
+
+	if ttl := e.redis.TTL("rate_limit:" + testOwner); ttl != 10*time.Second {
+		t.Fatalf("window TTL = %v, want 10s", ttl)
+	}
+
+	// Other users have their own counter
+	if ran, _, _ := e.run(command(testStaff, "access"), ok); !ran {
+		t.Fatal("another user was rate limited")
+	}
+
+	e.redis.FastForward(10 * time.Second)
+
+	if ran, _, _ := e.run(command(testOwner, "msg"), ok); !ran {
+		t.Fatal("still rate limited after the window")
+	}
+
+	// A counter left without an expiry is given one instead of limiting its user for good
+	e.redis.Set("rate_limit:"+testStaff, "5")
+
+	if ran, _, _ := e.run(command(testStaff, "access"), ok); ran {
+		t.Fatal("request over the limit ran")
+	}
+
+	if ttl := e.redis.TTL("rate_limit:" + testStaff); ttl != 10*time.Second {
+		t.Fatalf("TTL of counter without one = %v, want 10s", ttl)
+	}
+
+	// Requests are let through while Redis is down
+	e.redis.Close()
+
+	if ran, _, err := e.run(command(testOwner, "msg"), ok); !ran || err != nil {
+		t.Fatalf("with Redis down: ran = %v, err = %v", ran, err)
+	}
+}
+
+// Requests the auth middleware refuses never reach the rate limiter
+func TestMiddlewareRefusedNotCounted(t *testing.T) {
+	e := newTestEnv(t)
+
+	for i := 0; i < 3; i++ {
+		e.run(command(testUser, "msg"), ok)
+	}
+
+	if e.redis.Exists("rate_limit:" + testUser) {
+		t.Fatal("refused requests were counted")
+	}
+}
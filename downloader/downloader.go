@@ -0,0 +1,184 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Defaults used for unset fields
+const (
+	DefaultWorkers  = 4
+	DefaultTimeout  = 60 * time.Second
+	DefaultAttempts = 3
+	DefaultBackoff  = time.Second
+)
+
+// Returned (wrapped) when a server responds with a status that retrying won't fix, such as 403 or 404
+var ErrPermanent = errors.New("permanent download failure")
+
+// Downloads files with a bounded number of workers, retrying failed requests with exponential backoff
+type Downloader struct {
+	Client   *http.Client
+	Workers  int           // Maximum number of concurrent downloads
+	Timeout  time.Duration // Limit on each attempt, including reading the body
+	Attempts int           // Number of attempts per download, including the first
+	Backoff  time.Duration // Delay before the first retry, doubled for every retry after it
+}
+
+// Marks errors that happened while reading the response, which are worth retrying
+type bodyError struct {
+	err error
+}
+
+func (e *bodyError) Error() string {
+	return e.err.Error()
+}
+
+func (e *bodyError) Unwrap() error {
+	return e.err
+}
+
+type bodyReader struct {
+	r io.Reader
+}
+
+func (b bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+
+	if err != nil && err != io.EOF {
+		return n, &bodyError{err: err}
+	}
+
+	return n, err
+}
+
+func (d *Downloader) workers() int {
+	if d.Workers <= 0 {
+		return DefaultWorkers
+	}
+
+	return d.Workers
+}
+
+// Runs fn for every index in [0, n), on at most Workers goroutines at a time, and waits for all of them
+func (d *Downloader) ForEach(n int, fn func(i int)) {
+	var wg sync.WaitGroup
+	var sem = make(chan struct{}, d.workers())
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			fn(i)
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+// Whether a failed response is worth retrying
+func retryable(status int) bool {
+	return status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= 500
+}
+
+// Makes a single attempt at downloading url, passing the body to fn
+func (d *Downloader) attempt(ctx context.Context, url string, fn func(r io.Reader) error) error {
+	timeout := d.Timeout
+
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrPermanent, err)
+	}
+
+	client := d.Client
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("got status %d", resp.StatusCode)
+
+		if !retryable(resp.StatusCode) {
+			return fmt.Errorf("%w: %w", ErrPermanent, err)
+		}
+
+		return err
+	}
+
+	err = fn(bodyReader{r: resp.Body})
+
+	var be *bodyError
+	if err != nil && !errors.As(err, &be) {
+		// fn failed on its own (e.g. couldn't write a file), downloading again won't help
+		return fmt.Errorf("%w: %w", ErrPermanent, err)
+	}
+
+	return err
+}
+
+// Downloads url, passing the response body to fn. Failed requests, server errors and errors reading the body are
+// retried with exponential backoff, so fn must be able to start over each time it is called
+func (d *Downloader) Get(ctx context.Context, url string, fn func(r io.Reader) error) error {
+	attempts := d.Attempts
+
+	if attempts <= 0 {
+		attempts = DefaultAttempts
+	}
+
+	backoff := d.Backoff
+
+	if backoff <= 0 {
+		backoff = DefaultBackoff
+	}
+
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			// Jitter keeps parallel retries against the same CDN from lining up
+			delay := backoff<<(i-1) + time.Duration(rand.Int63n(int64(backoff)))
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+
+		err = d.attempt(ctx, url, fn)
+
+		if err == nil || errors.Is(err, ErrPermanent) || ctx.Err() != nil {
+			return err
+		}
+	}
+
+	return fmt.Errorf("giving up after %d attempts: %w", attempts, err)
+}
@@ -0,0 +1,194 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Responses a test server gives to successive requests
+type response struct {
+	status    int
+	body      string
+	truncated bool          // Promise more body than is sent, so reading it fails
+	delay     time.Duration // Wait before responding
+}
+
+func serve(t *testing.T, responses []response) (*httptest.Server, *atomic.Int32) {
+	var calls atomic.Int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1)) - 1
+
+		if n >= len(responses) {
+			t.Errorf("unexpected request %d", n+1)
+			http.Error(w, "too many requests", http.StatusTeapot)
+			return
+		}
+
+		resp := responses[n]
+
+		if resp.delay > 0 {
+			select {
+			case <-time.After(resp.delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		if resp.truncated {
+			w.Header().Set("Content-Length", "1000")
+		}
+
+		w.WriteHeader(resp.status)
+		w.Write([]byte(resp.body))
+	}))
+
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func TestGet(t *testing.T) {
+	var fail = errors.New("disk full")
+
+	tests := []struct {
+		name      string
+		responses []response
+		fn        func(r io.Reader) error
+		calls     int
+		body      string
+		permanent bool // Whether the error should be ErrPermanent, if there is one
+		wantErr   bool
+	}{
+		{"ok", []response{{status: 200, body: "data"}}, nil, 1, "data", false, false},
+		{"server error then ok", []response{{status: 500}, {status: 200, body: "data"}}, nil, 2, "data", false, false},
+		{"rate limited then ok", []response{{status: 429}, {status: 200, body: "data"}}, nil, 2, "data", false, false},
+		{"request timeout then ok", []response{{status: 408}, {status: 200, body: "data"}}, nil, 2, "data", false, false},
+		{"bad gateway every time", []response{{status: 502}, {status: 503}, {status: 504}}, nil, 3, "", false, true},
+		{"truncated body then ok", []response{{status: 200, body: "da", truncated: true}, {status: 200, body: "data"}}, nil, 2, "data", false, false},
+		{"timeout then ok", []response{{status: 200, delay: time.Second}, {status: 200, body: "data"}}, nil, 2, "data", false, false},
+		{"not found", []response{{status: 404}}, nil, 1, "", true, true},
+		{"forbidden", []response{{status: 403}}, nil, 1, "", true, true},
+		{"gone after server error", []response{{status: 500}, {status: 410}}, nil, 2, "", true, true},
+		{"no content", []response{{status: 204}}, nil, 1, "", true, true},
+		{"callback fails", []response{{status: 200, body: "data"}}, func(r io.Reader) error { return fail }, 1, "", true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, calls := serve(t, tt.responses)
+
+			d := &Downloader{Attempts: 3, Backoff: time.Millisecond, Timeout: 100 * time.Millisecond}
+
+			var body string
+			fn := tt.fn
+
+			if fn == nil {
+				fn = func(r io.Reader) error {
+					b, err := io.ReadAll(r)
+					body = string(b)
+					return err
+				}
+			}
+
+			err := d.Get(context.Background(), srv.URL, fn)
+
+			if int(calls.Load()) != tt.calls {
+				t.Fatalf("%d requests, want %d", calls.Load(), tt.calls)
+			}
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error = %v", err, tt.wantErr)
+			}
+
+			if err != nil && errors.Is(err, ErrPermanent) != tt.permanent {
+				t.Fatalf("error = %v, want permanent = %v", err, tt.permanent)
+			}
+
+			if tt.fn != nil && !errors.Is(err, fail) {
+				t.Fatalf("error = %v, want the callback's error", err)
+			}
+
+			if body != tt.body {
+				t.Fatalf("body = %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
+
+func TestGetBackoff(t *testing.T) {
+	srv, calls := serve(t, []response{{status: 500}, {status: 500}, {status: 500}, {status: 200}})
+
+	d := &Downloader{Attempts: 4, Backoff: 20 * time.Millisecond}
+
+	start := time.Now()
+	err := d.Get(context.Background(), srv.URL, func(r io.Reader) error { return nil })
+	took := time.Since(start)
+
+	if err != nil || calls.Load() != 4 {
+		t.Fatalf("error = %v after %d requests", err, calls.Load())
+	}
+
+	// 20ms, 40ms and 80ms, each with up to 20ms of jitter
+	if took < 140*time.Millisecond || took > 2*time.Second {
+		t.Fatalf("took %v, want the backoff to double between attempts", took)
+	}
+}
+
+func TestGetCancelledDuringBackoff(t *testing.T) {
+	srv, calls := serve(t, []response{{status: 500}, {status: 200}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Downloader{Attempts: 2, Backoff: time.Hour}
+
+	go func() {
+		for calls.Load() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		cancel()
+	}()
+
+	err := d.Get(ctx, srv.URL, func(r io.Reader) error { return nil })
+
+	if !errors.Is(err, context.Canceled) || calls.Load() != 1 {
+		t.Fatalf("error = %v after %d requests, want to stop waiting once cancelled", err, calls.Load())
+	}
+}
+
+func TestForEach(t *testing.T) {
+	var mu sync.Mutex
+	var running, most int
+	var seen = make([]bool, 20)
+
+	d := &Downloader{Workers: 3}
+	d.ForEach(len(seen), func(i int) {
+		mu.Lock()
+		running++
+		most = max(most, running)
+		seen[i] = true
+		mu.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+	})
+
+	if most > 3 {
+		t.Fatalf("%d downloads at once, want at most 3", most)
+	}
+
+	for i, ok := range seen {
+		if !ok {
+			t.Fatalf("index %d was skipped", i)
+		}
+	}
+}
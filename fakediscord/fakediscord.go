@@ -0,0 +1,204 @@
+package fakediscord
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	jsoniter "github.com/json-iterator/go"
+)
+
+var json = jsoniter.ConfigFastest
+
+// ID of the bot user sessions of a Server act as
+const BotID = "1000000000000000001"
+
+// A fake Discord REST API served by httptest
+//
+// It keeps channels, messages and interaction responses in memory, answers the calls discordapi.Client makes and
+// records every request, so a handler can be run against a session from Session and checked afterwards. Channels
+// must be added with AddChannel (or created through the API) before they can be used, and calls to channels that
+// don't exist fail with Unknown Channel like Discord would
+type Server struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	nextID    int64
+	calls     []Call
+	failures  []failure
+	channels  map[string]*discordgo.Channel
+	messages  map[string][]*discordgo.Message // By channel ID, oldest first
+	members   map[string][]string             // Thread members by thread ID
+	dms       map[string]string               // DM channel ID by recipient ID
+	originals map[string]*discordgo.Message   // Original interaction responses by interaction token
+}
+
+// A request made to the server
+type Call struct {
+	Method string
+	Path   string // Without the /api/v{version} prefix, such as /channels/{id}/messages
+	Body   []byte // The JSON body, or the payload_json part of multipart requests
+	Files  []File // Files uploaded in multipart requests
+	Status int    // HTTP status the server answered with
+}
+
+type File struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+type failure struct {
+	method string
+	path   string
+	status int
+	err    discordgo.APIErrorMessage
+}
+
+// Starts a server. Close it once done
+func New() *Server {
+	f := &Server{
+		nextID:    1000000000000000002,
+		channels:  map[string]*discordgo.Channel{},
+		messages:  map[string][]*discordgo.Message{},
+		members:   map[string][]string{},
+		dms:       map[string]string{},
+		originals: map[string]*discordgo.Message{},
+	}
+
+	f.Server = httptest.NewServer(f.routes())
+	return f
+}
+
+// Sends every request to the server rather than Discord
+type transport struct {
+	url *url.URL
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = t.url.Scheme
+	req.URL.Host = t.url.Host
+	req.Host = t.url.Host
+
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// Returns a session whose REST calls go to the server. It is never opened, so nothing is received from the gateway
+func (f *Server) Session() *discordgo.Session {
+	s, _ := discordgo.New("Bot fakediscord")
+
+	u, _ := url.Parse(f.URL)
+	s.Client = &http.Client{Transport: &transport{url: u}}
+	s.ShouldRetryOnRateLimit = false
+	s.MaxRestRetries = 0
+	s.State.User = &discordgo.User{ID: BotID, Username: "fakediscord", Bot: true}
+
+	return s
+}
+
+// Must be called with mu held
+func (f *Server) newID() string {
+	id := strconv.FormatInt(f.nextID, 10)
+	f.nextID++
+	return id
+}
+
+// Adds a channel, such as the ticket thread or log channel from the config
+func (f *Server) AddChannel(ch *discordgo.Channel) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.channels[ch.ID] = ch
+}
+
+// Adds a message to a channel as if it had been sent by msg.Author, giving it an ID if it has none
+func (f *Server) AddMessage(channelId string, msg *discordgo.Message) *discordgo.Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if msg.ID == "" {
+		msg.ID = f.newID()
+	}
+
+	msg.ChannelID = channelId
+	f.messages[channelId] = append(f.messages[channelId], msg)
+	return msg
+}
+
+// Makes the next request matching method and path (without the /api/v{version} prefix) fail with the given HTTP
+// status and Discord error code
+func (f *Server) FailNext(method string, path string, status int, code int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.failures = append(f.failures, failure{
+		method: method,
+		path:   path,
+		status: status,
+		err:    discordgo.APIErrorMessage{Code: code, Message: "fakediscord: failed on request"},
+	})
+}
+
+// Returns the requests made so far, oldest first
+func (f *Server) Calls() []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]Call(nil), f.calls...)
+}
+
+// Returns the requests made so far with the given method and path
+func (f *Server) CallsTo(method string, path string) []Call {
+	var matching []Call
+	for _, c := range f.Calls() {
+		if c.Method == method && c.Path == path {
+			matching = append(matching, c)
+		}
+	}
+
+	return matching
+}
+
+// Returns a channel, or nil if it doesn't exist
+func (f *Server) Channel(id string) *discordgo.Channel {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.channels[id]
+}
+
+// Returns the messages of a channel, oldest first
+func (f *Server) Messages(channelId string) []*discordgo.Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]*discordgo.Message(nil), f.messages[channelId]...)
+}
+
+// Returns the IDs of the users added to a thread
+func (f *Server) Members(threadId string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string(nil), f.members[threadId]...)
+}
+
+// Returns the DM channel opened with a user, or an empty string if there is none
+func (f *Server) DM(userId string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.dms[userId]
+}
+
+// Returns the original response to an interaction (with any edits applied), or nil if it wasn't responded to
+func (f *Server) Original(token string) *discordgo.Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.originals[token]
+}
@@ -0,0 +1,608 @@
+package fakediscord
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/go-chi/chi/v5"
+	jsoniter "github.com/json-iterator/go"
+)
+
+type callKey struct{}
+
+func (f *Server) routes() http.Handler {
+	r := chi.NewRouter()
+
+	r.Use(f.record)
+
+	r.Route("/api/v"+discordgo.APIVersion, func(r chi.Router) {
+		r.Get("/channels/{channelId}", f.getChannel)
+		r.Patch("/channels/{channelId}", f.editChannel)
+		r.Delete("/channels/{channelId}", f.deleteChannel)
+		r.Post("/channels/{channelId}/threads", f.startThread)
+		r.Put("/channels/{channelId}/thread-members/{userId}", f.addThreadMember)
+		r.Get("/channels/{channelId}/messages", f.getMessages)
+		r.Post("/channels/{channelId}/messages", f.sendMessage)
+		r.Patch("/channels/{channelId}/messages/{messageId}", f.editMessage)
+		r.Delete("/channels/{channelId}/messages/{messageId}", f.deleteMessage)
+		r.Put("/channels/{channelId}/pins/{messageId}", f.pinMessage)
+		r.Post("/users/@me/channels", f.createDM)
+		r.Post("/interactions/{interactionId}/{token}/callback", f.respondInteraction)
+		r.Patch("/webhooks/{appId}/{token}/messages/@original", f.editOriginal)
+	})
+
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, 0, "fakediscord: no route for "+r.Method+" "+r.URL.Path)
+	})
+
+	return r
+}
+
+// Records the request, and fails it if FailNext asked for it to be
+func (f *Server) record(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := Call{
+			Method: r.Method,
+			Path:   strings.TrimPrefix(r.URL.Path, "/api/v"+discordgo.APIVersion),
+		}
+
+		body, err := io.ReadAll(r.Body)
+
+		if err != nil {
+			writeError(w, http.StatusBadRequest, 0, "fakediscord: error reading body: "+err.Error())
+			return
+		}
+
+		call.Body = body
+
+		mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+		if mediaType == "multipart/form-data" {
+			call.Body, call.Files, err = readMultipart(body, params["boundary"])
+
+			if err != nil {
+				writeError(w, http.StatusBadRequest, 0, "fakediscord: error reading multipart body: "+err.Error())
+				return
+			}
+		}
+
+		f.mu.Lock()
+		index := len(f.calls)
+		f.calls = append(f.calls, call)
+
+		var fail *failure
+		for i, fl := range f.failures {
+			if fl.method == call.Method && fl.path == call.Path {
+				fail = &fl
+				f.failures = append(f.failures[:i], f.failures[i+1:]...)
+				break
+			}
+		}
+
+		f.mu.Unlock()
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+
+		if fail != nil {
+			writeError(sw, fail.status, fail.err.Code, fail.err.Message)
+		} else {
+			next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), callKey{}, &call)))
+		}
+
+		f.mu.Lock()
+		f.calls[index].Status = sw.status
+		f.mu.Unlock()
+	})
+}
+
+// Remembers the status a handler answered with
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func readMultipart(body []byte, boundary string) ([]byte, []File, error) {
+	var payload []byte
+	var files []File
+
+	mr := multipart.NewReader(bytes.NewReader(body), boundary)
+
+	for {
+		part, err := mr.NextPart()
+
+		if err == io.EOF {
+			return payload, files, nil
+		}
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		data, err := io.ReadAll(part)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if part.FormName() == "payload_json" {
+			payload = data
+			continue
+		}
+
+		files = append(files, File{Name: part.FileName(), ContentType: part.Header.Get("Content-Type"), Data: data})
+	}
+}
+
+func body(r *http.Request) []byte {
+	return r.Context().Value(callKey{}).(*Call).Body
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code int, message string) {
+	writeJSON(w, status, discordgo.APIErrorMessage{Code: code, Message: message})
+}
+
+func unknownChannel(w http.ResponseWriter) {
+	writeError(w, http.StatusNotFound, discordgo.ErrCodeUnknownChannel, "Unknown Channel")
+}
+
+func unknownMessage(w http.ResponseWriter) {
+	writeError(w, http.StatusNotFound, discordgo.ErrCodeUnknownMessage, "Unknown Message")
+}
+
+// Reports whether snowflake a is older than b
+func older(a string, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+
+	return a < b
+}
+
+// Applies the fields present in a message edit (or interaction response edit) to msg
+func applyEdit(msg *discordgo.Message, data []byte) error {
+	var fields map[string]jsoniter.RawMessage
+	err := json.Unmarshal(data, &fields)
+
+	if err != nil {
+		return err
+	}
+
+	var edit discordgo.Message
+	err = json.Unmarshal(data, &edit)
+
+	if err != nil {
+		return err
+	}
+
+	if _, ok := fields["content"]; ok {
+		msg.Content = edit.Content
+	}
+
+	if _, ok := fields["embeds"]; ok {
+		msg.Embeds = edit.Embeds
+	}
+
+	if _, ok := fields["components"]; ok {
+		msg.Components = edit.Components
+	}
+
+	if _, ok := fields["flags"]; ok {
+		msg.Flags = edit.Flags
+	}
+
+	now := time.Now()
+	msg.EditedTimestamp = &now
+	return nil
+}
+
+func (f *Server) getChannel(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ch, ok := f.channels[chi.URLParam(r, "channelId")]
+
+	if !ok {
+		unknownChannel(w)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ch)
+}
+
+func (f *Server) editChannel(w http.ResponseWriter, r *http.Request) {
+	var edit discordgo.ChannelEdit
+	err := json.Unmarshal(body(r), &edit)
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, 0, err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ch, ok := f.channels[chi.URLParam(r, "channelId")]
+
+	if !ok {
+		unknownChannel(w)
+		return
+	}
+
+	if edit.Name != "" {
+		ch.Name = edit.Name
+	}
+
+	if edit.Archived != nil || edit.Locked != nil {
+		if ch.ThreadMetadata == nil {
+			ch.ThreadMetadata = &discordgo.ThreadMetadata{}
+		}
+
+		if edit.Archived != nil {
+			ch.ThreadMetadata.Archived = *edit.Archived
+		}
+
+		if edit.Locked != nil {
+			ch.ThreadMetadata.Locked = *edit.Locked
+		}
+	}
+
+	writeJSON(w, http.StatusOK, ch)
+}
+
+func (f *Server) deleteChannel(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	channelId := chi.URLParam(r, "channelId")
+	ch, ok := f.channels[channelId]
+
+	if !ok {
+		unknownChannel(w)
+		return
+	}
+
+	delete(f.channels, channelId)
+	delete(f.messages, channelId)
+	delete(f.members, channelId)
+
+	writeJSON(w, http.StatusOK, ch)
+}
+
+func (f *Server) startThread(w http.ResponseWriter, r *http.Request) {
+	var data discordgo.ThreadStart
+	err := json.Unmarshal(body(r), &data)
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, 0, err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	parent, ok := f.channels[chi.URLParam(r, "channelId")]
+
+	if !ok {
+		unknownChannel(w)
+		return
+	}
+
+	if data.Type == 0 {
+		data.Type = discordgo.ChannelTypeGuildPublicThread
+	}
+
+	thread := &discordgo.Channel{
+		ID:       f.newID(),
+		GuildID:  parent.GuildID,
+		ParentID: parent.ID,
+		Name:     data.Name,
+		Type:     data.Type,
+		ThreadMetadata: &discordgo.ThreadMetadata{
+			AutoArchiveDuration: data.AutoArchiveDuration,
+			Invitable:           data.Invitable,
+		},
+	}
+
+	f.channels[thread.ID] = thread
+
+	writeJSON(w, http.StatusCreated, thread)
+}
+
+func (f *Server) addThreadMember(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	threadId := chi.URLParam(r, "channelId")
+
+	if _, ok := f.channels[threadId]; !ok {
+		unknownChannel(w)
+		return
+	}
+
+	userId := chi.URLParam(r, "userId")
+
+	for _, member := range f.members[threadId] {
+		if member == userId {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	f.members[threadId] = append(f.members[threadId], userId)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *Server) getMessages(w http.ResponseWriter, r *http.Request) {
+	limit := 50
+
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 100 {
+		limit = l
+	}
+
+	before := r.URL.Query().Get("before")
+	after := r.URL.Query().Get("after")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	channelId := chi.URLParam(r, "channelId")
+
+	if _, ok := f.channels[channelId]; !ok {
+		unknownChannel(w)
+		return
+	}
+
+	// Newest first, like Discord. after pages forwards from the oldest message after it
+	var msgs = []*discordgo.Message{}
+
+	if after != "" {
+		for _, msg := range f.messages[channelId] {
+			if older(after, msg.ID) && len(msgs) < limit {
+				msgs = append([]*discordgo.Message{msg}, msgs...)
+			}
+		}
+	} else {
+		all := f.messages[channelId]
+
+		for i := len(all) - 1; i >= 0 && len(msgs) < limit; i-- {
+			if before == "" || older(all[i].ID, before) {
+				msgs = append(msgs, all[i])
+			}
+		}
+	}
+
+	writeJSON(w, http.StatusOK, msgs)
+}
+
+func (f *Server) sendMessage(w http.ResponseWriter, r *http.Request) {
+	call := r.Context().Value(callKey{}).(*Call)
+
+	var msg discordgo.Message
+	err := json.Unmarshal(call.Body, &msg)
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, 0, err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	channelId := chi.URLParam(r, "channelId")
+	ch, ok := f.channels[channelId]
+
+	if !ok {
+		unknownChannel(w)
+		return
+	}
+
+	msg.ID = f.newID()
+	msg.ChannelID = channelId
+	msg.GuildID = ch.GuildID
+	msg.Author = &discordgo.User{ID: BotID, Username: "fakediscord", Bot: true}
+	msg.Timestamp = time.Now()
+
+	for _, file := range call.Files {
+		msg.Attachments = append(msg.Attachments, &discordgo.MessageAttachment{
+			ID:          f.newID(),
+			Filename:    file.Name,
+			ContentType: file.ContentType,
+			Size:        len(file.Data),
+		})
+	}
+
+	f.messages[channelId] = append(f.messages[channelId], &msg)
+
+	writeJSON(w, http.StatusOK, &msg)
+}
+
+func (f *Server) editMessage(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	channelId := chi.URLParam(r, "channelId")
+
+	if _, ok := f.channels[channelId]; !ok {
+		unknownChannel(w)
+		return
+	}
+
+	for _, msg := range f.messages[channelId] {
+		if msg.ID != chi.URLParam(r, "messageId") {
+			continue
+		}
+
+		err := applyEdit(msg, body(r))
+
+		if err != nil {
+			writeError(w, http.StatusBadRequest, 0, err.Error())
+			return
+		}
+
+		writeJSON(w, http.StatusOK, msg)
+		return
+	}
+
+	unknownMessage(w)
+}
+
+func (f *Server) deleteMessage(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	channelId := chi.URLParam(r, "channelId")
+
+	if _, ok := f.channels[channelId]; !ok {
+		unknownChannel(w)
+		return
+	}
+
+	for n, msg := range f.messages[channelId] {
+		if msg.ID == chi.URLParam(r, "messageId") {
+			f.messages[channelId] = append(f.messages[channelId][:n:n], f.messages[channelId][n+1:]...)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	unknownMessage(w)
+}
+
+func (f *Server) pinMessage(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	channelId := chi.URLParam(r, "channelId")
+
+	if _, ok := f.channels[channelId]; !ok {
+		unknownChannel(w)
+		return
+	}
+
+	for _, msg := range f.messages[channelId] {
+		if msg.ID == chi.URLParam(r, "messageId") {
+			msg.Pinned = true
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	unknownMessage(w)
+}
+
+func (f *Server) createDM(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		RecipientID string `json:"recipient_id"`
+	}
+
+	err := json.Unmarshal(body(r), &data)
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, 0, err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if channelId, ok := f.dms[data.RecipientID]; ok {
+		writeJSON(w, http.StatusOK, f.channels[channelId])
+		return
+	}
+
+	ch := &discordgo.Channel{
+		ID:         f.newID(),
+		Type:       discordgo.ChannelTypeDM,
+		Recipients: []*discordgo.User{{ID: data.RecipientID}},
+	}
+
+	f.channels[ch.ID] = ch
+	f.dms[data.RecipientID] = ch.ID
+
+	writeJSON(w, http.StatusOK, ch)
+}
+
+func (f *Server) respondInteraction(w http.ResponseWriter, r *http.Request) {
+	var resp struct {
+		Type discordgo.InteractionResponseType `json:"type"`
+		Data jsoniter.RawMessage               `json:"data"`
+	}
+
+	err := json.Unmarshal(body(r), &resp)
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, 0, err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	token := chi.URLParam(r, "token")
+
+	if _, ok := f.originals[token]; ok {
+		writeError(w, http.StatusBadRequest, discordgo.ErrCodeInteractionHasAlreadyBeenAcknowledged, "Interaction has already been acknowledged.")
+		return
+	}
+
+	msg := &discordgo.Message{
+		ID:        f.newID(),
+		Author:    &discordgo.User{ID: BotID, Username: "fakediscord", Bot: true},
+		Timestamp: time.Now(),
+	}
+
+	if len(resp.Data) > 0 {
+		err = json.Unmarshal(resp.Data, msg)
+
+		if err != nil {
+			writeError(w, http.StatusBadRequest, 0, err.Error())
+			return
+		}
+	}
+
+	// Other response types (modals, updates to the message with the component) have no message of their own, but
+	// still acknowledge the interaction
+	f.originals[token] = msg
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *Server) editOriginal(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	msg, ok := f.originals[chi.URLParam(r, "token")]
+
+	if !ok {
+		unknownMessage(w)
+		return
+	}
+
+	err := applyEdit(msg, body(r))
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, 0, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, msg)
+}
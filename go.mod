@@ -3,6 +3,9 @@ module ibl-tickets
 go 1.21.3
 
 require (
+	github.com/alicebob/miniredis/v2 v2.31.1
+	github.com/gabriel-vasile/mimetype v1.4.3
+	github.com/go-chi/chi/v5 v5.0.12
 	github.com/json-iterator/go v1.1.12
 	github.com/redis/go-redis/v9 v9.5.1
 	go.uber.org/zap v1.27.0
@@ -10,9 +13,9 @@ require (
 )
 
 require (
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
-	github.com/gabriel-vasile/mimetype v1.4.3 // indirect
 	github.com/go-playground/locales v0.14.1 // indirect
 	github.com/go-playground/universal-translator v0.18.1 // indirect
 	github.com/go-playground/validator/v10 v10.20.0 // indirect
@@ -22,6 +25,7 @@ require (
 	github.com/leodido/go-urn v1.4.0 // indirect
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/modern-go/reflect2 v1.0.2 // indirect
+	github.com/yuin/gopher-lua v1.1.0 // indirect
 	go.uber.org/multierr v1.11.0 // indirect
 	golang.org/x/net v0.25.0 // indirect
 	golang.org/x/sync v0.7.0 // indirect
@@ -0,0 +1,81 @@
+package commands
+
+import (
+	"errors"
+	"ibl-tickets/handlers"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Lists recent transcript and attachment access for a ticket: access <ticketId> [limit]
+func access(c *handlers.Context, m *discordgo.MessageCreate, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: access <ticketId> [limit]")
+	}
+
+	tikId := args[0]
+	limit := 20
+
+	if len(args) > 1 {
+		var err error
+		limit, err = strconv.Atoi(args[1])
+
+		if err != nil || limit < 1 || limit > 100 {
+			return errors.New("limit must be a number between 1 and 100")
+		}
+	}
+
+	accesses, err := c.Tickets.AccessLog(c.Ctx, tikId, limit)
+
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	for _, a := range accesses {
+		line := "<t:" + strconv.FormatInt(a.AccessedAt.Unix(), 10) + ":f> <@" + a.ViewerID + "> (" + a.ViewerID + ") from `" + a.IP + "`"
+
+		if a.AttachmentID != "" {
+			line += " downloaded attachment `" + a.AttachmentID + "`"
+		} else {
+			line += " viewed the transcript"
+		}
+
+		if !a.Granted {
+			line += " **[denied]**"
+		}
+
+		lines = append(lines, line+"\n-# "+truncate(strings.ReplaceAll(a.UserAgent, "`", ""), 100))
+	}
+
+	if len(lines) == 0 {
+		lines = []string{"Nobody has accessed this ticket yet"}
+	}
+
+	_, err = c.Discord.ChannelMessageSendComplex(m.ChannelID, &discordgo.MessageSend{
+		Embeds: []*discordgo.MessageEmbed{
+			{
+				Title:       "Recent access to " + tikId,
+				Description: truncate(strings.Join(lines, "\n"), 4096),
+			},
+		},
+		AllowedMentions: &discordgo.MessageAllowedMentions{
+			Parse: []discordgo.AllowedMentionType{},
+		},
+	})
+
+	return err
+}
+
+// Truncates a string to at most n characters
+func truncate(s string, n int) string {
+	r := []rune(s)
+
+	if len(r) <= n {
+		return s
+	}
+
+	return string(r[:n-3]) + "..."
+}
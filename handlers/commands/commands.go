@@ -0,0 +1,35 @@
+package commands
+
+import (
+	"ibl-tickets/handlers"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+type Handler func(c *handlers.Context, m *discordgo.MessageCreate, args []string) error
+
+// Commands are invoked by mentioning the bot followed by the command name and its arguments
+var Handlers = map[string]Handler{}
+
+func AddHandler(name string, handler Handler) {
+	Handlers[name] = handler
+}
+
+// Commands that staff may use as well as owners
+var staffHandlers = map[string]bool{}
+
+// Adds a command that staff may use as well as owners
+func AddStaffHandler(name string, handler Handler) {
+	Handlers[name] = handler
+	staffHandlers[name] = true
+}
+
+func IsStaffCommand(name string) bool {
+	return staffHandlers[name]
+}
+
+func init() {
+	AddHandler("msg", msg)
+	AddStaffHandler("link", link)
+	AddStaffHandler("access", access)
+}
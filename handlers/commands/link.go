@@ -0,0 +1,88 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"ibl-tickets/handlers"
+	"ibl-tickets/links"
+
+	"github.com/bwmarrin/discordgo"
+	"go.uber.org/zap"
+)
+
+// Mints a fresh transcript link: link <ticketId> [user|staff]
+//
+// User links are DM'd to the ticket opener, staff links to the staff member who asked for one
+func link(c *handlers.Context, m *discordgo.MessageCreate, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: link <ticketId> [user|staff]")
+	}
+
+	tikId := args[0]
+	audience := links.AudienceUser
+
+	if len(args) > 1 {
+		audience = args[1]
+	}
+
+	if audience != links.AudienceUser && audience != links.AudienceStaff {
+		return fmt.Errorf("audience must be %s or %s", links.AudienceUser, links.AudienceStaff)
+	}
+
+	tik, err := c.Tickets.Get(c.Ctx, tikId)
+
+	if err != nil {
+		return err
+	}
+
+	if tik.Open {
+		return errors.New("this ticket is still open and has no transcript yet")
+	}
+
+	recipient := tik.UserID
+
+	if audience == links.AudienceStaff {
+		recipient = m.Author.ID
+	}
+
+	dm, err := c.Discord.UserChannelCreate(recipient)
+
+	if err != nil {
+		return fmt.Errorf("error creating DM channel: %w", err)
+	}
+
+	_, err = c.Discord.ChannelMessageSendComplex(dm.ID, &discordgo.MessageSend{
+		Embeds: []*discordgo.MessageEmbed{
+			{
+				Title: "Ticket Transcript",
+				Fields: []*discordgo.MessageEmbedField{
+					{
+						Name:   "Ticket ID",
+						Value:  tikId,
+						Inline: false,
+					},
+					{
+						Name:   "Ticket URL",
+						Value:  links.URL(c.Config, c.Secrets, tikId, audience),
+						Inline: false,
+					},
+				},
+			},
+		},
+	})
+
+	if err != nil {
+		return fmt.Errorf("error sending link: %w", err)
+	}
+
+	c.Logger.Info("Minted transcript link", zap.String("ticket_id", tikId), zap.String("audience", audience), zap.String("recipient", recipient))
+
+	_, err = c.Discord.ChannelMessageSendComplex(m.ChannelID, &discordgo.MessageSend{
+		Content: "Sent a fresh " + audience + " link for ticket `" + tikId + "` to <@" + recipient + ">'s DMs",
+		AllowedMentions: &discordgo.MessageAllowedMentions{
+			Parse: []discordgo.AllowedMentionType{},
+		},
+	})
+
+	return err
+}
@@ -0,0 +1,72 @@
+package commands
+
+import (
+	"fmt"
+	"ibl-tickets/handlers"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func msg(c *handlers.Context, m *discordgo.MessageCreate, args []string) error {
+	// Delete all messages in the channel
+	messages, err := c.Discord.ChannelMessages(m.ChannelID, 100, "", "", "")
+
+	if err != nil {
+		return fmt.Errorf("error getting messages: %w", err)
+	}
+
+	for _, message := range messages {
+		err = c.Discord.ChannelMessageDelete(m.ChannelID, message.ID)
+
+		if err != nil {
+			return fmt.Errorf("error deleting message: %w", err)
+		}
+	}
+
+	// Send the ticket message
+	menuId, err := handlers.TicketMenuID.Build()
+
+	if err != nil {
+		return err
+	}
+
+	var smo []discordgo.SelectMenuOption
+
+	for key, topic := range c.Config.Topics {
+		smo = append(smo, discordgo.SelectMenuOption{
+			Label:       topic.Name,
+			Value:       key,
+			Description: topic.Description,
+			Emoji: &discordgo.ComponentEmoji{
+				Name: topic.Emoji,
+			},
+		})
+	}
+
+	_, err = c.Discord.ChannelMessageSendComplex(m.ChannelID, &discordgo.MessageSend{
+		Embeds: []*discordgo.MessageEmbed{
+			{
+				Title:       "How can we help?",
+				Type:        discordgo.EmbedTypeRich,
+				Description: "Please select a topic below to create a ticket. If you don't see a topic that fits your issue, please create a ticket with the `General Support` topic.",
+			},
+		},
+		Components: []discordgo.MessageComponent{
+			discordgo.ActionsRow{
+				Components: []discordgo.MessageComponent{
+					&discordgo.SelectMenu{
+						CustomID:    menuId,
+						Placeholder: "How can we help you",
+						Options:     smo,
+					},
+				},
+			},
+		},
+	})
+
+	if err != nil {
+		return fmt.Errorf("error sending the message: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,250 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"ibl-tickets/blobs"
+	"ibl-tickets/keys"
+	"ibl-tickets/tickets"
+	"ibl-tickets/types"
+
+	"github.com/bwmarrin/discordgo"
+	"go.uber.org/zap"
+)
+
+// Returns the open ticket that owns a channel, or nil if the channel is not an open ticket thread
+func ticketForChannel(s *discordgo.Session, config *types.Config, store tickets.Store, ctx context.Context, channelId string) (*tickets.Ticket, error) {
+	// Avoid hitting the database for channels we know aren't ticket threads
+	if ch, err := s.State.Channel(channelId); err == nil && ch.ParentID != config.Channels.ThreadChannel {
+		return nil, nil
+	}
+
+	t, err := store.ForChannel(ctx, channelId)
+
+	if errors.Is(err, tickets.ErrNotFound) {
+		return nil, nil
+	}
+
+	return t, err
+}
+
+// Returns the data key of a ticket, giving tickets opened before column encryption one so their message log can be
+// encrypted too
+func DataKey(keyring *keys.Keyring, store tickets.Store, ctx context.Context, t *tickets.Ticket) ([]byte, error) {
+	encKey, keyId := t.EncKey, t.EncKeyID
+
+	if encKey == "" {
+		_, wrapped, newKeyId, err := keyring.NewDataKey()
+
+		if err != nil {
+			return nil, fmt.Errorf("error creating data key: %w", err)
+		}
+
+		// Someone else may have given the ticket a key since it was read, in which case theirs is kept
+		encKey, keyId, err = store.SetDataKey(ctx, t.ID, wrapped, newKeyId)
+
+		if err != nil {
+			return nil, err
+		}
+
+		t.EncKey, t.EncKeyID = encKey, keyId
+	}
+
+	dataKey, err := keyring.TicketKey(encKey, keyId)
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting data key: %w", err)
+	}
+
+	return dataKey, nil
+}
+
+// What the message log keeps encrypted in enc_data
+type loggedData struct {
+	Content     *string                        `json:"content"`
+	Embeds      []*discordgo.MessageEmbed      `json:"embeds,omitempty"`
+	Attachments []*discordgo.MessageAttachment `json:"attachments,omitempty"`
+}
+
+// Logs an event with its content, embeds and attachments encrypted with the ticket's data key
+func logEvent(store tickets.Store, ctx context.Context, dataKey []byte, e *tickets.MessageEvent) error {
+	encData, err := blobs.EncryptJSON(dataKey, loggedData{Content: e.Content, Embeds: e.Embeds, Attachments: e.Attachments})
+
+	if err != nil {
+		return fmt.Errorf("error encrypting message: %w", err)
+	}
+
+	return store.LogMessage(ctx, &tickets.MessageEvent{
+		TicketID:  e.TicketID,
+		MessageID: e.MessageID,
+		Event:     e.Event,
+		AuthorID:  e.AuthorID,
+		EncData:   encData,
+	})
+}
+
+// Fills in the content, embeds and attachments of a logged event from its encrypted data. Events logged before the
+// message log was encrypted are left as they are
+func decryptEvent(dataKey []byte, e *tickets.MessageEvent) error {
+	if e.EncData == nil {
+		return nil
+	}
+
+	var data loggedData
+	err := blobs.DecryptJSON(dataKey, e.EncData, nil, &data)
+
+	if err != nil {
+		return fmt.Errorf("error decrypting message %s: %w", e.MessageID, err)
+	}
+
+	e.Content, e.Embeds, e.Attachments = data.Content, data.Embeds, data.Attachments
+	return nil
+}
+
+// Records a newly created message. Messages that are already in the log are ignored
+func recordCreate(store tickets.Store, ctx context.Context, tikId string, dataKey []byte, msg *discordgo.Message) error {
+	var authorId string
+
+	if msg.Author != nil {
+		authorId = msg.Author.ID
+	}
+
+	return logEvent(store, ctx, dataKey, &tickets.MessageEvent{
+		TicketID:    tikId,
+		MessageID:   msg.ID,
+		Event:       tickets.EventCreate,
+		AuthorID:    authorId,
+		Content:     &msg.Content,
+		Embeds:      msg.Embeds,
+		Attachments: msg.Attachments,
+	})
+}
+
+func MessageCreate(s *discordgo.Session, m *discordgo.MessageCreate, config *types.Config, store tickets.Store, keyring *keys.Keyring, ctx context.Context, logger *zap.Logger) {
+	if m.GuildID == "" {
+		return
+	}
+
+	t, err := ticketForChannel(s, config, store, ctx, m.ChannelID)
+
+	if err != nil {
+		logger.Error("Error finding ticket for message", zap.Error(err), zap.String("channelId", m.ChannelID), zap.String("messageId", m.ID))
+		return
+	}
+
+	if t == nil {
+		return
+	}
+
+	dataKey, err := DataKey(keyring, store, ctx, t)
+
+	if err != nil {
+		logger.Error("Error getting ticket data key", zap.Error(err), zap.String("ticket_id", t.ID))
+		return
+	}
+
+	err = recordCreate(store, ctx, t.ID, dataKey, m.Message)
+
+	if err != nil {
+		logger.Error("Error recording message", zap.Error(err), zap.String("ticket_id", t.ID), zap.String("messageId", m.ID))
+	}
+}
+
+func MessageUpdate(s *discordgo.Session, m *discordgo.MessageUpdate, config *types.Config, store tickets.Store, keyring *keys.Keyring, ctx context.Context, logger *zap.Logger) {
+	if m.GuildID == "" {
+		return
+	}
+
+	t, err := ticketForChannel(s, config, store, ctx, m.ChannelID)
+
+	if err != nil {
+		logger.Error("Error finding ticket for message update", zap.Error(err), zap.String("channelId", m.ChannelID), zap.String("messageId", m.ID))
+		return
+	}
+
+	if t == nil {
+		return
+	}
+
+	// Partial updates (such as embed unfurls) aren't edits, and don't carry the message's content
+	if m.EditedTimestamp == nil {
+		return
+	}
+
+	dataKey, err := DataKey(keyring, store, ctx, t)
+
+	if err != nil {
+		logger.Error("Error getting ticket data key", zap.Error(err), zap.String("ticket_id", t.ID))
+		return
+	}
+
+	last, err := store.LastLogged(ctx, m.ID)
+
+	if err == nil && last != nil {
+		err = decryptEvent(dataKey, last)
+	}
+
+	if err != nil {
+		logger.Error("Error getting logged message", zap.Error(err), zap.String("ticket_id", t.ID), zap.String("messageId", m.ID))
+		return
+	}
+
+	if last != nil && last.Content != nil && *last.Content == m.Content {
+		return
+	}
+
+	err = logEvent(store, ctx, dataKey, &tickets.MessageEvent{TicketID: t.ID, MessageID: m.ID, Event: tickets.EventUpdate, Content: &m.Content, Embeds: m.Embeds})
+
+	if err != nil {
+		logger.Error("Error recording message update", zap.Error(err), zap.String("ticket_id", t.ID), zap.String("messageId", m.ID))
+	}
+}
+
+func MessageDelete(s *discordgo.Session, m *discordgo.MessageDelete, config *types.Config, store tickets.Store, keyring *keys.Keyring, ctx context.Context, logger *zap.Logger) {
+	if m.GuildID == "" {
+		return
+	}
+
+	t, err := ticketForChannel(s, config, store, ctx, m.ChannelID)
+
+	if err != nil {
+		logger.Error("Error finding ticket for message delete", zap.Error(err), zap.String("channelId", m.ChannelID), zap.String("messageId", m.ID))
+		return
+	}
+
+	if t == nil {
+		return
+	}
+
+	err = store.LogMessage(ctx, &tickets.MessageEvent{TicketID: t.ID, MessageID: m.ID, Event: tickets.EventDelete})
+
+	if err != nil {
+		logger.Error("Error recording message delete", zap.Error(err), zap.String("ticket_id", t.ID), zap.String("messageId", m.ID))
+	}
+}
+
+func MessageDeleteBulk(s *discordgo.Session, m *discordgo.MessageDeleteBulk, config *types.Config, store tickets.Store, keyring *keys.Keyring, ctx context.Context, logger *zap.Logger) {
+	if m.GuildID == "" {
+		return
+	}
+
+	t, err := ticketForChannel(s, config, store, ctx, m.ChannelID)
+
+	if err != nil {
+		logger.Error("Error finding ticket for bulk message delete", zap.Error(err), zap.String("channelId", m.ChannelID))
+		return
+	}
+
+	if t == nil {
+		return
+	}
+
+	for _, msgId := range m.Messages {
+		err = store.LogMessage(ctx, &tickets.MessageEvent{TicketID: t.ID, MessageID: msgId, Event: tickets.EventDelete})
+
+		if err != nil {
+			logger.Error("Error recording message delete", zap.Error(err), zap.String("ticket_id", t.ID), zap.String("messageId", msgId))
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"ibl-tickets/discordapi"
+	"ibl-tickets/tickets"
+	"ibl-tickets/types"
+	"sort"
+	"strconv"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// A message as reconstructed from the ticket_messages log
+type LoggedMessage struct {
+	*discordgo.Message
+	Edits   []types.MessageEdit // Previous versions of the message, oldest first
+	Deleted bool                // Whether the message was deleted before the ticket was closed
+}
+
+// Records any messages in the thread that are missing from the log (e.g. sent while the bot was offline)
+func Backfill(s discordapi.Client, store tickets.Store, ctx context.Context, tikId string, channelId string, dataKey []byte) error {
+	var lastMessageId string
+	for {
+		msgs, err := s.ChannelMessages(channelId, 100, lastMessageId, "", "")
+
+		if err != nil {
+			return fmt.Errorf("error getting messages (lastMessageId=%s): %w", lastMessageId, err)
+		}
+
+		for _, msg := range msgs {
+			err = recordCreate(store, ctx, tikId, dataKey, msg)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(msgs) < 100 {
+			break
+		}
+
+		lastMessageId = msgs[len(msgs)-1].ID
+	}
+
+	return nil
+}
+
+// Assembles the messages of a ticket from its log, oldest first
+func Messages(store tickets.Store, ctx context.Context, tikId string, dataKey []byte) ([]*LoggedMessage, error) {
+	log, err := store.MessageLog(ctx, tikId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var byId = map[string]*LoggedMessage{}
+	for _, e := range log {
+		err = decryptEvent(dataKey, e)
+
+		if err != nil {
+			return nil, err
+		}
+
+		msg, ok := byId[e.MessageID]
+
+		if !ok {
+			// Edits and deletes can be logged for messages we never saw being created
+			msg = &LoggedMessage{Message: &discordgo.Message{ID: e.MessageID, Author: &discordgo.User{}}}
+			byId[e.MessageID] = msg
+		}
+
+		switch e.Event {
+		case tickets.EventCreate:
+			msg.Author.ID = e.AuthorID
+
+			if e.Content != nil {
+				msg.Content = *e.Content
+			}
+
+			msg.Embeds = e.Embeds
+			msg.Attachments = e.Attachments
+		case tickets.EventUpdate:
+			if e.Content != nil && *e.Content != msg.Content {
+				msg.Edits = append(msg.Edits, types.MessageEdit{
+					Content:  msg.Content,
+					Embeds:   msg.Embeds,
+					EditedAt: e.CreatedAt,
+				})
+
+				msg.Content = *e.Content
+			}
+
+			if e.Embeds != nil {
+				msg.Embeds = e.Embeds
+			}
+		case tickets.EventDelete:
+			msg.Deleted = true
+		}
+	}
+
+	var messages = make([]*LoggedMessage, 0, len(byId))
+
+	for _, msg := range byId {
+		messages = append(messages, msg)
+	}
+
+	// Snowflakes are ordered by creation time
+	sort.Slice(messages, func(i, j int) bool {
+		a, _ := strconv.ParseUint(messages[i].ID, 10, 64)
+		b, _ := strconv.ParseUint(messages[j].ID, 10, 64)
+		return a < b
+	})
+
+	return messages, nil
+}
@@ -0,0 +1,143 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"ibl-tickets/keys"
+	"ibl-tickets/tickets"
+	"ibl-tickets/types"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func testKeyring(t *testing.T) *keys.Keyring {
+	key := make([]byte, 32)
+
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+
+	keyring, err := keys.Load(&types.Secrets{MasterKeyID: "k1", MasterKey: base64.StdEncoding.EncodeToString(key)})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return keyring
+}
+
+func TestMessages(t *testing.T) {
+	ctx := context.Background()
+	store := tickets.NewMemoryStore()
+
+	tik := &tickets.Ticket{ID: "t1", ChannelID: "c1"}
+
+	if err := store.Create(ctx, tik); err != nil {
+		t.Fatal(err)
+	}
+
+	dataKey, err := DataKey(testKeyring(t), store, ctx, tik)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Logged before the message log was encrypted
+	legacy := "legacy"
+
+	if err := store.LogMessage(ctx, &tickets.MessageEvent{TicketID: "t1", MessageID: "1", Event: tickets.EventCreate, AuthorID: "u1", Content: &legacy}); err != nil {
+		t.Fatal(err)
+	}
+
+	text := func(s string) *string { return &s }
+
+	log := []*tickets.MessageEvent{
+		{MessageID: "20", Event: tickets.EventCreate, AuthorID: "u2", Content: text("second")},
+		{MessageID: "10", Event: tickets.EventCreate, AuthorID: "u1", Content: text("first"), Attachments: []*discordgo.MessageAttachment{{ID: "a1"}}},
+		{MessageID: "10", Event: tickets.EventUpdate, Content: text("first, edited")},
+		{MessageID: "10", Event: tickets.EventUpdate, Content: text("first, edited")}, // Embed unfurl, not an edit
+		{MessageID: "20", Event: tickets.EventDelete},
+		{MessageID: "5", Event: tickets.EventDelete}, // Sent before the bot saw it
+	}
+
+	for _, e := range log {
+		e.TicketID = "t1"
+
+		if err := logEvent(store, ctx, dataKey, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	logged, _ := store.MessageLog(ctx, "t1")
+
+	for _, e := range logged[1:] {
+		if e.Content != nil || e.Attachments != nil || e.EncData == nil || bytes.Contains(e.EncData, []byte("first")) {
+			t.Fatalf("event %s of message %s was logged in plaintext", e.Event, e.MessageID)
+		}
+	}
+
+	messages, err := Messages(store, ctx, "t1", dataKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(messages) != 4 || messages[0].ID != "1" || messages[1].ID != "5" || messages[2].ID != "10" || messages[3].ID != "20" {
+		t.Fatalf("Messages returned %d messages out of snowflake order", len(messages))
+	}
+
+	if messages[0].Content != "legacy" || messages[0].Author.ID != "u1" {
+		t.Fatalf("message logged in plaintext = %+v", messages[0])
+	}
+
+	if !messages[1].Deleted || messages[1].Content != "" {
+		t.Fatalf("message only seen deleted = %+v", messages[1])
+	}
+
+	first := messages[2]
+
+	if first.Author.ID != "u1" || first.Content != "first, edited" || len(first.Edits) != 1 || first.Edits[0].Content != "first" || len(first.Attachments) != 1 {
+		t.Fatalf("edited message = %+v with edits %+v", first.Message, first.Edits)
+	}
+
+	if second := messages[3]; !second.Deleted || second.Content != "second" || len(second.Edits) != 0 {
+		t.Fatalf("deleted message = %+v", second)
+	}
+}
+
+func TestDataKey(t *testing.T) {
+	ctx := context.Background()
+	store := tickets.NewMemoryStore()
+	keyring := testKeyring(t)
+
+	// Opened before column encryption, so it has no key until one is needed
+	if err := store.Create(ctx, &tickets.Ticket{ID: "t1", ChannelID: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := DataKey(keyring, store, ctx, &tickets.Ticket{ID: "t1"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A copy read before the key was stored gets the stored key rather than a new one
+	second, err := DataKey(keyring, store, ctx, &tickets.Ticket{ID: "t1"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, _ := store.Get(ctx, "t1")
+
+	if !bytes.Equal(first, second) || stored.EncKey == "" || stored.EncKeyID != "k1" {
+		t.Fatalf("DataKey gave %x then %x, ticket has %q (%s)", first, second, stored.EncKey, stored.EncKeyID)
+	}
+
+	if third, _ := DataKey(keyring, store, ctx, stored); !bytes.Equal(first, third) {
+		t.Fatal("DataKey of a ticket with a key returned a different key")
+	}
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"context"
+	"ibl-tickets/discordapi"
+	"ibl-tickets/keys"
+	"ibl-tickets/signing"
+	"ibl-tickets/storage"
+	"ibl-tickets/tickets"
+	"ibl-tickets/types"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// Kinds of requests
+const (
+	KindComponent = "component"
+	KindModal     = "modal"
+	KindCommand   = "command"
+)
+
+// What a command, component or modal handler runs with
+type Context struct {
+	Ctx     context.Context
+	Discord discordapi.Client
+	Config  *types.Config
+	Secrets *types.Secrets
+	Keyring *keys.Keyring
+	Signer  *signing.Keys
+	Store   storage.Store
+	Tickets tickets.Store
+	Redis   *redis.Client
+	Logger  *zap.Logger // Has the user, guild, channel and custom ID (or command) of the request as fields
+}
+
+// A command or interaction on its way to its handler
+type Request struct {
+	Kind        string
+	Name        string                   // Handler the request is routed to
+	UserID      string                   // User who sent the command or interaction
+	Interaction *discordgo.Interaction   // Set for components and modals
+	Message     *discordgo.MessageCreate // Set for commands
+}
+
+// Handles a request, or passes it on
+type Handler func(c *Context, r *Request) error
+
+// Wraps a handler, such as to check the request before passing it on
+type Middleware func(next Handler) Handler
+
+// Wraps h in middleware, the first of which runs first
+func Chain(h Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+
+	return h
+}
+
+// Answers a request without running its handler: ephemerally for interactions, in the channel for commands
+func (r *Request) Reply(c *Context, content string) error {
+	if r.Interaction != nil {
+		return c.Discord.InteractionRespond(r.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: content,
+				Flags:   discordgo.MessageFlagsEphemeral,
+				AllowedMentions: &discordgo.MessageAllowedMentions{
+					Parse: []discordgo.AllowedMentionType{},
+				},
+			},
+		})
+	}
+
+	_, err := c.Discord.ChannelMessageSendComplex(r.Message.ChannelID, &discordgo.MessageSend{
+		Content: content,
+		AllowedMentions: &discordgo.MessageAllowedMentions{
+			Parse: []discordgo.AllowedMentionType{},
+		},
+	})
+
+	return err
+}
@@ -0,0 +1,11 @@
+package handlers
+
+import "ibl-tickets/customid"
+
+// Custom IDs of the components and modals the bot sends. Changing the parameters of one means bumping its version
+// and registering a migration from the old one, as messages with the old custom IDs stay around
+var (
+	TicketMenuID  = customid.MustParse("tikm")               // Topic select menu of the ticket message
+	CloseID       = customid.MustParse("close:{ticketId}")   // Close button of a ticket
+	TicketModalID = customid.MustParse("tikmodal:{topicId}") // Questions asked when opening a ticket
+)
@@ -1,21 +1,25 @@
 package modal
 
 import (
-	"context"
-	"ibl-tickets/types"
+	"ibl-tickets/customid"
+	"ibl-tickets/handlers"
 
 	"github.com/bwmarrin/discordgo"
-	"github.com/jackc/pgx/v5/pgxpool"
-	"github.com/redis/go-redis/v9"
-	"go.uber.org/zap"
 )
 
-var Handlers = map[string]func(s *discordgo.Session, i *discordgo.Interaction, data discordgo.ModalSubmitInteractionData, config *types.Config, pool *pgxpool.Pool, ctx context.Context, logger *zap.Logger, rediscli *redis.Client) error{}
+type Handler func(c *handlers.Context, i *discordgo.Interaction, data discordgo.ModalSubmitInteractionData, args customid.Args) error
 
-func AddHandler(name string, handler func(s *discordgo.Session, i *discordgo.Interaction, data discordgo.ModalSubmitInteractionData, config *types.Config, pool *pgxpool.Pool, ctx context.Context, logger *zap.Logger, rediscli *redis.Client) error) {
-	Handlers[name] = handler
+// Handlers by the name of their custom ID
+var Handlers = map[string]Handler{}
+
+// Matches the custom IDs of modals to the names of their handlers
+var Router = customid.NewRouter()
+
+func AddHandler(p *customid.Pattern, handler Handler) {
+	Router.Handle(p)
+	Handlers[p.Name()] = handler
 }
 
 func init() {
-	AddHandler("tikmodal", tikModal)
+	AddHandler(handlers.TicketModalID, tikModal)
 }
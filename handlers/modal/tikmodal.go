@@ -3,20 +3,21 @@ package modal
 import (
 	"context"
 	"fmt"
-	"ibl-tickets/types"
+	"ibl-tickets/blobs"
+	"ibl-tickets/customid"
+	"ibl-tickets/discordapi"
+	"ibl-tickets/handlers"
+	"ibl-tickets/tickets"
 	"ibl-tickets/utils"
 	"strconv"
-	"strings"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/infinitybotlist/eureka/crypto"
-	"github.com/jackc/pgx/v5/pgxpool"
-	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
 )
 
-func _deleteThread(pool *pgxpool.Pool, ctx context.Context, s *discordgo.Session, threadId string, tikId string) error {
-	_, err := pool.Exec(ctx, "DELETE FROM tickets WHERE id = $1", tikId)
+func _deleteThread(tikStore tickets.Store, ctx context.Context, s discordapi.Client, threadId string, tikId string) error {
+	err := tikStore.Delete(ctx, tikId)
 
 	if err != nil {
 		return fmt.Errorf("error deleting ticket from database: %w", err)
@@ -31,17 +32,17 @@ func _deleteThread(pool *pgxpool.Pool, ctx context.Context, s *discordgo.Session
 	return nil
 }
 
-func tikModal(s *discordgo.Session, i *discordgo.Interaction, data discordgo.ModalSubmitInteractionData, config *types.Config, pool *pgxpool.Pool, ctx context.Context, logger *zap.Logger, rediscli *redis.Client) error {
-	topicId := strings.Split(data.CustomID, ":")[1]
+func tikModal(c *handlers.Context, i *discordgo.Interaction, data discordgo.ModalSubmitInteractionData, args customid.Args) error {
+	topicId := args["topicId"]
 
-	topic, ok := config.Topics[topicId]
+	topic, ok := c.Config.Topics[topicId]
 
 	if !ok {
 		return fmt.Errorf("topic not found")
 	}
 
 	// Send a message to the user
-	err := s.InteractionRespond(i, &discordgo.InteractionResponse{
+	err := c.Discord.InteractionRespond(i, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseChannelMessageWithSource,
 		Data: &discordgo.InteractionResponseData{
 			Content: "Creating ticket.\n\nPlease wait...",
@@ -77,7 +78,28 @@ func tikModal(s *discordgo.Session, i *discordgo.Interaction, data discordgo.Mod
 		answers[topic.Questions[questionNum].Question] = input.Value
 	}
 
-	thread, err := s.ThreadStartComplex(config.Channels.ThreadChannel, &discordgo.ThreadStart{
+	// The answers can contain private details, so they are only stored encrypted under the ticket's data key
+	dataKey, wrappedKey, keyId, err := c.Keyring.NewDataKey()
+
+	if err != nil {
+		return fmt.Errorf("error creating data key: %w", err)
+	}
+
+	encContext, err := blobs.EncryptJSON(dataKey, answers)
+
+	if err != nil {
+		return fmt.Errorf("error encrypting ticket context: %w", err)
+	}
+
+	tikId := crypto.RandString(64)
+
+	closeId, err := handlers.CloseID.Build(tikId)
+
+	if err != nil {
+		return err
+	}
+
+	thread, err := c.Discord.ThreadStartComplex(c.Config.Channels.ThreadChannel, &discordgo.ThreadStart{
 		Name: issue,
 		Type: discordgo.ChannelTypeGuildPrivateThread,
 	})
@@ -86,13 +108,20 @@ func tikModal(s *discordgo.Session, i *discordgo.Interaction, data discordgo.Mod
 		return fmt.Errorf("error creating thread: %w", err)
 	}
 
-	tikId := crypto.RandString(64)
-
 	// Add the ticket to the database
-	_, err = pool.Exec(ctx, "INSERT INTO tickets (id, user_id, channel_id, topic_id, ticket_context, issue) VALUES ($1, $2, $3, $4, $5, $6)", tikId, i.Member.User.ID, thread.ID, topicId, answers, issue)
+	err = c.Tickets.Create(c.Ctx, &tickets.Ticket{
+		ID:               tikId,
+		UserID:           i.Member.User.ID,
+		ChannelID:        thread.ID,
+		TopicID:          topicId,
+		Issue:            issue,
+		EncKey:           wrappedKey,
+		EncKeyID:         keyId,
+		EncTicketContext: encContext,
+	})
 
 	if err != nil {
-		logger.Error("Error inserting ticket into database", zap.Error(err), zap.String("issue", issue), zap.String("topicId", topicId))
+		c.Logger.Error("Error inserting ticket into database", zap.Error(err), zap.String("issue", issue), zap.String("topicId", topicId))
 		return fmt.Errorf("error inserting ticket into database: %w", err)
 	}
 
@@ -111,7 +140,7 @@ func tikModal(s *discordgo.Session, i *discordgo.Interaction, data discordgo.Mod
 		rolesStr += "<@&" + role + "> "
 	}
 
-	m, err := s.ChannelMessageSendComplex(thread.ID, &discordgo.MessageSend{
+	m, err := c.Discord.ChannelMessageSendComplex(thread.ID, &discordgo.MessageSend{
 		Content: i.Member.User.Mention() + " " + rolesStr,
 		Embeds: []*discordgo.MessageEmbed{
 			{
@@ -141,7 +170,7 @@ func tikModal(s *discordgo.Session, i *discordgo.Interaction, data discordgo.Mod
 					discordgo.Button{
 						Label:    "Close",
 						Style:    discordgo.SuccessButton,
-						CustomID: "close:" + tikId,
+						CustomID: closeId,
 					},
 				},
 			},
@@ -152,39 +181,39 @@ func tikModal(s *discordgo.Session, i *discordgo.Interaction, data discordgo.Mod
 	})
 
 	if err != nil {
-		logger.Error("Error sending message", zap.Error(err), zap.String("issue", issue), zap.String("topicId", topicId))
+		c.Logger.Error("Error sending message", zap.Error(err), zap.String("issue", issue), zap.String("topicId", topicId))
 
-		delThreadErr := _deleteThread(pool, ctx, s, thread.ID, tikId)
+		delThreadErr := _deleteThread(c.Tickets, c.Ctx, c.Discord, thread.ID, tikId)
 
-		if err != nil {
-			logger.Error("Error deleting thread", zap.Error(delThreadErr), zap.String("issue", issue), zap.String("topicId", topicId), zap.String("userId", i.Member.User.ID))
+		if delThreadErr != nil {
+			c.Logger.Error("Error deleting thread", zap.Error(delThreadErr), zap.String("issue", issue), zap.String("topicId", topicId))
 		}
 		return fmt.Errorf("error sending message: %w", err)
 	}
 
-	err = s.ThreadMemberAdd(thread.ID, i.Member.User.ID)
+	err = c.Discord.ThreadMemberAdd(thread.ID, i.Member.User.ID)
 
 	if err != nil {
-		logger.Error("Error adding user to thread", zap.Error(err), zap.String("issue", issue), zap.String("topicId", topicId), zap.String("userId", i.Member.User.ID))
-		err = _deleteThread(pool, ctx, s, thread.ID, tikId)
+		c.Logger.Error("Error adding user to thread", zap.Error(err), zap.String("issue", issue), zap.String("topicId", topicId))
+		err = _deleteThread(c.Tickets, c.Ctx, c.Discord, thread.ID, tikId)
 
 		if err != nil {
-			logger.Error("Error deleting thread", zap.Error(err), zap.String("issue", issue), zap.String("topicId", topicId), zap.String("userId", i.Member.User.ID))
+			c.Logger.Error("Error deleting thread", zap.Error(err), zap.String("issue", issue), zap.String("topicId", topicId))
 		}
 
 		return fmt.Errorf("error adding user to thread: %w", err)
 	}
 
 	// Pin the message
-	err = s.ChannelMessagePin(thread.ID, m.ID)
+	err = c.Discord.ChannelMessagePin(thread.ID, m.ID)
 
 	if err != nil {
-		logger.Error("Error pinning message", zap.Error(err), zap.String("issue", issue), zap.String("topicId", topicId))
+		c.Logger.Error("Error pinning message", zap.Error(err), zap.String("issue", issue), zap.String("topicId", topicId))
 		return fmt.Errorf("failed to pin start message: %w", err)
 	}
 
 	// Send a message to the user
-	s.InteractionResponseEdit(i, &discordgo.WebhookEdit{
+	c.Discord.InteractionResponseEdit(i, &discordgo.WebhookEdit{
 		Content: utils.Stringp("Your ticket has been created! You can view it here: (https://discord.com/channels/" + i.GuildID + "/" + thread.ID + ")"),
 	})
 
@@ -0,0 +1,173 @@
+package modal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"ibl-tickets/blobs"
+	"ibl-tickets/customid"
+	"ibl-tickets/fakediscord"
+	"ibl-tickets/handlers"
+	"ibl-tickets/keys"
+	"ibl-tickets/tickets"
+	"ibl-tickets/types"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"go.uber.org/zap"
+)
+
+const (
+	testThreadChannel = "2000000000000000001"
+	testOpener        = "3000000000000000001"
+	testRole          = "6000000000000000001"
+)
+
+// A handler context against fakediscord and a MemoryStore
+func newTestContext(t *testing.T) (*handlers.Context, *fakediscord.Server, *tickets.MemoryStore) {
+	key := make([]byte, 32)
+
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+
+	keyring, err := keys.Load(&types.Secrets{MasterKeyID: "k1", MasterKey: base64.StdEncoding.EncodeToString(key)})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	discord := fakediscord.New()
+	t.Cleanup(discord.Close)
+
+	discord.AddChannel(&discordgo.Channel{ID: testThreadChannel, Type: discordgo.ChannelTypeGuildText})
+
+	store := tickets.NewMemoryStore()
+
+	return &handlers.Context{
+		Ctx:     context.Background(),
+		Discord: discord.Session(),
+		Config: &types.Config{
+			Topics: map[string]types.Topic{
+				"support": {Name: "Support", Questions: []types.Question{{Question: "Bot ID?"}}, Ping: []string{testRole}},
+			},
+			Channels: types.ConfigChannels{ThreadChannel: testThreadChannel},
+		},
+		Keyring: keyring,
+		Tickets: store,
+		Logger:  zap.NewNop(),
+	}, discord, store
+}
+
+func submit(t *testing.T, c *handlers.Context, token string) error {
+	i := &discordgo.Interaction{
+		ID:      "4000000000000000001",
+		AppID:   fakediscord.BotID,
+		GuildID: "5000000000000000001",
+		Token:   token,
+		Member:  &discordgo.Member{User: &discordgo.User{ID: testOpener, Username: "opener"}},
+	}
+
+	data := discordgo.ModalSubmitInteractionData{
+		Components: []discordgo.MessageComponent{
+			&discordgo.ActionsRow{Components: []discordgo.MessageComponent{&discordgo.TextInput{CustomID: "issue", Value: "Can't log in"}}},
+			&discordgo.ActionsRow{Components: []discordgo.MessageComponent{&discordgo.TextInput{CustomID: "0", Value: "1234"}}},
+		},
+	}
+
+	return tikModal(c, i, data, customid.Args{"topicId": "support"})
+}
+
+// The ID fakediscord gives the ticket thread, the next one after the response to the interaction
+const testThread = "1000000000000000003"
+
+// Checks that one private thread was started under the thread channel
+func checkThreadStarted(t *testing.T, discord *fakediscord.Server) {
+	calls := discord.CallsTo(http.MethodPost, "/channels/"+testThreadChannel+"/threads")
+
+	if len(calls) != 1 || calls[0].Status != http.StatusCreated {
+		t.Fatalf("started %d threads, want 1", len(calls))
+	}
+
+	var start discordgo.ThreadStart
+
+	if err := json.Unmarshal(calls[0].Body, &start); err != nil {
+		t.Fatal(err)
+	}
+
+	if start.Type != discordgo.ChannelTypeGuildPrivateThread || start.Name != "Can't log in" {
+		t.Fatalf("thread started with %s", calls[0].Body)
+	}
+}
+
+func TestTicketModal(t *testing.T) {
+	c, discord, store := newTestContext(t)
+
+	if err := submit(t, c, "modal-1"); err != nil {
+		t.Fatalf("tikModal: %v", err)
+	}
+
+	checkThreadStarted(t, discord)
+	threadId := testThread
+
+	if members := discord.Members(threadId); len(members) != 1 || members[0] != testOpener {
+		t.Fatalf("thread members = %v, want the opener", members)
+	}
+
+	tik, err := store.ForChannel(c.Ctx, threadId)
+
+	if err != nil || tik.UserID != testOpener || tik.TopicID != "support" || tik.Issue != "Can't log in" || tik.TicketContext != nil {
+		t.Fatalf("stored ticket = %+v, %v", tik, err)
+	}
+
+	dataKey, err := c.Keyring.TicketKey(tik.EncKey, tik.EncKeyID)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var answers map[string]string
+
+	if err := blobs.DecryptJSON(dataKey, tik.EncTicketContext, nil, &answers); err != nil || answers["Bot ID?"] != "1234" {
+		t.Fatalf("ticket context = %v, %v", answers, err)
+	}
+
+	sent := discord.Messages(threadId)
+
+	if len(sent) != 1 || !sent[0].Pinned || !strings.Contains(sent[0].Content, "<@&"+testRole+">") {
+		t.Fatalf("thread messages = %+v, want the pinned ticket message pinging the topic's roles", sent)
+	}
+
+	closeId, _ := handlers.CloseID.Build(tik.ID)
+
+	if row, ok := sent[0].Components[0].(*discordgo.ActionsRow); !ok || row.Components[0].(*discordgo.Button).CustomID != closeId {
+		t.Fatalf("ticket message components = %+v, want the close button", sent[0].Components)
+	}
+
+	if reply := discord.Original("modal-1"); reply == nil || !strings.Contains(reply.Content, "/"+threadId+")") {
+		t.Fatalf("reply = %+v, want a link to the thread", reply)
+	}
+}
+
+func TestTicketModalAddMemberFails(t *testing.T) {
+	c, discord, store := newTestContext(t)
+
+	discord.FailNext(http.MethodPut, "/channels/"+testThread+"/thread-members/"+testOpener, http.StatusForbidden, discordgo.ErrCodeMissingAccess)
+
+	if err := submit(t, c, "modal-1"); err == nil {
+		t.Fatal("tikModal succeeded although the opener couldn't be added")
+	}
+
+	checkThreadStarted(t, discord)
+
+	if discord.Channel(testThread) != nil {
+		t.Fatal("thread was not deleted")
+	}
+
+	if _, err := store.ForChannel(c.Ctx, testThread); err == nil {
+		t.Fatal("ticket was not deleted")
+	}
+}
@@ -0,0 +1,301 @@
+package msgcomponent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"ibl-tickets/blobs"
+	"ibl-tickets/customid"
+	"ibl-tickets/fakediscord"
+	"ibl-tickets/handlers"
+	"ibl-tickets/keys"
+	"ibl-tickets/locks"
+	"ibl-tickets/signing"
+	"ibl-tickets/storage"
+	"ibl-tickets/tickets"
+	"ibl-tickets/types"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/bwmarrin/discordgo"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+const (
+	testMenuChannel = "2000000000000000001"
+	testLogChannel  = "2000000000000000002"
+	testThread      = "2000000000000000003"
+	testOpener      = "3000000000000000001"
+	testStaff       = "3000000000000000002"
+)
+
+func randomKey(t *testing.T) string {
+	key := make([]byte, 32)
+
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// A handler context against fakediscord, a MemoryStore, a scratch directory and miniredis
+func newTestContext(t *testing.T) (*handlers.Context, *fakediscord.Server) {
+	secrets := &types.Secrets{
+		MasterKeyID:          "k1",
+		MasterKey:            randomKey(t),
+		TranscriptSigningKey: randomKey(t),
+		BlobHashSecret:       "hash secret",
+		LinkSecret:           "link secret",
+	}
+
+	keyring, err := keys.Load(secrets)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := signing.Load(secrets)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	discord := fakediscord.New()
+	t.Cleanup(discord.Close)
+
+	discord.AddChannel(&discordgo.Channel{ID: testMenuChannel, Type: discordgo.ChannelTypeGuildText})
+	discord.AddChannel(&discordgo.Channel{ID: testLogChannel, Type: discordgo.ChannelTypeGuildText})
+
+	rd := miniredis.RunT(t)
+	rediscli := redis.NewClient(&redis.Options{Addr: rd.Addr()})
+	t.Cleanup(func() { rediscli.Close() })
+
+	config := &types.Config{
+		Topics: map[string]types.Topic{
+			"support": {Name: "Support", Questions: []types.Question{{Question: "Bot ID?", Required: true}}},
+		},
+		Channels: types.ConfigChannels{LogChannel: testLogChannel},
+	}
+
+	config.Database.ExposedPath = "https://tickets.example/"
+
+	return &handlers.Context{
+		Ctx:     context.Background(),
+		Discord: discord.Session(),
+		Config:  config,
+		Secrets: secrets,
+		Keyring: keyring,
+		Signer:  signer,
+		Store:   &storage.FileStore{Root: t.TempDir()},
+		Tickets: tickets.NewMemoryStore(),
+		Redis:   rediscli,
+		Logger:  zap.NewNop(),
+	}, discord
+}
+
+// An interaction from user in channelId, with its own token
+func interaction(channelId string, userId string, token string) *discordgo.Interaction {
+	return &discordgo.Interaction{
+		ID:        "4000000000000000001",
+		AppID:     fakediscord.BotID,
+		GuildID:   "5000000000000000001",
+		ChannelID: channelId,
+		Token:     token,
+		Member:    &discordgo.Member{User: &discordgo.User{ID: userId, Username: "user"}},
+	}
+}
+
+func TestTicketMenu(t *testing.T) {
+	c, discord := newTestContext(t)
+
+	menu := discord.AddMessage(testMenuChannel, &discordgo.Message{
+		Author: &discordgo.User{ID: fakediscord.BotID},
+		Embeds: []*discordgo.MessageEmbed{{Title: "Open a ticket"}},
+	})
+
+	i := interaction(testMenuChannel, testOpener, "menu-1")
+	i.Message = menu
+
+	data := discordgo.MessageComponentInteractionData{Values: []string{"support"}}
+
+	if err := tikm(c, i, data, nil); err != nil {
+		t.Fatalf("tikm: %v", err)
+	}
+
+	if calls := discord.CallsTo(http.MethodPatch, "/channels/"+testMenuChannel+"/messages/"+menu.ID); len(calls) != 1 {
+		t.Fatalf("select menu was reset %d times, want once", len(calls))
+	}
+
+	calls := discord.CallsTo(http.MethodPost, "/interactions/"+i.ID+"/menu-1/callback")
+
+	if len(calls) != 1 {
+		t.Fatalf("interaction was answered %d times", len(calls))
+	}
+
+	var resp struct {
+		Type discordgo.InteractionResponseType `json:"type"`
+		Data struct {
+			CustomID string `json:"custom_id"`
+			Title    string `json:"title"`
+		} `json:"data"`
+	}
+
+	if err := json.Unmarshal(calls[0].Body, &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	modalId, _ := handlers.TicketModalID.Build("support")
+
+	if resp.Type != discordgo.InteractionResponseModal || resp.Data.CustomID != modalId || resp.Data.Title != "Support" {
+		t.Fatalf("interaction response = %s, want the support modal", calls[0].Body)
+	}
+
+	if !strings.Contains(string(calls[0].Body), "Bot ID?") {
+		t.Fatalf("modal %s doesn't ask the topic's questions", calls[0].Body)
+	}
+
+	// Picking again straight away is refused
+	again := interaction(testMenuChannel, testOpener, "menu-2")
+	again.Message = menu
+
+	if err := tikm(c, again, data, nil); err != nil {
+		t.Fatalf("tikm on cooldown: %v", err)
+	}
+
+	if reply := discord.Original("menu-2"); reply == nil || !strings.Contains(reply.Content, "cooldown") || reply.Flags&discordgo.MessageFlagsEphemeral == 0 {
+		t.Fatalf("reply on cooldown = %+v", reply)
+	}
+}
+
+// Stores an open ticket in testThread, with a message in the thread
+func openTicket(t *testing.T, c *handlers.Context, discord *fakediscord.Server, tikId string) {
+	discord.AddChannel(&discordgo.Channel{ID: testThread, Type: discordgo.ChannelTypeGuildPrivateThread})
+	discord.AddMessage(testThread, &discordgo.Message{Author: &discordgo.User{ID: testOpener}, Content: "hello"})
+
+	_, wrapped, keyId, err := c.Keyring.NewDataKey()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Tickets.Create(c.Ctx, &tickets.Ticket{ID: tikId, UserID: testOpener, ChannelID: testThread, TopicID: "support", Issue: "help", EncKey: wrapped, EncKeyID: keyId})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func pressClose(t *testing.T, c *handlers.Context, tikId string, token string) *discordgo.Interaction {
+	i := interaction(testThread, testStaff, token)
+
+	if err := close(c, i, discordgo.MessageComponentInteractionData{}, customid.Args{"ticketId": tikId}); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	return i
+}
+
+func TestClose(t *testing.T) {
+	c, discord := newTestContext(t)
+	openTicket(t, c, discord, "t1")
+
+	pressClose(t, c, "t1", "close-1")
+
+	if reply := discord.Original("close-1"); reply == nil || !strings.Contains(reply.Content, "has been closed") {
+		t.Fatalf("reply = %+v, want the ticket closed", reply)
+	}
+
+	tik, _ := c.Tickets.Get(c.Ctx, "t1")
+
+	if tik.Open || tik.CloseUserID != testStaff {
+		t.Fatalf("ticket after closing = %+v", tik)
+	}
+
+	dataKey, _ := c.Keyring.TicketKey(tik.EncKey, tik.EncKeyID)
+
+	var messages []types.Message
+
+	if err := blobs.DecryptJSON(dataKey, tik.EncMessages, nil, &messages); err != nil || len(messages) != 1 || messages[0].Content != "hello" {
+		t.Fatalf("transcript = %+v, %v", messages, err)
+	}
+
+	if sent := discord.Messages(testLogChannel); len(sent) != 1 {
+		t.Fatalf("log channel has %d messages, want the transcript", len(sent))
+	}
+
+	if dm := discord.DM(testOpener); dm == "" || len(discord.Messages(dm)) != 1 {
+		t.Fatal("transcript was not sent to the opener")
+	}
+
+	if thread := discord.Channel(testThread); !thread.ThreadMetadata.Locked || !thread.ThreadMetadata.Archived {
+		t.Fatalf("thread was not locked and archived: %+v", thread.ThreadMetadata)
+	}
+
+	// Pressing close on a finished close
+	pressClose(t, c, "t1", "close-2")
+
+	if reply := discord.Original("close-2"); reply == nil || !strings.Contains(reply.Content, "already closed") {
+		t.Fatalf("reply = %+v, want the ticket already closed", reply)
+	}
+}
+
+func TestCloseResumesClosedTicket(t *testing.T) {
+	c, discord := newTestContext(t)
+	openTicket(t, c, discord, "t1")
+
+	// The transcript is stored, which marks the ticket closed, but can't be sent
+	discord.FailNext(http.MethodPost, "/channels/"+testLogChannel+"/messages", http.StatusInternalServerError, 0)
+
+	pressClose(t, c, "t1", "close-1")
+
+	if reply := discord.Original("close-1"); reply == nil || reply.Content != closeStepErrors["notify"] {
+		t.Fatalf("reply = %+v, want the notify step error", reply)
+	}
+
+	if tik, _ := c.Tickets.Get(c.Ctx, "t1"); tik.Open {
+		t.Fatal("ticket is still open after its transcript was stored")
+	}
+
+	// Pressing close again finishes the close rather than saying the ticket is closed
+	pressClose(t, c, "t1", "close-2")
+
+	if reply := discord.Original("close-2"); reply == nil || !strings.Contains(reply.Content, "has been closed") {
+		t.Fatalf("reply = %+v, want the ticket closed", reply)
+	}
+
+	if j, _ := c.Tickets.CloseJob(c.Ctx, "t1"); j.Step != tickets.StepDone {
+		t.Fatalf("close job is at %s after resuming", j.Step)
+	}
+
+	if thread := discord.Channel(testThread); !thread.ThreadMetadata.Archived {
+		t.Fatal("thread was not archived")
+	}
+}
+
+func TestCloseWhileLocked(t *testing.T) {
+	c, discord := newTestContext(t)
+	openTicket(t, c, discord, "t1")
+
+	lock, err := locks.Acquire(c.Ctx, c.Redis, "t1", testOpener, locks.DefaultTTL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer lock.Release(c.Ctx)
+
+	pressClose(t, c, "t1", "close-1")
+
+	if reply := discord.Original("close-1"); reply == nil || !strings.Contains(reply.Content, "already being closed by <@"+testOpener+">") {
+		t.Fatalf("reply = %+v, want the lock holder named", reply)
+	}
+
+	if _, err := c.Tickets.CloseJob(c.Ctx, "t1"); err == nil {
+		t.Fatal("a close job was started while the ticket was locked")
+	}
+}
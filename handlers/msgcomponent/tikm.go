@@ -1,21 +1,19 @@
 package msgcomponent
 
 import (
-	"context"
 	"fmt"
-	"ibl-tickets/types"
+	"ibl-tickets/customid"
+	"ibl-tickets/handlers"
 	"strconv"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
-	"github.com/jackc/pgx/v5/pgxpool"
-	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
 )
 
-func tikm(s *discordgo.Session, i *discordgo.Interaction, data discordgo.MessageComponentInteractionData, config *types.Config, pool *pgxpool.Pool, ctx context.Context, logger *zap.Logger, rediscli *redis.Client) error {
+func tikm(c *handlers.Context, i *discordgo.Interaction, data discordgo.MessageComponentInteractionData, args customid.Args) error {
 	// Edit existing message to reset the select menu
-	_, err := s.ChannelMessageEditComplex(&discordgo.MessageEdit{
+	_, err := c.Discord.ChannelMessageEditComplex(&discordgo.MessageEdit{
 		Embeds:     &i.Message.Embeds,
 		Components: &i.Message.Components,
 		ID:         i.Message.ID,
@@ -23,38 +21,44 @@ func tikm(s *discordgo.Session, i *discordgo.Interaction, data discordgo.Message
 	})
 
 	if err != nil {
-		logger.Error("Error resetting select menu", zap.Error(err), zap.String("channelId", i.Message.ChannelID), zap.String("userId", i.Member.User.ID), zap.String("customId", data.CustomID))
+		c.Logger.Error("Error resetting select menu", zap.Error(err))
 	}
 
 	topicId := data.Values[0]
-	logger.Info("Creating ticket", zap.String("topicId", topicId), zap.String("userId", i.Member.User.ID))
+	c.Logger.Info("Creating ticket", zap.String("topicId", topicId))
 
 	// Create new ticket under ticket channel via private threads
-	topic, ok := config.Topics[topicId]
+	topic, ok := c.Config.Topics[topicId]
 
 	if !ok {
-		logger.Error("Invalid topic ID", zap.String("topicId", topicId), zap.String("userId", i.Member.User.ID))
+		c.Logger.Error("Invalid topic ID", zap.String("topicId", topicId))
 		return fmt.Errorf("topic not found")
 	}
 
+	modalId, err := handlers.TicketModalID.Build(topicId)
+
+	if err != nil {
+		return err
+	}
+
 	// Check cooldown from redis
 	cooldownKey := "ticket_cooldown:" + i.Member.User.ID
 
-	cooldown := rediscli.TTL(ctx, cooldownKey).Val()
+	cooldown := c.Redis.TTL(c.Ctx, cooldownKey).Val()
 
 	if cooldown == -2 || cooldown == -1 {
 		// Set cooldown
-		err = rediscli.Set(ctx, cooldownKey, "0", 10*time.Second).Err()
+		err = c.Redis.Set(c.Ctx, cooldownKey, "0", 10*time.Second).Err()
 
 		if err != nil {
-			logger.Error("Error setting cooldown", zap.Error(err), zap.String("userId", i.Member.User.ID))
+			c.Logger.Error("Error setting cooldown", zap.Error(err))
 			return fmt.Errorf("error setting cooldown: %w", err)
 		}
 	} else {
 		// Cooldown exists
-		logger.Info("User is on cooldown", zap.String("userId", i.Member.User.ID), zap.Duration("cooldown", cooldown))
+		c.Logger.Info("User is on cooldown", zap.Duration("cooldown", cooldown))
 
-		s.InteractionRespond(i, &discordgo.InteractionResponse{
+		c.Discord.InteractionRespond(i, &discordgo.InteractionResponse{
 			Type: discordgo.InteractionResponseChannelMessageWithSource,
 			Data: &discordgo.InteractionResponseData{
 				Content: "You are on cooldown. Please wait ``" + cooldown.String() + "`` before creating another ticket.",
@@ -99,17 +103,17 @@ func tikm(s *discordgo.Session, i *discordgo.Interaction, data discordgo.Message
 		}
 	}
 
-	err = s.InteractionRespond(i, &discordgo.InteractionResponse{
+	err = c.Discord.InteractionRespond(i, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseModal,
 		Data: &discordgo.InteractionResponseData{
-			CustomID:   "tikmodal:" + topicId,
+			CustomID:   modalId,
 			Title:      topic.Name,
 			Components: modalqas,
 		},
 	})
 
 	if err != nil {
-		logger.Error("Error sending message", zap.Error(err), zap.String("userId", i.Member.User.ID))
+		c.Logger.Error("Error sending message", zap.Error(err))
 		return fmt.Errorf("error sending message: %w", err)
 	}
 
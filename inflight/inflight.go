@@ -0,0 +1,101 @@
+package inflight
+
+import (
+	"sync"
+	"time"
+)
+
+// Keeps track of running operations (interaction handlers, close jobs etc.) so shutdown can wait for them
+type Tracker struct {
+	mu       sync.Mutex
+	draining chan struct{}
+	closed   bool
+	next     int
+	running  map[int]string
+	wg       sync.WaitGroup
+}
+
+func New() *Tracker {
+	return &Tracker{
+		draining: make(chan struct{}),
+		running:  map[int]string{},
+	}
+}
+
+// Records that an operation named name has started, returning a function to call once it has finished. Returns false
+// (and no function) once the tracker is draining, in which case the operation shouldn't be started
+//
+// A nil tracker tracks nothing and never drains
+func (t *Tracker) Start(name string) (func(), bool) {
+	if t == nil {
+		return func() {}, true
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil, false
+	}
+
+	id := t.next
+	t.next++
+	t.running[id] = name
+	t.wg.Add(1)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mu.Lock()
+			delete(t.running, id)
+			t.mu.Unlock()
+
+			t.wg.Done()
+		})
+	}, true
+}
+
+// Closed once the tracker starts draining
+func (t *Tracker) Draining() <-chan struct{} {
+	if t == nil {
+		return nil
+	}
+
+	return t.draining
+}
+
+// Stops new operations from starting and waits up to timeout for running ones to finish, returning the names of
+// those still running
+func (t *Tracker) Drain(timeout time.Duration) []string {
+	t.mu.Lock()
+
+	if !t.closed {
+		t.closed = true
+		close(t.draining)
+	}
+
+	t.mu.Unlock()
+
+	done := make(chan struct{})
+
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var abandoned []string
+	for _, name := range t.running {
+		abandoned = append(abandoned, name)
+	}
+
+	return abandoned
+}
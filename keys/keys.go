@@ -0,0 +1,143 @@
+package keys
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"ibl-tickets/blobs"
+	"ibl-tickets/types"
+	"os"
+	"strings"
+)
+
+// Holds the master keys that wrap per-ticket data keys
+//
+// Only wrapped data keys and the ID of the master key that wrapped them are ever stored in the database
+type Keyring struct {
+	CurrentID string            // ID of the master key new data keys are wrapped with
+	keys      map[string][]byte // Master keys by ID
+}
+
+// Decodes a base64 encoded AES-256 master key
+func decodeKey(id string, encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+
+	if err != nil {
+		return nil, fmt.Errorf("master key %s is not valid base64: %w", id, err)
+	}
+
+	if len(key) != 32 {
+		return nil, fmt.Errorf("master key %s must be 32 bytes, got %d", id, len(key))
+	}
+
+	return key, nil
+}
+
+// Loads the master key from secrets.yaml (or from master_key_file if set) along with any previous master keys
+func Load(secrets *types.Secrets) (*Keyring, error) {
+	if secrets.MasterKeyID == "" {
+		return nil, errors.New("master_key_id must be set in secrets.yaml")
+	}
+
+	encoded := secrets.MasterKey
+
+	if secrets.MasterKeyFile != "" {
+		bytes, err := os.ReadFile(secrets.MasterKeyFile)
+
+		if err != nil {
+			return nil, fmt.Errorf("error reading master key file: %w", err)
+		}
+
+		encoded = string(bytes)
+	}
+
+	key, err := decodeKey(secrets.MasterKeyID, encoded)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var k = &Keyring{
+		CurrentID: secrets.MasterKeyID,
+		keys:      map[string][]byte{secrets.MasterKeyID: key},
+	}
+
+	for id, encoded := range secrets.PreviousMasterKeys {
+		if id == secrets.MasterKeyID {
+			return nil, fmt.Errorf("master key %s is both the current and a previous master key", id)
+		}
+
+		key, err := decodeKey(id, encoded)
+
+		if err != nil {
+			return nil, err
+		}
+
+		k.keys[id] = key
+	}
+
+	return k, nil
+}
+
+// Wraps a data key with the current master key, returning the wrapped key and the ID of the master key used
+func (k *Keyring) Wrap(dataKey []byte) (string, string, error) {
+	wrapped, err := blobs.Encrypt(k.keys[k.CurrentID], dataKey)
+
+	if err != nil {
+		return "", "", fmt.Errorf("error wrapping data key: %w", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(wrapped), k.CurrentID, nil
+}
+
+// Unwraps a data key wrapped with the master key keyId
+func (k *Keyring) Unwrap(wrapped string, keyId string) ([]byte, error) {
+	masterKey, ok := k.keys[keyId]
+
+	if !ok {
+		return nil, fmt.Errorf("unknown master key: %s", keyId)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(wrapped)
+
+	if err != nil {
+		return nil, fmt.Errorf("wrapped data key is not valid base64: %w", err)
+	}
+
+	dataKey, err := blobs.Decrypt(masterKey, data)
+
+	if err != nil {
+		return nil, fmt.Errorf("error unwrapping data key: %w", err)
+	}
+
+	return dataKey, nil
+}
+
+// Creates a new random data key, returning it along with its wrapped form and the ID of the master key used
+func (k *Keyring) NewDataKey() ([]byte, string, string, error) {
+	dataKey := make([]byte, 32)
+
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, "", "", fmt.Errorf("error generating data key: %w", err)
+	}
+
+	wrapped, keyId, err := k.Wrap(dataKey)
+
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	return dataKey, wrapped, keyId, nil
+}
+
+// Returns the data key of a ticket from its enc_key and enc_key_id columns
+//
+// Tickets closed before envelope encryption have no key ID and store the key material in plaintext
+func (k *Keyring) TicketKey(encKey string, keyId string) ([]byte, error) {
+	if keyId == "" {
+		return blobs.LegacyTicketKey(encKey), nil
+	}
+
+	return k.Unwrap(encKey, keyId)
+}
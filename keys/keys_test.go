@@ -0,0 +1,185 @@
+package keys
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"ibl-tickets/blobs"
+	"ibl-tickets/types"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func masterKey(t *testing.T) string {
+	key := make([]byte, 32)
+
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func testKeyring(t *testing.T, secrets *types.Secrets) *Keyring {
+	k, err := Load(secrets)
+
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	return k
+}
+
+func TestRoundTrip(t *testing.T) {
+	k := testKeyring(t, &types.Secrets{MasterKeyID: "k1", MasterKey: masterKey(t)})
+
+	dataKey, wrapped, keyId, err := k.NewDataKey()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keyId != "k1" {
+		t.Fatalf("wrapped with %s, want k1", keyId)
+	}
+
+	if len(dataKey) != 32 {
+		t.Fatalf("data key is %d bytes, want 32", len(dataKey))
+	}
+
+	if bytes.Contains([]byte(wrapped), []byte(base64.StdEncoding.EncodeToString(dataKey))) {
+		t.Fatal("wrapped key contains the data key")
+	}
+
+	got, err := k.TicketKey(wrapped, keyId)
+
+	if err != nil {
+		t.Fatalf("TicketKey: %v", err)
+	}
+
+	if !bytes.Equal(got, dataKey) {
+		t.Fatal("unwrapped key differs from the data key")
+	}
+}
+
+func TestRotation(t *testing.T) {
+	oldKey := masterKey(t)
+	old := testKeyring(t, &types.Secrets{MasterKeyID: "k1", MasterKey: oldKey})
+
+	dataKey, wrapped, keyId, err := old.NewDataKey()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := testKeyring(t, &types.Secrets{
+		MasterKeyID:        "k2",
+		MasterKey:          masterKey(t),
+		PreviousMasterKeys: map[string]string{"k1": oldKey},
+	})
+
+	got, err := rotated.Unwrap(wrapped, keyId)
+
+	if err != nil || !bytes.Equal(got, dataKey) {
+		t.Fatalf("unwrapping with a previous master key: %v", err)
+	}
+
+	rewrapped, newId, err := rotated.Wrap(got)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if newId != "k2" {
+		t.Fatalf("rewrapped with %s, want k2", newId)
+	}
+
+	got, err = rotated.Unwrap(rewrapped, newId)
+
+	if err != nil || !bytes.Equal(got, dataKey) {
+		t.Fatalf("unwrapping rewrapped key: %v", err)
+	}
+}
+
+func TestTampered(t *testing.T) {
+	k := testKeyring(t, &types.Secrets{MasterKeyID: "k1", MasterKey: masterKey(t)})
+	other := testKeyring(t, &types.Secrets{MasterKeyID: "k1", MasterKey: masterKey(t)})
+
+	_, wrapped, _, err := k.NewDataKey()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, _ := base64.StdEncoding.DecodeString(wrapped)
+	raw[len(raw)-1] ^= 1
+	flipped := base64.StdEncoding.EncodeToString(raw)
+
+	tests := map[string]struct {
+		k       *Keyring
+		wrapped string
+		keyId   string
+	}{
+		"flipped bit":      {k: k, wrapped: flipped, keyId: "k1"},
+		"truncated":        {k: k, wrapped: base64.StdEncoding.EncodeToString(raw[:len(raw)-4]), keyId: "k1"},
+		"too short":        {k: k, wrapped: base64.StdEncoding.EncodeToString(raw[:4]), keyId: "k1"},
+		"not base64":       {k: k, wrapped: "not base64!", keyId: "k1"},
+		"unknown key ID":   {k: k, wrapped: wrapped, keyId: "k2"},
+		"wrong master key": {k: other, wrapped: wrapped, keyId: "k1"},
+		"retired and gone": {k: testKeyring(t, &types.Secrets{MasterKeyID: "k2", MasterKey: masterKey(t)}), wrapped: wrapped, keyId: "k1"},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := tt.k.Unwrap(tt.wrapped, tt.keyId); err == nil {
+				t.Fatal("unwrapped without an error")
+			}
+		})
+	}
+}
+
+func TestLegacyTicketKey(t *testing.T) {
+	k := testKeyring(t, &types.Secrets{MasterKeyID: "k1", MasterKey: masterKey(t)})
+
+	got, err := k.TicketKey("legacy", "")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, blobs.LegacyTicketKey("legacy")) {
+		t.Fatal("keyless tickets should use the legacy key derivation")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	valid := masterKey(t)
+
+	file := filepath.Join(t.TempDir(), "master.key")
+
+	if err := os.WriteFile(file, []byte(valid+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Load(&types.Secrets{MasterKeyID: "k1", MasterKeyFile: file}); err != nil {
+		t.Errorf("loading from a file: %v", err)
+	}
+
+	invalid := map[string]*types.Secrets{
+		"missing ID":          {MasterKey: valid},
+		"not base64":          {MasterKeyID: "k1", MasterKey: "not base64!"},
+		"short key":           {MasterKeyID: "k1", MasterKey: base64.StdEncoding.EncodeToString(make([]byte, 16))},
+		"missing file":        {MasterKeyID: "k1", MasterKeyFile: filepath.Join(t.TempDir(), "missing")},
+		"current is previous": {MasterKeyID: "k1", MasterKey: valid, PreviousMasterKeys: map[string]string{"k1": valid}},
+		"bad previous key":    {MasterKeyID: "k1", MasterKey: valid, PreviousMasterKeys: map[string]string{"k0": "short"}},
+	}
+
+	for name, secrets := range invalid {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Load(secrets); err == nil {
+				t.Fatal("loaded without an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package links
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"ibl-tickets/types"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Who a transcript link was issued to
+const (
+	AudienceUser  = "user"  // The user who opened the ticket
+	AudienceStaff = "staff" // Staff, e.g. the link posted to the log channel
+)
+
+var (
+	ErrInvalidLink = errors.New("this link is invalid")
+	ErrExpiredLink = errors.New("this link has expired, please ask our support team for a new one")
+)
+
+func signature(secret string, tikId string, audience string, expiry string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(tikId + "\n" + audience + "\n" + expiry))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns the query parameters of a signed link to a ticket
+func Sign(secret string, tikId string, audience string, expiry time.Time) url.Values {
+	exp := strconv.FormatInt(expiry.Unix(), 10)
+
+	return url.Values{
+		"aud": {audience},
+		"exp": {exp},
+		"sig": {signature(secret, tikId, audience, exp)},
+	}
+}
+
+// Returns a signed link to a tickets transcript, valid for the configured time for the audience
+func URL(config *types.Config, secrets *types.Secrets, tikId string, audience string) string {
+	expiry := config.Web.UserLinkExpiry
+
+	if audience == AudienceStaff {
+		expiry = config.Web.StaffLinkExpiry
+	}
+
+	return config.Database.ExposedPath + tikId + "?" + Sign(secrets.LinkSecret, tikId, audience, time.Now().Add(expiry)).Encode()
+}
+
+// Verifies the query parameters of a link to a ticket, returning the audience it was issued to
+func Verify(secret string, tikId string, query url.Values) (string, error) {
+	audience := query.Get("aud")
+	exp := query.Get("exp")
+	sig := query.Get("sig")
+
+	if audience != AudienceUser && audience != AudienceStaff {
+		return "", ErrInvalidLink
+	}
+
+	if !hmac.Equal([]byte(sig), []byte(signature(secret, tikId, audience, exp))) {
+		return "", ErrInvalidLink
+	}
+
+	expiry, err := strconv.ParseInt(exp, 10, 64)
+
+	if err != nil {
+		return "", ErrInvalidLink
+	}
+
+	if time.Now().After(time.Unix(expiry, 0)) {
+		return "", ErrExpiredLink
+	}
+
+	return audience, nil
+}
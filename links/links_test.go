@@ -0,0 +1,118 @@
+package links
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const secret = "test-link-secret"
+
+func TestRoundTrip(t *testing.T) {
+	for _, audience := range []string{AudienceUser, AudienceStaff} {
+		query := Sign(secret, "ticket1", audience, time.Now().Add(time.Hour))
+
+		// Links go through a URL, so check what comes back out of one
+		parsed, err := url.ParseQuery(query.Encode())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := Verify(secret, "ticket1", parsed)
+
+		if err != nil {
+			t.Fatalf("Verify %s link: %v", audience, err)
+		}
+
+		if got != audience {
+			t.Fatalf("Verify = %s, want %s", got, audience)
+		}
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	valid := func() url.Values {
+		return Sign(secret, "ticket1", AudienceUser, time.Now().Add(time.Hour))
+	}
+
+	with := func(key string, value string) url.Values {
+		q := valid()
+		q.Set(key, value)
+		return q
+	}
+
+	tests := map[string]struct {
+		secret string
+		tikId  string
+		query  url.Values
+		err    error
+	}{
+		"expired": {
+			secret: secret,
+			tikId:  "ticket1",
+			query:  Sign(secret, "ticket1", AudienceUser, time.Now().Add(-time.Minute)),
+			err:    ErrExpiredLink,
+		},
+		"wrong audience": {
+			secret: secret,
+			tikId:  "ticket1",
+			query:  with("aud", AudienceStaff),
+			err:    ErrInvalidLink,
+		},
+		"unknown audience": {
+			secret: secret,
+			tikId:  "ticket1",
+			query:  with("aud", "admin"),
+			err:    ErrInvalidLink,
+		},
+		"extended expiry": {
+			secret: secret,
+			tikId:  "ticket1",
+			query:  with("exp", strconv.FormatInt(time.Now().Add(24*time.Hour).Unix(), 10)),
+			err:    ErrInvalidLink,
+		},
+		"other ticket": {
+			secret: secret,
+			tikId:  "ticket2",
+			query:  valid(),
+			err:    ErrInvalidLink,
+		},
+		"wrong secret": {
+			secret: "other-secret",
+			tikId:  "ticket1",
+			query:  valid(),
+			err:    ErrInvalidLink,
+		},
+		"modified signature": {
+			secret: secret,
+			tikId:  "ticket1",
+			query:  with("sig", valid().Get("sig")[1:]+"0"),
+			err:    ErrInvalidLink,
+		},
+		"missing signature": {
+			secret: secret,
+			tikId:  "ticket1",
+			query:  url.Values{"aud": {AudienceUser}, "exp": {valid().Get("exp")}},
+			err:    ErrInvalidLink,
+		},
+		"empty": {
+			secret: secret,
+			tikId:  "ticket1",
+			query:  url.Values{},
+			err:    ErrInvalidLink,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := Verify(tt.secret, tt.tikId, tt.query)
+
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Verify error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package locks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// How long a lock is held without being refreshed, so a crashed process can't keep a ticket locked for long
+const DefaultTTL = 30 * time.Second
+
+// Returned by Refresh and Release if the lock expired and may have been taken by someone else
+var ErrLost = errors.New("lock was lost")
+
+// Returned by Acquire if the ticket is locked by someone else
+type HeldError struct {
+	Holder string // ID of the user the lock was taken for
+}
+
+func (e *HeldError) Error() string {
+	return "ticket is locked by " + e.Holder
+}
+
+// Deletes the lock only if we still hold it
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// Extends the lock only if we still hold it
+var refreshScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// A lock on a ticket held in Redis
+//
+// Every lock taken on a ticket gets a larger fencing token than the one before it. Writes made while holding the lock
+// should be conditional on the token (see closejob), so a holder whose lock expired while it was stalled can't
+// overwrite the work of the next one
+type Lock struct {
+	TicketID string
+	Token    int64
+	Holder   string
+
+	client *redis.Client
+	value  string
+	ttl    time.Duration
+}
+
+func key(tikId string) string {
+	return "ticket_lock:" + tikId
+}
+
+func fenceKey(tikId string) string {
+	return "ticket_lock_fence:" + tikId
+}
+
+// Locks a ticket for holder (a user ID) for ttl, returning a *HeldError naming the current holder if it is taken
+func Acquire(ctx context.Context, client *redis.Client, tikId string, holder string, ttl time.Duration) (*Lock, error) {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+
+	token, err := client.Incr(ctx, fenceKey(tikId)).Result()
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting fencing token: %w", err)
+	}
+
+	var l = &Lock{
+		TicketID: tikId,
+		Token:    token,
+		Holder:   holder,
+		client:   client,
+		value:    strconv.FormatInt(token, 10) + ":" + holder,
+		ttl:      ttl,
+	}
+
+	ok, err := client.SetNX(ctx, key(tikId), l.value, ttl).Result()
+
+	if err != nil {
+		return nil, fmt.Errorf("error acquiring lock: %w", err)
+	}
+
+	if !ok {
+		current, err := client.Get(ctx, key(tikId)).Result()
+
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return nil, fmt.Errorf("error getting lock holder: %w", err)
+		}
+
+		// The lock may have expired since, but losing a race is reported the same way
+		_, currentHolder, _ := strings.Cut(current, ":")
+		return nil, &HeldError{Holder: currentHolder}
+	}
+
+	return l, nil
+}
+
+// Extends the lock by its ttl
+func (l *Lock) Refresh(ctx context.Context) error {
+	n, err := refreshScript.Run(ctx, l.client, []string{key(l.TicketID)}, l.value, l.ttl.Milliseconds()).Int()
+
+	if err != nil {
+		return fmt.Errorf("error refreshing lock: %w", err)
+	}
+
+	if n == 0 {
+		return ErrLost
+	}
+
+	return nil
+}
+
+// Releases the lock if it is still held
+func (l *Lock) Release(ctx context.Context) error {
+	n, err := releaseScript.Run(ctx, l.client, []string{key(l.TicketID)}, l.value).Int()
+
+	if err != nil {
+		return fmt.Errorf("error releasing lock: %w", err)
+	}
+
+	if n == 0 {
+		return ErrLost
+	}
+
+	return nil
+}
+
+// Refreshes the lock in the background until the returned function is called. onLost is called (once) if the lock
+// can't be refreshed
+func (l *Lock) KeepAlive(ctx context.Context, onLost func(err error)) func() {
+	ctx, cancel := context.WithCancel(ctx)
+
+	go func() {
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			err := l.Refresh(ctx)
+
+			if err != nil && ctx.Err() == nil {
+				onLost(err)
+				return
+			}
+		}
+	}()
+
+	return cancel
+}
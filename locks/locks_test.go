@@ -0,0 +1,190 @@
+package locks
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	rd := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: rd.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return rd, client
+}
+
+func TestAcquire(t *testing.T) {
+	ctx := context.Background()
+	rd, client := newTestRedis(t)
+
+	first, err := Acquire(ctx, client, "t1", "u1", time.Minute)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.TicketID != "t1" || first.Holder != "u1" || first.Token < 1 {
+		t.Fatalf("lock = %+v", first)
+	}
+
+	if ttl := rd.TTL(key("t1")); ttl != time.Minute {
+		t.Fatalf("lock TTL = %v, want %v", ttl, time.Minute)
+	}
+
+	_, err = Acquire(ctx, client, "t1", "u2", time.Minute)
+
+	var held *HeldError
+	if !errors.As(err, &held) || held.Holder != "u1" || err.Error() != "ticket is locked by u1" {
+		t.Fatalf("second Acquire error = %v, want held by u1", err)
+	}
+
+	// Other tickets are locked separately
+	if _, err := Acquire(ctx, client, "t2", "u2", 0); err != nil {
+		t.Fatalf("locking another ticket: %v", err)
+	}
+
+	if ttl := rd.TTL(key("t2")); ttl != DefaultTTL {
+		t.Fatalf("lock TTL without one = %v, want %v", ttl, DefaultTTL)
+	}
+
+	if err := first.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every lock gets a larger token than the ones before it, including attempts that found it held
+	second, err := Acquire(ctx, client, "t1", "u2", time.Minute)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if second.Token <= first.Token+1 {
+		t.Fatalf("token after a failed and a successful Acquire = %d, want more than %d", second.Token, first.Token+1)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	ctx := context.Background()
+	rd, client := newTestRedis(t)
+
+	stale, err := Acquire(ctx, client, "t1", "u1", time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The lock expires while its holder is stalled, and someone else takes it
+	rd.FastForward(time.Second)
+
+	current, err := Acquire(ctx, client, "t1", "u1", time.Minute)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Releasing the stale lock, even for the same user, must not free the newer one
+	if err := stale.Release(ctx); !errors.Is(err, ErrLost) {
+		t.Fatalf("releasing stale lock: error = %v, want %v", err, ErrLost)
+	}
+
+	_, err = Acquire(ctx, client, "t1", "u2", time.Minute)
+
+	var held *HeldError
+	if !errors.As(err, &held) {
+		t.Fatalf("Acquire after a stale release = %v, want the lock still held", err)
+	}
+
+	if err := current.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if rd.Exists(key("t1")) {
+		t.Fatal("lock still exists after being released")
+	}
+
+	if err := current.Release(ctx); !errors.Is(err, ErrLost) {
+		t.Fatalf("releasing twice: error = %v, want %v", err, ErrLost)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	ctx := context.Background()
+	rd, client := newTestRedis(t)
+
+	lock, err := Acquire(ctx, client, "t1", "u1", 10*time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rd.FastForward(8 * time.Second)
+
+	if err := lock.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if ttl := rd.TTL(key("t1")); ttl != 10*time.Second {
+		t.Fatalf("TTL after refresh = %v, want %v", ttl, 10*time.Second)
+	}
+
+	// Once the lock expired and was taken by someone else, it can't be extended
+	rd.FastForward(10 * time.Second)
+
+	newer, err := Acquire(ctx, client, "t1", "u2", 10*time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rd.FastForward(5 * time.Second)
+
+	if err := lock.Refresh(ctx); !errors.Is(err, ErrLost) {
+		t.Fatalf("refreshing lost lock: error = %v, want %v", err, ErrLost)
+	}
+
+	if ttl := rd.TTL(key("t1")); ttl != 5*time.Second {
+		t.Fatalf("refreshing the lost lock changed the newer one's TTL to %v", ttl)
+	}
+
+	if err := newer.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	ctx := context.Background()
+	rd, client := newTestRedis(t)
+
+	lock, err := Acquire(ctx, client, "t1", "u1", 30*time.Millisecond)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lost := make(chan error, 1)
+	stop := lock.KeepAlive(ctx, func(err error) {
+		lost <- err
+	})
+
+	defer stop()
+
+	// Taking the lock from under it is noticed on the next refresh
+	rd.Set(key("t1"), "999:u2")
+
+	select {
+	case err := <-lost:
+		if !errors.Is(err, ErrLost) {
+			t.Fatalf("onLost error = %v, want %v", err, ErrLost)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("KeepAlive didn't notice the lock was lost")
+	}
+
+	if v, _ := rd.Get(key("t1")); v != "999:u2" {
+		t.Fatalf("lock = %q, KeepAlive overwrote the new holder", v)
+	}
+}
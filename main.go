@@ -3,13 +3,26 @@ package main
 import (
 	"context"
 	_ "embed"
-	"ibl-tickets/handlers/modal"
-	"ibl-tickets/handlers/msgcomponent"
+	"ibl-tickets/cli"
+	"ibl-tickets/closejob"
+	"ibl-tickets/dispatch"
+	"ibl-tickets/handlers/events"
+	"ibl-tickets/inflight"
+	"ibl-tickets/keys"
+	"ibl-tickets/migrations"
+	"ibl-tickets/reconcile"
+	"ibl-tickets/replay"
+	"ibl-tickets/signing"
+	"ibl-tickets/storage"
+	"ibl-tickets/tickets"
 	"ibl-tickets/types"
-	"ibl-tickets/utils"
+	"ibl-tickets/web"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/infinitybotlist/eureka/proxy"
@@ -25,6 +38,14 @@ var (
 
 	secrets *types.Secrets
 
+	keyring *keys.Keyring
+
+	signer *signing.Keys
+
+	store storage.Store
+
+	tikStore tickets.Store
+
 	discord *discordgo.Session
 
 	owners Owners
@@ -33,11 +54,18 @@ var (
 
 	rediscli *redis.Client
 
-	ctx = context.Background()
+	// Cancelled once shutdown gives up waiting on running handlers
+	ctx, cancelCtx = context.WithCancel(context.Background())
+
+	// Running handlers and background jobs, drained on shutdown
+	tracker = inflight.New()
 
 	logger *zap.Logger
 )
 
+// Used when shutdown_timeout is not set
+const defaultShutdownTimeout = 60 * time.Second
+
 type Owners struct {
 	Owners []*discordgo.TeamMember
 }
@@ -97,12 +125,67 @@ func main() {
 
 	f.Close()
 
+	if secrets.LinkSecret == "" || secrets.SessionSecret == "" || secrets.BlobHashSecret == "" {
+		panic("link_secret, session_secret and blob_hash_secret must be set in secrets.yaml")
+	}
+
+	keyring, err = keys.Load(secrets)
+
+	if err != nil {
+		panic(err)
+	}
+
+	signer, err = signing.Load(secrets)
+
+	if err != nil {
+		panic(err)
+	}
+
+	store, err = storage.New(config, secrets)
+
+	if err != nil {
+		panic(err)
+	}
+
 	pool, err = pgxpool.New(ctx, config.Database.Postgres)
 
 	if err != nil {
 		panic(err)
 	}
 
+	tikStore = tickets.NewPostgresStore(pool)
+
+	// Run a CLI subcommand instead of the bot if one was given
+	if len(os.Args) > 1 {
+		err = cli.Run(&cli.Context{
+			Config:  config,
+			Secrets: secrets,
+			Keyring: keyring,
+			Signer:  signer,
+			Store:   store,
+			Tickets: tikStore,
+			Pool:    pool,
+			Ctx:     ctx,
+			Logger:  logger,
+		}, os.Args[1:])
+
+		pool.Close()
+
+		if err != nil {
+			logger.Error("Error running command", zap.Error(err), zap.String("command", os.Args[1]))
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	// Refuse to run against a schema the code doesn't match
+	err = migrations.Check(ctx, pool)
+
+	if err != nil {
+		panic(err)
+	}
+
 	rOptions, err := redis.ParseURL(config.Database.Redis)
 
 	if err != nil {
@@ -143,146 +226,210 @@ func main() {
 		logger.Info("Bot is ready", zap.String("username", i.User.Username+"#"+i.User.Discriminator), zap.String("userId", i.User.ID))
 	})
 
-	discord.AddHandler(func(s *discordgo.Session, m *discordgo.MessageCreate) {
-		// Check that the message starts with mentioning the bot
-		var mentioned bool
-		for _, user := range m.Mentions {
-			if user.ID == discord.State.User.ID {
-				mentioned = true
-				break
-			}
-		}
+	dispatcher := &dispatch.Dispatcher{
+		Config:  config,
+		Secrets: secrets,
+		Keyring: keyring,
+		Signer:  signer,
+		Store:   store,
+		Tickets: tikStore,
+		Ctx:     ctx,
+		Logger:  logger,
+		Redis:   rediscli,
+		Tracker: tracker,
+		IsOwner: owners.IsOwner,
+	}
 
-		if mentioned {
-			m.Content = strings.TrimSpace(strings.TrimPrefix(m.Content, "<@"+discord.State.User.ID+">"))
-			m.Content = strings.TrimSpace(strings.TrimPrefix(m.Content, "<@!"+discord.State.User.ID+">"))
+	// Interactions and commands can be recorded to reproduce incidents with the replay command
+	var recorder *replay.Recorder
 
-			if !owners.IsOwner(m.Author.ID) {
-				_, err := s.ChannelMessageSend(m.ChannelID, "You are not allowed to use this bot.")
+	if config.RecordEvents != "" {
+		recorder, err = replay.NewRecorder(config.RecordEvents)
 
-				if err != nil {
-					logger.Error("Error sending message", zap.Error(err))
-					return
-				}
+		if err != nil {
+			panic(err)
+		}
+
+		logger.Warn("Recording interactions and messages", zap.String("file", config.RecordEvents))
+
+		discord.AddHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			if err := recorder.Interaction(s, i); err != nil {
+				logger.Error("Error recording interaction", zap.Error(err))
 			}
+		})
 
-			switch m.Content {
-			case "msg":
-				// Delete all messages in the channel
-				messages, err := s.ChannelMessages(m.ChannelID, 100, "", "", "")
-
-				if err != nil {
-					panic(err)
-				}
-
-				for _, message := range messages {
-					err = s.ChannelMessageDelete(m.ChannelID, message.ID)
-
-					if err != nil {
-						panic(err)
-					}
-				}
-
-				// Send the ticket message
-				var smo []discordgo.SelectMenuOption
-
-				for key, topic := range config.Topics {
-					smo = append(smo, discordgo.SelectMenuOption{
-						Label:       topic.Name,
-						Value:       key,
-						Description: topic.Description,
-						Emoji: &discordgo.ComponentEmoji{
-							Name: topic.Emoji,
-						},
-					})
-				}
-
-				_, err = s.ChannelMessageSendComplex(m.ChannelID, &discordgo.MessageSend{
-					Embeds: []*discordgo.MessageEmbed{
-						{
-							Title:       "How can we help?",
-							Type:        discordgo.EmbedTypeRich,
-							Description: "Please select a topic below to create a ticket. If you don't see a topic that fits your issue, please create a ticket with the `General Support` topic.",
-						},
-					},
-					Components: []discordgo.MessageComponent{
-						discordgo.ActionsRow{
-							Components: []discordgo.MessageComponent{
-								&discordgo.SelectMenu{
-									CustomID:    "tikm",
-									Placeholder: "How can we help you",
-									Options:     smo,
-								},
-							},
-						},
-					},
-				})
-
-				if err != nil {
-					_, merr := s.ChannelMessageSend(m.ChannelID, "An error occurred while sending the message:"+err.Error())
-
-					if err != nil {
-						logger.Error("Error sending message", zap.Error(err), zap.NamedError("merr", merr), zap.String("channelId", m.ChannelID), zap.String("userId", m.Author.ID))
-					}
-				}
+		discord.AddHandler(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+			if err := recorder.Message(s, m); err != nil {
+				logger.Error("Error recording message", zap.Error(err))
 			}
+		})
+	}
+
+	discord.AddHandler(dispatcher.Command)
+
+	// Record ticket thread traffic as it happens so the transcript includes edits and deleted messages. Events that
+	// arrive during shutdown are dropped, as closing a ticket backfills any messages that are missing from the log
+	discord.AddHandler(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+		if done, ok := tracker.Start("message log"); ok {
+			defer done()
+			events.MessageCreate(s, m, config, tikStore, keyring, ctx, logger)
 		}
 	})
 
-	discord.AddHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) {
-		switch i.Type {
-		case discordgo.InteractionMessageComponent:
-			data := i.MessageComponentData()
+	discord.AddHandler(func(s *discordgo.Session, m *discordgo.MessageUpdate) {
+		if done, ok := tracker.Start("message log"); ok {
+			defer done()
+			events.MessageUpdate(s, m, config, tikStore, keyring, ctx, logger)
+		}
+	})
 
-			fn, ok := msgcomponent.Handlers[strings.Split(data.CustomID, ":")[0]]
+	discord.AddHandler(func(s *discordgo.Session, m *discordgo.MessageDelete) {
+		if done, ok := tracker.Start("message log"); ok {
+			defer done()
+			events.MessageDelete(s, m, config, tikStore, keyring, ctx, logger)
+		}
+	})
 
-			if !ok {
-				logger.Error("Invalid component handler", zap.String("customId", data.CustomID), zap.String("userId", i.Member.User.ID))
-				s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
-					Content: utils.Stringp("An error occurred while handling this component. Please contact our support team about this!"),
-				})
-				return
-			}
+	discord.AddHandler(func(s *discordgo.Session, m *discordgo.MessageDeleteBulk) {
+		if done, ok := tracker.Start("message log"); ok {
+			defer done()
+			events.MessageDeleteBulk(s, m, config, tikStore, keyring, ctx, logger)
+		}
+	})
 
-			err = fn(s, i.Interaction, data, config, pool, ctx, logger, rediscli)
+	discord.AddHandler(dispatcher.Interaction)
 
-			if err != nil {
-				logger.Error("Error handling component", zap.Error(err), zap.String("customId", data.CustomID), zap.String("userId", i.Member.User.ID))
-				s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
-					Content: utils.Stringp("An error occurred while handling this component. Please contact our support team about this:" + err.Error()),
-				})
-				return
-			}
-		case discordgo.InteractionModalSubmit:
-			data := i.ModalSubmitData()
+	err = discord.Open()
 
-			fn, ok := modal.Handlers[strings.Split(data.CustomID, ":")[0]]
+	if err != nil {
+		panic(err)
+	}
 
-			if !ok {
-				logger.Error("Invalid modal handler", zap.String("customId", data.CustomID), zap.String("userId", i.Member.User.ID))
-				s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
-					Content: utils.Stringp("An error occurred while handling this modal. Please contact our support team about this!"),
-				})
-				return
-			}
+	// Finish closing any tickets whose close was interrupted by a restart or failed part way
+	closer := &closejob.Runner{
+		Discord: discord,
+		Config:  config,
+		Secrets: secrets,
+		Keyring: keyring,
+		Signer:  signer,
+		Store:   store,
+		Tickets: tikStore,
+		Redis:   rediscli,
+		Logger:  logger,
+		Tracker: tracker,
+	}
 
-			err = fn(s, i.Interaction, data, config, pool, ctx, logger, rediscli)
+	go closer.Worker(ctx)
+
+	// Keep open tickets in line with their threads if staff delete, lock or archive them by hand
+	sweeper := &reconcile.Sweeper{
+		Discord: discord,
+		BotID:   discord.State.User.ID,
+		Config:  config,
+		Tickets: tikStore,
+		Redis:   rediscli,
+		Logger:  logger,
+		Closer:  closer,
+		Tracker: tracker,
+	}
 
-			if err != nil {
-				logger.Error("Error handling modal", zap.Error(err), zap.String("customId", data.CustomID), zap.String("userId", i.Member.User.ID))
-				s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
-					Content: utils.Stringp("An error occurred while handling this modal. Please contact our support team about this:" + err.Error()),
-				})
-				return
-			}
+	// Thread events missed during shutdown are caught by the sweep on the next start
+	discord.AddHandler(func(s *discordgo.Session, e *discordgo.ThreadDelete) {
+		if done, ok := tracker.Start("thread delete " + e.ID); ok {
+			defer done()
+			sweeper.ThreadDelete(ctx, e)
 		}
 	})
 
-	err = discord.Open()
+	discord.AddHandler(func(s *discordgo.Session, e *discordgo.ThreadUpdate) {
+		if done, ok := tracker.Start("thread update " + e.ID); ok {
+			defer done()
+			sweeper.ThreadUpdate(ctx, e)
+		}
+	})
+
+	go sweeper.Worker(ctx)
+
+	srv := &web.Server{
+		Config:  config,
+		Secrets: secrets,
+		Keyring: keyring,
+		Signer:  signer,
+		Store:   store,
+		Tickets: tikStore,
+		Logger:  logger,
+		Discord: discord,
+		IsOwner: owners.IsOwner,
+	}
+
+	go func() {
+		err := srv.ListenAndServe()
+
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+
+	logger.Info("Shutting down", zap.String("signal", (<-sig).String()))
+
+	timeout := config.ShutdownTimeout
+
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), timeout)
+	defer cancelShutdown()
+
+	// Transcript requests finish alongside the handlers below
+	webDone := make(chan struct{})
+
+	go func() {
+		defer close(webDone)
+
+		err := srv.Shutdown(shutdownCtx)
+
+		if err != nil {
+			logger.Error("Error shutting down transcript server", zap.Error(err))
+		}
+	}()
+
+	// New interactions get told to try again while running ones finish
+	abandoned := tracker.Drain(timeout)
+
+	for _, name := range abandoned {
+		logger.Warn("Abandoned operation on shutdown", zap.String("operation", name))
+	}
+
+	if len(abandoned) > 0 {
+		logger.Warn("Shutdown timed out, interrupted ticket closes will be resumed after the next start", zap.Int("abandoned", len(abandoned)))
+	}
+
+	// Interrupt whatever is still running so it lets go of its connections
+	cancelCtx()
+	<-webDone
+
+	err = discord.Close()
 
 	if err != nil {
-		panic(err)
+		logger.Error("Error closing Discord session", zap.Error(err))
+	}
+
+	if recorder != nil {
+		recorder.Close()
 	}
 
-	select {}
+	err = rediscli.Close()
+
+	if err != nil {
+		logger.Error("Error closing Redis client", zap.Error(err))
+	}
+
+	pool.Close()
+
+	logger.Info("Shut down")
+	logger.Sync()
 }
@@ -0,0 +1,495 @@
+package migrations
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Migrations are sql/{version}_{name}.up.sql files, each with a matching .down.sql that undoes it. Versions are
+// applied in order and recorded in schema_migrations
+//
+// Down migrations that delete data start with a "-- destructive: {what is lost}" line and are only reverted when
+// forced. A down migration with nothing but comments is recorded as reverted without changing anything
+//
+//go:embed sql/*.sql
+var files embed.FS
+
+// Serializes migrations run from several processes at once
+const advisoryLock = 0x69626c74
+
+const destructiveMarker = "-- destructive:"
+
+var (
+	// Returned by Check if the database is missing migrations or columns, or has migrations this build doesn't know about
+	ErrOutdated = errors.New("database schema does not match this build")
+
+	// Returned by Down if a migration it would revert deletes data and force isn't set
+	ErrDestructive = errors.New("reverting this migration deletes data")
+)
+
+type Migration struct {
+	Version     int
+	Name        string
+	Up          string
+	Down        string
+	Destructive string // What reverting the migration deletes, empty if nothing
+}
+
+// Reports whether the down migration only has comments, so there is nothing to run
+func (m Migration) noopDown() bool {
+	for _, line := range strings.Split(m.Down, "\n") {
+		line = strings.TrimSpace(line)
+
+		if line != "" && !strings.HasPrefix(line, "--") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// A migration and whether (and when) it has been applied
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Returns every embedded migration, oldest first
+func Load() ([]Migration, error) {
+	entries, err := fs.Glob(files, "sql/*.up.sql")
+
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	for _, entry := range entries {
+		base := strings.TrimSuffix(strings.TrimPrefix(entry, "sql/"), ".up.sql")
+		versionStr, name, ok := strings.Cut(base, "_")
+
+		if !ok {
+			return nil, fmt.Errorf("migration %s is not named {version}_{name}.up.sql", entry)
+		}
+
+		version, err := strconv.Atoi(versionStr)
+
+		if err != nil {
+			return nil, fmt.Errorf("migration %s has an invalid version: %w", entry, err)
+		}
+
+		up, err := files.ReadFile(entry)
+
+		if err != nil {
+			return nil, err
+		}
+
+		down, err := files.ReadFile("sql/" + base + ".down.sql")
+
+		if err != nil {
+			return nil, fmt.Errorf("migration %s has no down migration: %w", entry, err)
+		}
+
+		var m = Migration{Version: version, Name: name, Up: string(up), Down: string(down)}
+
+		if first, _, _ := strings.Cut(m.Down, "\n"); strings.HasPrefix(first, destructiveMarker) {
+			m.Destructive = strings.TrimSpace(strings.TrimPrefix(first, destructiveMarker))
+		}
+
+		migrations = append(migrations, m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("more than one migration has version %d", migrations[i].Version)
+		}
+	}
+
+	return migrations, nil
+}
+
+// Returns the version of the newest embedded migration
+func Latest() (int, error) {
+	migrations, err := Load()
+
+	if err != nil {
+		return 0, err
+	}
+
+	if len(migrations) == 0 {
+		return 0, nil
+	}
+
+	return migrations[len(migrations)-1].Version, nil
+}
+
+func ensureTable(ctx context.Context, tx pgx.Tx) error {
+	_, err := tx.Exec(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, name TEXT NOT NULL, applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW())")
+
+	if err != nil {
+		return fmt.Errorf("error creating schema_migrations: %w", err)
+	}
+
+	return nil
+}
+
+// Returns when each applied migration was applied, by version
+func applied(ctx context.Context, q interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}) (map[int]time.Time, error) {
+	rows, err := q.Query(ctx, "SELECT version, applied_at FROM schema_migrations")
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting applied migrations: %w", err)
+	}
+
+	defer rows.Close()
+
+	var versions = map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+
+		err = rows.Scan(&version, &appliedAt)
+
+		if err != nil {
+			return nil, fmt.Errorf("error scanning applied migration: %w", err)
+		}
+
+		versions[version] = appliedAt
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("error reading applied migrations: %w", rows.Err())
+	}
+
+	return versions, nil
+}
+
+// Runs fn in a transaction holding the migration lock
+func locked(ctx context.Context, pool *pgxpool.Pool, fn func(tx pgx.Tx) error) error {
+	tx, err := pool.Begin(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", advisoryLock)
+
+	if err != nil {
+		return fmt.Errorf("error taking migration lock: %w", err)
+	}
+
+	err = ensureTable(ctx, tx)
+
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Applies every migration that hasn't been applied yet, each in its own transaction, returning those applied
+func Up(ctx context.Context, pool *pgxpool.Pool) ([]Migration, error) {
+	migrations, err := Load()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for _, m := range migrations {
+		var ran bool
+
+		err = locked(ctx, pool, func(tx pgx.Tx) error {
+			versions, err := applied(ctx, tx)
+
+			if err != nil {
+				return err
+			}
+
+			if _, ok := versions[m.Version]; ok {
+				return nil
+			}
+
+			_, err = tx.Exec(ctx, m.Up)
+
+			if err != nil {
+				return fmt.Errorf("error applying migration %d_%s: %w", m.Version, m.Name, err)
+			}
+
+			_, err = tx.Exec(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.Version, m.Name)
+
+			if err != nil {
+				return fmt.Errorf("error recording migration %d_%s: %w", m.Version, m.Name, err)
+			}
+
+			ran = true
+			return nil
+		})
+
+		if err != nil {
+			return done, err
+		}
+
+		if ran {
+			done = append(done, m)
+		}
+	}
+
+	return done, nil
+}
+
+// Reverts the newest n applied migrations, each in its own transaction, returning those reverted
+//
+// Unless force is set, nothing is reverted if any of them is destructive, returning an error wrapping ErrDestructive
+func Down(ctx context.Context, pool *pgxpool.Pool, n int, force bool) ([]Migration, error) {
+	migrations, err := Load()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !force {
+		versions, err := applied(ctx, pool)
+
+		if err != nil {
+			return nil, err
+		}
+
+		var count int
+		for i := len(migrations) - 1; i >= 0 && count < n; i-- {
+			m := migrations[i]
+
+			if _, ok := versions[m.Version]; !ok {
+				continue
+			}
+
+			count++
+
+			if m.Destructive != "" {
+				return nil, fmt.Errorf("%w: %04d_%s %s, pass --force to revert it anyway", ErrDestructive, m.Version, m.Name, m.Destructive)
+			}
+		}
+	}
+
+	var done []Migration
+	for i := len(migrations) - 1; i >= 0 && len(done) < n; i-- {
+		m := migrations[i]
+		var ran bool
+
+		err = locked(ctx, pool, func(tx pgx.Tx) error {
+			versions, err := applied(ctx, tx)
+
+			if err != nil {
+				return err
+			}
+
+			if _, ok := versions[m.Version]; !ok {
+				return nil
+			}
+
+			if !m.noopDown() {
+				_, err = tx.Exec(ctx, m.Down)
+
+				if err != nil {
+					return fmt.Errorf("error reverting migration %d_%s: %w", m.Version, m.Name, err)
+				}
+			}
+
+			_, err = tx.Exec(ctx, "DELETE FROM schema_migrations WHERE version = $1", m.Version)
+
+			if err != nil {
+				return fmt.Errorf("error recording migration %d_%s: %w", m.Version, m.Name, err)
+			}
+
+			ran = true
+			return nil
+		})
+
+		if err != nil {
+			return done, err
+		}
+
+		if ran {
+			done = append(done, m)
+		}
+	}
+
+	return done, nil
+}
+
+// Returns every embedded migration along with whether it has been applied, and the versions of any applied migrations
+// this build doesn't know about
+func Statuses(ctx context.Context, pool *pgxpool.Pool) ([]Status, []int, error) {
+	migrations, err := Load()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var exists bool
+	err = pool.QueryRow(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("error checking for schema_migrations: %w", err)
+	}
+
+	var versions = map[int]time.Time{}
+
+	if exists {
+		versions, err = applied(ctx, pool)
+
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var statuses []Status
+	for _, m := range migrations {
+		var s = Status{Migration: m}
+
+		if appliedAt, ok := versions[m.Version]; ok {
+			s.AppliedAt = &appliedAt
+			delete(versions, m.Version)
+		}
+
+		statuses = append(statuses, s)
+	}
+
+	var unknown []int
+	for version := range versions {
+		unknown = append(unknown, version)
+	}
+
+	sort.Ints(unknown)
+
+	return statuses, unknown, nil
+}
+
+// Columns every table must have once all migrations have been applied. Migrations adopt tables created before they
+// existed as they are, so having applied them doesn't guarantee the columns exist. Keep this in step with the migrations
+var columns = map[string][]string{
+	"tickets": {
+		"id", "user_id", "channel_id", "topic_id", "issue", "open", "close_user_id", "ticket_context", "messages",
+		"enc_key", "created_at", "enc_key_id", "enc_ticket_context", "enc_messages",
+	},
+	"ticket_messages": {
+		"id", "ticket_id", "message_id", "event", "author_id", "content", "embeds", "attachments", "enc_data", "created_at",
+	},
+	"ticket_access_log": {
+		"id", "ticket_id", "viewer_id", "ip", "user_agent", "attachment_id", "granted", "accessed_at",
+	},
+	"attachment_blobs": {
+		"hash", "size", "enc_key", "enc_key_id", "created_at", "deleting",
+	},
+	"attachment_refs": {
+		"ticket_id", "attachment_id", "hash",
+	},
+	"close_jobs": {
+		"ticket_id", "step", "close_user_id", "snapshot", "log_message_id", "dm_message_id", "attempts", "fence",
+		"last_error", "created_at", "updated_at",
+	},
+	"close_job_attachments": {
+		"ticket_id", "attachment_id", "message_id", "data",
+	},
+}
+
+// Returns the columns in columns that are missing from the database, as table.column
+func missingColumns(ctx context.Context, pool *pgxpool.Pool) ([]string, error) {
+	rows, err := pool.Query(ctx, "SELECT table_name, column_name FROM information_schema.columns WHERE table_schema = current_schema()")
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting columns: %w", err)
+	}
+
+	defer rows.Close()
+
+	var existing = map[string]bool{}
+	for rows.Next() {
+		var table, column string
+
+		err = rows.Scan(&table, &column)
+
+		if err != nil {
+			return nil, fmt.Errorf("error scanning column: %w", err)
+		}
+
+		existing[table+"."+column] = true
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("error reading columns: %w", rows.Err())
+	}
+
+	var missing []string
+	for table, cols := range columns {
+		for _, column := range cols {
+			if !existing[table+"."+column] {
+				missing = append(missing, table+"."+column)
+			}
+		}
+	}
+
+	sort.Strings(missing)
+
+	return missing, nil
+}
+
+// Returns ErrOutdated (wrapped with what doesn't match) unless every embedded migration has been applied and no others,
+// and every table has the columns the migrations create
+func Check(ctx context.Context, pool *pgxpool.Pool) error {
+	statuses, unknown, err := Statuses(ctx, pool)
+
+	if err != nil {
+		return err
+	}
+
+	var pending []string
+	for _, s := range statuses {
+		if s.AppliedAt == nil {
+			pending = append(pending, strconv.Itoa(s.Version)+"_"+s.Name)
+		}
+	}
+
+	if len(pending) > 0 {
+		return fmt.Errorf("%w: migrations %s have not been applied, run migrate up", ErrOutdated, strings.Join(pending, ", "))
+	}
+
+	if len(unknown) > 0 {
+		return fmt.Errorf("%w: the database has migrations newer than this build (%v)", ErrOutdated, unknown)
+	}
+
+	missing, err := missingColumns(ctx, pool)
+
+	if err != nil {
+		return err
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: columns %s are missing, tables adopted from before migrations need them added by hand", ErrOutdated, strings.Join(missing, ", "))
+	}
+
+	return nil
+}
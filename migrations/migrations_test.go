@@ -0,0 +1,83 @@
+package migrations
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestDestructiveDowns(t *testing.T) {
+	migrations, err := Load()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	drops := regexp.MustCompile(`(?i)\bDROP\s+(TABLE|COLUMN)\b`)
+
+	for _, m := range migrations {
+		if drops.MatchString(m.Down) && m.Destructive == "" {
+			t.Errorf("%04d_%s drops data when reverted but isn't marked destructive", m.Version, m.Name)
+		}
+
+		if m.Version == 1 && !m.noopDown() {
+			t.Errorf("reverting 0001_%s must leave tickets in place", m.Name)
+		}
+	}
+}
+
+var (
+	createTable = regexp.MustCompile(`(?is)CREATE TABLE IF NOT EXISTS (\w+) \((.*?)\n\);`)
+	addColumn   = regexp.MustCompile(`(?i)ALTER TABLE (\w+)|ADD COLUMN IF NOT EXISTS (\w+)`)
+)
+
+// Every column the up migrations create must be checked by Check, so adopted tables missing one are caught
+func TestColumnsMatchMigrations(t *testing.T) {
+	migrations, err := Load()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var created = map[string][]string{}
+	for _, m := range migrations {
+		for _, match := range createTable.FindAllStringSubmatch(m.Up, -1) {
+			for _, line := range strings.Split(match[2], "\n") {
+				column := strings.Fields(strings.TrimSpace(line))
+
+				if len(column) == 0 || strings.ToUpper(column[0]) == "PRIMARY" || strings.ToUpper(column[0]) == "UNIQUE" {
+					continue
+				}
+
+				created[match[1]] = append(created[match[1]], column[0])
+			}
+		}
+
+		var table string
+		for _, match := range addColumn.FindAllStringSubmatch(m.Up, -1) {
+			if match[1] != "" {
+				table = match[1]
+				continue
+			}
+
+			created[table] = append(created[table], match[2])
+		}
+	}
+
+	for table, want := range created {
+		got := append([]string{}, columns[table]...)
+		sort.Strings(got)
+		sort.Strings(want)
+
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("columns checked for %s = %v, migrations create %v", table, got, want)
+		}
+	}
+
+	for table := range columns {
+		if _, ok := created[table]; !ok {
+			t.Errorf("columns checks %s, which no migration creates", table)
+		}
+	}
+}
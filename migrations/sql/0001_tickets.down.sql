@@ -0,0 +1 @@
+-- tickets predates migrations and holds every ticket ever opened, so reverting this migration leaves it in place
@@ -0,0 +1,16 @@
+-- Tables created before migrations existed are adopted as they are
+CREATE TABLE IF NOT EXISTS tickets (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    channel_id TEXT NOT NULL,
+    topic_id TEXT NOT NULL,
+    issue TEXT NOT NULL,
+    open BOOLEAN NOT NULL DEFAULT TRUE,
+    close_user_id TEXT,
+    ticket_context JSONB,
+    messages JSONB,
+    enc_key TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS tickets_channel_id_idx ON tickets (channel_id);
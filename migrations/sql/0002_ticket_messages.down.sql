@@ -0,0 +1,2 @@
+-- destructive: drops the message log of every open ticket
+DROP TABLE IF EXISTS ticket_messages;
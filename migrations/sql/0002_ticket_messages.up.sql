@@ -0,0 +1,17 @@
+-- Live log of ticket thread messages, deleted once the ticket's transcript has been stored
+CREATE TABLE IF NOT EXISTS ticket_messages (
+    id BIGSERIAL PRIMARY KEY,
+    ticket_id TEXT NOT NULL REFERENCES tickets (id) ON DELETE CASCADE,
+    message_id TEXT NOT NULL,
+    event TEXT NOT NULL,
+    author_id TEXT,
+    content TEXT,
+    embeds JSONB,
+    attachments JSONB,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS ticket_messages_ticket_id_idx ON ticket_messages (ticket_id, id);
+
+-- A message is only logged as created once, however often it is backfilled
+CREATE UNIQUE INDEX IF NOT EXISTS ticket_messages_create_idx ON ticket_messages (message_id) WHERE event = 'create';
@@ -0,0 +1,2 @@
+-- destructive: drops the transcript access audit log
+DROP TABLE IF EXISTS ticket_access_log;
@@ -0,0 +1,13 @@
+-- Kept when a ticket is deleted, as it is an audit log
+CREATE TABLE IF NOT EXISTS ticket_access_log (
+    id BIGSERIAL PRIMARY KEY,
+    ticket_id TEXT NOT NULL,
+    viewer_id TEXT NOT NULL,
+    ip TEXT NOT NULL,
+    user_agent TEXT NOT NULL,
+    attachment_id TEXT,
+    granted BOOLEAN NOT NULL,
+    accessed_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS ticket_access_log_ticket_id_idx ON ticket_access_log (ticket_id, accessed_at DESC);
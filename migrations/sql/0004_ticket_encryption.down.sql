@@ -0,0 +1,5 @@
+-- destructive: drops the encrypted context and messages of every ticket closed since
+ALTER TABLE tickets
+    DROP COLUMN IF EXISTS enc_key_id,
+    DROP COLUMN IF EXISTS enc_ticket_context,
+    DROP COLUMN IF EXISTS enc_messages;
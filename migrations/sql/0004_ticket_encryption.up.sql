@@ -0,0 +1,6 @@
+-- enc_key holds the ticket's data key wrapped with the master key named by enc_key_id. enc_ticket_context and
+-- enc_messages replace the plaintext columns, which are only set for tickets stored before encryption
+ALTER TABLE tickets
+    ADD COLUMN IF NOT EXISTS enc_key_id TEXT,
+    ADD COLUMN IF NOT EXISTS enc_ticket_context BYTEA,
+    ADD COLUMN IF NOT EXISTS enc_messages BYTEA;
@@ -0,0 +1,3 @@
+-- destructive: drops the records of every stored attachment, leaving their blobs unreachable
+DROP TABLE IF EXISTS attachment_refs;
+DROP TABLE IF EXISTS attachment_blobs;
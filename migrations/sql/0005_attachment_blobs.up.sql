@@ -0,0 +1,17 @@
+-- One row per stored blob, keyed by the HMAC of its contents
+CREATE TABLE IF NOT EXISTS attachment_blobs (
+    hash TEXT PRIMARY KEY,
+    size BIGINT NOT NULL,
+    enc_key TEXT NOT NULL,
+    enc_key_id TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS attachment_refs (
+    ticket_id TEXT NOT NULL REFERENCES tickets (id) ON DELETE CASCADE,
+    attachment_id TEXT NOT NULL,
+    hash TEXT NOT NULL REFERENCES attachment_blobs (hash),
+    PRIMARY KEY (ticket_id, attachment_id)
+);
+
+CREATE INDEX IF NOT EXISTS attachment_refs_hash_idx ON attachment_refs (hash);
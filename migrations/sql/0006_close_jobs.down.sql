@@ -0,0 +1,3 @@
+-- destructive: drops the progress of every unfinished close
+DROP TABLE IF EXISTS close_job_attachments;
+DROP TABLE IF EXISTS close_jobs;
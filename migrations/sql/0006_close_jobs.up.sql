@@ -0,0 +1,24 @@
+-- Progress of closing a ticket, see closejob
+CREATE TABLE IF NOT EXISTS close_jobs (
+    ticket_id TEXT PRIMARY KEY REFERENCES tickets (id) ON DELETE CASCADE,
+    step TEXT NOT NULL,
+    close_user_id TEXT NOT NULL,
+    snapshot BYTEA,
+    log_message_id TEXT,
+    dm_message_id TEXT,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    fence BIGINT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS close_jobs_unfinished_idx ON close_jobs (created_at) WHERE step <> 'done';
+
+CREATE TABLE IF NOT EXISTS close_job_attachments (
+    ticket_id TEXT NOT NULL REFERENCES close_jobs (ticket_id) ON DELETE CASCADE,
+    attachment_id TEXT NOT NULL,
+    message_id TEXT NOT NULL,
+    data BYTEA NOT NULL,
+    PRIMARY KEY (ticket_id, attachment_id)
+);
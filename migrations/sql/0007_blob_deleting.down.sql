@@ -0,0 +1,3 @@
+-- destructive: forgets which blobs were being removed, leaving rows whose object may already be gone
+ALTER TABLE attachment_blobs
+    DROP COLUMN IF EXISTS deleting;
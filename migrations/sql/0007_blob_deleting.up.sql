@@ -0,0 +1,5 @@
+-- Set by garbage collection before it removes a blob's object, so a removal that fails part way leaves a marked row
+-- rather than one pointing at a missing object. A close storing the same content takes the row back by uploading it
+-- again
+ALTER TABLE attachment_blobs
+    ADD COLUMN IF NOT EXISTS deleting BOOLEAN NOT NULL DEFAULT FALSE;
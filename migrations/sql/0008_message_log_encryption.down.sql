@@ -0,0 +1,3 @@
+-- destructive: drops the content of every message logged since, so open tickets lose it from their transcripts
+ALTER TABLE ticket_messages
+    DROP COLUMN IF EXISTS enc_data;
@@ -0,0 +1,4 @@
+-- enc_data holds the content, embeds and attachments of a logged message encrypted with the ticket's data key. The
+-- plaintext columns are only set for events logged before the message log was encrypted
+ALTER TABLE ticket_messages
+    ADD COLUMN IF NOT EXISTS enc_data BYTEA;
@@ -0,0 +1,295 @@
+package reconcile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"ibl-tickets/closejob"
+	"ibl-tickets/discordapi"
+	"ibl-tickets/inflight"
+	"ibl-tickets/locks"
+	"ibl-tickets/tickets"
+	"ibl-tickets/types"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// How often every open ticket is checked against its thread by Worker
+const SweepInterval = 30 * time.Minute
+
+// Ways a ticket's thread can drift from its row in tickets
+const (
+	DriftDeleted  = "deleted"  // The thread no longer exists
+	DriftLocked   = "locked"   // The thread was locked, which only staff can do
+	DriftArchived = "archived" // The thread was archived (by hand or through inactivity) but not locked
+)
+
+// Keeps open tickets in line with their threads
+//
+// Open tickets whose thread was deleted or locked are closed (deleted threads from the message log), and open tickets
+// whose thread was archived are unarchived so the ticket can carry on. Every fix is reported to the log channel
+type Sweeper struct {
+	Discord discordapi.Client
+	BotID   string // The user tickets are closed and locked as
+	Config  *types.Config
+	Tickets tickets.Store
+	Redis   *redis.Client
+	Logger  *zap.Logger
+	Closer  *closejob.Runner
+	Tracker *inflight.Tracker // Sweep stops once it drains
+}
+
+// Returns how a thread differs from an open ticket, or an empty string if it doesn't
+func drift(thread *discordgo.Channel) string {
+	if thread == nil {
+		return DriftDeleted
+	}
+
+	if thread.ThreadMetadata == nil {
+		return ""
+	}
+
+	if thread.ThreadMetadata.Locked {
+		return DriftLocked
+	}
+
+	if thread.ThreadMetadata.Archived {
+		return DriftArchived
+	}
+
+	return ""
+}
+
+// Checks every open ticket that isn't being closed against its thread
+func (s *Sweeper) Sweep(ctx context.Context) {
+	open, err := s.Tickets.Unclosed(ctx)
+
+	if err != nil {
+		s.Logger.Error("Error getting open tickets", zap.Error(err))
+		return
+	}
+
+	var drifted int
+	for _, t := range open {
+		thread, err := s.Discord.Channel(t.ChannelID)
+
+		if closejob.ThreadMissing(err) {
+			thread, err = nil, nil
+		}
+
+		if err != nil {
+			s.Logger.Error("Error getting ticket thread", zap.Error(err), zap.String("ticket_id", t.ID), zap.String("channel_id", t.ChannelID))
+			continue
+		}
+
+		if d := drift(thread); d != "" {
+			done, ok := s.Tracker.Start("reconcile " + t.ID)
+
+			if !ok {
+				return
+			}
+
+			drifted++
+			s.fix(ctx, t.ID, t.ChannelID, d)
+			done()
+		}
+	}
+
+	s.Logger.Info("Reconciled open tickets", zap.Int("tickets", len(open)), zap.Int("drifted", drifted))
+}
+
+// Sweeps now and then every SweepInterval until ctx is done or the tracker drains
+func (s *Sweeper) Worker(ctx context.Context) {
+	ticker := time.NewTicker(SweepInterval)
+	defer ticker.Stop()
+
+	for {
+		s.Sweep(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.Tracker.Draining():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Returns the open ticket of a thread that isn't being closed, or an empty string if there is none
+func (s *Sweeper) ticketForThread(ctx context.Context, thread *discordgo.Channel) (string, error) {
+	if thread.ParentID != s.Config.Channels.ThreadChannel {
+		return "", nil
+	}
+
+	t, err := s.Tickets.ForChannel(ctx, thread.ID)
+
+	if errors.Is(err, tickets.ErrNotFound) {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	_, err = s.Tickets.CloseJob(ctx, t.ID)
+
+	if errors.Is(err, tickets.ErrNotFound) {
+		return t.ID, nil
+	}
+
+	// Tickets that are being closed are left to their close job
+	return "", err
+}
+
+// Handles a ticket thread being deleted
+func (s *Sweeper) ThreadDelete(ctx context.Context, e *discordgo.ThreadDelete) {
+	tikId, err := s.ticketForThread(ctx, e.Channel)
+
+	if err != nil {
+		s.Logger.Error("Error finding ticket for thread", zap.Error(err), zap.String("channel_id", e.ID))
+		return
+	}
+
+	if tikId != "" {
+		s.fix(ctx, tikId, e.ID, DriftDeleted)
+	}
+}
+
+// Handles a ticket thread being locked or archived
+func (s *Sweeper) ThreadUpdate(ctx context.Context, e *discordgo.ThreadUpdate) {
+	d := drift(e.Channel)
+
+	if d == "" {
+		return
+	}
+
+	tikId, err := s.ticketForThread(ctx, e.Channel)
+
+	if err != nil {
+		s.Logger.Error("Error finding ticket for thread", zap.Error(err), zap.String("channel_id", e.ID))
+		return
+	}
+
+	if tikId != "" {
+		s.fix(ctx, tikId, e.ID, d)
+	}
+}
+
+// Brings a ticket back in line with its thread and reports what was done
+//
+// Every fix runs under the ticket's lock, so it can't race a close or another fix of the same ticket
+func (s *Sweeper) fix(ctx context.Context, tikId string, channelId string, d string) {
+	s.Logger.Warn("Ticket has drifted from its thread", zap.String("ticket_id", tikId), zap.String("channel_id", channelId), zap.String("drift", d))
+
+	lock, err := locks.Acquire(ctx, s.Redis, tikId, s.BotID, locks.DefaultTTL)
+
+	var held *locks.HeldError
+	if errors.As(err, &held) {
+		// Someone is closing (or fixing) it already
+		return
+	}
+
+	if err != nil {
+		s.Logger.Error("Error locking ticket", zap.Error(err), zap.String("ticket_id", tikId))
+		s.report(tikId, channelId, d, "Fixing it failed: "+err.Error())
+		return
+	}
+
+	defer lock.Release(ctx)
+
+	// The ticket may have started closing between finding the drift and taking the lock
+	_, err = s.Tickets.CloseJob(ctx, tikId)
+
+	if err == nil {
+		return
+	}
+
+	if !errors.Is(err, tickets.ErrNotFound) {
+		s.Logger.Error("Error getting close job", zap.Error(err), zap.String("ticket_id", tikId))
+		s.report(tikId, channelId, d, "Fixing it failed: "+err.Error())
+		return
+	}
+
+	var action string
+
+	switch d {
+	case DriftArchived:
+		action = "The thread was unarchived."
+		err = s.unarchive(channelId)
+	default:
+		action = "The ticket was closed."
+		err = s.close(ctx, lock)
+	}
+
+	if err != nil {
+		s.Logger.Error("Error reconciling ticket", zap.Error(err), zap.String("ticket_id", tikId), zap.String("drift", d))
+		action = "Fixing it failed: " + err.Error()
+	}
+
+	s.report(tikId, channelId, d, action)
+}
+
+func (s *Sweeper) unarchive(channelId string) error {
+	var archived = false
+	_, err := s.Discord.ChannelEdit(channelId, &discordgo.ChannelEdit{
+		Archived: &archived,
+	})
+
+	if err != nil {
+		return fmt.Errorf("error unarchiving thread: %w", err)
+	}
+
+	return nil
+}
+
+// Closes a ticket on behalf of the bot, under the lock fix took
+func (s *Sweeper) close(ctx context.Context, lock *locks.Lock) error {
+	_, err := closejob.Start(ctx, s.Tickets, lock.TicketID, lock.Holder)
+
+	if err != nil {
+		return err
+	}
+
+	return s.Closer.Run(ctx, lock)
+}
+
+// Reports a drifted ticket to the log channel
+func (s *Sweeper) report(tikId string, channelId string, d string, action string) {
+	var what = map[string]string{
+		DriftDeleted:  "The thread of this open ticket was deleted.",
+		DriftLocked:   "The thread of this open ticket was locked.",
+		DriftArchived: "The thread of this open ticket was archived.",
+	}
+
+	_, err := s.Discord.ChannelMessageSendComplex(s.Config.Channels.LogChannel, &discordgo.MessageSend{
+		Embeds: []*discordgo.MessageEmbed{
+			{
+				Title:       "Ticket Drift",
+				Description: what[d] + " " + action,
+				Fields: []*discordgo.MessageEmbedField{
+					{
+						Name:   "Ticket ID",
+						Value:  tikId,
+						Inline: false,
+					},
+					{
+						Name:   "Thread",
+						Value:  "<#" + channelId + ">",
+						Inline: false,
+					},
+				},
+			},
+		},
+		AllowedMentions: &discordgo.MessageAllowedMentions{
+			Parse: []discordgo.AllowedMentionType{},
+		},
+	})
+
+	if err != nil {
+		s.Logger.Error("Error reporting ticket drift", zap.Error(err), zap.String("ticket_id", tikId))
+	}
+}
@@ -0,0 +1,108 @@
+package reconcile
+
+import (
+	"context"
+	"ibl-tickets/fakediscord"
+	"ibl-tickets/locks"
+	"ibl-tickets/tickets"
+	"ibl-tickets/types"
+	"net/http"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/bwmarrin/discordgo"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+const (
+	testThreadChannel = "2000000000000000001"
+	testLogChannel    = "2000000000000000002"
+	testThread        = "2000000000000000003"
+)
+
+// A sweeper against fakediscord, a MemoryStore and miniredis, with one open ticket t1 whose thread is archived
+func newTestSweeper(t *testing.T) (*Sweeper, *fakediscord.Server) {
+	discord := fakediscord.New()
+	t.Cleanup(discord.Close)
+
+	discord.AddChannel(&discordgo.Channel{ID: testLogChannel, Type: discordgo.ChannelTypeGuildText})
+	discord.AddChannel(&discordgo.Channel{
+		ID:             testThread,
+		ParentID:       testThreadChannel,
+		Type:           discordgo.ChannelTypeGuildPrivateThread,
+		ThreadMetadata: &discordgo.ThreadMetadata{Archived: true},
+	})
+
+	rd := miniredis.RunT(t)
+	rediscli := redis.NewClient(&redis.Options{Addr: rd.Addr()})
+	t.Cleanup(func() { rediscli.Close() })
+
+	store := tickets.NewMemoryStore()
+
+	if err := store.Create(context.Background(), &tickets.Ticket{ID: "t1", ChannelID: testThread, TopicID: "support"}); err != nil {
+		t.Fatal(err)
+	}
+
+	return &Sweeper{
+		Discord: discord.Session(),
+		BotID:   fakediscord.BotID,
+		Config:  &types.Config{Channels: types.ConfigChannels{ThreadChannel: testThreadChannel, LogChannel: testLogChannel}},
+		Tickets: store,
+		Redis:   rediscli,
+		Logger:  zap.NewNop(),
+	}, discord
+}
+
+func archived(discord *fakediscord.Server) *discordgo.ThreadUpdate {
+	return &discordgo.ThreadUpdate{Channel: discord.Channel(testThread)}
+}
+
+func TestUnarchive(t *testing.T) {
+	s, discord := newTestSweeper(t)
+
+	s.ThreadUpdate(context.Background(), archived(discord))
+
+	if thread := discord.Channel(testThread); thread.ThreadMetadata.Archived {
+		t.Fatal("archived thread of an open ticket was not unarchived")
+	}
+
+	if sent := discord.Messages(testLogChannel); len(sent) != 1 || sent[0].Embeds[0].Title != "Ticket Drift" {
+		t.Fatalf("log channel messages = %+v, want the drift reported", sent)
+	}
+}
+
+func TestUnarchiveWhileLocked(t *testing.T) {
+	ctx := context.Background()
+	s, discord := newTestSweeper(t)
+
+	// Someone is closing the ticket, which locks and archives the thread itself
+	lock, err := locks.Acquire(ctx, s.Redis, "t1", "3000000000000000001", locks.DefaultTTL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.ThreadUpdate(ctx, archived(discord))
+
+	if calls := discord.CallsTo(http.MethodPatch, "/channels/"+testThread); len(calls) != 0 {
+		t.Fatalf("thread was edited while the ticket was locked: %d calls", len(calls))
+	}
+
+	if sent := discord.Messages(testLogChannel); len(sent) != 0 {
+		t.Fatalf("drift of a locked ticket was reported: %+v", sent)
+	}
+
+	lock.Release(ctx)
+
+	// Once the close has started, the drift is left to its job even though the ticket is unlocked
+	if _, err := s.Tickets.StartClose(ctx, "t1", "3000000000000000001", "snapshot"); err != nil {
+		t.Fatal(err)
+	}
+
+	s.fix(ctx, "t1", testThread, DriftArchived)
+
+	if calls := discord.CallsTo(http.MethodPatch, "/channels/"+testThread); len(calls) != 0 {
+		t.Fatal("thread of a ticket being closed was unarchived")
+	}
+}
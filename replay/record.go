@@ -0,0 +1,289 @@
+package replay
+
+import (
+	"fmt"
+	"ibl-tickets/dispatch"
+	"ibl-tickets/fakediscord"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	jsoniter "github.com/json-iterator/go"
+)
+
+var json = jsoniter.ConfigFastest
+
+// Kinds of recorded events
+const (
+	TypeInteractionCreate = "interaction_create"
+	TypeMessageCreate     = "message_create"
+)
+
+// What scrubbed text is replaced with
+const Redacted = "[redacted]"
+
+// Embed fields that are kept when scrubbing, as they name the ticket a message belongs to rather than anything about
+// the user
+var keptFields = map[string]bool{
+	"Ticket ID": true,
+	"Topic ID":  true,
+}
+
+// A recorded gateway event. Recordings are files of events, one per line
+type Event struct {
+	Type string              `json:"type"`
+	At   time.Time           `json:"at"`
+	Data jsoniter.RawMessage `json:"data"`
+}
+
+// Writes scrubbed InteractionCreate and MessageCreate events to a file
+//
+// User IDs are replaced with pseudonyms (the same user gets the same pseudonym for as long as the recorder runs) and
+// the bot's ID with fakediscord.BotID. Names, avatars, interaction tokens, attachment URLs, modal answers and message
+// content are removed, except for the content of commands, which only hold command arguments. Ticket messages keep
+// their Ticket ID and Topic ID fields so the tickets they belong to can be recreated on replay
+type Recorder struct {
+	mu         sync.Mutex
+	file       *os.File
+	pseudonyms map[string]string
+	tokens     int
+}
+
+// Opens path for appending events to
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return nil, fmt.Errorf("error opening recording: %w", err)
+	}
+
+	return &Recorder{file: file, pseudonyms: map[string]string{}}, nil
+}
+
+func (r *Recorder) Close() error {
+	return r.file.Close()
+}
+
+// Records an interaction
+func (r *Recorder) Interaction(s *discordgo.Session, i *discordgo.InteractionCreate) error {
+	// Scrubbing works on a copy, as handlers are reading the event at the same time
+	b, err := marshalInteraction(i.Interaction)
+
+	if err != nil {
+		return fmt.Errorf("error copying event: %w", err)
+	}
+
+	var scrubbed discordgo.InteractionCreate
+	err = json.Unmarshal(b, &scrubbed)
+
+	if err != nil {
+		return fmt.Errorf("error copying event: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.tokens++
+	scrubbed.Token = "token" + strconv.Itoa(r.tokens)
+	scrubbed.Member = r.member(s, scrubbed.Member)
+	scrubbed.User = r.user(s, scrubbed.User)
+	scrubbed.Message = r.message(s, scrubbed.Message, false)
+
+	if scrubbed.Type == discordgo.InteractionModalSubmit {
+		data := scrubbed.ModalSubmitData()
+
+		for _, row := range data.Components {
+			if row, ok := row.(*discordgo.ActionsRow); ok {
+				for _, c := range row.Components {
+					if input, ok := c.(*discordgo.TextInput); ok {
+						input.Value = Redacted
+					}
+				}
+			}
+		}
+	}
+
+	b, err = marshalInteraction(scrubbed.Interaction)
+
+	if err != nil {
+		return fmt.Errorf("error marshalling event: %w", err)
+	}
+
+	return r.write(TypeInteractionCreate, b)
+}
+
+// Records a message
+func (r *Recorder) Message(s *discordgo.Session, m *discordgo.MessageCreate) error {
+	b, err := json.Marshal(m)
+
+	if err != nil {
+		return fmt.Errorf("error copying event: %w", err)
+	}
+
+	var scrubbed discordgo.MessageCreate
+	err = json.Unmarshal(b, &scrubbed)
+
+	if err != nil {
+		return fmt.Errorf("error copying event: %w", err)
+	}
+
+	_, isCommand := dispatch.CommandArgs(s, m)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	scrubbed.Message = r.message(s, scrubbed.Message, isCommand)
+
+	b, err = json.Marshal(&scrubbed)
+
+	if err != nil {
+		return fmt.Errorf("error marshalling event: %w", err)
+	}
+
+	return r.write(TypeMessageCreate, b)
+}
+
+// discordgo.ModalSubmitInteractionData leaves its components out when marshalled
+type modalSubmitData struct {
+	CustomID   string                       `json:"custom_id"`
+	Components []discordgo.MessageComponent `json:"components"`
+}
+
+func (modalSubmitData) Type() discordgo.InteractionType {
+	return discordgo.InteractionModalSubmit
+}
+
+func marshalInteraction(i *discordgo.Interaction) ([]byte, error) {
+	if data, ok := i.Data.(discordgo.ModalSubmitInteractionData); ok {
+		cp := *i
+		cp.Data = modalSubmitData{CustomID: data.CustomID, Components: data.Components}
+		i = &cp
+	}
+
+	return json.Marshal(i)
+}
+
+// Must be called with mu held
+func (r *Recorder) write(eventType string, data []byte) error {
+	line, err := json.Marshal(Event{Type: eventType, At: time.Now(), Data: data})
+
+	if err != nil {
+		return fmt.Errorf("error marshalling event: %w", err)
+	}
+
+	_, err = r.file.Write(append(line, '\n'))
+
+	if err != nil {
+		return fmt.Errorf("error writing event: %w", err)
+	}
+
+	return nil
+}
+
+// Must be called with mu held
+func (r *Recorder) pseudonym(s *discordgo.Session, userId string) string {
+	if s.State.User != nil && userId == s.State.User.ID {
+		return fakediscord.BotID
+	}
+
+	p, ok := r.pseudonyms[userId]
+
+	if !ok {
+		p = strconv.Itoa(9000000000000000000 + len(r.pseudonyms) + 1)
+		r.pseudonyms[userId] = p
+	}
+
+	return p
+}
+
+// Must be called with mu held
+func (r *Recorder) user(s *discordgo.Session, u *discordgo.User) *discordgo.User {
+	if u == nil {
+		return nil
+	}
+
+	id := r.pseudonym(s, u.ID)
+
+	return &discordgo.User{
+		ID:            id,
+		Username:      "user" + id,
+		Discriminator: "0",
+		Bot:           u.Bot,
+	}
+}
+
+// Must be called with mu held
+func (r *Recorder) member(s *discordgo.Session, m *discordgo.Member) *discordgo.Member {
+	if m == nil {
+		return nil
+	}
+
+	return &discordgo.Member{
+		GuildID:     m.GuildID,
+		JoinedAt:    m.JoinedAt,
+		User:        r.user(s, m.User),
+		Roles:       m.Roles,
+		Permissions: m.Permissions,
+	}
+}
+
+// Must be called with mu held
+func (r *Recorder) message(s *discordgo.Session, msg *discordgo.Message, keepContent bool) *discordgo.Message {
+	if msg == nil {
+		return nil
+	}
+
+	if keepContent {
+		if s.State.User != nil {
+			msg.Content = strings.ReplaceAll(msg.Content, "<@"+s.State.User.ID+">", "<@"+fakediscord.BotID+">")
+			msg.Content = strings.ReplaceAll(msg.Content, "<@!"+s.State.User.ID+">", "<@!"+fakediscord.BotID+">")
+		}
+	} else if msg.Content != "" {
+		msg.Content = Redacted
+	}
+
+	msg.Author = r.user(s, msg.Author)
+	msg.Member = r.member(s, msg.Member)
+
+	for i, u := range msg.Mentions {
+		msg.Mentions[i] = r.user(s, u)
+	}
+
+	for _, a := range msg.Attachments {
+		a.Filename = Redacted
+		a.URL = ""
+		a.ProxyURL = ""
+	}
+
+	for _, e := range msg.Embeds {
+		if e.Title != "" {
+			e.Title = Redacted
+		}
+
+		if e.Description != "" {
+			e.Description = Redacted
+		}
+
+		e.URL = ""
+		e.Author = nil
+		e.Footer = nil
+		e.Image = nil
+		e.Thumbnail = nil
+		e.Video = nil
+
+		for _, f := range e.Fields {
+			if !keptFields[f.Name] {
+				f.Value = Redacted
+			}
+		}
+	}
+
+	msg.ReferencedMessage = nil
+	msg.Interaction = nil
+	msg.Thread = nil
+
+	return msg
+}
@@ -0,0 +1,298 @@
+package replay
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"ibl-tickets/dispatch"
+	"ibl-tickets/fakediscord"
+	"ibl-tickets/storage"
+	"ibl-tickets/tickets"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/redis/go-redis/v9"
+)
+
+// Reads the events of a recording
+func Load(path string) ([]Event, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var events []Event
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+
+		var e Event
+		err = json.Unmarshal(scanner.Bytes(), &e)
+
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		events = append(events, e)
+	}
+
+	return events, scanner.Err()
+}
+
+// The Discord calls handling a recorded event made
+type Result struct {
+	Event string // What the event was, such as "component close:{ticketId}"
+	Calls []fakediscord.Call
+}
+
+// Replays recorded events through a Dispatcher against a fake Discord
+//
+// The Dispatcher's ticket store must be Tickets, and its Redis and storage must not be
+// the configured ones, as replayed events act on them. Channels the events happened in are created in the fake Discord as they are needed, and tickets whose
+// close button is pressed are created from the ticket message the button is on
+type Runner struct {
+	Dispatcher *dispatch.Dispatcher
+	Discord    *fakediscord.Server
+	Tickets    *tickets.MemoryStore
+}
+
+// Runs events in order, returning the calls made for each
+func (r *Runner) Run(events []Event) ([]Result, error) {
+	err := r.isolated()
+
+	if err != nil {
+		return nil, err
+	}
+
+	s := r.Discord.Session()
+
+	for _, id := range []string{r.Dispatcher.Config.Channels.ThreadChannel, r.Dispatcher.Config.Channels.LogChannel} {
+		if id != "" && r.Discord.Channel(id) == nil {
+			r.Discord.AddChannel(&discordgo.Channel{ID: id, Type: discordgo.ChannelTypeGuildText})
+		}
+	}
+
+	var results []Result
+	for n, e := range events {
+		before := len(r.Discord.Calls())
+
+		var name string
+		var err error
+
+		switch e.Type {
+		case TypeInteractionCreate:
+			name, err = r.interaction(s, e)
+		case TypeMessageCreate:
+			name, err = r.message(s, e)
+		default:
+			err = fmt.Errorf("unknown event type %s", e.Type)
+		}
+
+		if err != nil {
+			return results, fmt.Errorf("event %d: %w", n+1, err)
+		}
+
+		results = append(results, Result{Event: name, Calls: r.Discord.Calls()[before:]})
+	}
+
+	return results, nil
+}
+
+// Refuses Dispatchers that would act on the configured database, Redis or storage
+func (r *Runner) isolated() error {
+	d := r.Dispatcher
+
+	if d.Tickets != tickets.Store(r.Tickets) {
+		return errors.New("replay must run against the runner's ticket store")
+	}
+
+	if d.Redis == nil {
+		return errors.New("replay needs a Redis, such as miniredis")
+	}
+
+	if d.Config.Database.Redis != "" {
+		rOptions, err := redis.ParseURL(d.Config.Database.Redis)
+
+		if err == nil && rOptions.Addr == d.Redis.Options().Addr {
+			return errors.New("replay must not run against the configured Redis")
+		}
+	}
+
+	switch store := d.Store.(type) {
+	case *storage.FileStore:
+		if d.Config.Database.FileStoragePath != "" && filepath.Clean(store.Root) == filepath.Clean(d.Config.Database.FileStoragePath) {
+			return errors.New("replay must not run against the configured file storage")
+		}
+	case *storage.S3Store:
+		return errors.New("replay must not run against S3")
+	}
+
+	return nil
+}
+
+// Creates a channel an event happened in, unless it exists already
+func (r *Runner) ensureChannel(guildId string, channelId string, parentId string) {
+	if channelId == "" || r.Discord.Channel(channelId) != nil {
+		return
+	}
+
+	r.Discord.AddChannel(&discordgo.Channel{ID: channelId, GuildID: guildId, ParentID: parentId})
+}
+
+func (r *Runner) interaction(s *discordgo.Session, e Event) (string, error) {
+	var i discordgo.InteractionCreate
+	err := json.Unmarshal(e.Data, &i)
+
+	if err != nil {
+		return "", err
+	}
+
+	name := dispatch.InteractionName(&i)
+
+	// Ticket messages are only sent in ticket threads
+	var parentId string
+	if tikId, _ := ticketFields(i.Message); tikId != "" {
+		parentId = r.Dispatcher.Config.Channels.ThreadChannel
+	}
+
+	r.ensureChannel(i.GuildID, i.ChannelID, parentId)
+
+	if i.Message != nil {
+		var found bool
+		for _, msg := range r.Discord.Messages(i.ChannelID) {
+			if msg.ID == i.Message.ID {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			r.Discord.AddMessage(i.ChannelID, i.Message)
+		}
+
+		err = r.seedTicket(&i)
+
+		if err != nil {
+			return "", err
+		}
+	}
+
+	r.Dispatcher.Interaction(s, &i)
+	return name, nil
+}
+
+// Returns the Ticket ID and Topic ID fields of a ticket message, or empty strings if msg isn't one
+func ticketFields(msg *discordgo.Message) (string, string) {
+	if msg == nil {
+		return "", ""
+	}
+
+	var fields = map[string]string{}
+	for _, e := range msg.Embeds {
+		for _, f := range e.Fields {
+			fields[f.Name] = f.Value
+		}
+	}
+
+	return fields["Ticket ID"], fields["Topic ID"]
+}
+
+// Creates the ticket a ticket message belongs to, as it was opened before the recording started
+func (r *Runner) seedTicket(i *discordgo.InteractionCreate) error {
+	tikId, topicId := ticketFields(i.Message)
+
+	if tikId == "" || topicId == "" {
+		return nil
+	}
+
+	_, err := r.Tickets.Get(r.Dispatcher.Ctx, tikId)
+
+	if !errors.Is(err, tickets.ErrNotFound) {
+		return err
+	}
+
+	// The ticket message mentions the user who opened the ticket
+	var userId string
+	if len(i.Message.Mentions) > 0 {
+		userId = i.Message.Mentions[0].ID
+	}
+
+	return r.Tickets.Create(r.Dispatcher.Ctx, &tickets.Ticket{
+		ID:        tikId,
+		UserID:    userId,
+		ChannelID: i.ChannelID,
+		TopicID:   topicId,
+		Issue:     Redacted,
+	})
+}
+
+func (r *Runner) message(s *discordgo.Session, e Event) (string, error) {
+	var m discordgo.MessageCreate
+	err := json.Unmarshal(e.Data, &m)
+
+	if err != nil {
+		return "", err
+	}
+
+	r.ensureChannel(m.GuildID, m.ChannelID, "")
+
+	name := "message " + m.ID
+
+	if args, ok := dispatch.CommandArgs(s, &m); ok && len(args) > 0 {
+		name = "command " + args[0]
+	}
+
+	r.Dispatcher.Command(s, &m)
+	return name, nil
+}
+
+// Writes results as one line per event followed by an indented line per call, which is what expectations are
+// compared against
+func Summary(results []Result) string {
+	var sb strings.Builder
+
+	for n, res := range results {
+		sb.WriteString("#" + strconv.Itoa(n+1) + " " + res.Event + "\n")
+
+		for _, c := range res.Calls {
+			sb.WriteString("    " + c.Method + " " + c.Path + " " + strconv.Itoa(c.Status) + "\n")
+		}
+	}
+
+	return sb.String()
+}
+
+// Compares results with an expected summary, returning an error describing the first difference
+func Check(results []Result, expected string) error {
+	got := strings.Split(Summary(results), "\n")
+	want := strings.Split(strings.ReplaceAll(expected, "\r\n", "\n"), "\n")
+
+	for n := 0; n < len(got) || n < len(want); n++ {
+		var g, w string
+
+		if n < len(got) {
+			g = got[n]
+		}
+
+		if n < len(want) {
+			w = want[n]
+		}
+
+		if g != w {
+			return fmt.Errorf("line %d: expected %q, got %q", n+1, w, g)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,172 @@
+package replay
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"ibl-tickets/dispatch"
+	"ibl-tickets/fakediscord"
+	"ibl-tickets/keys"
+	"ibl-tickets/signing"
+	"ibl-tickets/storage"
+	"ibl-tickets/tickets"
+	"ibl-tickets/types"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+const (
+	testThreadChannel = "6000000000000000001"
+	testLogChannel    = "6000000000000000009"
+	testOwner         = "9000000000000000002" // The staff member in testdata/close.jsonl
+)
+
+func randomKey(t *testing.T) string {
+	key := make([]byte, 32)
+
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// A runner against fakediscord, a MemoryStore, a scratch directory and miniredis, configured with a Redis and file
+// storage that replay must leave alone
+func newTestRunner(t *testing.T) *Runner {
+	secrets := &types.Secrets{
+		MasterKeyID:          "k1",
+		MasterKey:            randomKey(t),
+		TranscriptSigningKey: randomKey(t),
+		BlobHashSecret:       "hash secret",
+		LinkSecret:           "link secret",
+	}
+
+	keyring, err := keys.Load(secrets)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := signing.Load(secrets)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	discord := fakediscord.New()
+	t.Cleanup(discord.Close)
+
+	rd := miniredis.RunT(t)
+	rediscli := redis.NewClient(&redis.Options{Addr: rd.Addr()})
+	t.Cleanup(func() { rediscli.Close() })
+
+	config := &types.Config{
+		Topics: map[string]types.Topic{
+			"support": {Name: "Support", Questions: []types.Question{{Question: "Bot ID?", Required: true}}},
+		},
+		Channels: types.ConfigChannels{ThreadChannel: testThreadChannel, LogChannel: testLogChannel},
+	}
+
+	config.Database.Redis = "redis://127.0.0.1:6379/0"
+	config.Database.FileStoragePath = t.TempDir()
+	config.Database.ExposedPath = "https://tickets.example/"
+
+	tikStore := tickets.NewMemoryStore()
+
+	return &Runner{
+		Dispatcher: &dispatch.Dispatcher{
+			Config:  config,
+			Secrets: secrets,
+			Keyring: keyring,
+			Signer:  signer,
+			Store:   &storage.FileStore{Root: t.TempDir()},
+			Tickets: tikStore,
+			Ctx:     context.Background(),
+			Logger:  zap.NewNop(),
+			Redis:   rediscli,
+			IsOwner: func(userId string) bool {
+				return userId == testOwner
+			},
+		},
+		Discord: discord,
+		Tickets: tikStore,
+	}
+}
+
+func TestReplay(t *testing.T) {
+	events, err := Load("testdata/close.jsonl")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := os.ReadFile("testdata/close.expect")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestRunner(t)
+	results, err := r.Run(events)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Check(results, string(expected))
+
+	if err != nil {
+		t.Fatalf("%v, calls made:\n%s", err, Summary(results))
+	}
+
+	tik, err := r.Tickets.Get(context.Background(), "tikreplay1")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tik.Open {
+		t.Fatal("expected the replayed ticket to be closed")
+	}
+}
+
+func TestReplayRefusesConfigured(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(r *Runner)
+		err    string
+	}{
+		{"redis", func(r *Runner) {
+			r.Dispatcher.Redis = redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379"})
+		}, "configured Redis"},
+		{"file storage", func(r *Runner) {
+			r.Dispatcher.Store = &storage.FileStore{Root: r.Dispatcher.Config.Database.FileStoragePath + "/"}
+		}, "configured file storage"},
+		{"ticket store", func(r *Runner) {
+			r.Dispatcher.Tickets = tickets.NewMemoryStore()
+		}, "ticket store"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRunner(t)
+			tt.modify(r)
+
+			_, err := r.Run(nil)
+
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected an error about the %s, got %v", tt.err, err)
+			}
+
+			if len(r.Discord.Calls()) != 0 {
+				t.Fatalf("expected no calls, got %d", len(r.Discord.Calls()))
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	stdjson "encoding/json"
+	"errors"
+	"fmt"
+	"ibl-tickets/types"
+	"strings"
+	"time"
+)
+
+const Algorithm = "ed25519"
+
+var (
+	ErrUnsigned         = errors.New("transcript is not signed")
+	ErrUnknownKey       = errors.New("transcript was signed with an unknown key")
+	ErrInvalidSignature = errors.New("transcript signature is invalid, the transcript has been modified")
+)
+
+// Signs transcripts at close time and verifies transcripts presented back to us
+//
+// Only the current key can sign, but transcripts signed with previous keys can still be verified
+type Keys struct {
+	KeyID      string // ID of the current signing key
+	privateKey ed25519.PrivateKey
+	publicKeys map[string]ed25519.PublicKey // Public keys by ID
+}
+
+// Returns the ID of a public key, which is the first 8 bytes of its SHA-256 hash in hex
+func KeyID(publicKey ed25519.PublicKey) string {
+	hash := sha256.Sum256(publicKey)
+	return hex.EncodeToString(hash[:8])
+}
+
+// Loads the signing key (a base64 encoded 32 byte ed25519 seed) and any previous public keys from secrets.yaml
+func Load(secrets *types.Secrets) (*Keys, error) {
+	if secrets.TranscriptSigningKey == "" {
+		return nil, errors.New("transcript_signing_key must be set in secrets.yaml")
+	}
+
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(secrets.TranscriptSigningKey))
+
+	if err != nil {
+		return nil, fmt.Errorf("transcript_signing_key is not valid base64: %w", err)
+	}
+
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("transcript_signing_key must be %d bytes, got %d", ed25519.SeedSize, len(seed))
+	}
+
+	privateKey := ed25519.NewKeyFromSeed(seed)
+	publicKey := privateKey.Public().(ed25519.PublicKey)
+
+	var k = &Keys{
+		KeyID:      KeyID(publicKey),
+		privateKey: privateKey,
+		publicKeys: map[string]ed25519.PublicKey{KeyID(publicKey): publicKey},
+	}
+
+	for _, encoded := range secrets.PreviousTranscriptVerifyKeys {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+
+		if err != nil {
+			return nil, fmt.Errorf("previous transcript verify key is not valid base64: %w", err)
+		}
+
+		if len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("previous transcript verify keys must be %d bytes, got %d", ed25519.PublicKeySize, len(key))
+		}
+
+		k.publicKeys[KeyID(key)] = key
+	}
+
+	return k, nil
+}
+
+// Returns the base64 encoded public key of the current signing key, to be kept in previous_transcript_verify_keys once it is replaced
+func (k *Keys) PublicKey() string {
+	return base64.StdEncoding.EncodeToString(k.privateKey.Public().(ed25519.PublicKey))
+}
+
+// Returns the bytes that are signed: the standard JSON encoding of the transcript with an empty signature value
+//
+// encoding/json sorts map keys and follows struct field order, so decoding and re-encoding a transcript gives the same bytes
+func signedBytes(t *types.FileTranscriptData) ([]byte, error) {
+	var unsigned = *t
+	var signature = *t.Signature
+	signature.Value = ""
+	unsigned.Signature = &signature
+
+	return stdjson.Marshal(unsigned)
+}
+
+// Signs a transcript, setting its Signature. Attachments are covered through their SHA-256 hashes
+func (k *Keys) Sign(t *types.FileTranscriptData, signedAt time.Time) error {
+	t.Signature = &types.TranscriptSignature{
+		Algorithm: Algorithm,
+		KeyID:     k.KeyID,
+		SignedAt:  signedAt.UTC(),
+	}
+
+	data, err := signedBytes(t)
+
+	if err != nil {
+		t.Signature = nil
+		return fmt.Errorf("error encoding transcript: %w", err)
+	}
+
+	t.Signature.Value = base64.StdEncoding.EncodeToString(ed25519.Sign(k.privateKey, data))
+
+	return nil
+}
+
+// Checks that a .ibltranscript file was signed by one of our keys and has not been modified since, returning the decoded transcript
+func (k *Keys) Verify(file []byte) (*types.FileTranscriptData, error) {
+	var t types.FileTranscriptData
+
+	err := stdjson.Unmarshal(file, &t)
+
+	if err != nil {
+		return nil, fmt.Errorf("file is not a transcript: %w", err)
+	}
+
+	if t.Signature == nil || t.Signature.Value == "" {
+		return &t, ErrUnsigned
+	}
+
+	if t.Signature.Algorithm != Algorithm {
+		return &t, fmt.Errorf("unsupported signature algorithm: %s", t.Signature.Algorithm)
+	}
+
+	publicKey, ok := k.publicKeys[t.Signature.KeyID]
+
+	if !ok {
+		return &t, ErrUnknownKey
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(t.Signature.Value)
+
+	if err != nil {
+		return &t, ErrInvalidSignature
+	}
+
+	data, err := signedBytes(&t)
+
+	if err != nil {
+		return &t, fmt.Errorf("error encoding transcript: %w", err)
+	}
+
+	if !ed25519.Verify(publicKey, data, signature) {
+		return &t, ErrInvalidSignature
+	}
+
+	return &t, nil
+}
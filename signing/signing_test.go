@@ -0,0 +1,182 @@
+package signing
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	stdjson "encoding/json"
+	"errors"
+	"ibl-tickets/types"
+	"testing"
+	"time"
+)
+
+func testKeys(t *testing.T, previous ...string) *Keys {
+	seed := make([]byte, 32)
+
+	if _, err := rand.Read(seed); err != nil {
+		t.Fatal(err)
+	}
+
+	k, err := Load(&types.Secrets{
+		TranscriptSigningKey:         base64.StdEncoding.EncodeToString(seed),
+		PreviousTranscriptVerifyKeys: previous,
+	})
+
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	return k
+}
+
+func testTranscript() *types.FileTranscriptData {
+	return &types.FileTranscriptData{
+		Issue:         "Can't log in",
+		TopicID:       "support",
+		TicketContext: map[string]string{"b": "2", "a": "1"},
+		Messages: []types.Message{
+			{
+				ID:       "m1",
+				Content:  "hello",
+				AuthorID: "u1",
+				Attachments: []types.Attachment{
+					{ID: "a1", Name: "log.txt", Size: 12, SHA256: "aa"},
+				},
+			},
+			{ID: "m2", Content: "hi", AuthorID: "staff1"},
+		},
+		UserID:      "u1",
+		CloseUserID: "staff1",
+		ChannelID:   "c1",
+		TicketID:    "t1",
+	}
+}
+
+// Signs a transcript and encodes it like the .ibltranscript file sent out at close time
+func signedFile(t *testing.T, k *Keys) []byte {
+	tr := testTranscript()
+
+	if err := k.Sign(tr, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := stdjson.Marshal(tr)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return file
+}
+
+// Decodes a signed file, lets modify change it and encodes it again
+func modified(t *testing.T, file []byte, modify func(tr *types.FileTranscriptData)) []byte {
+	var tr types.FileTranscriptData
+
+	if err := stdjson.Unmarshal(file, &tr); err != nil {
+		t.Fatal(err)
+	}
+
+	modify(&tr)
+
+	out, err := stdjson.Marshal(tr)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return out
+}
+
+func TestRoundTrip(t *testing.T) {
+	k := testKeys(t)
+	file := signedFile(t, k)
+
+	tr, err := k.Verify(file)
+
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	if tr.TicketID != "t1" || tr.Signature.KeyID != k.KeyID {
+		t.Fatalf("Verify returned ticket %s signed with %s", tr.TicketID, tr.Signature.KeyID)
+	}
+
+	// Re-encoding (e.g. by a viewer that pretty prints the file) must not break the signature
+	var indented bytes.Buffer
+
+	if err := stdjson.Indent(&indented, file, "", "  "); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := k.Verify(indented.Bytes()); err != nil {
+		t.Fatalf("Verify indented: %v", err)
+	}
+}
+
+func TestPreviousKey(t *testing.T) {
+	old := testKeys(t)
+	file := signedFile(t, old)
+
+	rotated := testKeys(t, old.PublicKey())
+
+	if _, err := rotated.Verify(file); err != nil {
+		t.Fatalf("Verify with the retired key kept: %v", err)
+	}
+
+	if _, err := testKeys(t).Verify(file); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Verify with the retired key dropped error = %v, want %v", err, ErrUnknownKey)
+	}
+}
+
+func TestModified(t *testing.T) {
+	k := testKeys(t)
+	file := signedFile(t, k)
+
+	tests := map[string]func(tr *types.FileTranscriptData){
+		"message content":    func(tr *types.FileTranscriptData) { tr.Messages[0].Content = "goodbye" },
+		"message author":     func(tr *types.FileTranscriptData) { tr.Messages[1].AuthorID = "u1" },
+		"removed message":    func(tr *types.FileTranscriptData) { tr.Messages = tr.Messages[:1] },
+		"reordered messages": func(tr *types.FileTranscriptData) { tr.Messages[0], tr.Messages[1] = tr.Messages[1], tr.Messages[0] },
+		"attachment hash":    func(tr *types.FileTranscriptData) { tr.Messages[0].Attachments[0].SHA256 = "bb" },
+		"ticket context":     func(tr *types.FileTranscriptData) { tr.TicketContext["a"] = "3" },
+		"closed by":          func(tr *types.FileTranscriptData) { tr.CloseUserID = "u1" },
+		"signed at":          func(tr *types.FileTranscriptData) { tr.Signature.SignedAt = tr.Signature.SignedAt.Add(time.Hour) },
+		"signature value": func(tr *types.FileTranscriptData) {
+			sig, _ := base64.StdEncoding.DecodeString(tr.Signature.Value)
+			sig[0] ^= 1
+			tr.Signature.Value = base64.StdEncoding.EncodeToString(sig)
+		},
+		"signature not base64": func(tr *types.FileTranscriptData) { tr.Signature.Value = "not base64!" },
+	}
+
+	for name, modify := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := k.Verify(modified(t, file, modify)); !errors.Is(err, ErrInvalidSignature) {
+				t.Fatalf("Verify error = %v, want %v", err, ErrInvalidSignature)
+			}
+		})
+	}
+}
+
+func TestUnsigned(t *testing.T) {
+	k := testKeys(t)
+	file := signedFile(t, k)
+
+	unsigned := modified(t, file, func(tr *types.FileTranscriptData) { tr.Signature = nil })
+
+	if _, err := k.Verify(unsigned); !errors.Is(err, ErrUnsigned) {
+		t.Fatalf("Verify unsigned error = %v, want %v", err, ErrUnsigned)
+	}
+
+	algorithm := modified(t, file, func(tr *types.FileTranscriptData) { tr.Signature.Algorithm = "rsa" })
+
+	if _, err := k.Verify(algorithm); err == nil {
+		t.Fatal("Verify accepted an unsupported algorithm")
+	}
+
+	if _, err := k.Verify([]byte("not json")); err == nil {
+		t.Fatal("Verify accepted a file that isn't a transcript")
+	}
+}
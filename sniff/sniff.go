@@ -0,0 +1,99 @@
+package sniff
+
+import (
+	"ibl-tickets/types"
+	"mime"
+	"path"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// Number of bytes needed from the start of a file to detect its type
+const HeaderSize = 3072
+
+type Result struct {
+	Type     string // Media type detected from the file's contents, without parameters
+	Claimed  string // Media type Discord reported (or guessed from the filename if Discord reported none)
+	Blocked  bool   // Whether attachments.allow or attachments.deny rule out the detected type
+	Mismatch bool   // Whether the detected type contradicts the claimed type, e.g. an executable named like an image
+}
+
+// Strips parameters such as charset from a media type
+func mediaType(t string) string {
+	mt, _, err := mime.ParseMediaType(t)
+
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(t))
+	}
+
+	return mt
+}
+
+// Reports whether a detected type matches a pattern from the allow or deny list. Patterns are either
+// exact media types (aliases included) or a whole top level type such as image/*
+func matches(m *mimetype.MIME, pattern string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+
+	if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return strings.HasPrefix(mediaType(m.String()), prefix+"/")
+	}
+
+	return m.Is(pattern)
+}
+
+// Reports whether a or one of its parents in the mimetype tree is t
+func descendsFrom(a *mimetype.MIME, t string) bool {
+	for m := a; m != nil; m = m.Parent() {
+		if m.Is(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Detects the type of an attachment from the start of its contents and checks it against the attachment policy
+//
+// Types only count as mismatched if neither is a more specific form of the other, so a CSV file sniffed as
+// plain text or a file of unknown binary format is not flagged
+func Check(config types.ConfigAttachments, header []byte, name string, claimed string) Result {
+	detected := mimetype.Detect(header)
+
+	var r = Result{
+		Type:    mediaType(detected.String()),
+		Claimed: mediaType(claimed),
+	}
+
+	if r.Claimed == "" {
+		r.Claimed = mediaType(mime.TypeByExtension(path.Ext(name)))
+	}
+
+	for _, pattern := range config.Deny {
+		if matches(detected, pattern) {
+			r.Blocked = true
+		}
+	}
+
+	if len(config.Allow) > 0 && !r.Blocked {
+		r.Blocked = true
+
+		for _, pattern := range config.Allow {
+			if matches(detected, pattern) {
+				r.Blocked = false
+				break
+			}
+		}
+	}
+
+	if r.Claimed != "" && !descendsFrom(detected, r.Claimed) {
+		claimedMime := mimetype.Lookup(r.Claimed)
+
+		// Types the library doesn't know can't be judged
+		if claimedMime != nil && !descendsFrom(claimedMime, r.Type) {
+			r.Mismatch = true
+		}
+	}
+
+	return r
+}
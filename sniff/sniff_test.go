@@ -0,0 +1,66 @@
+package sniff
+
+import (
+	"ibl-tickets/types"
+	"testing"
+)
+
+// The start of a Windows executable
+func executable() []byte {
+	b := make([]byte, 512)
+	copy(b, "MZ")
+	b[0x3c] = 0x80
+	copy(b[0x80:], "PE\x00\x00")
+	return b
+}
+
+func TestCheck(t *testing.T) {
+	var (
+		png = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00")
+		gif = []byte("GIF89a\x01\x00\x01\x00")
+		pdf = []byte("%PDF-1.4\n")
+		zip = []byte("PK\x03\x04\x14\x00\x00\x00")
+		csv = []byte("a,b,c\n1,2,3\n4,5,6\n")
+		txt = []byte("hello world\n")
+		bin = []byte{0x00, 0x01, 0x02, 0x03, 0xfe, 0xff}
+	)
+
+	deny := types.ConfigAttachments{Deny: []string{"application/vnd.microsoft.portable-executable", "application/x-elf", "application/zip"}}
+	images := types.ConfigAttachments{Allow: []string{"image/*", "application/pdf"}, Deny: []string{"image/gif"}}
+
+	tests := []struct {
+		name     string
+		config   types.ConfigAttachments
+		header   []byte
+		filename string
+		claimed  string
+		want     Result
+	}{
+		{"image", deny, png, "cat.png", "image/png", Result{Type: "image/png", Claimed: "image/png"}},
+		{"executable declared as image", deny, executable(), "cat.png", "image/png", Result{Type: "application/vnd.microsoft.portable-executable", Claimed: "image/png", Blocked: true, Mismatch: true}},
+		{"executable named as image", deny, executable(), "cat.png", "", Result{Type: "application/vnd.microsoft.portable-executable", Claimed: "image/png", Blocked: true, Mismatch: true}},
+		{"executable allowed but mismatched", types.ConfigAttachments{}, executable(), "cat.png", "image/png", Result{Type: "application/vnd.microsoft.portable-executable", Claimed: "image/png", Mismatch: true}},
+		{"executable declared as binary", deny, executable(), "setup.exe", "application/octet-stream", Result{Type: "application/vnd.microsoft.portable-executable", Claimed: "application/octet-stream", Blocked: true}},
+		{"archive", deny, zip, "files.zip", "application/zip", Result{Type: "application/zip", Claimed: "application/zip", Blocked: true}},
+		{"deny is case insensitive", types.ConfigAttachments{Deny: []string{" Image/PNG "}}, png, "cat.png", "image/png", Result{Type: "image/png", Claimed: "image/png", Blocked: true}},
+		{"claimed type parameters", deny, csv, "data.csv", "text/csv; charset=utf-8", Result{Type: "text/csv", Claimed: "text/csv"}},
+		{"more specific than claimed", deny, csv, "data.txt", "text/plain", Result{Type: "text/csv", Claimed: "text/plain"}},
+		{"less specific than claimed", deny, txt, "data.csv", "text/csv", Result{Type: "text/plain", Claimed: "text/csv"}},
+		{"unknown binary", deny, bin, "cat.png", "image/png", Result{Type: "application/octet-stream", Claimed: "image/png"}},
+		{"unknown claimed type", deny, png, "cat.png", "application/x-made-up", Result{Type: "image/png", Claimed: "application/x-made-up"}},
+		{"nothing claimed", deny, png, "cat", "", Result{Type: "image/png"}},
+		{"allowed by wildcard", images, png, "cat.png", "image/png", Result{Type: "image/png", Claimed: "image/png"}},
+		{"allowed exactly", images, pdf, "doc.pdf", "application/pdf", Result{Type: "application/pdf", Claimed: "application/pdf"}},
+		{"not allowed", images, txt, "notes.txt", "text/plain", Result{Type: "text/plain", Claimed: "text/plain", Blocked: true}},
+		{"denied despite allow", images, gif, "cat.gif", "image/gif", Result{Type: "image/gif", Claimed: "image/gif", Blocked: true}},
+		{"pdf declared as image", images, pdf, "cat.png", "image/png", Result{Type: "application/pdf", Claimed: "image/png", Mismatch: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Check(tt.config, tt.header, tt.filename, tt.claimed); got != tt.want {
+				t.Fatalf("Check = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
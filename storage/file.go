@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Stores objects as files under Root
+type FileStore struct {
+	Root string
+}
+
+func (f *FileStore) path(key string) (string, error) {
+	p := filepath.Join(f.Root, filepath.FromSlash(key))
+
+	// Keys come from ticket and attachment IDs, but never let one escape the root
+	if !strings.HasPrefix(p, filepath.Clean(f.Root)+string(filepath.Separator)) {
+		return "", errors.New("invalid key: " + key)
+	}
+
+	return p, nil
+}
+
+// Writes to a temporary file that is renamed into place on Close
+type fileWriter struct {
+	*os.File
+	path   string
+	closed bool
+}
+
+func (w *fileWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+
+	w.closed = true
+
+	err := w.File.Close()
+
+	if err == nil {
+		err = os.Rename(w.File.Name(), w.path)
+	}
+
+	if err != nil {
+		os.Remove(w.File.Name())
+	}
+
+	return err
+}
+
+func (w *fileWriter) Abort() error {
+	if w.closed {
+		return nil
+	}
+
+	w.closed = true
+	w.File.Close()
+
+	return os.Remove(w.File.Name())
+}
+
+func (f *FileStore) Create(ctx context.Context, key string) (Writer, error) {
+	p, err := f.path(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(p), 0775)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p), "."+filepath.Base(p)+".*.tmp")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileWriter{File: tmp, path: p}, nil
+}
+
+func (f *FileStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	p, err := f.path(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(p)
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+
+	return file, err
+}
+
+func (f *FileStore) Delete(ctx context.Context, key string) error {
+	p, err := f.path(key)
+
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(p)
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+// Only whole folders can be removed, so prefix must end with a slash
+func (f *FileStore) DeletePrefix(ctx context.Context, prefix string) error {
+	if !strings.HasSuffix(prefix, "/") {
+		return errors.New("file storage can only delete folder prefixes")
+	}
+
+	p, err := f.path(strings.TrimSuffix(prefix, "/"))
+
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(p)
+}
+
+// Only whole folders can be listed, so prefix must end with a slash
+func (f *FileStore) List(ctx context.Context, prefix string) ([]Object, error) {
+	if !strings.HasSuffix(prefix, "/") {
+		return nil, errors.New("file storage can only list folder prefixes")
+	}
+
+	dir, err := f.path(strings.TrimSuffix(prefix, "/"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []Object
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		// Temporary files of writers that haven't been closed yet
+		if d.IsDir() || (strings.HasPrefix(d.Name(), ".") && strings.HasSuffix(d.Name(), ".tmp")) {
+			return nil
+		}
+
+		info, err := d.Info()
+
+		if err != nil {
+			return err
+		}
+
+		key, err := filepath.Rel(f.Root, p)
+
+		if err != nil {
+			return err
+		}
+
+		objects = append(objects, Object{Key: filepath.ToSlash(key), ModTime: info.ModTime()})
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return objects, nil
+}
@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileList(t *testing.T) {
+	ctx := context.Background()
+	s := &FileStore{Root: t.TempDir()}
+
+	if objects, err := s.List(ctx, "blobs/"); err != nil || len(objects) != 0 {
+		t.Fatalf("List of a missing directory = %v, %v", objects, err)
+	}
+
+	put(t, s, "blobs/ab/1.encBlob", "one")
+	put(t, s, "blobs/cd/2.encBlob", "two")
+	put(t, s, "t1/a.encBlob", "not a blob")
+
+	// An upload that is still being written
+	if err := os.WriteFile(filepath.Join(s.Root, "blobs", "ab", ".3.encBlob.tmp"), []byte("partial"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	objects, err := s.List(ctx, "blobs/")
+
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+
+	if len(objects) != 2 || objects[0].Key != "blobs/ab/1.encBlob" || objects[1].Key != "blobs/cd/2.encBlob" || objects[0].ModTime.IsZero() {
+		t.Fatalf("List = %+v, want the two finished blobs", objects)
+	}
+}
@@ -0,0 +1,413 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"ibl-tickets/types"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Payload hash used for uploads streamed from disk, the connection itself is protected by TLS
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// Hash of an empty body
+const emptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Stores objects in an S3 compatible bucket (AWS, MinIO, R2 etc.) using path style requests signed with SigV4
+type S3Store struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	prefix    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func NewS3Store(config types.ConfigS3, accessKey string, secretKey string) (*S3Store, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, errors.New("database.storage.s3.endpoint and database.storage.s3.bucket must be set to use s3 storage")
+	}
+
+	if accessKey == "" || secretKey == "" {
+		return nil, errors.New("s3_access_key and s3_secret_key must be set in secrets.yaml to use s3 storage")
+	}
+
+	endpoint, err := url.Parse(config.Endpoint)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint: %w", err)
+	}
+
+	region := config.Region
+
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	return &S3Store{
+		endpoint:  endpoint,
+		bucket:    config.Bucket,
+		region:    region,
+		prefix:    config.Prefix,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+// Encodes a string as required by SigV4, leaving slashes alone if path is set
+func uriEncode(s string, path bool) string {
+	var b strings.Builder
+
+	for _, c := range []byte(s) {
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '.' || c == '_' || c == '~' || (path && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Signs a request with AWS Signature Version 4, covering the host and every header already set on the request
+func (s *S3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := now.UTC().Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	var headers = map[string]string{"host": req.URL.Host}
+
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	var names []string
+
+	for name := range headers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+
+	var queryKeys []string
+
+	for k := range query {
+		queryKeys = append(queryKeys, k)
+	}
+
+	sort.Strings(queryKeys)
+
+	var canonicalQuery []string
+
+	for _, k := range queryKeys {
+		for _, v := range query[k] {
+			canonicalQuery = append(canonicalQuery, uriEncode(k, false)+"="+uriEncode(v, false))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, true),
+		strings.Join(canonicalQuery, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := hmacSHA256(hmacSHA256(hmacSHA256(hmacSHA256([]byte("AWS4"+s.secretKey), date), s.region), "s3"), "aws4_request")
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+hex.EncodeToString(hmacSHA256(signingKey, stringToSign)))
+}
+
+// Creates a signed request for an object (or the bucket itself if key is empty)
+func (s *S3Store) request(ctx context.Context, method string, key string, query url.Values, body io.Reader, payloadHash string) (*http.Request, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket
+
+	if key != "" {
+		u.Path += "/" + s.prefix + key
+	}
+
+	u.RawPath = uriEncode(u.Path, true)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.sign(req, payloadHash, time.Now())
+
+	return req, nil
+}
+
+// Reads an S3 error response into an error
+func s3Error(resp *http.Response) error {
+	var body struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+
+	xml.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&body)
+
+	return fmt.Errorf("s3 request failed with status %d: %s %s", resp.StatusCode, body.Code, body.Message)
+}
+
+// Buffers uploads on disk so memory stays bounded, then PUTs them with a known length on Close
+type s3Writer struct {
+	*os.File
+	ctx    context.Context
+	store  *S3Store
+	key    string
+	closed bool
+}
+
+func (w *s3Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+
+	w.closed = true
+
+	defer os.Remove(w.File.Name())
+	defer w.File.Close()
+
+	size, err := w.File.Seek(0, io.SeekCurrent)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = w.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	req, err := w.store.request(w.ctx, http.MethodPut, w.key, nil, w.File, unsignedPayload)
+
+	if err != nil {
+		return err
+	}
+
+	req.ContentLength = size
+
+	resp, err := w.store.client.Do(req)
+
+	if err != nil {
+		return fmt.Errorf("error uploading object: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+
+	return nil
+}
+
+func (w *s3Writer) Abort() error {
+	if w.closed {
+		return nil
+	}
+
+	w.closed = true
+	w.File.Close()
+
+	return os.Remove(w.File.Name())
+}
+
+func (s *S3Store) Create(ctx context.Context, key string) (Writer, error) {
+	tmp, err := os.CreateTemp("", "ibl-tickets-upload-*")
+
+	if err != nil {
+		return nil, fmt.Errorf("error creating upload buffer: %w", err)
+	}
+
+	return &s3Writer{File: tmp, ctx: ctx, store: s, key: key}, nil
+}
+
+func (s *S3Store) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := s.request(ctx, http.MethodGet, key, nil, nil, emptyPayload)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.Do(req)
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting object: %w", err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotFound
+	default:
+		defer resp.Body.Close()
+		return nil, s3Error(resp)
+	}
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	req, err := s.request(ctx, http.MethodDelete, key, nil, nil, emptyPayload)
+
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Do(req)
+
+	if err != nil {
+		return fmt.Errorf("error deleting object: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	default:
+		return s3Error(resp)
+	}
+}
+
+// Lists a page of the objects (with keys relative to the configured prefix) starting with prefix
+func (s *S3Store) list(ctx context.Context, prefix string, continuationToken string) ([]Object, string, error) {
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {s.prefix + prefix},
+	}
+
+	if continuationToken != "" {
+		query.Set("continuation-token", continuationToken)
+	}
+
+	req, err := s.request(ctx, http.MethodGet, "", query, nil, emptyPayload)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	resp, err := s.client.Do(req)
+
+	if err != nil {
+		return nil, "", fmt.Errorf("error listing objects: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", s3Error(resp)
+	}
+
+	var result struct {
+		Contents []struct {
+			Key          string    `xml:"Key"`
+			LastModified time.Time `xml:"LastModified"`
+		} `xml:"Contents"`
+		IsTruncated           bool   `xml:"IsTruncated"`
+		NextContinuationToken string `xml:"NextContinuationToken"`
+	}
+
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+
+	if err != nil {
+		return nil, "", fmt.Errorf("error decoding object list: %w", err)
+	}
+
+	var objects []Object
+
+	for _, obj := range result.Contents {
+		objects = append(objects, Object{Key: strings.TrimPrefix(obj.Key, s.prefix), ModTime: obj.LastModified})
+	}
+
+	if !result.IsTruncated {
+		return objects, "", nil
+	}
+
+	return objects, result.NextContinuationToken, nil
+}
+
+func (s *S3Store) DeletePrefix(ctx context.Context, prefix string) error {
+	var token string
+	for {
+		objects, next, err := s.list(ctx, prefix, token)
+
+		if err != nil {
+			return err
+		}
+
+		for _, obj := range objects {
+			err = s.Delete(ctx, obj.Key)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		if next == "" {
+			return nil
+		}
+
+		token = next
+	}
+}
+
+func (s *S3Store) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	var token string
+	for {
+		page, next, err := s.list(ctx, prefix, token)
+
+		if err != nil {
+			return nil, err
+		}
+
+		objects = append(objects, page...)
+
+		if next == "" {
+			return objects, nil
+		}
+
+		token = next
+	}
+}
@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"ibl-tickets/types"
+	"io"
+	"time"
+)
+
+// Storage backends
+const (
+	TypeFile = "file"
+	TypeS3   = "s3"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+// Writes an object. Close publishes it, while Abort discards everything written so far
+type Writer interface {
+	io.WriteCloser
+	Abort() error
+}
+
+// An object listed by Store.List
+type Object struct {
+	Key     string
+	ModTime time.Time // When the object was last written
+}
+
+// Where encrypted attachment blobs are kept. Keys are slash separated paths such as {tikId}/{attachmentId}.encBlob
+type Store interface {
+	// Returns a writer for the object at key. The object only becomes visible once Close returns without error
+	Create(ctx context.Context, key string) (Writer, error)
+
+	// Opens the object at key, returning ErrNotFound if it does not exist
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+
+	// Deletes the object at key. Deleting an object that does not exist is not an error
+	Delete(ctx context.Context, key string) error
+
+	// Deletes every object whose key starts with prefix
+	DeletePrefix(ctx context.Context, prefix string) error
+
+	// Returns every object whose key starts with prefix. Objects that are still being written are left out
+	List(ctx context.Context, prefix string) ([]Object, error)
+}
+
+// Creates the store selected by database.storage.type
+func New(config *types.Config, secrets *types.Secrets) (Store, error) {
+	switch config.Database.Storage.Type {
+	case TypeFile, "":
+		if config.Database.FileStoragePath == "" {
+			return nil, errors.New("database.file_storage_path must be set to use file storage")
+		}
+
+		return &FileStore{Root: config.Database.FileStoragePath}, nil
+	case TypeS3:
+		return NewS3Store(config.Database.Storage.S3, secrets.S3AccessKey, secrets.S3SecretKey)
+	default:
+		return nil, fmt.Errorf("unknown storage type: %s", config.Database.Storage.Type)
+	}
+}
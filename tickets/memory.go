@@ -0,0 +1,669 @@
+package tickets
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Keeps tickets and everything stored with them in memory, for running handlers and close jobs without Postgres
+type MemoryStore struct {
+	mu               sync.Mutex
+	tickets          map[string]Ticket
+	log              []MessageEvent
+	closeJobs        map[string]CloseJob
+	closeAttachments map[string][]CloseAttachment
+	blobs            map[string]Blob
+	refs             map[[2]string]string // Blob hash by ticket and attachment ID
+	deleting         map[string]bool      // Blobs whose removal was started but didn't finish
+	access           []Access
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		tickets:          map[string]Ticket{},
+		closeJobs:        map[string]CloseJob{},
+		closeAttachments: map[string][]CloseAttachment{},
+		blobs:            map[string]Blob{},
+		refs:             map[[2]string]string{},
+		deleting:         map[string]bool{},
+	}
+}
+
+func (m *MemoryStore) Create(ctx context.Context, t *Ticket) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.tickets[t.ID]; ok {
+		return fmt.Errorf("error inserting ticket: ticket %s already exists", t.ID)
+	}
+
+	t.Open = true
+	m.tickets[t.ID] = *t
+	return nil
+}
+
+func (m *MemoryStore) Get(ctx context.Context, id string) (*Ticket, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.tickets[id]
+
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return &t, nil
+}
+
+func (m *MemoryStore) ForChannel(ctx context.Context, channelId string) (*Ticket, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, t := range m.tickets {
+		t := t
+
+		if t.ChannelID == channelId && t.Open {
+			return &t, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+func (m *MemoryStore) Unclosed(ctx context.Context) ([]*Ticket, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var tickets []*Ticket
+	for _, t := range m.tickets {
+		t := t
+
+		if _, ok := m.closeJobs[t.ID]; t.Open && !ok {
+			tickets = append(tickets, &t)
+		}
+	}
+
+	sort.Slice(tickets, func(i, j int) bool {
+		return tickets[i].ID < tickets[j].ID
+	})
+
+	return tickets, nil
+}
+
+func (m *MemoryStore) SetDataKey(ctx context.Context, tikId string, encKey string, encKeyId string) (string, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.tickets[tikId]
+
+	if !ok {
+		return "", "", ErrNotFound
+	}
+
+	if t.EncKey == "" {
+		t.EncKey = encKey
+		t.EncKeyID = encKeyId
+		m.tickets[tikId] = t
+	}
+
+	return t.EncKey, t.EncKeyID, nil
+}
+
+func (m *MemoryStore) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.tickets, id)
+	delete(m.closeJobs, id)
+	delete(m.closeAttachments, id)
+	m.dropLog(id)
+
+	for ref := range m.refs {
+		if ref[0] == id {
+			delete(m.refs, ref)
+		}
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) dropLog(tikId string) {
+	var kept = m.log[:0]
+
+	for _, e := range m.log {
+		if e.TicketID != tikId {
+			kept = append(kept, e)
+		}
+	}
+
+	m.log = kept
+}
+
+func (m *MemoryStore) LogMessage(ctx context.Context, e *MessageEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.tickets[e.TicketID]; !ok {
+		return fmt.Errorf("error recording message: ticket %s does not exist", e.TicketID)
+	}
+
+	if e.Event == EventCreate {
+		for _, logged := range m.log {
+			if logged.MessageID == e.MessageID && logged.Event == EventCreate {
+				return nil
+			}
+		}
+	}
+
+	var logged = *e
+
+	if logged.CreatedAt.IsZero() {
+		logged.CreatedAt = time.Now()
+	}
+
+	m.log = append(m.log, logged)
+	return nil
+}
+
+func (m *MemoryStore) MessageLog(ctx context.Context, tikId string) ([]*MessageEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var log []*MessageEvent
+	for _, e := range m.log {
+		e := e
+
+		if e.TicketID == tikId {
+			log = append(log, &e)
+		}
+	}
+
+	return log, nil
+}
+
+func (m *MemoryStore) LastLogged(ctx context.Context, messageId string) (*MessageEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := len(m.log) - 1; i >= 0; i-- {
+		if e := m.log[i]; e.MessageID == messageId && e.Event != EventDelete {
+			return &e, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (m *MemoryStore) StartClose(ctx context.Context, tikId string, closeUserId string, step string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.tickets[tikId]; !ok {
+		return false, fmt.Errorf("error creating close job: ticket %s does not exist", tikId)
+	}
+
+	if _, ok := m.closeJobs[tikId]; ok {
+		return false, nil
+	}
+
+	now := time.Now()
+	m.closeJobs[tikId] = CloseJob{TicketID: tikId, Step: step, CloseUserID: closeUserId, CreatedAt: now, UpdatedAt: now}
+	return true, nil
+}
+
+func (m *MemoryStore) CloseJob(ctx context.Context, tikId string) (*CloseJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	j, ok := m.closeJobs[tikId]
+
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return &j, nil
+}
+
+func (m *MemoryStore) UnfinishedCloseJobs(ctx context.Context) ([]*CloseJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var jobs []*CloseJob
+	for _, j := range m.closeJobs {
+		j := j
+
+		if j.Step != StepDone {
+			jobs = append(jobs, &j)
+		}
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+	})
+
+	return jobs, nil
+}
+
+func (m *MemoryStore) ClaimCloseJob(ctx context.Context, tikId string, token int64) (*CloseJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	j, ok := m.closeJobs[tikId]
+
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	if j.Fence >= token {
+		return nil, ErrFenced
+	}
+
+	j.Attempts++
+	j.Fence = token
+	j.UpdatedAt = time.Now()
+	m.closeJobs[tikId] = j
+
+	return &j, nil
+}
+
+func (m *MemoryStore) FailCloseJob(ctx context.Context, tikId string, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if j, ok := m.closeJobs[tikId]; ok {
+		j.LastError = reason
+		j.UpdatedAt = time.Now()
+		m.closeJobs[tikId] = j
+	}
+
+	return nil
+}
+
+// Applies fn to a close job and moves it on to its next step, or changes nothing if a newer lock has claimed the job
+// or fn fails. Must be called with mu held
+func (m *MemoryStore) step(tikId string, token int64, next string, fn func(j *CloseJob) error) error {
+	j, ok := m.closeJobs[tikId]
+
+	if !ok || j.Fence != token {
+		return ErrFenced
+	}
+
+	if fn != nil {
+		if err := fn(&j); err != nil {
+			return err
+		}
+	}
+
+	j.Step = next
+	j.LastError = ""
+	j.UpdatedAt = time.Now()
+	m.closeJobs[tikId] = j
+
+	return nil
+}
+
+func (m *MemoryStore) AdvanceCloseJob(ctx context.Context, tikId string, token int64, next string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.step(tikId, token, next, nil)
+}
+
+func (m *MemoryStore) SaveSnapshot(ctx context.Context, tikId string, token int64, snapshot []byte, next string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.step(tikId, token, next, func(j *CloseJob) error {
+		j.Snapshot = snapshot
+		return nil
+	})
+}
+
+func (m *MemoryStore) SaveCloseAttachment(ctx context.Context, tikId string, a *CloseAttachment, blob *Blob, upload func(ctx context.Context) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.closeJobs[tikId]; !ok {
+		return fmt.Errorf("error saving attachment: ticket %s has no close job", tikId)
+	}
+
+	if blob != nil {
+		if _, ok := m.blobs[blob.Hash]; !ok || m.deleting[blob.Hash] {
+			// Holding mu while uploading is what keeps CollectBlob from removing it before the reference exists
+			if err := upload(ctx); err != nil {
+				return err
+			}
+
+			var stored = *blob
+
+			if stored.CreatedAt.IsZero() {
+				stored.CreatedAt = time.Now()
+			}
+
+			m.blobs[blob.Hash] = stored
+			delete(m.deleting, blob.Hash)
+		}
+
+		m.refs[[2]string{tikId, a.AttachmentID}] = blob.Hash
+	}
+
+	for _, saved := range m.closeAttachments[tikId] {
+		if saved.AttachmentID == a.AttachmentID {
+			return nil
+		}
+	}
+
+	m.closeAttachments[tikId] = append(m.closeAttachments[tikId], *a)
+	return nil
+}
+
+func (m *MemoryStore) CloseAttachments(ctx context.Context, tikId string) ([]*CloseAttachment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var saved []*CloseAttachment
+	for _, a := range m.closeAttachments[tikId] {
+		a := a
+		saved = append(saved, &a)
+	}
+
+	return saved, nil
+}
+
+func (m *MemoryStore) SaveTranscript(ctx context.Context, tikId string, token int64, closeUserId string, encMessages []byte, encContext []byte, next string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.step(tikId, token, next, func(j *CloseJob) error {
+		t := m.tickets[tikId]
+		t.Open = false
+		t.CloseUserID = closeUserId
+		t.Messages = nil
+		t.EncMessages = encMessages
+		t.TicketContext = nil
+		t.EncTicketContext = encContext
+		m.tickets[tikId] = t
+
+		m.dropLog(tikId)
+		j.Snapshot = nil
+		return nil
+	})
+}
+
+func (m *MemoryStore) SetLogMessage(ctx context.Context, tikId string, token int64, messageId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	j, ok := m.closeJobs[tikId]
+
+	if !ok || j.Fence != token {
+		return ErrFenced
+	}
+
+	j.LogMessageID = &messageId
+	j.UpdatedAt = time.Now()
+	m.closeJobs[tikId] = j
+
+	return nil
+}
+
+func (m *MemoryStore) SaveDMMessage(ctx context.Context, tikId string, token int64, messageId *string, next string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.step(tikId, token, next, func(j *CloseJob) error {
+		j.DMMessageID = messageId
+		return nil
+	})
+}
+
+func (m *MemoryStore) FinishCloseJob(ctx context.Context, tikId string, token int64, next string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.step(tikId, token, next, func(j *CloseJob) error {
+		delete(m.closeAttachments, tikId)
+		return nil
+	})
+}
+
+func (m *MemoryStore) Blob(ctx context.Context, tikId string, attachmentId string) (*Blob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hash, ok := m.refs[[2]string{tikId, attachmentId}]
+
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	b := m.blobs[hash]
+	return &b, nil
+}
+
+// Must be called with mu held
+func (m *MemoryStore) referenced(hash string) bool {
+	for _, h := range m.refs {
+		if h == hash {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *MemoryStore) UnreferencedBlobs(ctx context.Context, before time.Time) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var hashes []string
+	for hash, b := range m.blobs {
+		if (b.CreatedAt.Before(before) || m.deleting[hash]) && !m.referenced(hash) {
+			hashes = append(hashes, hash)
+		}
+	}
+
+	sort.Strings(hashes)
+	return hashes, nil
+}
+
+func (m *MemoryStore) CollectBlob(ctx context.Context, hash string, remove func(ctx context.Context) error) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.blobs[hash]; !ok || m.referenced(hash) {
+		return false, nil
+	}
+
+	m.deleting[hash] = true
+
+	if err := remove(ctx); err != nil {
+		return false, err
+	}
+
+	delete(m.blobs, hash)
+	delete(m.deleting, hash)
+	return true, nil
+}
+
+func (m *MemoryStore) BlobExists(ctx context.Context, hash string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.blobs[hash]
+	return ok, nil
+}
+
+func (m *MemoryStore) ClaimOrphan(ctx context.Context, hash string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.blobs[hash]; ok {
+		return false, nil
+	}
+
+	m.blobs[hash] = Blob{Hash: hash, CreatedAt: time.Now()}
+	m.deleting[hash] = true
+	return true, nil
+}
+
+func (m *MemoryStore) CountKeysToRewrap(ctx context.Context, keyId string, after string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var total int64
+	for id, t := range m.tickets {
+		if t.EncKey != "" && t.EncKeyID != keyId && id > after {
+			total++
+		}
+	}
+
+	return total, nil
+}
+
+func (m *MemoryStore) RewrapTicketKeys(ctx context.Context, keyId string, after string, limit int, rewrap func(id string, key WrappedKey) (WrappedKey, error)) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var keys = map[string]WrappedKey{}
+	for id, t := range m.tickets {
+		if t.EncKey != "" && t.EncKeyID != keyId && id > after {
+			keys[id] = WrappedKey{EncKey: t.EncKey, EncKeyID: t.EncKeyID}
+		}
+	}
+
+	return rewrapBatch(keys, limit, rewrap, func(id string, key WrappedKey) {
+		t := m.tickets[id]
+		t.EncKey = key.EncKey
+		t.EncKeyID = key.EncKeyID
+		m.tickets[id] = t
+	})
+}
+
+func (m *MemoryStore) RewrapBlobKeys(ctx context.Context, keyId string, after string, limit int, rewrap func(hash string, key WrappedKey) (WrappedKey, error)) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var keys = map[string]WrappedKey{}
+	for hash, b := range m.blobs {
+		if b.EncKeyID != keyId && b.EncKeyID != "" && !m.deleting[hash] && hash > after {
+			keys[hash] = WrappedKey{EncKey: b.EncKey, EncKeyID: b.EncKeyID}
+		}
+	}
+
+	return rewrapBatch(keys, limit, rewrap, func(hash string, key WrappedKey) {
+		b := m.blobs[hash]
+		b.EncKey = key.EncKey
+		b.EncKeyID = key.EncKeyID
+		m.blobs[hash] = b
+	})
+}
+
+// Re-wraps the first limit keys by ID, only storing them once all of them have been re-wrapped
+func rewrapBatch(keys map[string]WrappedKey, limit int, rewrap func(id string, key WrappedKey) (WrappedKey, error), store func(id string, key WrappedKey)) ([]string, error) {
+	var ids []string
+	for id := range keys {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+	ids = ids[:min(limit, len(ids))]
+
+	var rewrapped = map[string]WrappedKey{}
+	for _, id := range ids {
+		key, err := rewrap(id, keys[id])
+
+		if err != nil {
+			return nil, err
+		}
+
+		rewrapped[id] = key
+	}
+
+	for id, key := range rewrapped {
+		store(id, key)
+	}
+
+	return ids, nil
+}
+
+func (m *MemoryStore) CountPlaintextTickets(ctx context.Context, after string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var total int64
+	for id, t := range m.tickets {
+		if (t.Messages != nil || t.TicketContext != nil) && id > after {
+			total++
+		}
+	}
+
+	return total, nil
+}
+
+func (m *MemoryStore) EncryptPlaintextTickets(ctx context.Context, after string, limit int, encrypt func(t *Ticket) error) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ids []string
+	for id, t := range m.tickets {
+		if (t.Messages != nil || t.TicketContext != nil) && id > after {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Strings(ids)
+	ids = ids[:min(limit, len(ids))]
+
+	var encrypted []Ticket
+	for _, id := range ids {
+		t := m.tickets[id]
+		err := encrypt(&t)
+
+		if err != nil {
+			return nil, err
+		}
+
+		t.Messages = nil
+		t.TicketContext = nil
+		encrypted = append(encrypted, t)
+	}
+
+	for _, t := range encrypted {
+		m.tickets[t.ID] = t
+	}
+
+	return ids, nil
+}
+
+func (m *MemoryStore) LogAccess(ctx context.Context, a *Access) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var logged = *a
+
+	if logged.AccessedAt.IsZero() {
+		logged.AccessedAt = time.Now()
+	}
+
+	m.access = append(m.access, logged)
+	return nil
+}
+
+func (m *MemoryStore) AccessLog(ctx context.Context, tikId string, limit int) ([]*Access, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var accesses []*Access
+	for i := len(m.access) - 1; i >= 0 && len(accesses) < limit; i-- {
+		if m.access[i].TicketID == tikId {
+			a := m.access[i]
+			accesses = append(accesses, &a)
+		}
+	}
+
+	return accesses, nil
+}
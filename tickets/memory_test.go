@@ -0,0 +1,505 @@
+package tickets
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func testTicket(t *testing.T, m *MemoryStore, id string) {
+	err := m.Create(context.Background(), &Ticket{ID: id, UserID: "u1", ChannelID: "c-" + id, TopicID: "support", Issue: "help"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryTickets(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStore()
+
+	testTicket(t, m, "t1")
+	testTicket(t, m, "t2")
+
+	if err := m.Create(ctx, &Ticket{ID: "t1"}); err == nil {
+		t.Fatal("Create accepted a ticket that already exists")
+	}
+
+	tik, err := m.ForChannel(ctx, "c-t1")
+
+	if err != nil || tik.ID != "t1" || !tik.Open {
+		t.Fatalf("ForChannel = %+v, %v", tik, err)
+	}
+
+	if _, err := m.ForChannel(ctx, "c-t3"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("ForChannel unknown channel error = %v, want %v", err, ErrNotFound)
+	}
+
+	if _, err := m.StartClose(ctx, "t2", "staff1", "snapshot"); err != nil {
+		t.Fatal(err)
+	}
+
+	unclosed, err := m.Unclosed(ctx)
+
+	if err != nil || len(unclosed) != 1 || unclosed[0].ID != "t1" {
+		t.Fatalf("Unclosed = %v, %v, want only t1", unclosed, err)
+	}
+}
+
+func TestMemoryMessageLog(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStore()
+	testTicket(t, m, "t1")
+
+	first, edited := "first", "edited"
+
+	events := []*MessageEvent{
+		{TicketID: "t1", MessageID: "m1", Event: EventCreate, AuthorID: "u1", Content: &first},
+		{TicketID: "t1", MessageID: "m1", Event: EventCreate, AuthorID: "u1", Content: &edited}, // Backfilled again
+		{TicketID: "t1", MessageID: "m1", Event: EventUpdate, Content: &edited},
+		{TicketID: "t1", MessageID: "m1", Event: EventDelete},
+	}
+
+	for _, e := range events {
+		if err := m.LogMessage(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	log, err := m.MessageLog(ctx, "t1")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(log) != 3 || log[0].Event != EventCreate || *log[0].Content != "first" || log[2].Event != EventDelete {
+		t.Fatalf("MessageLog logged %d events, want the create once followed by the update and delete", len(log))
+	}
+
+	last, err := m.LastLogged(ctx, "m1")
+
+	if err != nil || last == nil || last.Event != EventUpdate || *last.Content != "edited" {
+		t.Fatalf("LastLogged = %+v, %v, want the edit", last, err)
+	}
+
+	if last, _ := m.LastLogged(ctx, "m2"); last != nil {
+		t.Fatalf("LastLogged of a message never logged = %+v", last)
+	}
+
+	if err := m.LogMessage(ctx, &MessageEvent{TicketID: "t2", MessageID: "m2", Event: EventCreate}); err == nil {
+		t.Fatal("LogMessage accepted an event for a ticket that doesn't exist")
+	}
+}
+
+func TestMemorySetDataKey(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStore()
+	testTicket(t, m, "t1")
+
+	if key, keyId, err := m.SetDataKey(ctx, "t1", "wrapped", "k1"); err != nil || key != "wrapped" || keyId != "k1" {
+		t.Fatalf("SetDataKey = %s, %s, %v", key, keyId, err)
+	}
+
+	if key, keyId, _ := m.SetDataKey(ctx, "t1", "other", "k2"); key != "wrapped" || keyId != "k1" {
+		t.Fatalf("SetDataKey replaced the ticket's key with %s (%s)", key, keyId)
+	}
+
+	if _, _, err := m.SetDataKey(ctx, "t2", "wrapped", "k1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("SetDataKey of a missing ticket error = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestMemoryCloseJobFencing(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStore()
+	testTicket(t, m, "t1")
+
+	if _, err := m.ClaimCloseJob(ctx, "t1", 1); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("ClaimCloseJob without a job error = %v, want %v", err, ErrNotFound)
+	}
+
+	created, err := m.StartClose(ctx, "t1", "staff1", "snapshot")
+
+	if err != nil || !created {
+		t.Fatalf("StartClose = %v, %v", created, err)
+	}
+
+	if created, _ := m.StartClose(ctx, "t1", "staff2", "snapshot"); created {
+		t.Fatal("StartClose created a second job for the same ticket")
+	}
+
+	j, err := m.ClaimCloseJob(ctx, "t1", 1)
+
+	if err != nil || j.Attempts != 1 || j.CloseUserID != "staff1" {
+		t.Fatalf("ClaimCloseJob = %+v, %v", j, err)
+	}
+
+	if err := m.SaveSnapshot(ctx, "t1", 1, []byte("snap"), "attachments"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A newer lock takes over, so writes under the old token must fail and change nothing
+	if _, err := m.ClaimCloseJob(ctx, "t1", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.ClaimCloseJob(ctx, "t1", 2); !errors.Is(err, ErrFenced) {
+		t.Fatalf("ClaimCloseJob with the same token error = %v, want %v", err, ErrFenced)
+	}
+
+	if err := m.AdvanceCloseJob(ctx, "t1", 1, "transcript"); !errors.Is(err, ErrFenced) {
+		t.Fatalf("AdvanceCloseJob with an old token error = %v, want %v", err, ErrFenced)
+	}
+
+	if err := m.SaveTranscript(ctx, "t1", 1, "staff1", []byte("messages"), []byte("context"), "notify"); !errors.Is(err, ErrFenced) {
+		t.Fatalf("SaveTranscript with an old token error = %v, want %v", err, ErrFenced)
+	}
+
+	if err := m.SetLogMessage(ctx, "t1", 1, "msg"); !errors.Is(err, ErrFenced) {
+		t.Fatalf("SetLogMessage with an old token error = %v, want %v", err, ErrFenced)
+	}
+
+	j, _ = m.CloseJob(ctx, "t1")
+	tik, _ := m.Get(ctx, "t1")
+
+	if j.Step != "attachments" || j.LogMessageID != nil || !tik.Open {
+		t.Fatalf("fenced writes changed the job (%+v) or ticket (%+v)", j, tik)
+	}
+
+	if err := m.SaveTranscript(ctx, "t1", 2, "staff1", []byte("messages"), []byte("context"), "notify"); err != nil {
+		t.Fatal(err)
+	}
+
+	j, _ = m.CloseJob(ctx, "t1")
+	tik, _ = m.Get(ctx, "t1")
+
+	if j.Step != "notify" || j.Snapshot != nil || tik.Open || tik.CloseUserID != "staff1" {
+		t.Fatalf("SaveTranscript left job %+v and ticket %+v", j, tik)
+	}
+
+	unfinished, _ := m.UnfinishedCloseJobs(ctx)
+
+	if len(unfinished) != 1 {
+		t.Fatalf("UnfinishedCloseJobs = %v", unfinished)
+	}
+
+	if err := m.FinishCloseJob(ctx, "t1", 2, StepDone); err != nil {
+		t.Fatal(err)
+	}
+
+	if unfinished, _ := m.UnfinishedCloseJobs(ctx); len(unfinished) != 0 {
+		t.Fatalf("UnfinishedCloseJobs after finishing = %v", unfinished)
+	}
+}
+
+func TestMemoryBlobs(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStore()
+	testTicket(t, m, "t1")
+	testTicket(t, m, "t2")
+
+	for _, id := range []string{"t1", "t2"} {
+		if _, err := m.StartClose(ctx, id, "staff1", "attachments"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var uploads int
+	upload := func(ctx context.Context) error {
+		uploads++
+		return nil
+	}
+
+	blob := &Blob{Hash: "h1", Size: 5, EncKey: "key", EncKeyID: "k1"}
+
+	// The same content in two tickets is only uploaded once
+	if err := m.SaveCloseAttachment(ctx, "t1", &CloseAttachment{AttachmentID: "a1", MessageID: "m1"}, blob, upload); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SaveCloseAttachment(ctx, "t2", &CloseAttachment{AttachmentID: "a2", MessageID: "m2"}, blob, upload); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SaveCloseAttachment(ctx, "t1", &CloseAttachment{AttachmentID: "a3", MessageID: "m1"}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if uploads != 1 {
+		t.Fatalf("uploaded %d times, want 1", uploads)
+	}
+
+	if saved, _ := m.CloseAttachments(ctx, "t1"); len(saved) != 2 {
+		t.Fatalf("CloseAttachments = %d attachments, want 2", len(saved))
+	}
+
+	if b, err := m.Blob(ctx, "t2", "a2"); err != nil || b.Hash != "h1" || b.EncKey != "key" {
+		t.Fatalf("Blob = %+v, %v", b, err)
+	}
+
+	if _, err := m.Blob(ctx, "t1", "a3"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Blob of an attachment that wasn't stored error = %v, want %v", err, ErrNotFound)
+	}
+
+	later := time.Now().Add(time.Hour)
+	remove := func(ctx context.Context) error { return nil }
+
+	// Deleting a ticket drops its references, but the blob stays until nothing references it
+	if err := m.Delete(ctx, "t1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if hashes, _ := m.UnreferencedBlobs(ctx, later); len(hashes) != 0 {
+		t.Fatalf("UnreferencedBlobs = %v while t2 references h1", hashes)
+	}
+
+	if removed, _ := m.CollectBlob(ctx, "h1", remove); removed {
+		t.Fatal("CollectBlob removed a referenced blob")
+	}
+
+	if err := m.Delete(ctx, "t2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if hashes, _ := m.UnreferencedBlobs(ctx, time.Now().Add(-time.Hour)); len(hashes) != 0 {
+		t.Fatalf("UnreferencedBlobs = %v for blobs newer than the cutoff", hashes)
+	}
+
+	if hashes, _ := m.UnreferencedBlobs(ctx, later); len(hashes) != 1 || hashes[0] != "h1" {
+		t.Fatalf("UnreferencedBlobs = %v, want h1", hashes)
+	}
+
+	if removed, err := m.CollectBlob(ctx, "h1", remove); err != nil || !removed {
+		t.Fatalf("CollectBlob = %v, %v", removed, err)
+	}
+
+	if hashes, _ := m.UnreferencedBlobs(ctx, later); len(hashes) != 0 {
+		t.Fatalf("UnreferencedBlobs after collecting = %v", hashes)
+	}
+}
+
+func TestMemoryBlobRemovalFails(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStore()
+	testTicket(t, m, "t1")
+
+	if _, err := m.StartClose(ctx, "t1", "staff1", "attachments"); err != nil {
+		t.Fatal(err)
+	}
+
+	var uploads int
+	upload := func(ctx context.Context) error {
+		uploads++
+		return nil
+	}
+
+	blob := &Blob{Hash: "h1", Size: 5, EncKey: "key", EncKeyID: "k1", CreatedAt: time.Now()}
+
+	if err := m.SaveCloseAttachment(ctx, "t1", &CloseAttachment{AttachmentID: "a1", MessageID: "m1"}, blob, upload); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Delete(ctx, "t1"); err != nil {
+		t.Fatal(err)
+	}
+
+	failed := errors.New("storage is down")
+
+	if _, err := m.CollectBlob(ctx, "h1", func(ctx context.Context) error { return failed }); !errors.Is(err, failed) {
+		t.Fatalf("CollectBlob error = %v, want %v", err, failed)
+	}
+
+	// The blob may be half gone, so it is collected again however new it is
+	if hashes, _ := m.UnreferencedBlobs(ctx, time.Now().Add(-time.Hour)); len(hashes) != 1 || hashes[0] != "h1" {
+		t.Fatalf("UnreferencedBlobs after a failed removal = %v, want h1", hashes)
+	}
+
+	// A close storing the same content takes it back by uploading again rather than trusting what is left
+	testTicket(t, m, "t2")
+
+	if _, err := m.StartClose(ctx, "t2", "staff1", "attachments"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SaveCloseAttachment(ctx, "t2", &CloseAttachment{AttachmentID: "a2", MessageID: "m2"}, blob, upload); err != nil {
+		t.Fatal(err)
+	}
+
+	if uploads != 2 {
+		t.Fatalf("uploaded %d times, want the blob uploaded again", uploads)
+	}
+
+	if hashes, _ := m.UnreferencedBlobs(ctx, time.Now().Add(time.Hour)); len(hashes) != 0 {
+		t.Fatalf("UnreferencedBlobs after taking the blob back = %v", hashes)
+	}
+}
+
+func TestMemoryClaimOrphan(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStore()
+
+	claimed, err := m.ClaimOrphan(ctx, "h1")
+
+	if err != nil || !claimed {
+		t.Fatalf("ClaimOrphan = %v, %v", claimed, err)
+	}
+
+	if exists, _ := m.BlobExists(ctx, "h1"); !exists {
+		t.Fatal("claimed orphan has no blob")
+	}
+
+	if claimed, _ := m.ClaimOrphan(ctx, "h1"); claimed {
+		t.Fatal("ClaimOrphan claimed a hash that has a blob")
+	}
+
+	if removed, err := m.CollectBlob(ctx, "h1", func(ctx context.Context) error { return nil }); err != nil || !removed {
+		t.Fatalf("CollectBlob of a claimed orphan = %v, %v", removed, err)
+	}
+
+	if exists, _ := m.BlobExists(ctx, "h1"); exists {
+		t.Fatal("collected orphan still has a blob")
+	}
+}
+
+func TestMemoryRewrapTicketKeys(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStore()
+
+	for _, tik := range []*Ticket{
+		{ID: "t1", EncKey: "old1", EncKeyID: "k1"},
+		{ID: "t2", EncKey: "new2", EncKeyID: "k2"},
+		{ID: "t3", EncKey: "legacy3"},
+		{ID: "t4"}, // Opened before envelope encryption
+		{ID: "t5", EncKey: "old5", EncKeyID: "k1"},
+	} {
+		if err := m.Create(ctx, tik); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	total, err := m.CountKeysToRewrap(ctx, "k2", "")
+
+	if err != nil || total != 3 {
+		t.Fatalf("CountKeysToRewrap = %d, %v, want 3", total, err)
+	}
+
+	rewrap := func(id string, key WrappedKey) (WrappedKey, error) {
+		return WrappedKey{EncKey: "new-" + id, EncKeyID: "k2"}, nil
+	}
+
+	ids, err := m.RewrapTicketKeys(ctx, "k2", "", 2, rewrap)
+
+	if err != nil || len(ids) != 2 || ids[0] != "t1" || ids[1] != "t3" {
+		t.Fatalf("RewrapTicketKeys = %v, %v, want [t1 t3]", ids, err)
+	}
+
+	// A failing key leaves the whole batch as it was
+	ids, err = m.RewrapTicketKeys(ctx, "k2", "t3", 2, func(id string, key WrappedKey) (WrappedKey, error) {
+		return key, errors.New("can't unwrap")
+	})
+
+	if err == nil || ids != nil {
+		t.Fatalf("RewrapTicketKeys with a failing rewrap = %v, %v", ids, err)
+	}
+
+	ids, err = m.RewrapTicketKeys(ctx, "k2", "t3", 2, rewrap)
+
+	if err != nil || len(ids) != 1 || ids[0] != "t5" {
+		t.Fatalf("RewrapTicketKeys after t3 = %v, %v, want [t5]", ids, err)
+	}
+
+	for id, want := range map[string]string{"t1": "new-t1", "t2": "new2", "t3": "new-t3", "t4": "", "t5": "new-t5"} {
+		tik, _ := m.Get(ctx, id)
+
+		if tik.EncKey != want {
+			t.Errorf("key of %s = %q, want %q", id, tik.EncKey, want)
+		}
+	}
+
+	if total, _ := m.CountKeysToRewrap(ctx, "k2", ""); total != 0 {
+		t.Fatalf("%d keys left to rewrap", total)
+	}
+}
+
+func TestMemoryEncryptPlaintextTickets(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStore()
+
+	testTicket(t, m, "t1")
+	testTicket(t, m, "t2")
+	testTicket(t, m, "t3")
+
+	// Tickets are only ever stored with plaintext columns by older versions
+	m.tickets["t1"] = Ticket{ID: "t1", Messages: []byte(`[]`), TicketContext: []byte(`{}`)}
+	m.tickets["t3"] = Ticket{ID: "t3", EncKey: "key3", EncKeyID: "k1", TicketContext: []byte(`{}`), EncMessages: []byte("enc")}
+
+	total, err := m.CountPlaintextTickets(ctx, "")
+
+	if err != nil || total != 2 {
+		t.Fatalf("CountPlaintextTickets = %d, %v, want 2", total, err)
+	}
+
+	ids, err := m.EncryptPlaintextTickets(ctx, "", 10, func(tik *Ticket) error {
+		if tik.EncKey == "" {
+			tik.EncKey, tik.EncKeyID = "new-"+tik.ID, "k1"
+		}
+
+		if tik.Messages != nil {
+			tik.EncMessages = append([]byte("enc:"), tik.Messages...)
+		}
+
+		tik.EncTicketContext = append([]byte("enc:"), tik.TicketContext...)
+		return nil
+	})
+
+	if err != nil || len(ids) != 2 || ids[0] != "t1" || ids[1] != "t3" {
+		t.Fatalf("EncryptPlaintextTickets = %v, %v, want [t1 t3]", ids, err)
+	}
+
+	t1, _ := m.Get(ctx, "t1")
+
+	if t1.Messages != nil || t1.TicketContext != nil || t1.EncKey != "new-t1" || string(t1.EncMessages) != "enc:[]" {
+		t.Fatalf("t1 after encrypting = %+v", t1)
+	}
+
+	t3, _ := m.Get(ctx, "t3")
+
+	if t3.TicketContext != nil || t3.EncKey != "key3" || string(t3.EncMessages) != "enc" || string(t3.EncTicketContext) != "enc:{}" {
+		t.Fatalf("t3 after encrypting = %+v", t3)
+	}
+
+	if total, _ := m.CountPlaintextTickets(ctx, ""); total != 0 {
+		t.Fatalf("%d tickets left to encrypt", total)
+	}
+}
+
+func TestMemoryAccessLog(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStore()
+
+	for _, a := range []*Access{
+		{TicketID: "t1", ViewerID: "u1", Granted: true},
+		{TicketID: "t2", ViewerID: "u2", Granted: true},
+		{TicketID: "t1", ViewerID: "u3", AttachmentID: "a1"},
+		{TicketID: "t1", ViewerID: "u4", Granted: true},
+	} {
+		if err := m.LogAccess(ctx, a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	accesses, err := m.AccessLog(ctx, "t1", 2)
+
+	if err != nil || len(accesses) != 2 {
+		t.Fatalf("AccessLog = %v, %v, want 2 accesses", accesses, err)
+	}
+
+	if accesses[0].ViewerID != "u4" || accesses[1].ViewerID != "u3" || accesses[1].AttachmentID != "a1" || accesses[1].Granted {
+		t.Fatalf("AccessLog = %+v, %+v, want the newest first", accesses[0], accesses[1])
+	}
+
+	if accesses[0].AccessedAt.IsZero() {
+		t.Fatal("access logged without a time")
+	}
+}
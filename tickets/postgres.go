@@ -0,0 +1,853 @@
+package tickets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Stores tickets in the tickets table, and everything else in the tables next to it
+type PostgresStore struct {
+	pool *pgxpool.Pool
+}
+
+func NewPostgresStore(pool *pgxpool.Pool) *PostgresStore {
+	return &PostgresStore{pool: pool}
+}
+
+const ticketColumns = "id, user_id, channel_id, topic_id, issue, open, COALESCE(close_user_id, ''), COALESCE(enc_key, ''), COALESCE(enc_key_id, ''), enc_ticket_context, enc_messages, ticket_context, messages"
+
+func scanTicket(row pgx.Row) (*Ticket, error) {
+	var t Ticket
+	err := row.Scan(&t.ID, &t.UserID, &t.ChannelID, &t.TopicID, &t.Issue, &t.Open, &t.CloseUserID, &t.EncKey, &t.EncKeyID, &t.EncTicketContext, &t.EncMessages, &t.TicketContext, &t.Messages)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+func (p *PostgresStore) Create(ctx context.Context, t *Ticket) error {
+	_, err := p.pool.Exec(ctx, "INSERT INTO tickets (id, user_id, channel_id, topic_id, enc_ticket_context, issue, enc_key, enc_key_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)", t.ID, t.UserID, t.ChannelID, t.TopicID, t.EncTicketContext, t.Issue, t.EncKey, t.EncKeyID)
+
+	if err != nil {
+		return fmt.Errorf("error inserting ticket: %w", err)
+	}
+
+	t.Open = true
+	return nil
+}
+
+func (p *PostgresStore) Get(ctx context.Context, id string) (*Ticket, error) {
+	t, err := scanTicket(p.pool.QueryRow(ctx, "SELECT "+ticketColumns+" FROM tickets WHERE id = $1", id))
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting ticket: %w", err)
+	}
+
+	return t, nil
+}
+
+func (p *PostgresStore) ForChannel(ctx context.Context, channelId string) (*Ticket, error) {
+	t, err := scanTicket(p.pool.QueryRow(ctx, "SELECT "+ticketColumns+" FROM tickets WHERE channel_id = $1 AND open = true", channelId))
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error finding ticket for channel: %w", err)
+	}
+
+	return t, nil
+}
+
+func (p *PostgresStore) Unclosed(ctx context.Context) ([]*Ticket, error) {
+	rows, err := p.pool.Query(ctx, "SELECT "+ticketColumns+" FROM tickets t WHERE open = true AND NOT EXISTS (SELECT 1 FROM close_jobs j WHERE j.ticket_id = t.id)")
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting open tickets: %w", err)
+	}
+
+	defer rows.Close()
+
+	var tickets []*Ticket
+	for rows.Next() {
+		t, err := scanTicket(rows)
+
+		if err != nil {
+			return nil, fmt.Errorf("error scanning ticket: %w", err)
+		}
+
+		tickets = append(tickets, t)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("error reading open tickets: %w", rows.Err())
+	}
+
+	return tickets, nil
+}
+
+func (p *PostgresStore) SetDataKey(ctx context.Context, tikId string, encKey string, encKeyId string) (string, string, error) {
+	// Returns the key already stored if another writer got there first
+	var stored, storedId string
+	err := p.pool.QueryRow(ctx, "WITH updated AS (UPDATE tickets SET enc_key = $2, enc_key_id = $3 WHERE id = $1 AND enc_key IS NULL RETURNING enc_key, enc_key_id) SELECT enc_key, enc_key_id FROM updated UNION ALL SELECT enc_key, COALESCE(enc_key_id, '') FROM tickets WHERE id = $1 AND enc_key IS NOT NULL", tikId, encKey, encKeyId).Scan(&stored, &storedId)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", "", ErrNotFound
+	}
+
+	if err != nil {
+		return "", "", fmt.Errorf("error setting data key: %w", err)
+	}
+
+	return stored, storedId, nil
+}
+
+func (p *PostgresStore) Delete(ctx context.Context, id string) error {
+	_, err := p.pool.Exec(ctx, "DELETE FROM tickets WHERE id = $1", id)
+
+	if err != nil {
+		return fmt.Errorf("error deleting ticket: %w", err)
+	}
+
+	return nil
+}
+
+func nullString(s string) *string {
+	if s == "" {
+		return nil
+	}
+
+	return &s
+}
+
+const messageEventColumns = "ticket_id, message_id, event, COALESCE(author_id, ''), content, embeds, attachments, enc_data, created_at"
+
+func scanMessageEvent(row pgx.Row) (*MessageEvent, error) {
+	var e MessageEvent
+	err := row.Scan(&e.TicketID, &e.MessageID, &e.Event, &e.AuthorID, &e.Content, &e.Embeds, &e.Attachments, &e.EncData, &e.CreatedAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+func (p *PostgresStore) LogMessage(ctx context.Context, e *MessageEvent) error {
+	_, err := p.pool.Exec(ctx, "INSERT INTO ticket_messages (ticket_id, message_id, event, author_id, content, embeds, attachments, enc_data) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT (message_id) WHERE event = 'create' DO NOTHING", e.TicketID, e.MessageID, e.Event, nullString(e.AuthorID), e.Content, e.Embeds, e.Attachments, e.EncData)
+
+	if err != nil {
+		return fmt.Errorf("error recording message: %w", err)
+	}
+
+	return nil
+}
+
+func (p *PostgresStore) MessageLog(ctx context.Context, tikId string) ([]*MessageEvent, error) {
+	rows, err := p.pool.Query(ctx, "SELECT "+messageEventColumns+" FROM ticket_messages WHERE ticket_id = $1 ORDER BY id", tikId)
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting ticket messages: %w", err)
+	}
+
+	defer rows.Close()
+
+	var log []*MessageEvent
+	for rows.Next() {
+		e, err := scanMessageEvent(rows)
+
+		if err != nil {
+			return nil, fmt.Errorf("error scanning ticket message: %w", err)
+		}
+
+		log = append(log, e)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("error reading ticket messages: %w", rows.Err())
+	}
+
+	return log, nil
+}
+
+func (p *PostgresStore) LastLogged(ctx context.Context, messageId string) (*MessageEvent, error) {
+	e, err := scanMessageEvent(p.pool.QueryRow(ctx, "SELECT "+messageEventColumns+" FROM ticket_messages WHERE message_id = $1 AND event <> $2 ORDER BY id DESC LIMIT 1", messageId, EventDelete))
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting logged message: %w", err)
+	}
+
+	return e, nil
+}
+
+const closeJobColumns = "ticket_id, step, close_user_id, snapshot, log_message_id, dm_message_id, attempts, fence, COALESCE(last_error, ''), created_at, updated_at"
+
+func scanCloseJob(row pgx.Row) (*CloseJob, error) {
+	var j CloseJob
+	err := row.Scan(&j.TicketID, &j.Step, &j.CloseUserID, &j.Snapshot, &j.LogMessageID, &j.DMMessageID, &j.Attempts, &j.Fence, &j.LastError, &j.CreatedAt, &j.UpdatedAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &j, nil
+}
+
+func (p *PostgresStore) StartClose(ctx context.Context, tikId string, closeUserId string, step string) (bool, error) {
+	tag, err := p.pool.Exec(ctx, "INSERT INTO close_jobs (ticket_id, step, close_user_id) VALUES ($1, $2, $3) ON CONFLICT (ticket_id) DO NOTHING", tikId, step, closeUserId)
+
+	if err != nil {
+		return false, fmt.Errorf("error creating close job: %w", err)
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+func (p *PostgresStore) CloseJob(ctx context.Context, tikId string) (*CloseJob, error) {
+	j, err := scanCloseJob(p.pool.QueryRow(ctx, "SELECT "+closeJobColumns+" FROM close_jobs WHERE ticket_id = $1", tikId))
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting close job: %w", err)
+	}
+
+	return j, nil
+}
+
+func (p *PostgresStore) UnfinishedCloseJobs(ctx context.Context) ([]*CloseJob, error) {
+	rows, err := p.pool.Query(ctx, "SELECT "+closeJobColumns+" FROM close_jobs WHERE step <> $1 ORDER BY created_at", StepDone)
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting unfinished close jobs: %w", err)
+	}
+
+	defer rows.Close()
+
+	var jobs []*CloseJob
+	for rows.Next() {
+		j, err := scanCloseJob(rows)
+
+		if err != nil {
+			return nil, fmt.Errorf("error scanning close job: %w", err)
+		}
+
+		jobs = append(jobs, j)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("error reading unfinished close jobs: %w", rows.Err())
+	}
+
+	return jobs, nil
+}
+
+func (p *PostgresStore) ClaimCloseJob(ctx context.Context, tikId string, token int64) (*CloseJob, error) {
+	// Claiming the job with our token fences off anyone still running it under an older lock
+	j, err := scanCloseJob(p.pool.QueryRow(ctx, "UPDATE close_jobs SET attempts = attempts + 1, fence = $2, updated_at = NOW() WHERE ticket_id = $1 AND fence < $2 RETURNING "+closeJobColumns, tikId, token))
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		var exists bool
+		err = p.pool.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM close_jobs WHERE ticket_id = $1)", tikId).Scan(&exists)
+
+		if err == nil && exists {
+			return nil, ErrFenced
+		}
+
+		if err == nil {
+			return nil, ErrNotFound
+		}
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error claiming close job: %w", err)
+	}
+
+	return j, nil
+}
+
+func (p *PostgresStore) FailCloseJob(ctx context.Context, tikId string, reason string) error {
+	_, err := p.pool.Exec(ctx, "UPDATE close_jobs SET last_error = $2, updated_at = NOW() WHERE ticket_id = $1", tikId, reason)
+
+	if err != nil {
+		return fmt.Errorf("error recording close job failure: %w", err)
+	}
+
+	return nil
+}
+
+// Moves a close job on to its next step as part of tx, failing with ErrFenced if a newer lock has claimed the job
+func advance(ctx context.Context, tx pgx.Tx, tikId string, token int64, next string) error {
+	tag, err := tx.Exec(ctx, "UPDATE close_jobs SET step = $2, last_error = NULL, updated_at = NOW() WHERE ticket_id = $1 AND fence = $3", tikId, next, token)
+
+	if err != nil {
+		return fmt.Errorf("error advancing close job: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrFenced
+	}
+
+	return nil
+}
+
+// Runs fn in a transaction that also moves a close job on to its next step
+func (p *PostgresStore) step(ctx context.Context, tikId string, token int64, next string, fn func(tx pgx.Tx) error) error {
+	tx, err := p.pool.Begin(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback(ctx)
+
+	err = fn(tx)
+
+	if err != nil {
+		return err
+	}
+
+	err = advance(ctx, tx, tikId, token, next)
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (p *PostgresStore) AdvanceCloseJob(ctx context.Context, tikId string, token int64, next string) error {
+	return p.step(ctx, tikId, token, next, func(tx pgx.Tx) error {
+		return nil
+	})
+}
+
+func (p *PostgresStore) SaveSnapshot(ctx context.Context, tikId string, token int64, snapshot []byte, next string) error {
+	return p.step(ctx, tikId, token, next, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, "UPDATE close_jobs SET snapshot = $2 WHERE ticket_id = $1", tikId, snapshot)
+
+		if err != nil {
+			return fmt.Errorf("error saving snapshot: %w", err)
+		}
+
+		return nil
+	})
+}
+
+func (p *PostgresStore) SaveCloseAttachment(ctx context.Context, tikId string, a *CloseAttachment, blob *Blob, upload func(ctx context.Context) error) error {
+	tx, err := p.pool.Begin(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback(ctx)
+
+	if blob != nil {
+		err = addReference(ctx, tx, tikId, a.AttachmentID, blob, upload)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(ctx, "INSERT INTO close_job_attachments (ticket_id, attachment_id, message_id, data) VALUES ($1, $2, $3, $4) ON CONFLICT (ticket_id, attachment_id) DO NOTHING", tikId, a.AttachmentID, a.MessageID, a.Data)
+
+	if err != nil {
+		return fmt.Errorf("error saving attachment: %w", err)
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Records an attachment as a reference to blob as part of tx, adding the blob (and uploading it) if it isn't stored
+// yet. Concurrent closes storing the same content wait on each other through the attachment_blobs row
+func addReference(ctx context.Context, tx pgx.Tx, tikId string, attachmentId string, blob *Blob, upload func(ctx context.Context) error) error {
+	err := addBlob(ctx, tx, blob, upload)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, "INSERT INTO attachment_refs (ticket_id, attachment_id, hash) VALUES ($1, $2, $3) ON CONFLICT (ticket_id, attachment_id) DO UPDATE SET hash = EXCLUDED.hash", tikId, attachmentId, blob.Hash)
+
+	if err != nil {
+		return fmt.Errorf("error adding blob reference: %w", err)
+	}
+
+	return nil
+}
+
+func addBlob(ctx context.Context, tx pgx.Tx, blob *Blob, upload func(ctx context.Context) error) error {
+	// Another close or garbage collection may add the row between looking for it and inserting it, in which case it
+	// is looked for again
+	for i := 0; i < 2; i++ {
+		// A blob that garbage collection started removing is taken back by storing our copy of its contents in its place
+		tag, err := tx.Exec(ctx, "UPDATE attachment_blobs SET deleting = false, size = $2, enc_key = $3, enc_key_id = $4, created_at = NOW() WHERE hash = $1 AND deleting", blob.Hash, blob.Size, blob.EncKey, blob.EncKeyID)
+
+		if err != nil {
+			return fmt.Errorf("error taking back blob: %w", err)
+		}
+
+		if tag.RowsAffected() == 1 {
+			return upload(ctx)
+		}
+
+		// Locking the row keeps garbage collection from removing the blob before our reference is committed
+		var existing string
+		err = tx.QueryRow(ctx, "SELECT hash FROM attachment_blobs WHERE hash = $1 AND NOT deleting FOR SHARE", blob.Hash).Scan(&existing)
+
+		if err == nil {
+			return nil
+		}
+
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("error getting blob: %w", err)
+		}
+
+		// If another close is storing the same content, this waits for it and then inserts nothing
+		tag, err = tx.Exec(ctx, "INSERT INTO attachment_blobs (hash, size, enc_key, enc_key_id) VALUES ($1, $2, $3, $4) ON CONFLICT (hash) DO NOTHING", blob.Hash, blob.Size, blob.EncKey, blob.EncKeyID)
+
+		if err != nil {
+			return fmt.Errorf("error adding blob: %w", err)
+		}
+
+		if tag.RowsAffected() == 1 {
+			return upload(ctx)
+		}
+	}
+
+	return fmt.Errorf("blob %s kept changing while adding it", blob.Hash)
+}
+
+func (p *PostgresStore) CloseAttachments(ctx context.Context, tikId string) ([]*CloseAttachment, error) {
+	rows, err := p.pool.Query(ctx, "SELECT attachment_id, message_id, data FROM close_job_attachments WHERE ticket_id = $1", tikId)
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting saved attachments: %w", err)
+	}
+
+	defer rows.Close()
+
+	var saved []*CloseAttachment
+	for rows.Next() {
+		var a CloseAttachment
+
+		err = rows.Scan(&a.AttachmentID, &a.MessageID, &a.Data)
+
+		if err != nil {
+			return nil, fmt.Errorf("error scanning saved attachment: %w", err)
+		}
+
+		saved = append(saved, &a)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("error reading saved attachments: %w", rows.Err())
+	}
+
+	return saved, nil
+}
+
+func (p *PostgresStore) SaveTranscript(ctx context.Context, tikId string, token int64, closeUserId string, encMessages []byte, encContext []byte, next string) error {
+	return p.step(ctx, tikId, token, next, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, "UPDATE tickets SET open = false, close_user_id = $2, messages = NULL, enc_messages = $3, ticket_context = NULL, enc_ticket_context = $4 WHERE id = $1", tikId, closeUserId, encMessages, encContext)
+
+		if err != nil {
+			return fmt.Errorf("error updating ticket with messages: %w", err)
+		}
+
+		_, err = tx.Exec(ctx, "DELETE FROM ticket_messages WHERE ticket_id = $1", tikId)
+
+		if err != nil {
+			return fmt.Errorf("error deleting message log: %w", err)
+		}
+
+		_, err = tx.Exec(ctx, "UPDATE close_jobs SET snapshot = NULL WHERE ticket_id = $1", tikId)
+
+		if err != nil {
+			return fmt.Errorf("error deleting snapshot: %w", err)
+		}
+
+		return nil
+	})
+}
+
+func (p *PostgresStore) SetLogMessage(ctx context.Context, tikId string, token int64, messageId string) error {
+	tag, err := p.pool.Exec(ctx, "UPDATE close_jobs SET log_message_id = $2, updated_at = NOW() WHERE ticket_id = $1 AND fence = $3", tikId, messageId, token)
+
+	if err != nil {
+		return fmt.Errorf("error recording transcript message: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrFenced
+	}
+
+	return nil
+}
+
+func (p *PostgresStore) SaveDMMessage(ctx context.Context, tikId string, token int64, messageId *string, next string) error {
+	return p.step(ctx, tikId, token, next, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, "UPDATE close_jobs SET dm_message_id = $2 WHERE ticket_id = $1", tikId, messageId)
+
+		if err != nil {
+			return fmt.Errorf("error recording transcript message: %w", err)
+		}
+
+		return nil
+	})
+}
+
+func (p *PostgresStore) FinishCloseJob(ctx context.Context, tikId string, token int64, next string) error {
+	return p.step(ctx, tikId, token, next, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, "DELETE FROM close_job_attachments WHERE ticket_id = $1", tikId)
+
+		if err != nil {
+			return fmt.Errorf("error deleting saved attachments: %w", err)
+		}
+
+		return nil
+	})
+}
+
+func (p *PostgresStore) Blob(ctx context.Context, tikId string, attachmentId string) (*Blob, error) {
+	var b Blob
+	err := p.pool.QueryRow(ctx, "SELECT b.hash, b.size, b.enc_key, b.enc_key_id, b.created_at FROM attachment_refs r JOIN attachment_blobs b ON b.hash = r.hash WHERE r.ticket_id = $1 AND r.attachment_id = $2", tikId, attachmentId).Scan(&b.Hash, &b.Size, &b.EncKey, &b.EncKeyID, &b.CreatedAt)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting blob: %w", err)
+	}
+
+	return &b, nil
+}
+
+func (p *PostgresStore) UnreferencedBlobs(ctx context.Context, before time.Time) ([]string, error) {
+	rows, err := p.pool.Query(ctx, "SELECT hash FROM attachment_blobs b WHERE (created_at < $1 OR deleting) AND NOT EXISTS (SELECT 1 FROM attachment_refs r WHERE r.hash = b.hash)", before)
+
+	if err != nil {
+		return nil, fmt.Errorf("error finding unreferenced blobs: %w", err)
+	}
+
+	hashes, err := pgx.CollectRows(rows, pgx.RowTo[string])
+
+	if err != nil {
+		return nil, fmt.Errorf("error finding unreferenced blobs: %w", err)
+	}
+
+	return hashes, nil
+}
+
+// Marks the blob as being removed in one transaction, then removes it in another holding its attachment_blobs row. A
+// close adding a reference to the blob either commits first (and the blob is kept) or waits and takes the row back
+// by storing the content again, and a failed removal leaves the row marked for the next run
+func (p *PostgresStore) CollectBlob(ctx context.Context, hash string, remove func(ctx context.Context) error) (bool, error) {
+	marked, err := p.markDeleting(ctx, hash)
+
+	if err != nil || !marked {
+		return false, err
+	}
+
+	tx, err := p.pool.Begin(ctx)
+
+	if err != nil {
+		return false, err
+	}
+
+	defer tx.Rollback(ctx)
+
+	var locked string
+	err = tx.QueryRow(ctx, "SELECT hash FROM attachment_blobs WHERE hash = $1 AND deleting FOR UPDATE", hash).Scan(&locked)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		// Taken back by a close
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	err = remove(ctx)
+
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(ctx, "DELETE FROM attachment_blobs WHERE hash = $1", hash)
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit(ctx)
+}
+
+// Marks a blob as being removed if it is still unreferenced once its row is locked
+func (p *PostgresStore) markDeleting(ctx context.Context, hash string) (bool, error) {
+	tx, err := p.pool.Begin(ctx)
+
+	if err != nil {
+		return false, err
+	}
+
+	defer tx.Rollback(ctx)
+
+	var locked string
+	err = tx.QueryRow(ctx, "SELECT hash FROM attachment_blobs WHERE hash = $1 FOR UPDATE", hash).Scan(&locked)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	// A fresh statement sees references committed while we waited for the lock
+	var referenced bool
+	err = tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM attachment_refs WHERE hash = $1)", hash).Scan(&referenced)
+
+	if err != nil {
+		return false, err
+	}
+
+	if referenced {
+		return false, nil
+	}
+
+	_, err = tx.Exec(ctx, "UPDATE attachment_blobs SET deleting = true WHERE hash = $1", hash)
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit(ctx)
+}
+
+func (p *PostgresStore) BlobExists(ctx context.Context, hash string) (bool, error) {
+	var exists bool
+	err := p.pool.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM attachment_blobs WHERE hash = $1)", hash).Scan(&exists)
+
+	if err != nil {
+		return false, fmt.Errorf("error getting blob: %w", err)
+	}
+
+	return exists, nil
+}
+
+// The placeholder row locks the hash like any other blob, so a close storing the same content at the same time
+// either inserts first (and the contents are kept) or finds the placeholder and takes it back
+func (p *PostgresStore) ClaimOrphan(ctx context.Context, hash string) (bool, error) {
+	tag, err := p.pool.Exec(ctx, "INSERT INTO attachment_blobs (hash, size, enc_key, enc_key_id, deleting) VALUES ($1, 0, '', '', true) ON CONFLICT (hash) DO NOTHING", hash)
+
+	if err != nil {
+		return false, fmt.Errorf("error claiming orphaned blob: %w", err)
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+func (p *PostgresStore) CountKeysToRewrap(ctx context.Context, keyId string, after string) (int64, error) {
+	var total int64
+	err := p.pool.QueryRow(ctx, "SELECT COUNT(*) FROM tickets WHERE enc_key IS NOT NULL AND enc_key_id IS DISTINCT FROM $1 AND id > $2", keyId, after).Scan(&total)
+
+	if err != nil {
+		return 0, fmt.Errorf("error counting tickets: %w", err)
+	}
+
+	return total, nil
+}
+
+func (p *PostgresStore) RewrapTicketKeys(ctx context.Context, keyId string, after string, limit int, rewrap func(id string, key WrappedKey) (WrappedKey, error)) ([]string, error) {
+	return p.rewrapKeys(
+		ctx,
+		"SELECT id, enc_key, COALESCE(enc_key_id, '') FROM tickets WHERE enc_key IS NOT NULL AND enc_key_id IS DISTINCT FROM $1 AND id > $2 ORDER BY id LIMIT $3 FOR UPDATE",
+		"UPDATE tickets SET enc_key = $1, enc_key_id = $2 WHERE id = $3",
+		keyId, after, limit, rewrap,
+	)
+}
+
+// Blobs being removed are skipped, as are the placeholders ClaimOrphan adds, which have no key
+func (p *PostgresStore) RewrapBlobKeys(ctx context.Context, keyId string, after string, limit int, rewrap func(hash string, key WrappedKey) (WrappedKey, error)) ([]string, error) {
+	return p.rewrapKeys(
+		ctx,
+		"SELECT hash, enc_key, enc_key_id FROM attachment_blobs WHERE enc_key_id <> $1 AND enc_key_id <> '' AND NOT deleting AND hash > $2 ORDER BY hash LIMIT $3 FOR UPDATE",
+		"UPDATE attachment_blobs SET enc_key = $1, enc_key_id = $2 WHERE hash = $3",
+		keyId, after, limit, rewrap,
+	)
+}
+
+// Re-wraps a batch of keys in one transaction. query selects the ID, key and key ID of the batch, and update stores a
+// key and key ID by ID
+func (p *PostgresStore) rewrapKeys(ctx context.Context, query string, update string, keyId string, after string, limit int, rewrap func(id string, key WrappedKey) (WrappedKey, error)) ([]string, error) {
+	tx, err := p.pool.Begin(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %w", err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, query, keyId, after, limit)
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting keys: %w", err)
+	}
+
+	type rowKey struct {
+		id  string
+		key WrappedKey
+	}
+
+	batch, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (rowKey, error) {
+		var k rowKey
+		err := row.Scan(&k.id, &k.key.EncKey, &k.key.EncKeyID)
+		return k, err
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("error reading keys: %w", err)
+	}
+
+	var ids []string
+	for _, k := range batch {
+		rewrapped, err := rewrap(k.id, k.key)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, k.id)
+
+		if rewrapped == k.key {
+			continue
+		}
+
+		_, err = tx.Exec(ctx, update, rewrapped.EncKey, rewrapped.EncKeyID, k.id)
+
+		if err != nil {
+			return nil, fmt.Errorf("error updating key of %s: %w", k.id, err)
+		}
+	}
+
+	err = tx.Commit(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("error committing batch: %w", err)
+	}
+
+	return ids, nil
+}
+
+func (p *PostgresStore) CountPlaintextTickets(ctx context.Context, after string) (int64, error) {
+	var total int64
+	err := p.pool.QueryRow(ctx, "SELECT COUNT(*) FROM tickets WHERE (messages IS NOT NULL OR ticket_context IS NOT NULL) AND id > $1", after).Scan(&total)
+
+	if err != nil {
+		return 0, fmt.Errorf("error counting tickets: %w", err)
+	}
+
+	return total, nil
+}
+
+func (p *PostgresStore) EncryptPlaintextTickets(ctx context.Context, after string, limit int, encrypt func(t *Ticket) error) ([]string, error) {
+	tx, err := p.pool.Begin(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %w", err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, "SELECT "+ticketColumns+" FROM tickets WHERE (messages IS NOT NULL OR ticket_context IS NOT NULL) AND id > $1 ORDER BY id LIMIT $2 FOR UPDATE", after, limit)
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting tickets: %w", err)
+	}
+
+	batch, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*Ticket, error) {
+		return scanTicket(row)
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("error reading tickets: %w", err)
+	}
+
+	var ids []string
+	for _, t := range batch {
+		err = encrypt(t)
+
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = tx.Exec(ctx, "UPDATE tickets SET enc_key = $1, enc_key_id = $2, messages = NULL, enc_messages = $3, ticket_context = NULL, enc_ticket_context = $4 WHERE id = $5", nullString(t.EncKey), nullString(t.EncKeyID), t.EncMessages, t.EncTicketContext, t.ID)
+
+		if err != nil {
+			return nil, fmt.Errorf("error updating ticket %s: %w", t.ID, err)
+		}
+
+		ids = append(ids, t.ID)
+	}
+
+	err = tx.Commit(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("error committing batch: %w", err)
+	}
+
+	return ids, nil
+}
+
+func (p *PostgresStore) LogAccess(ctx context.Context, a *Access) error {
+	_, err := p.pool.Exec(ctx, "INSERT INTO ticket_access_log (ticket_id, viewer_id, ip, user_agent, attachment_id, granted) VALUES ($1, $2, $3, $4, $5, $6)", a.TicketID, a.ViewerID, a.IP, a.UserAgent, nullString(a.AttachmentID), a.Granted)
+
+	if err != nil {
+		return fmt.Errorf("error recording ticket access: %w", err)
+	}
+
+	return nil
+}
+
+func (p *PostgresStore) AccessLog(ctx context.Context, tikId string, limit int) ([]*Access, error) {
+	rows, err := p.pool.Query(ctx, "SELECT ticket_id, viewer_id, ip, user_agent, COALESCE(attachment_id, ''), granted, accessed_at FROM ticket_access_log WHERE ticket_id = $1 ORDER BY accessed_at DESC LIMIT $2", tikId, limit)
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting access log: %w", err)
+	}
+
+	accesses, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*Access, error) {
+		var a Access
+		err := row.Scan(&a.TicketID, &a.ViewerID, &a.IP, &a.UserAgent, &a.AttachmentID, &a.Granted, &a.AccessedAt)
+		return &a, err
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("error reading access log: %w", err)
+	}
+
+	return accesses, nil
+}
@@ -0,0 +1,233 @@
+package tickets
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var (
+	ErrNotFound = errors.New("ticket not found")
+
+	// Returned when writing to a close job that a newer lock on the ticket has claimed since
+	ErrFenced = errors.New("close job was taken over by a newer lock")
+)
+
+// A row of tickets. Encrypted columns are kept as stored, callers decrypt them with the ticket's data key
+type Ticket struct {
+	ID               string
+	UserID           string
+	ChannelID        string
+	TopicID          string
+	Issue            string
+	Open             bool
+	CloseUserID      string // Empty until the ticket is closed
+	EncKey           string // Wrapped data key, empty for tickets opened before envelope encryption
+	EncKeyID         string // ID of the master key that wrapped EncKey
+	EncTicketContext []byte
+	EncMessages      []byte
+	TicketContext    []byte // Plaintext context, only set for tickets stored before column encryption
+	Messages         []byte // Plaintext transcript, only set for tickets stored before column encryption
+}
+
+// Events recorded in the message log of a ticket
+const (
+	EventCreate = "create"
+	EventUpdate = "update"
+	EventDelete = "delete"
+)
+
+// A row of the message log (ticket_messages), which records what happens in a ticket thread until it is closed
+//
+// Content, embeds and attachments are logged encrypted with the ticket's data key in EncData. The plaintext fields
+// are only set for events logged before the message log was encrypted, see events
+type MessageEvent struct {
+	TicketID    string
+	MessageID   string
+	Event       string
+	AuthorID    string  // Only logged for creates
+	Content     *string // Nil for deletes
+	Embeds      []*discordgo.MessageEmbed
+	Attachments []*discordgo.MessageAttachment // Only logged for creates
+	EncData     []byte                         // Nil for deletes
+	CreatedAt   time.Time
+}
+
+// The step close jobs end on, see closejob
+const StepDone = "done"
+
+// A row of close_jobs, see closejob
+type CloseJob struct {
+	TicketID     string
+	Step         string
+	CloseUserID  string
+	Snapshot     []byte // Encrypted with the ticket's data key
+	LogMessageID *string
+	DMMessageID  *string
+	Attempts     int
+	Fence        int64  // Fencing token of the newest lock that claimed the job
+	LastError    string // Why the last run failed, empty if it didn't
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// An attachment saved by a close job (close_job_attachments)
+type CloseAttachment struct {
+	AttachmentID string
+	MessageID    string
+	Data         []byte // Encrypted with the ticket's data key
+}
+
+// A stored attachment blob (attachment_blobs), see dedup
+type Blob struct {
+	Hash      string
+	Size      int64
+	EncKey    string // Blob key wrapped with the master key
+	EncKeyID  string
+	CreatedAt time.Time
+}
+
+// A data key wrapped with a master key
+type WrappedKey struct {
+	EncKey   string
+	EncKeyID string // Empty for legacy ticket key material, which isn't wrapped
+}
+
+// A row of ticket_access_log, recording a transcript view or attachment download (or an attempt at one)
+type Access struct {
+	TicketID     string
+	ViewerID     string
+	IP           string
+	UserAgent    string
+	AttachmentID string // Empty for transcript views
+	Granted      bool
+	AccessedAt   time.Time
+}
+
+// Where tickets, their message logs, close jobs and attachment blob records are kept
+//
+// Writes that have to happen together, such as a close job step and its result, are single methods so every store
+// can make them atomic. Close job writes take the fencing token of the lock the job runs under and fail with ErrFenced
+// if a newer lock has claimed the job since
+type Store interface {
+	// Stores a new open ticket
+	Create(ctx context.Context, t *Ticket) error
+
+	// Returns the ticket with the given ID, or ErrNotFound
+	Get(ctx context.Context, id string) (*Ticket, error)
+
+	// Returns the open ticket whose thread is channelId, or ErrNotFound
+	ForChannel(ctx context.Context, channelId string) (*Ticket, error)
+
+	// Returns every open ticket that has no close job
+	Unclosed(ctx context.Context) ([]*Ticket, error)
+
+	// Stores a data key for a ticket opened before column encryption unless it has one already, returning the wrapped
+	// key and key ID the ticket ends up with
+	SetDataKey(ctx context.Context, tikId string, encKey string, encKeyId string) (string, string, error)
+
+	// Deletes the ticket with the given ID along with its message log, close job and blob references. Deleting a
+	// ticket that does not exist is not an error
+	Delete(ctx context.Context, id string) error
+
+	// Adds an event to the message log of a ticket. A message is only logged as created once, later creates are ignored
+	LogMessage(ctx context.Context, e *MessageEvent) error
+
+	// Returns the message log of a ticket in the order it was logged
+	MessageLog(ctx context.Context, tikId string) ([]*MessageEvent, error)
+
+	// Returns the last create or update logged for a message, or nil if it hasn't been logged
+	LastLogged(ctx context.Context, messageId string) (*MessageEvent, error)
+
+	// Creates the close job of a ticket at step unless it has one already, returning whether it was created
+	StartClose(ctx context.Context, tikId string, closeUserId string, step string) (bool, error)
+
+	// Returns the close job of a ticket, or ErrNotFound
+	CloseJob(ctx context.Context, tikId string) (*CloseJob, error)
+
+	// Returns every close job that isn't done, oldest first
+	UnfinishedCloseJobs(ctx context.Context) ([]*CloseJob, error)
+
+	// Claims a close job for the lock with the given fencing token, counting an attempt. Returns ErrFenced if a lock
+	// with the same or a newer token claimed it already, and ErrNotFound if there is no job
+	ClaimCloseJob(ctx context.Context, tikId string, token int64) (*CloseJob, error)
+
+	// Records why the last run of a close job failed
+	FailCloseJob(ctx context.Context, tikId string, reason string) error
+
+	// Moves a close job on to its next step
+	AdvanceCloseJob(ctx context.Context, tikId string, token int64, next string) error
+
+	// Saves the snapshot of a close job and moves it on to its next step
+	SaveSnapshot(ctx context.Context, tikId string, token int64, snapshot []byte, next string) error
+
+	// Records an attachment as saved by a close job, unless it was saved already
+	//
+	// If blob is set the attachment is also recorded as a reference to it. Blobs that aren't stored yet, or that are
+	// being removed, are added by calling upload to store their contents before anything is committed, while blobs
+	// that are stored are kept from being collected until the reference has been committed
+	SaveCloseAttachment(ctx context.Context, tikId string, a *CloseAttachment, blob *Blob, upload func(ctx context.Context) error) error
+
+	// Returns the attachments saved by a close job
+	CloseAttachments(ctx context.Context, tikId string) ([]*CloseAttachment, error)
+
+	// Stores the encrypted transcript of a ticket and marks it as closed, then drops its message log and the
+	// snapshot of its close job and moves the job on to its next step
+	SaveTranscript(ctx context.Context, tikId string, token int64, closeUserId string, encMessages []byte, encContext []byte, next string) error
+
+	// Records the log channel message a close job sent the transcript in
+	SetLogMessage(ctx context.Context, tikId string, token int64, messageId string) error
+
+	// Records the DM a close job sent the transcript in (nil if it couldn't be sent) and moves it on to its next step
+	SaveDMMessage(ctx context.Context, tikId string, token int64, messageId *string, next string) error
+
+	// Drops the attachments saved by a close job and moves it on to its next step
+	FinishCloseJob(ctx context.Context, tikId string, token int64, next string) error
+
+	// Returns the blob an attachment references, or ErrNotFound for attachments stored before deduplication
+	Blob(ctx context.Context, tikId string, attachmentId string) (*Blob, error)
+
+	// Returns the hashes of blobs created before before that no attachment references, along with those whose removal
+	// was started but didn't finish
+	UnreferencedBlobs(ctx context.Context, before time.Time) ([]string, error)
+
+	// Removes a blob if it is still unreferenced, calling remove to delete its contents. Returns whether it was removed
+	//
+	// The blob is marked as being removed before remove is called and only dropped after it succeeds, so a blob whose
+	// contents may be gone is never left looking stored
+	CollectBlob(ctx context.Context, hash string, remove func(ctx context.Context) error) (bool, error)
+
+	// Reports whether there is a blob with the given hash, including one being removed
+	BlobExists(ctx context.Context, hash string) (bool, error)
+
+	// Records contents found in storage without a blob as a blob being removed, so CollectBlob can remove them.
+	// Returns false if there is a blob with the hash by then, such as one a close has just added
+	ClaimOrphan(ctx context.Context, hash string) (bool, error)
+
+	// Counts the tickets after the ticket ID after whose data key isn't wrapped with the master key keyId
+	CountKeysToRewrap(ctx context.Context, keyId string, after string) (int64, error)
+
+	// Re-wraps the data keys of up to limit tickets after the ticket ID after that aren't wrapped with the master key
+	// keyId, in ID order, calling rewrap for each. Keys rewrap returns unchanged are left as they are, and none are
+	// stored if it fails. Returns the IDs of the tickets in the batch
+	RewrapTicketKeys(ctx context.Context, keyId string, after string, limit int, rewrap func(id string, key WrappedKey) (WrappedKey, error)) ([]string, error)
+
+	// Re-wraps blob keys like RewrapTicketKeys, by blob hash. Blobs being removed are skipped
+	RewrapBlobKeys(ctx context.Context, keyId string, after string, limit int, rewrap func(hash string, key WrappedKey) (WrappedKey, error)) ([]string, error)
+
+	// Counts the tickets after the ticket ID after that still have plaintext messages or context
+	CountPlaintextTickets(ctx context.Context, after string) (int64, error)
+
+	// Encrypts up to limit tickets after the ticket ID after that still have plaintext messages or context, in ID
+	// order, calling encrypt for each to set its data key and encrypted columns. The plaintext columns are cleared,
+	// and nothing is stored if encrypt fails. Returns the IDs of the tickets in the batch
+	EncryptPlaintextTickets(ctx context.Context, after string, limit int, encrypt func(t *Ticket) error) ([]string, error)
+
+	// Records an access (or attempted access) to a ticket
+	LogAccess(ctx context.Context, a *Access) error
+
+	// Returns the latest limit accesses to a ticket, newest first
+	AccessLog(ctx context.Context, tikId string, limit int) ([]*Access, error)
+}
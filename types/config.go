@@ -1,5 +1,7 @@
 package types
 
+import "time"
+
 // Config data
 type Topic struct {
 	Name        string     `yaml:"name"`
@@ -16,10 +18,23 @@ type Question struct {
 }
 
 type ConfigDatabase struct {
-	Postgres        string `yaml:"postgres"`
-	Redis           string `yaml:"redis"`
-	FileStoragePath string `yaml:"file_storage_path"`
-	ExposedPath     string `yaml:"exposed_path"`
+	Postgres        string        `yaml:"postgres"`
+	Redis           string        `yaml:"redis"`
+	FileStoragePath string        `yaml:"file_storage_path"`
+	ExposedPath     string        `yaml:"exposed_path"`
+	Storage         ConfigStorage `yaml:"storage"`
+}
+
+type ConfigS3 struct {
+	Endpoint string `yaml:"endpoint"` // Base URL of the S3 compatible API, e.g. https://s3.us-east-1.amazonaws.com
+	Bucket   string `yaml:"bucket"`
+	Region   string `yaml:"region"` // Defaults to us-east-1
+	Prefix   string `yaml:"prefix"` // Prepended to every object key, e.g. transcripts/
+}
+
+type ConfigStorage struct {
+	Type string   `yaml:"type"` // file (default, blobs are kept under file_storage_path) or s3
+	S3   ConfigS3 `yaml:"s3"`
 }
 
 type ConfigChannels struct {
@@ -27,12 +42,67 @@ type ConfigChannels struct {
 	LogChannel    string `yaml:"log_channel"`
 }
 
+type ConfigAttachments struct {
+	MaxSize          int64         `yaml:"max_size"`          // Attachments larger than this many bytes are left out of transcripts
+	Allow            []string      `yaml:"allow"`             // If set, only attachments whose sniffed type matches one of these (e.g. image/png or image/*) are stored
+	Deny             []string      `yaml:"deny"`              // Attachments whose sniffed type matches one of these are never stored
+	DownloadWorkers  int           `yaml:"download_workers"`  // Maximum number of attachments downloaded at once when closing a ticket
+	DownloadTimeout  time.Duration `yaml:"download_timeout"`  // Limit on each attempt at downloading an attachment
+	DownloadAttempts int           `yaml:"download_attempts"` // Attempts per attachment (per URL) before it is recorded as failed
+}
+
+type ConfigStaff struct {
+	GuildID string   `yaml:"guild_id"` // Guild in which staff roles are checked
+	Roles   []string `yaml:"roles"`    // Members with any of these roles are treated as staff
+}
+
+type ConfigOAuth2 struct {
+	ClientID     string `yaml:"client_id"`
+	RedirectURL  string `yaml:"redirect_url"`  // Must point to /auth/callback on the transcript server
+	AuthorizeURL string `yaml:"authorize_url"` // Discord authorization page
+	TokenURL     string `yaml:"token_url"`     // Endpoint codes are exchanged for access tokens at
+	APIURL       string `yaml:"api_url"`       // Base URL of the API used to fetch the logged in user
+}
+
+type ConfigWeb struct {
+	Bind            string        `yaml:"bind"`              // Address the transcript server listens on, ExposedPath should be proxied to this
+	UserLinkExpiry  time.Duration `yaml:"user_link_expiry"`  // How long transcript links sent to the ticket opener are valid for
+	StaffLinkExpiry time.Duration `yaml:"staff_link_expiry"` // How long transcript links posted for staff are valid for
+	SessionExpiry   time.Duration `yaml:"session_expiry"`    // How long a transcript viewer stays logged in for
+	TrustedProxies  []string      `yaml:"trusted_proxies"`   // Addresses or CIDR ranges of the proxies in front of Bind, whose X-Forwarded-For is trusted
+	OAuth2          ConfigOAuth2  `yaml:"oauth2"`
+}
+
+type ConfigRateLimit struct {
+	Requests int           `yaml:"requests"` // Commands and interactions a user may send per window, 0 disables the limit
+	Window   time.Duration `yaml:"window"`
+}
+
 type Config struct {
-	Topics   map[string]Topic `yaml:"topics"`
-	Database ConfigDatabase   `yaml:"database"`
-	Channels ConfigChannels   `yaml:"channels"`
+	Topics      map[string]Topic  `yaml:"topics"`
+	Database    ConfigDatabase    `yaml:"database"`
+	Channels    ConfigChannels    `yaml:"channels"`
+	Staff       ConfigStaff       `yaml:"staff"`
+	Attachments ConfigAttachments `yaml:"attachments"`
+	Web         ConfigWeb         `yaml:"web"`
+	RateLimit   ConfigRateLimit   `yaml:"rate_limit"`
+
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"` // How long running handlers and close jobs get to finish on shutdown
+	RecordEvents    string        `yaml:"record_events"`    // If set, interactions and messages are recorded (scrubbed of personal data) to this file for replay
 }
 
 type Secrets struct {
-	Token string `yaml:"token"`
+	Token                        string            `yaml:"token"`
+	LinkSecret                   string            `yaml:"link_secret"`          // HMAC key used to sign transcript links
+	BlobHashSecret               string            `yaml:"blob_hash_secret"`     // HMAC key attachments are content addressed with
+	SessionSecret                string            `yaml:"session_secret"`       // HMAC key used to sign transcript viewer sessions
+	OAuth2ClientSecret           string            `yaml:"oauth2_client_secret"` // Client secret of the application used to log in to the transcript viewer
+	MasterKeyID                  string            `yaml:"master_key_id"`        // ID of the master key, stored next to every data key it wraps
+	MasterKey                    string            `yaml:"master_key"`           // Base64 encoded 32 byte master key that wraps per-ticket data keys
+	MasterKeyFile                string            `yaml:"master_key_file"`      // File to read the base64 encoded master key from instead of master_key
+	PreviousMasterKeys           map[string]string `yaml:"previous_master_keys"` // Retired master keys by ID, only used to unwrap keys until they have been rotated
+	S3AccessKey                  string            `yaml:"s3_access_key"`        // Only needed when database.storage.type is s3
+	S3SecretKey                  string            `yaml:"s3_secret_key"`
+	TranscriptSigningKey         string            `yaml:"transcript_signing_key"`          // Base64 encoded 32 byte ed25519 seed that transcripts are signed with
+	PreviousTranscriptVerifyKeys []string          `yaml:"previous_transcript_verify_keys"` // Base64 encoded public keys of retired signing keys, so their transcripts still verify
 }
@@ -1,15 +1,26 @@
 package types
 
-import "github.com/bwmarrin/discordgo"
+import (
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
 
 type Attachment struct {
-	ID          string   `json:"id"`           // ID of the attachment within the ticket
-	URL         string   `json:"url"`          // URL of the attachment
-	ProxyURL    string   `json:"proxy_url"`    // URL (cached) of the attachment
-	Name        string   `json:"name"`         // Name of the attachment
-	ContentType string   `json:"content_type"` // Content type of the attachment
-	Size        int      `json:"size"`         // Size of the attachment in bytes
-	Errors      []string `json:"errors"`       // Non-fatal errors that occurred while uploading the attachment
+	ID           string   `json:"id"`                      // ID of the attachment within the ticket
+	URL          string   `json:"url"`                     // URL of the attachment
+	ProxyURL     string   `json:"proxy_url"`               // URL (cached) of the attachment
+	Name         string   `json:"name"`                    // Name of the attachment
+	ContentType  string   `json:"content_type"`            // Content type of the attachment
+	Size         int      `json:"size"`                    // Size of the attachment in bytes
+	Errors       []string `json:"errors"`                  // Non-fatal errors that occurred while uploading the attachment
+	SHA256       string   `json:"sha256,omitempty"`        // Hex encoded SHA-256 hash of the attachment, covered by the transcript signature
+	DetectedType string   `json:"detected_type,omitempty"` // Content type sniffed from the attachment itself
+}
+
+// Reports whether the attachment was stored. Older transcripts have no hashes, but only stored attachments had no errors
+func (a Attachment) Stored() bool {
+	return a.SHA256 != "" || len(a.Errors) == 0
 }
 
 type Message struct {
@@ -18,16 +29,32 @@ type Message struct {
 	Embeds      []*discordgo.MessageEmbed `json:"embeds"`
 	AuthorID    string                    `json:"author_id"`
 	Attachments []Attachment              `json:"attachments"`
+	Edits       []MessageEdit             `json:"edits,omitempty"`   // Previous versions of the message, oldest first
+	Deleted     bool                      `json:"deleted,omitempty"` // Whether the message was deleted before the ticket was closed
+}
+
+type MessageEdit struct {
+	Content  string                    `json:"content"`   // Content of the message before the edit
+	Embeds   []*discordgo.MessageEmbed `json:"embeds"`    // Embeds of the message before the edit
+	EditedAt time.Time                 `json:"edited_at"` // Time at which the edit was made
 }
 
 type FileTranscriptData struct {
-	Issue         string            `json:"issue"`
-	TopicID       string            `json:"topic_id"`
-	Topic         Topic             `json:"topic"`
-	TicketContext map[string]string `json:"ticket_context"`
-	Messages      []Message         `json:"messages"`
-	UserID        string            `json:"user_id"`
-	CloseUserID   string            `json:"close_user_id"`
-	ChannelID     string            `json:"channel_id"`
-	TicketID      string            `json:"ticket_id"`
+	Issue         string               `json:"issue"`
+	TopicID       string               `json:"topic_id"`
+	Topic         Topic                `json:"topic"`
+	TicketContext map[string]string    `json:"ticket_context"`
+	Messages      []Message            `json:"messages"`
+	UserID        string               `json:"user_id"`
+	CloseUserID   string               `json:"close_user_id"`
+	ChannelID     string               `json:"channel_id"`
+	TicketID      string               `json:"ticket_id"`
+	Signature     *TranscriptSignature `json:"signature,omitempty"` // Signature over the rest of the transcript, set at close time
+}
+
+type TranscriptSignature struct {
+	Algorithm string    `json:"algorithm"` // Always ed25519
+	KeyID     string    `json:"key_id"`    // ID of the key the transcript was signed with
+	SignedAt  time.Time `json:"signed_at"`
+	Value     string    `json:"value"` // Base64 encoded signature
 }
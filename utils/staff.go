@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"fmt"
+	"ibl-tickets/types"
+	"slices"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Returns whether a user holds one of the configured staff roles in the staff guild
+func IsStaff(s *discordgo.Session, config *types.Config, userId string) (bool, error) {
+	if config.Staff.GuildID == "" || len(config.Staff.Roles) == 0 {
+		return false, nil
+	}
+
+	member, err := s.State.Member(config.Staff.GuildID, userId)
+
+	if err != nil {
+		member, err = s.GuildMember(config.Staff.GuildID, userId)
+
+		if err != nil {
+			if restErr, ok := err.(*discordgo.RESTError); ok && restErr.Message != nil && restErr.Message.Code == discordgo.ErrCodeUnknownMember {
+				return false, nil
+			}
+
+			return false, fmt.Errorf("error getting member: %w", err)
+		}
+	}
+
+	for _, role := range member.Roles {
+		if slices.Contains(config.Staff.Roles, role) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,136 @@
+package web
+
+import (
+	"errors"
+	"ibl-tickets/tickets"
+	"net/http"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"go.uber.org/zap"
+)
+
+// How a viewer is related to the ticket they accessed
+const (
+	viewerOwner  = "owner"
+	viewerStaff  = "staff"
+	viewerOpener = "opener"
+	viewerOther  = "other"
+)
+
+// How often the log channel is alerted about accesses by the same viewer. Later ones are only in the access log
+const alertInterval = 10 * time.Minute
+
+// Records an access (or attempted access) to a ticket, alerting the log channel if it was made by someone other than the opener or staff
+//
+// openerId is empty if the ticket wasn't loaded, and attachmentId is empty for transcript views. Attempts on tickets
+// that don't exist aren't alerted about, as anyone who can log in can make them
+func (srv *Server) recordAccess(r *http.Request, tikId string, openerId string, viewerId string, role string, attachmentId string, granted bool) {
+	err := srv.Tickets.LogAccess(r.Context(), &tickets.Access{
+		TicketID:     tikId,
+		ViewerID:     viewerId,
+		IP:           r.RemoteAddr,
+		UserAgent:    r.UserAgent(),
+		AttachmentID: attachmentId,
+		Granted:      granted,
+	})
+
+	if err != nil {
+		srv.Logger.Error("Error recording ticket access", zap.Error(err), zap.String("ticket_id", tikId), zap.String("viewerId", viewerId))
+	}
+
+	if role != viewerOther {
+		return
+	}
+
+	if openerId == "" {
+		t, err := srv.Tickets.Get(r.Context(), tikId)
+
+		if err != nil {
+			if !errors.Is(err, tickets.ErrNotFound) {
+				srv.Logger.Error("Error getting ticket", zap.Error(err), zap.String("ticket_id", tikId))
+			}
+
+			return
+		}
+
+		openerId = t.UserID
+	}
+
+	if !srv.shouldAlert(viewerId) {
+		return
+	}
+
+	var action = "viewed the transcript of"
+
+	if attachmentId != "" {
+		action = "downloaded attachment `" + attachmentId + "` of"
+	}
+
+	if !granted {
+		action = "tried to access"
+	}
+
+	var fields = []*discordgo.MessageEmbedField{
+		{
+			Name:   "Ticket ID",
+			Value:  tikId,
+			Inline: false,
+		},
+	}
+
+	fields = append(fields, &discordgo.MessageEmbedField{
+		Name:   "User",
+		Value:  "<@" + openerId + ">",
+		Inline: false,
+	})
+
+	fields = append(fields, &discordgo.MessageEmbedField{
+		Name:   "IP",
+		Value:  r.RemoteAddr,
+		Inline: false,
+	})
+
+	_, err = srv.Discord.ChannelMessageSendComplex(srv.Config.Channels.LogChannel, &discordgo.MessageSend{
+		Embeds: []*discordgo.MessageEmbed{
+			{
+				Title:       "Unexpected Transcript Access",
+				Description: "<@" + viewerId + "> (" + viewerId + ") " + action + " a ticket they did not open. Their accesses over the next " + alertInterval.String() + " are only recorded in the access log",
+				Fields:      fields,
+			},
+		},
+		AllowedMentions: &discordgo.MessageAllowedMentions{
+			Parse: []discordgo.AllowedMentionType{},
+		},
+	})
+
+	if err != nil {
+		srv.Logger.Error("Error sending access alert", zap.Error(err), zap.String("ticket_id", tikId), zap.String("viewerId", viewerId))
+	}
+}
+
+// Reports whether the log channel may be alerted about an access by viewerId, which it is once every alertInterval,
+// so someone trying ticket IDs can't flood it
+func (srv *Server) shouldAlert(viewerId string) bool {
+	srv.alertsMu.Lock()
+	defer srv.alertsMu.Unlock()
+
+	now := time.Now()
+
+	for id, at := range srv.alerted {
+		if now.Sub(at) >= alertInterval {
+			delete(srv.alerted, id)
+		}
+	}
+
+	if _, ok := srv.alerted[viewerId]; ok {
+		return false
+	}
+
+	if srv.alerted == nil {
+		srv.alerted = map[string]time.Time{}
+	}
+
+	srv.alerted[viewerId] = now
+	return true
+}
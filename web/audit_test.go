@@ -0,0 +1,141 @@
+package web
+
+import (
+	"context"
+	"ibl-tickets/links"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestAccessAlerts(t *testing.T) {
+	srv, discord, store := newTestServer(t)
+
+	session := sessionFor(srv, testOther, time.Now().Add(time.Hour))
+	userLink := links.Sign(srv.Secrets.LinkSecret, "t1", links.AudienceUser, time.Now().Add(time.Hour))
+
+	alerts := func() int {
+		return len(discord.Messages(testLogChannel))
+	}
+
+	// Anyone can try ticket IDs, so only ones that exist are alerted about
+	for _, tikId := range []string{"t2", "t3", "t4"} {
+		if rec := get(srv, "/ticket/"+tikId, session); rec.Code != http.StatusForbidden {
+			t.Fatalf("%s: status = %d, want %d", tikId, rec.Code, http.StatusForbidden)
+		}
+	}
+
+	if n := alerts(); n != 0 {
+		t.Fatalf("%d alerts about tickets that don't exist, want none", n)
+	}
+
+	if rec := get(srv, "/ticket/t1", session); rec.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+
+	if n := alerts(); n != 1 {
+		t.Fatalf("%d alerts after trying an existing ticket, want 1", n)
+	}
+
+	// Further attempts by the same viewer are only logged
+	get(srv, "/ticket/t1", session)
+	get(srv, "/ticket/t1?"+userLink.Encode(), session)
+
+	if n := alerts(); n != 1 {
+		t.Fatalf("%d alerts after repeated attempts, want 1", n)
+	}
+
+	accesses, err := store.AccessLog(context.Background(), "t1", 10)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(accesses) != 3 {
+		t.Fatalf("%d accesses logged, want 3", len(accesses))
+	}
+
+	// Other viewers are alerted about separately, and again once the interval has passed
+	srv.alertsMu.Lock()
+	srv.alerted[testOther] = time.Now().Add(-alertInterval)
+	srv.alertsMu.Unlock()
+
+	get(srv, "/ticket/t1", sessionFor(srv, testOpener, time.Now().Add(time.Hour)))
+	get(srv, "/ticket/t1", session)
+
+	if n := alerts(); n != 3 {
+		t.Fatalf("%d alerts, want 3", n)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies := []netip.Prefix{
+		netip.MustParsePrefix("127.0.0.1/32"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		realIP     string
+		want       string
+	}{
+		{"direct", "203.0.113.1:1234", nil, "", "203.0.113.1"},
+		{"forged forwarded for", "203.0.113.1:1234", []string{"198.51.100.1"}, "", "203.0.113.1"},
+		{"forged real ip", "203.0.113.1:1234", nil, "198.51.100.1", "203.0.113.1"},
+		{"through proxy", "127.0.0.1:1234", []string{"198.51.100.1"}, "", "198.51.100.1"},
+		{"through proxies", "127.0.0.1:1234", []string{"198.51.100.1, 10.0.0.2"}, "", "198.51.100.1"},
+		{"spoofed behind proxy", "127.0.0.1:1234", []string{"192.0.2.9, 198.51.100.1"}, "", "198.51.100.1"},
+		{"split headers", "127.0.0.1:1234", []string{"192.0.2.9", "198.51.100.1"}, "", "198.51.100.1"},
+		{"invalid hop", "127.0.0.1:1234", []string{"nonsense, 10.0.0.2"}, "", "10.0.0.2"},
+		{"real ip through proxy", "127.0.0.1:1234", nil, "198.51.100.1", "198.51.100.1"},
+		{"proxy without headers", "127.0.0.1:1234", nil, "", "127.0.0.1"},
+		{"mapped ipv4", "[::ffff:127.0.0.1]:1234", []string{"198.51.100.1"}, "", "198.51.100.1"},
+		{"untrusted ipv6", "[2001:db8::1]:1234", []string{"198.51.100.1"}, "", "2001:db8::1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+
+			for _, v := range tt.forwarded {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+
+			if got := clientIP(req, proxies); got != tt.want {
+				t.Fatalf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRealIPAuditLog(t *testing.T) {
+	srv, _, store := newTestServer(t)
+	srv.Config.Web.TrustedProxies = []string{"127.0.0.1", "not an address"}
+
+	for _, remoteAddr := range []string{"203.0.113.1:1234", "127.0.0.1:1234"} {
+		req := httptest.NewRequest(http.MethodGet, "/ticket/t1", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", "198.51.100.1")
+		req.AddCookie(sessionFor(srv, testStaff, time.Now().Add(time.Hour)))
+		srv.Routes().ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	accesses, err := store.AccessLog(context.Background(), "t1", 10)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(accesses) != 2 || accesses[1].IP != "203.0.113.1" || accesses[0].IP != "198.51.100.1" {
+		t.Fatalf("logged IPs = %+v, want the forwarded address only from the proxy", accesses)
+	}
+}
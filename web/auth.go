@@ -0,0 +1,316 @@
+package web
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"ibl-tickets/links"
+	"ibl-tickets/utils"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	sessionCookie = "ibl_tickets_session"
+	stateCookie   = "ibl_tickets_oauth2_state"
+)
+
+// Signs a cookie value with the session secret, the purpose stops values from one cookie being replayed in another
+func (srv *Server) signValue(purpose string, value string) string {
+	mac := hmac.New(sha256.New, []byte(srv.Secrets.SessionSecret))
+	mac.Write([]byte(purpose + "\n" + value))
+	return base64.RawURLEncoding.EncodeToString([]byte(value)) + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns the value of a cookie signed with signValue, or false if it is missing or invalid
+func (srv *Server) verifyValue(purpose string, signed string) (string, bool) {
+	encValue, _, ok := strings.Cut(signed, ".")
+
+	if !ok {
+		return "", false
+	}
+
+	value, err := base64.RawURLEncoding.DecodeString(encValue)
+
+	if err != nil {
+		return "", false
+	}
+
+	if !hmac.Equal([]byte(signed), []byte(srv.signValue(purpose, string(value)))) {
+		return "", false
+	}
+
+	return string(value), true
+}
+
+func (srv *Server) setCookie(w http.ResponseWriter, name string, value string, expiry time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Expires:  expiry,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(srv.Config.Database.ExposedPath, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Returns the Discord user ID of the logged in viewer, or an empty string if there is none
+func (srv *Server) viewer(r *http.Request) string {
+	cookie, err := r.Cookie(sessionCookie)
+
+	if err != nil {
+		return ""
+	}
+
+	value, ok := srv.verifyValue(sessionCookie, cookie.Value)
+
+	if !ok {
+		return ""
+	}
+
+	userId, exp, ok := strings.Cut(value, ":")
+
+	if !ok {
+		return ""
+	}
+
+	expiry, err := strconv.ParseInt(exp, 10, 64)
+
+	if err != nil || time.Now().After(time.Unix(expiry, 0)) {
+		return ""
+	}
+
+	return userId
+}
+
+// Redirects to Discord to log in, returning to next afterwards
+func (srv *Server) login(w http.ResponseWriter, r *http.Request) {
+	next := r.URL.Query().Get("next")
+
+	// Only allow redirects back to this site
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		next = "/"
+	}
+
+	state := make([]byte, 32)
+
+	if _, err := rand.Read(state); err != nil {
+		srv.Logger.Error("Error generating oauth2 state", zap.Error(err))
+		http.Error(w, "An error occurred while logging in", http.StatusInternalServerError)
+		return
+	}
+
+	stateStr := hex.EncodeToString(state)
+
+	srv.setCookie(w, stateCookie, srv.signValue(stateCookie, stateStr+":"+next), time.Now().Add(10*time.Minute))
+
+	http.Redirect(w, r, srv.Config.Web.OAuth2.AuthorizeURL+"?"+url.Values{
+		"client_id":     {srv.Config.Web.OAuth2.ClientID},
+		"redirect_uri":  {srv.Config.Web.OAuth2.RedirectURL},
+		"response_type": {"code"},
+		"scope":         {"identify"},
+		"state":         {stateStr},
+		"prompt":        {"none"},
+	}.Encode(), http.StatusFound)
+}
+
+// Exchanges an authorization code for the ID of the user who logged in
+func (srv *Server) exchangeCode(r *http.Request, code string) (string, error) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, srv.Config.Web.OAuth2.TokenURL, strings.NewReader(url.Values{
+		"client_id":     {srv.Config.Web.OAuth2.ClientID},
+		"client_secret": {srv.Secrets.OAuth2ClientSecret},
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {srv.Config.Web.OAuth2.RedirectURL},
+	}.Encode()))
+
+	if err != nil {
+		return "", fmt.Errorf("error creating token request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := oauth2Client.Do(req)
+
+	if err != nil {
+		return "", fmt.Errorf("error exchanging code: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error exchanging code: got status %d", resp.StatusCode)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&token)
+
+	if err != nil {
+		return "", fmt.Errorf("error decoding token: %w", err)
+	}
+
+	if token.AccessToken == "" {
+		return "", errors.New("token response did not contain an access token")
+	}
+
+	req, err = http.NewRequestWithContext(r.Context(), http.MethodGet, srv.Config.Web.OAuth2.APIURL+"/users/@me", nil)
+
+	if err != nil {
+		return "", fmt.Errorf("error creating user request: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+
+	resp, err = oauth2Client.Do(req)
+
+	if err != nil {
+		return "", fmt.Errorf("error getting user: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error getting user: got status %d", resp.StatusCode)
+	}
+
+	var user struct {
+		ID string `json:"id"`
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&user)
+
+	if err != nil {
+		return "", fmt.Errorf("error decoding user: %w", err)
+	}
+
+	if user.ID == "" {
+		return "", errors.New("user response did not contain an ID")
+	}
+
+	return user.ID, nil
+}
+
+func (srv *Server) callback(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(stateCookie)
+
+	if err != nil {
+		http.Error(w, "Your login has expired, please try again", http.StatusBadRequest)
+		return
+	}
+
+	value, ok := srv.verifyValue(stateCookie, cookie.Value)
+
+	if !ok {
+		http.Error(w, "Your login has expired, please try again", http.StatusBadRequest)
+		return
+	}
+
+	state, next, _ := strings.Cut(value, ":")
+
+	if !hmac.Equal([]byte(state), []byte(r.URL.Query().Get("state"))) {
+		http.Error(w, "Invalid login state, please try again", http.StatusBadRequest)
+		return
+	}
+
+	// Clear the state cookie so it can't be reused
+	srv.setCookie(w, stateCookie, "", time.Unix(0, 0))
+
+	if errMsg := r.URL.Query().Get("error"); errMsg != "" {
+		http.Error(w, "Login failed: "+errMsg, http.StatusUnauthorized)
+		return
+	}
+
+	userId, err := srv.exchangeCode(r, r.URL.Query().Get("code"))
+
+	if err != nil {
+		srv.Logger.Error("Error completing oauth2 login", zap.Error(err))
+		http.Error(w, "An error occurred while logging in", http.StatusBadGateway)
+		return
+	}
+
+	expiry := time.Now().Add(srv.Config.Web.SessionExpiry)
+	srv.setCookie(w, sessionCookie, srv.signValue(sessionCookie, userId+":"+strconv.FormatInt(expiry.Unix(), 10)), expiry)
+
+	http.Redirect(w, r, next, http.StatusFound)
+}
+
+// A logged in viewer who passed authenticate
+type viewer struct {
+	ID   string
+	Role string // viewerOwner or viewerStaff, or viewerOpener until authorize checks that they opened the ticket
+}
+
+// Checks that the logged in viewer may see a ticket, redirecting to login or writing an error if they can't
+//
+// Staff and owners may view any ticket, anyone else must present a valid link issued to the ticket's opener, which
+// authorize then checks they are. This runs before the ticket is loaded, so nobody without both learns whether a
+// ticket exists or has it decrypted. Denials are recorded in the access log, attachmentId is empty for transcript views
+func (srv *Server) authenticate(w http.ResponseWriter, r *http.Request, tikId string, attachmentId string) (*viewer, bool) {
+	viewerId := srv.viewer(r)
+
+	if viewerId == "" {
+		http.Redirect(w, r, "/auth/login?"+url.Values{"next": {r.URL.RequestURI()}}.Encode(), http.StatusFound)
+		return nil, false
+	}
+
+	if srv.IsOwner(viewerId) {
+		return &viewer{ID: viewerId, Role: viewerOwner}, true
+	}
+
+	isStaff, err := utils.IsStaff(srv.Discord, srv.Config, viewerId)
+
+	if err != nil {
+		srv.Logger.Error("Error checking staff status", zap.Error(err), zap.String("userId", viewerId))
+		http.Error(w, "An error occurred while checking your access to this ticket", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	if isStaff {
+		return &viewer{ID: viewerId, Role: viewerStaff}, true
+	}
+
+	audience, err := links.Verify(srv.Secrets.LinkSecret, tikId, r.URL.Query())
+
+	if err != nil {
+		// Without a valid link we can't tell (and don't look up) whether they opened the ticket
+		srv.recordAccess(r, tikId, "", viewerId, viewerOther, attachmentId, false)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil, false
+	}
+
+	// Staff links are posted to the log channel, so they only let staff in, who got in above without one
+	if audience != links.AudienceUser {
+		srv.recordAccess(r, tikId, "", viewerId, viewerOther, attachmentId, false)
+		http.Error(w, "This link can only be used by staff", http.StatusForbidden)
+		return nil, false
+	}
+
+	return &viewer{ID: viewerId, Role: viewerOpener}, true
+}
+
+// Checks that a viewer who got in with a link opened the ticket, writing an error if they didn't. Links can be passed
+// on, so anyone else is denied (and reported) even with a valid one
+func (srv *Server) authorize(w http.ResponseWriter, r *http.Request, v *viewer, t *ticket, attachmentId string) bool {
+	if v.Role != viewerOpener || v.ID == t.UserID {
+		return true
+	}
+
+	v.Role = viewerOther
+	srv.recordAccess(r, t.ID, t.UserID, v.ID, v.Role, attachmentId, false)
+	http.Error(w, "You do not have access to this ticket", http.StatusForbidden)
+	return false
+}
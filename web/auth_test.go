@@ -0,0 +1,358 @@
+package web
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"ibl-tickets/blobs"
+	"ibl-tickets/fakediscord"
+	"ibl-tickets/keys"
+	"ibl-tickets/links"
+	"ibl-tickets/storage"
+	"ibl-tickets/tickets"
+	"ibl-tickets/types"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"go.uber.org/zap"
+)
+
+const (
+	testGuild      = "5000000000000000001"
+	testStaffRole  = "5000000000000000002"
+	testLogChannel = "5000000000000000003"
+	testOpener     = "7000000000000000001"
+	testOther      = "7000000000000000002"
+	testStaff      = "7000000000000000003"
+	testOwner      = "7000000000000000004"
+)
+
+func randomKey(t *testing.T) string {
+	key := make([]byte, 32)
+
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// A server with a closed ticket t1 opened by testOpener, viewed by members of testGuild held in the session state
+func newTestServer(t *testing.T) (*Server, *fakediscord.Server, *tickets.MemoryStore) {
+	ctx := context.Background()
+
+	secrets := &types.Secrets{
+		MasterKeyID:   "k1",
+		MasterKey:     randomKey(t),
+		LinkSecret:    "link secret",
+		SessionSecret: "session secret",
+	}
+
+	keyring, err := keys.Load(secrets)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	discord := fakediscord.New()
+	t.Cleanup(discord.Close)
+
+	discord.AddChannel(&discordgo.Channel{ID: testLogChannel, Type: discordgo.ChannelTypeGuildText})
+
+	s := discord.Session()
+	s.State.GuildAdd(&discordgo.Guild{ID: testGuild})
+
+	for _, m := range []*discordgo.Member{
+		{GuildID: testGuild, User: &discordgo.User{ID: testOpener}},
+		{GuildID: testGuild, User: &discordgo.User{ID: testOther}},
+		{GuildID: testGuild, User: &discordgo.User{ID: testStaff}, Roles: []string{testStaffRole}},
+		{GuildID: testGuild, User: &discordgo.User{ID: testOwner}},
+	} {
+		if err := s.State.MemberAdd(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config := &types.Config{
+		Channels: types.ConfigChannels{LogChannel: testLogChannel},
+		Staff:    types.ConfigStaff{GuildID: testGuild, Roles: []string{testStaffRole}},
+	}
+
+	config.Database.ExposedPath = "https://tickets.example/"
+	config.Web.SessionExpiry = time.Hour
+
+	store := tickets.NewMemoryStore()
+
+	dataKey, wrapped, keyId, err := keyring.NewDataKey()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encContext, err := blobs.EncryptJSON(dataKey, map[string]string{"Bot ID?": "123"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encMessages, err := blobs.EncryptJSON(dataKey, []types.Message{{ID: "m1", AuthorID: testOpener, Content: "hello"}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.Create(ctx, &tickets.Ticket{ID: "t1", UserID: testOpener, ChannelID: "c1", TopicID: "support", Issue: "help", EncKey: wrapped, EncKeyID: keyId})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.StartClose(ctx, "t1", testStaff, "transcript"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.ClaimCloseJob(ctx, "t1", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.SaveTranscript(ctx, "t1", 1, testStaff, encMessages, encContext, tickets.StepDone); err != nil {
+		t.Fatal(err)
+	}
+
+	return &Server{
+		Config:  config,
+		Secrets: secrets,
+		Keyring: keyring,
+		Store:   &storage.FileStore{Root: t.TempDir()},
+		Tickets: store,
+		Logger:  zap.NewNop(),
+		Discord: s,
+		IsOwner: func(userId string) bool {
+			return userId == testOwner
+		},
+	}, discord, store
+}
+
+// A session cookie for userId expiring at expiry
+func sessionFor(srv *Server, userId string, expiry time.Time) *http.Cookie {
+	return &http.Cookie{Name: sessionCookie, Value: srv.signValue(sessionCookie, userId+":"+strconv.FormatInt(expiry.Unix(), 10))}
+}
+
+func get(srv *Server, path string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+
+	rec := httptest.NewRecorder()
+	srv.Routes().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestTranscriptLinks(t *testing.T) {
+	srv, _, _ := newTestServer(t)
+
+	userLink := links.Sign(srv.Secrets.LinkSecret, "t1", links.AudienceUser, time.Now().Add(time.Hour))
+	staffLink := links.Sign(srv.Secrets.LinkSecret, "t1", links.AudienceStaff, time.Now().Add(time.Hour))
+	expiredLink := links.Sign(srv.Secrets.LinkSecret, "t1", links.AudienceUser, time.Now().Add(-time.Minute))
+	otherTicketLink := links.Sign(srv.Secrets.LinkSecret, "t2", links.AudienceUser, time.Now().Add(time.Hour))
+
+	// A staff link relabelled as a user link, and a user link relabelled as a staff one
+	relabelled := url.Values{"aud": {links.AudienceUser}, "exp": staffLink["exp"], "sig": staffLink["sig"]}
+	promoted := url.Values{"aud": {links.AudienceStaff}, "exp": userLink["exp"], "sig": userLink["sig"]}
+
+	// A user link with its expiry pushed back
+	extended := url.Values{"aud": {links.AudienceUser}, "exp": {strconv.FormatInt(time.Now().Add(24*time.Hour).Unix(), 10)}, "sig": userLink["sig"]}
+
+	tests := []struct {
+		name   string
+		viewer string
+		query  url.Values
+		status int
+	}{
+		{"opener with user link", testOpener, userLink, http.StatusOK},
+		{"opener without link", testOpener, nil, http.StatusForbidden},
+		{"opener with expired link", testOpener, expiredLink, http.StatusForbidden},
+		{"opener with extended link", testOpener, extended, http.StatusForbidden},
+		{"opener with link to another ticket", testOpener, otherTicketLink, http.StatusForbidden},
+		{"opener with staff link", testOpener, staffLink, http.StatusForbidden},
+		{"opener with relabelled staff link", testOpener, relabelled, http.StatusForbidden},
+		{"other user with user link", testOther, userLink, http.StatusForbidden},
+		{"other user with staff link", testOther, staffLink, http.StatusForbidden},
+		{"other user with promoted user link", testOther, promoted, http.StatusForbidden},
+		{"staff without link", testStaff, nil, http.StatusOK},
+		{"staff with staff link", testStaff, staffLink, http.StatusOK},
+		{"staff with user link", testStaff, userLink, http.StatusOK},
+		{"owner without link", testOwner, nil, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := get(srv, "/ticket/t1?"+tt.query.Encode(), sessionFor(srv, tt.viewer, time.Now().Add(time.Hour)))
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+
+			if tt.status == http.StatusOK && !strings.Contains(rec.Body.String(), "hello") {
+				t.Fatal("transcript doesn't show its messages")
+			}
+		})
+	}
+}
+
+func TestSessionCookies(t *testing.T) {
+	srv, _, _ := newTestServer(t)
+
+	valid := sessionFor(srv, testStaff, time.Now().Add(time.Hour))
+
+	// The signed value names another user
+	value, _ := srv.verifyValue(sessionCookie, valid.Value)
+	_, sig, _ := strings.Cut(valid.Value, ".")
+	forged := strings.Replace(value, testStaff, testOwner, 1)
+
+	var badSig = []byte(valid.Value)
+	badSig[len(badSig)-1] ^= 1
+
+	tests := map[string]*http.Cookie{
+		"expired":        sessionFor(srv, testStaff, time.Now().Add(-time.Minute)),
+		"forged user":    {Name: sessionCookie, Value: base64.RawURLEncoding.EncodeToString([]byte(forged)) + "." + sig},
+		"bad signature":  {Name: sessionCookie, Value: string(badSig)},
+		"unsigned":       {Name: sessionCookie, Value: testStaff},
+		"state cookie":   {Name: sessionCookie, Value: srv.signValue(stateCookie, testStaff+":"+strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))},
+		"other secret":   {Name: sessionCookie, Value: (&Server{Secrets: &types.Secrets{SessionSecret: "other"}}).signValue(sessionCookie, testStaff+":"+strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))},
+		"missing expiry": {Name: sessionCookie, Value: srv.signValue(sessionCookie, testStaff)},
+		"no session":     nil,
+		"wrong name":     {Name: stateCookie, Value: valid.Value},
+		"not base64":     {Name: sessionCookie, Value: "!!!." + sig},
+	}
+
+	for name, cookie := range tests {
+		t.Run(name, func(t *testing.T) {
+			var cookies []*http.Cookie
+
+			if cookie != nil {
+				cookies = append(cookies, cookie)
+			}
+
+			rec := get(srv, "/ticket/t1", cookies...)
+
+			if rec.Code != http.StatusFound || !strings.HasPrefix(rec.Header().Get("Location"), "/auth/login?") {
+				t.Fatalf("status = %d, location = %q, want a redirect to login", rec.Code, rec.Header().Get("Location"))
+			}
+		})
+	}
+
+	if rec := get(srv, "/ticket/t1", valid); rec.Code != http.StatusOK {
+		t.Fatalf("valid session: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	srv, _, _ := newTestServer(t)
+
+	oauth2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			if r.FormValue("code") != "good code" {
+				http.Error(w, "invalid code", http.StatusBadRequest)
+				return
+			}
+
+			w.Write([]byte(`{"access_token": "token", "token_type": "Bearer"}`))
+		case "/users/@me":
+			if r.Header.Get("Authorization") != "Bearer token" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			w.Write([]byte(`{"id": "` + testStaff + `"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(oauth2.Close)
+
+	srv.Config.Web.OAuth2 = types.ConfigOAuth2{
+		ClientID:     "client",
+		RedirectURL:  "https://tickets.example/auth/callback",
+		AuthorizeURL: oauth2.URL + "/authorize",
+		TokenURL:     oauth2.URL + "/token",
+		APIURL:       oauth2.URL,
+	}
+
+	login := func(t *testing.T, next string) (string, *http.Cookie) {
+		rec := get(srv, "/auth/login?"+url.Values{"next": {next}}.Encode())
+
+		location, err := url.Parse(rec.Header().Get("Location"))
+
+		if rec.Code != http.StatusFound || err != nil {
+			t.Fatalf("login: status = %d, location = %q", rec.Code, rec.Header().Get("Location"))
+		}
+
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == stateCookie {
+				return location.Query().Get("state"), c
+			}
+		}
+
+		t.Fatal("login didn't set a state cookie")
+		return "", nil
+	}
+
+	t.Run("logs in", func(t *testing.T) {
+		state, stateCookie := login(t, "/ticket/t1")
+		rec := get(srv, "/auth/callback?"+url.Values{"state": {state}, "code": {"good code"}}.Encode(), stateCookie)
+
+		if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/ticket/t1" {
+			t.Fatalf("callback: status = %d, location = %q", rec.Code, rec.Header().Get("Location"))
+		}
+
+		var session *http.Cookie
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == sessionCookie {
+				session = c
+			}
+		}
+
+		if session == nil || !session.HttpOnly || !session.Secure {
+			t.Fatalf("session cookie = %+v, want an HttpOnly, Secure cookie", session)
+		}
+
+		if rec := get(srv, "/ticket/t1", session); rec.Code != http.StatusOK {
+			t.Fatalf("viewing with the new session: status = %d", rec.Code)
+		}
+	})
+
+	t.Run("only redirects to this site", func(t *testing.T) {
+		state, stateCookie := login(t, "//evil.example/")
+		rec := get(srv, "/auth/callback?"+url.Values{"state": {state}, "code": {"good code"}}.Encode(), stateCookie)
+
+		if rec.Header().Get("Location") != "/" {
+			t.Fatalf("callback redirected to %q, want /", rec.Header().Get("Location"))
+		}
+	})
+
+	t.Run("wrong state", func(t *testing.T) {
+		_, stateCookie := login(t, "/ticket/t1")
+
+		if rec := get(srv, "/auth/callback?"+url.Values{"state": {"other"}, "code": {"good code"}}.Encode(), stateCookie); rec.Code != http.StatusBadRequest {
+			t.Fatalf("callback with the wrong state: status = %d", rec.Code)
+		}
+	})
+
+	t.Run("bad code", func(t *testing.T) {
+		state, stateCookie := login(t, "/ticket/t1")
+
+		if rec := get(srv, "/auth/callback?"+url.Values{"state": {state}, "code": {"bad code"}}.Encode(), stateCookie); rec.Code != http.StatusBadGateway {
+			t.Fatalf("callback with a bad code: status = %d", rec.Code)
+		}
+	})
+}
@@ -0,0 +1,108 @@
+package web
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Sets RemoteAddr to the IP address of the client. Forwarded headers are only used on requests from one of
+// web.trusted_proxies, anyone else could put whatever they like in them
+func (srv *Server) realIP() func(http.Handler) http.Handler {
+	var proxies []netip.Prefix
+
+	for _, entry := range srv.Config.Web.TrustedProxies {
+		prefix, err := parseProxy(entry)
+
+		if err != nil {
+			srv.Logger.Error("Ignoring invalid trusted proxy", zap.Error(err), zap.String("proxy", entry))
+			continue
+		}
+
+		proxies = append(proxies, prefix)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.RemoteAddr = clientIP(r, proxies)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Parses a trusted proxy, which is either an address or a CIDR range
+func parseProxy(entry string) (netip.Prefix, error) {
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(entry)
+
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func isTrusted(addr netip.Addr, proxies []netip.Prefix) bool {
+	for _, prefix := range proxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the IP address of the client that made a request, going back through X-Forwarded-For (or X-Real-IP)
+// only while the address it came from is a trusted proxy
+func clientIP(r *http.Request, proxies []netip.Prefix) string {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	addr := addrPort.Addr().Unmap()
+
+	if !isTrusted(addr, proxies) {
+		return addr.String()
+	}
+
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+
+		// Each proxy appends the address it got the request from, so the client is the last one that isn't a proxy
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+
+			if err != nil {
+				break
+			}
+
+			addr = hop.Unmap()
+
+			if !isTrusted(addr, proxies) {
+				break
+			}
+		}
+
+		return addr.String()
+	}
+
+	if realIP, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return realIP.Unmap().String()
+	}
+
+	return addr.String()
+}
@@ -0,0 +1,175 @@
+package web
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"html/template"
+	"ibl-tickets/dedup"
+	"ibl-tickets/storage"
+	"ibl-tickets/types"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+//go:embed templates/*.html
+var templateFiles embed.FS
+
+var templates = template.Must(template.New("").Funcs(template.FuncMap{
+	"attachmentUrl": func(tikId string, attachmentId string, query string) string {
+		return "/ticket/" + tikId + "/attachments/" + attachmentId + "?" + query
+	},
+}).ParseFS(templateFiles, "templates/*.html"))
+
+type transcriptPage struct {
+	Ticket *ticket
+	Topic  types.Topic
+	Query  string // Signed link query, passed on to attachment links
+}
+
+func (srv *Server) transcript(w http.ResponseWriter, r *http.Request) {
+	tikId := chi.URLParam(r, "id")
+
+	v, ok := srv.authenticate(w, r, tikId, "")
+
+	if !ok {
+		return
+	}
+
+	t, err := srv.getTicket(r.Context(), tikId)
+
+	if err != nil {
+		srv.ticketError(w, tikId, err)
+		return
+	}
+
+	if !srv.authorize(w, r, v, t, "") {
+		return
+	}
+
+	srv.recordAccess(r, tikId, t.UserID, v.ID, v.Role, "", true)
+
+	topic, ok := srv.Config.Topics[t.TopicID]
+
+	if !ok {
+		topic = types.Topic{Name: t.TopicID}
+	}
+
+	var buf bytes.Buffer
+	err = templates.ExecuteTemplate(&buf, "transcript.html", transcriptPage{
+		Ticket: t,
+		Topic:  topic,
+		Query:  r.URL.Query().Encode(),
+	})
+
+	if err != nil {
+		srv.Logger.Error("Error rendering transcript", zap.Error(err), zap.String("ticket_id", tikId))
+		http.Error(w, "An error occurred while rendering this transcript", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func (srv *Server) attachment(w http.ResponseWriter, r *http.Request) {
+	tikId := chi.URLParam(r, "id")
+	attachmentId := chi.URLParam(r, "attachmentId")
+
+	v, ok := srv.authenticate(w, r, tikId, attachmentId)
+
+	if !ok {
+		return
+	}
+
+	t, err := srv.getTicket(r.Context(), tikId)
+
+	if err != nil {
+		srv.ticketError(w, tikId, err)
+		return
+	}
+
+	if !srv.authorize(w, r, v, t, attachmentId) {
+		return
+	}
+
+	// Recorded once we know whether the attachment could be served
+	record := func(granted bool) {
+		srv.recordAccess(r, tikId, t.UserID, v.ID, v.Role, attachmentId, granted)
+	}
+
+	// Only attachments that made it into the transcript can be downloaded
+	var attachment *types.Attachment
+	for _, msg := range t.Messages {
+		for i := range msg.Attachments {
+			if msg.Attachments[i].ID == attachmentId && msg.Attachments[i].Stored() {
+				attachment = &msg.Attachments[i]
+			}
+		}
+	}
+
+	if attachment == nil {
+		record(false)
+		http.Error(w, "This attachment does not exist", http.StatusNotFound)
+		return
+	}
+
+	data, err := dedup.OpenAttachment(r.Context(), srv.Tickets, srv.Store, srv.Keyring, tikId, attachmentId, t.Key)
+
+	if errors.Is(err, storage.ErrNotFound) {
+		record(false)
+		http.Error(w, "This attachment has been purged", http.StatusGone)
+		return
+	}
+
+	if err != nil {
+		record(false)
+		srv.Logger.Error("Error reading attachment", zap.Error(err), zap.String("ticket_id", tikId), zap.String("attachment_id", attachmentId))
+		http.Error(w, "An error occurred while reading this attachment", http.StatusInternalServerError)
+		return
+	}
+
+	defer data.Close()
+
+	record(true)
+
+	// The sniffed type is what the file really is, whatever Discord claimed
+	contentType := attachment.DetectedType
+
+	if contentType == "" {
+		contentType = attachment.ContentType
+	}
+
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(attachment.Name))
+	}
+
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	// Attachments are user uploaded, so only render media inline and never let the browser sniff them into something else
+	disposition := "attachment"
+
+	if strings.HasPrefix(contentType, "image/") || strings.HasPrefix(contentType, "video/") || strings.HasPrefix(contentType, "audio/") {
+		disposition = "inline"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Name}))
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	// Chunks are only written once authenticated, so a tampered blob ends the response early rather than serving bad data
+	_, err = io.Copy(w, data)
+
+	if err != nil {
+		srv.Logger.Error("Error streaming attachment", zap.Error(err), zap.String("ticket_id", tikId), zap.String("attachment_id", attachmentId))
+	}
+}
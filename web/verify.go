@@ -0,0 +1,73 @@
+package web
+
+import (
+	"bytes"
+	"errors"
+	"ibl-tickets/signing"
+	"ibl-tickets/types"
+	"io"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// Largest transcript that can be uploaded for verification
+const maxVerifySize = 32 << 20
+
+type verifyPage struct {
+	Checked    bool
+	Valid      bool
+	Error      string
+	Transcript *types.FileTranscriptData
+}
+
+func (srv *Server) renderVerify(w http.ResponseWriter, status int, page verifyPage) {
+	var buf bytes.Buffer
+	err := templates.ExecuteTemplate(&buf, "verify.html", page)
+
+	if err != nil {
+		srv.Logger.Error("Error rendering verify page", zap.Error(err))
+		http.Error(w, "An error occurred while rendering this page", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+func (srv *Server) verifyForm(w http.ResponseWriter, r *http.Request) {
+	srv.renderVerify(w, http.StatusOK, verifyPage{})
+}
+
+// Checks an uploaded .ibltranscript file. Anyone can do this, as it only reveals whether the file they already have is genuine
+func (srv *Server) verify(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxVerifySize)
+
+	f, _, err := r.FormFile("transcript")
+
+	if err != nil {
+		srv.renderVerify(w, http.StatusBadRequest, verifyPage{Checked: true, Error: "No transcript was uploaded, or it is too large"})
+		return
+	}
+
+	defer f.Close()
+
+	file, err := io.ReadAll(f)
+
+	if err != nil {
+		srv.renderVerify(w, http.StatusBadRequest, verifyPage{Checked: true, Error: "The transcript could not be read"})
+		return
+	}
+
+	t, err := srv.Signer.Verify(file)
+
+	switch {
+	case err == nil:
+		srv.renderVerify(w, http.StatusOK, verifyPage{Checked: true, Valid: true, Transcript: t})
+	case errors.Is(err, signing.ErrUnsigned), errors.Is(err, signing.ErrUnknownKey), errors.Is(err, signing.ErrInvalidSignature):
+		srv.renderVerify(w, http.StatusOK, verifyPage{Checked: true, Error: err.Error()})
+	default:
+		srv.renderVerify(w, http.StatusBadRequest, verifyPage{Checked: true, Error: "This file is not a transcript"})
+	}
+}
@@ -0,0 +1,181 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"ibl-tickets/blobs"
+	"ibl-tickets/keys"
+	"ibl-tickets/signing"
+	"ibl-tickets/storage"
+	"ibl-tickets/tickets"
+	"ibl-tickets/types"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/infinitybotlist/eureka/zapchi"
+	jsoniter "github.com/json-iterator/go"
+	"go.uber.org/zap"
+)
+
+var json = jsoniter.ConfigFastest
+
+var oauth2Client = &http.Client{Timeout: 10 * time.Second}
+
+var (
+	errTicketNotFound = errors.New("ticket not found")
+	errTicketOpen     = errors.New("ticket is still open")
+	errTicketPurged   = errors.New("ticket has been purged")
+)
+
+// Serves ticket transcripts and their attachments under config.Database.ExposedPath
+type Server struct {
+	Config  *types.Config
+	Secrets *types.Secrets
+	Keyring *keys.Keyring
+	Signer  *signing.Keys
+	Store   storage.Store
+	Tickets tickets.Store
+	Logger  *zap.Logger
+	Discord *discordgo.Session
+	IsOwner func(userId string) bool
+
+	httpOnce sync.Once
+	http     *http.Server
+
+	alertsMu sync.Mutex
+	alerted  map[string]time.Time // When each viewer was last alerted about, see shouldAlert
+}
+
+// A closed ticket as stored in the database
+type ticket struct {
+	ID            string
+	Issue         string
+	TopicID       string
+	UserID        string
+	CloseUserID   string
+	TicketContext map[string]string
+	Messages      []types.Message
+	EncKey        string // Wrapped data key, or the plaintext key material for tickets closed before envelope encryption
+	EncKeyID      string // ID of the master key that wrapped EncKey
+	Key           []byte // Unwrapped data key, nil for old tickets that never had one
+}
+
+func (srv *Server) Routes() http.Handler {
+	r := chi.NewRouter()
+
+	r.Use(
+		middleware.Recoverer,
+		srv.realIP(),
+		middleware.CleanPath,
+		zapchi.Logger(srv.Logger, "web"),
+	)
+
+	r.Get("/auth/login", srv.login)
+	r.Get("/auth/callback", srv.callback)
+	r.Get("/ticket/{id}", srv.transcript)
+	r.Get("/ticket/{id}/attachments/{attachmentId}", srv.attachment)
+	r.Get("/verify", srv.verifyForm)
+	r.Post("/verify", srv.verify)
+
+	return r
+}
+
+func (srv *Server) server() *http.Server {
+	srv.httpOnce.Do(func() {
+		srv.http = &http.Server{Addr: srv.Config.Web.Bind, Handler: srv.Routes()}
+	})
+
+	return srv.http
+}
+
+// Serves until Shutdown is called, after which it returns nil
+func (srv *Server) ListenAndServe() error {
+	srv.Logger.Info("Starting transcript server", zap.String("bind", srv.Config.Web.Bind))
+	err := srv.server().ListenAndServe()
+
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// Stops accepting connections and waits for requests being served to finish, until ctx is done
+func (srv *Server) Shutdown(ctx context.Context) error {
+	return srv.server().Shutdown(ctx)
+}
+
+// Fetches and decrypts a closed ticket, returning errTicketNotFound, errTicketOpen or errTicketPurged if it cannot be shown
+func (srv *Server) getTicket(ctx context.Context, tikId string) (*ticket, error) {
+	row, err := srv.Tickets.Get(ctx, tikId)
+
+	if errors.Is(err, tickets.ErrNotFound) {
+		return nil, errTicketNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if row.Open {
+		return nil, errTicketOpen
+	}
+
+	// Closed tickets always have a transcript unless it has been purged
+	if row.Messages == nil && row.EncMessages == nil {
+		return nil, errTicketPurged
+	}
+
+	var t = ticket{
+		ID:          tikId,
+		Issue:       row.Issue,
+		TopicID:     row.TopicID,
+		UserID:      row.UserID,
+		CloseUserID: row.CloseUserID,
+		EncKey:      row.EncKey,
+		EncKeyID:    row.EncKeyID,
+	}
+
+	// Tickets closed before column encryption without attachments have no key, but also nothing encrypted
+	if t.EncKey != "" {
+		t.Key, err = srv.Keyring.TicketKey(t.EncKey, t.EncKeyID)
+
+		if err != nil {
+			return nil, fmt.Errorf("error getting ticket key: %w", err)
+		}
+	}
+
+	err = blobs.DecryptJSON(t.Key, row.EncTicketContext, row.TicketContext, &t.TicketContext)
+
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting ticket context: %w", err)
+	}
+
+	err = blobs.DecryptJSON(t.Key, row.EncMessages, row.Messages, &t.Messages)
+
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting messages: %w", err)
+	}
+
+	return &t, nil
+}
+
+// Writes the error returned by getTicket with the appropriate status code
+func (srv *Server) ticketError(w http.ResponseWriter, tikId string, err error) {
+	switch err {
+	case errTicketNotFound:
+		http.Error(w, "This ticket does not exist", http.StatusNotFound)
+	case errTicketOpen:
+		http.Error(w, "This ticket has not been closed yet", http.StatusNotFound)
+	case errTicketPurged:
+		http.Error(w, "This ticket has been purged", http.StatusGone)
+	default:
+		srv.Logger.Error("Error getting ticket", zap.Error(err), zap.String("ticket_id", tikId))
+		http.Error(w, "An error occurred while getting this ticket", http.StatusInternalServerError)
+	}
+}